@@ -0,0 +1,133 @@
+// Package audit keeps an append-only trail of authorization decisions, separate
+// from the operational logs: who authenticated, from which NATS server, with
+// what result and when. Events never carry credentials; nats_tokens are only
+// identified by their fingerprint.
+//
+// File writes one JSON object per line and reopens its file on Reopen, so
+// external tools such as logrotate can move the file away and signal the
+// server with SIGHUP.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Results of audited decisions.
+const (
+	ResultAllowed = "allowed"
+	ResultDenied  = "denied"
+)
+
+// Event is one audited authorization decision.
+type Event struct {
+	Time          time.Time `json:"time"`
+	Username      string    `json:"username,omitempty"`
+	Account       string    `json:"account,omitempty"`
+	ServerID      string    `json:"server_id,omitempty"`
+	ServerName    string    `json:"server_name,omitempty"`
+	ServerCluster string    `json:"server_cluster,omitempty"`
+	Method        string    `json:"method,omitempty"`
+	Result        string    `json:"result"`
+	ErrorCode     string    `json:"error_code,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	TokenHash     string    `json:"token_hash,omitempty"`
+	KeyLabel      string    `json:"key_label,omitempty"`
+}
+
+// Auditor receives an event for every authorization decision.
+type Auditor interface {
+	Record(event Event)
+}
+
+// NewEvent builds the audit event of a decision made at t.
+func NewEvent(d auth.Decision, t time.Time) Event {
+	result := ResultAllowed
+	if !d.Allowed() {
+		result = ResultDenied
+	}
+	return Event{
+		Time:          t.UTC(),
+		Username:      d.Username,
+		Account:       d.Account,
+		ServerID:      d.ServerID,
+		ServerName:    d.ServerName,
+		ServerCluster: d.ServerCluster,
+		Method:        d.Method,
+		Result:        result,
+		ErrorCode:     d.Code,
+		Reason:        d.Reason,
+		TokenHash:     d.TokenHash,
+		KeyLabel:      d.KeyLabel,
+	}
+}
+
+// File appends events to a file as JSON lines. It is safe for concurrent use.
+type File struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// OpenFile opens the audit file at path for appending, creating it readable by
+// the owner only if it does not exist.
+func OpenFile(path string) (*File, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, f: f}, nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit file: %w", err)
+	}
+	return f, nil
+}
+
+// Record appends the event as one line. Write errors are logged and never
+// affect the authorization response.
+func (a *File) Record(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode audit event")
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(line); err != nil {
+		logrus.WithError(err).WithField("path", a.path).Error("Failed to write audit event")
+	}
+}
+
+// Reopen closes the audit file and opens the file at its path again, so
+// events go to a fresh file after the old one was rotated away. The current
+// file is kept when the path cannot be opened.
+func (a *File) Reopen() error {
+	f, err := openAppend(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	old := a.f
+	a.f = f
+	a.mu.Unlock()
+	return old.Close()
+}
+
+// Close closes the audit file.
+func (a *File) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readEvents decodes the JSON lines of an audit file.
+func readEvents(t *testing.T, path string) []Event {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func TestNewEvent(t *testing.T) {
+	at := time.Date(2025, 6, 1, 12, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+
+	allowed := NewEvent(auth.Decision{
+		Username:      "svc",
+		Method:        auth.MethodToken,
+		Account:       "DEVELOPMENT",
+		ServerID:      "NSERVER",
+		ServerName:    "nats-1",
+		ServerCluster: "east",
+		UserNkey:      "UCLIENT",
+		TokenHash:     "0123abcd",
+		KeyLabel:      "2025-key",
+	}, at)
+	assert.Equal(t, Event{
+		Time:          at.UTC(),
+		Username:      "svc",
+		Account:       "DEVELOPMENT",
+		ServerID:      "NSERVER",
+		ServerName:    "nats-1",
+		ServerCluster: "east",
+		Method:        auth.MethodToken,
+		Result:        ResultAllowed,
+		TokenHash:     "0123abcd",
+		KeyLabel:      "2025-key",
+	}, allowed)
+
+	denied := NewEvent(auth.Decision{
+		Username: "mallory",
+		Method:   auth.MethodPassword,
+		Error:    "user not found",
+		Reason:   "user_not_found",
+		Code:     "ERR_USER_NOT_FOUND",
+	}, at)
+	assert.Equal(t, ResultDenied, denied.Result)
+	assert.Equal(t, "ERR_USER_NOT_FOUND", denied.ErrorCode)
+	assert.Equal(t, "user_not_found", denied.Reason)
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenFile(path)
+	require.NoError(t, err)
+	defer a.Close()
+
+	first := Event{Time: time.Unix(1700000000, 0).UTC(), Username: "alice", Result: ResultAllowed}
+	a.Record(first)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// Rotation: the file is moved away and reopened at its path
+	rotated := path + ".1"
+	require.NoError(t, os.Rename(path, rotated))
+	second := Event{Time: time.Unix(1700000060, 0).UTC(), Username: "mallory", Result: ResultDenied, ErrorCode: "ERR_USER_NOT_FOUND"}
+	a.Record(second)
+	require.NoError(t, a.Reopen())
+	third := Event{Time: time.Unix(1700000120, 0).UTC(), Username: "bob", Result: ResultAllowed}
+	a.Record(third)
+
+	assert.Equal(t, []Event{first, second}, readEvents(t, rotated))
+	assert.Equal(t, []Event{third}, readEvents(t, path))
+
+	// Events are appended to an existing file
+	require.NoError(t, a.Close())
+	a, err = OpenFile(path)
+	require.NoError(t, err)
+	defer a.Close()
+	a.Record(first)
+	assert.Equal(t, []Event{third, first}, readEvents(t, path))
+}
+
+func TestOpenFileError(t *testing.T) {
+	_, err := OpenFile(filepath.Join(t.TempDir(), "missing", "audit.log"))
+	assert.ErrorContains(t, err, "open audit file")
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// TimeWindow is a daily period a user may connect in. Start and End are
+// HH:MM (or HH:MM:SS) times of day in the user's Locale. Weekdays, e.g. Mon
+// or Monday, limit the window to those days; empty means every day.
+type TimeWindow struct {
+	Start    string   `yaml:"Start"`
+	End      string   `yaml:"End"`
+	Weekdays []string `yaml:"Weekdays,omitempty"`
+}
+
+// weekdays maps lower-case weekday names and abbreviations to their day.
+var weekdays = func() map[string]time.Weekday {
+	days := make(map[string]time.Weekday, 14)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		days[strings.ToLower(d.String())] = d
+		days[strings.ToLower(d.String()[:3])] = d
+	}
+	return days
+}()
+
+// ValidateTimes rejects time windows with malformed times or weekdays and an
+// unknown locale, an IANA time zone such as "Europe/Berlin".
+func ValidateTimes(windows []TimeWindow, locale string) error {
+	for _, w := range windows {
+		for _, t := range []string{w.Start, w.End} {
+			if _, err := clockTime(t); err != nil {
+				return err
+			}
+		}
+		for _, day := range w.Weekdays {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("unknown weekday %q", day)
+			}
+		}
+	}
+	if locale != "" {
+		if _, err := time.LoadLocation(locale); err != nil {
+			return fmt.Errorf("unknown locale %q", locale)
+		}
+	}
+	return nil
+}
+
+// TimeRanges returns the windows open on the weekday of now in locale as NATS
+// time ranges, and whether the user may connect today at all. Users without
+// windows may always connect and get no ranges. The windows must have passed
+// ValidateTimes.
+func TimeRanges(windows []TimeWindow, locale string, now time.Time) ([]jwt.TimeRange, bool) {
+	if len(windows) == 0 {
+		return nil, true
+	}
+	if loc, err := time.LoadLocation(locale); err == nil {
+		now = now.In(loc)
+	}
+	var ranges []jwt.TimeRange
+	for _, w := range windows {
+		if !w.openOn(now.Weekday()) {
+			continue
+		}
+		start, _ := clockTime(w.Start)
+		end, _ := clockTime(w.End)
+		ranges = append(ranges, jwt.TimeRange{Start: start, End: end})
+	}
+	return ranges, len(ranges) > 0
+}
+
+// openOn reports whether the window applies on day.
+func (w TimeWindow) openOn(day time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, name := range w.Weekdays {
+		if weekdays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// clockTime normalizes an HH:MM or HH:MM:SS time of day to the HH:MM:SS form
+// of NATS time ranges.
+func clockTime(s string) (string, error) {
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format("15:04:05"), nil
+		}
+	}
+	return "", fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+}
@@ -3,9 +3,16 @@
 // - Key pair management (Issuer and Curve keys)
 // - User credential and permission storage
 // - JWT claim generation and validation
+// - Authorization decision reporting
 package auth
 
 import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nkeys"
 )
@@ -13,6 +20,8 @@ import (
 // KeyPairs holds the cryptographic key pairs used for NATS authentication.
 // Contains both the issuer key pair (for signing tokens) and optional curve key
 // pair (for encryption). The HasXKey flag indicates if curve keys are available.
+// When Issuer is a scoped signing key rather than the account identity key,
+// IssuerAccount holds the account's identity public key.
 //
 // Usage:
 //
@@ -22,9 +31,13 @@ import (
 //	    HasXKey: true,
 //	}
 type KeyPairs struct {
-	Issuer  nkeys.KeyPair // Key pair for signing JWTs
-	Curve   nkeys.KeyPair // Optional key pair for encryption (XKey)
-	HasXKey bool          // True if Curve keys are available
+	Issuer        nkeys.KeyPair // Key pair for signing JWTs
+	Curve         nkeys.KeyPair // Optional key pair for encryption (XKey)
+	HasXKey       bool          // True if Curve keys are available
+	IssuerAccount string        // Optional account identity key when Issuer is a signing key
+	// AccountIssuers sign the user JWTs of their account instead of Issuer,
+	// keyed by lower-cased account name; Issuer still signs the responses
+	AccountIssuers map[string]nkeys.KeyPair
 }
 
 // User represents an authenticated NATS user with their permissions and credentials.
@@ -43,4 +56,139 @@ type User struct {
 	Permissions jwt.Permissions // NATS permissions (pub/sub)
 	Pass        string          // User password (hashed in production)
 	Account     string          // NATS account name
+	ExpiresAt   time.Time       // Optional end of life of the user record, zero means never
+	// AlternateKeys are extra identifiers, e.g. an email address, the user may log in with
+	AlternateKeys []string
+	// KeyLabel names the token secret that validated a token user, empty otherwise
+	KeyLabel string
+	// Template names a permission template combined with Permissions, empty for none
+	Template string
+	// NotAfter caps the expiry of issued user JWTs, e.g. at the exp of the
+	// nats_token the user authenticated with; zero means no cap
+	NotAfter time.Time
+	// Limits caps the user's subscriptions, data and message payload size
+	Limits Limits
+	// ConnectionTypes restricts how the user may connect, e.g. WEBSOCKET; empty allows all
+	ConnectionTypes []string
+	// BearerToken issues a bearer user JWT, usable without proving possession of the nkey
+	BearerToken bool
+	// Src restricts the networks the user may connect from, as CIDRs; empty allows all
+	Src []string
+	// Times restricts the time windows the user may connect in; empty allows any time
+	Times []TimeWindow
+	// Locale is the IANA time zone Times are in, e.g. Europe/Berlin; empty means the server's
+	Locale string
+}
+
+// ValidateCIDRs rejects source networks that are not CIDRs such as "10.0.0.0/8",
+// which NATS would refuse in a user JWT.
+func ValidateCIDRs(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid source CIDR %q", cidr)
+		}
+	}
+	return nil
+}
+
+// ConnectionTypes are the client connection types NATS distinguishes.
+var ConnectionTypes = []string{
+	jwt.ConnectionTypeStandard,
+	jwt.ConnectionTypeWebsocket,
+	jwt.ConnectionTypeLeafnode,
+	jwt.ConnectionTypeLeafnodeWS,
+	jwt.ConnectionTypeMqtt,
+	jwt.ConnectionTypeMqttWS,
+	jwt.ConnectionTypeInProcess,
+}
+
+// NormalizeConnectionTypes upper-cases the given connection types and rejects
+// any that is not one of ConnectionTypes.
+func NormalizeConnectionTypes(types []string) ([]string, error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+	normalized := make([]string, len(types))
+	for i, connType := range types {
+		normalized[i] = strings.ToUpper(connType)
+		if !slices.Contains(ConnectionTypes, normalized[i]) {
+			return nil, fmt.Errorf("unknown connection type %q", connType)
+		}
+	}
+	return normalized, nil
+}
+
+// Limits caps the connection of a user. A nil field keeps the NATS default of
+// unlimited; zero allows nothing and -1 is explicitly unlimited.
+type Limits struct {
+	Subs    *int64 `json:"subs,omitempty" yaml:"subs,omitempty"`       // Maximum number of subscriptions
+	Data    *int64 `json:"data,omitempty" yaml:"data,omitempty"`       // Maximum number of bytes
+	Payload *int64 `json:"payload,omitempty" yaml:"payload,omitempty"` // Maximum message payload in bytes
+}
+
+// Validate rejects limits below -1, which NATS does not define.
+func (l Limits) Validate() error {
+	for name, limit := range map[string]*int64{"subs": l.Subs, "data": l.Data, "payload": l.Payload} {
+		if limit != nil && *limit < jwt.NoLimit {
+			return fmt.Errorf("limit %s must be -1 (unlimited) or more, got %d", name, *limit)
+		}
+	}
+	return nil
+}
+
+// Apply sets the configured limits on limits, leaving the others untouched.
+func (l Limits) Apply(limits *jwt.NatsLimits) {
+	if l.Subs != nil {
+		limits.Subs = *l.Subs
+	}
+	if l.Data != nil {
+		limits.Data = *l.Data
+	}
+	if l.Payload != nil {
+		limits.Payload = *l.Payload
+	}
+}
+
+// Expired reports whether the user record has passed its expiry at the given time.
+func (u *User) Expired(now time.Time) bool {
+	return !u.ExpiresAt.IsZero() && !now.Before(u.ExpiresAt)
+}
+
+// Authentication methods reported in Decision.Method.
+const (
+	MethodToken    = "token"    // nats_token bearer authentication
+	MethodPassword = "password" // Username/password authentication
+)
+
+// Decision describes the outcome of a single authorization request. It never
+// carries credentials and is safe to hand to logging and eventing sinks.
+//
+// Example:
+//
+//	d := Decision{
+//	    Username:   "alice",
+//	    Method:     MethodPassword,
+//	    Account:    "DEVELOPMENT",
+//	    ServerID:   "NDXXX",
+//	    ServerName: "nats-1",
+//	}
+type Decision struct {
+	Username      string // Username or token user_id, empty if not yet known
+	Method        string // Authentication method attempted (MethodToken or MethodPassword)
+	Account       string // NATS account the user was placed in
+	ServerID      string // ID of the NATS server that sent the request
+	ServerName    string // Optional name of the NATS server that sent the request
+	ServerCluster string // Optional cluster of the NATS server that sent the request
+	UserNkey      string // Public nkey of the connecting client
+	KeyLabel      string // Label of the token secret that validated the token, if labeled
+	Error         string // Rejection reason, empty when access was granted
+	Reason        string // Machine-readable rejection code, empty when not classified
+	Category      string // Rejection category: bad_request, unauthenticated or unauthorized
+	Code          string // Stable error code of Reason, e.g. ERR_USER_NOT_FOUND, empty when unmapped
+	TokenHash     string // Fingerprint of the nats_token presented, empty for other methods
+}
+
+// Allowed reports whether the decision granted access.
+func (d Decision) Allowed() bool {
+	return d.Error == ""
 }
@@ -2,6 +2,7 @@
 package authkeys
 
 import (
+	"errors"
 	"fmt"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
 	"strings"
@@ -13,11 +14,22 @@ import (
 // authentication. It handles issuer account signing keys and optional xkey seeds,
 // converting them into auth.KeyPairs for use in authentication configurations.
 
+// Errors returned when a seed has the expected prefix but does not decode to
+// the expected kind of key.
+var (
+	ErrNotAccountKey = errors.New("public key is not an account key")
+	ErrNotCurveKey   = errors.New("public key is not a curve (xkey) key")
+)
+
 // Parse creates an auth.KeyPairs from the provided issuer and xkey seeds.
 // The issuerSeed is required and must be a valid NATS account seed (starting with 'SA').
 // The xkeySeed is optional; if provided, it must be a valid NATS xkey seed (starting with 'SX').
-// Returns an error if either seed is invalid or cannot be parsed.
-func Parse(issuerSeed, xkeySeed string) (*auth.KeyPairs, error) {
+// The issuerAccount is optional; if provided, the issuer seed is treated as a scoped
+// signing key of that account and issuerAccount must be its public key (starting with 'A').
+// The accountSeeds are optional account seeds keyed by NATS account name, signing
+// the user JWTs of their account; names are matched case-insensitively.
+// Returns an error if any seed is invalid or cannot be parsed.
+func Parse(issuerSeed, xkeySeed, issuerAccount string, accountSeeds map[string]string) (*auth.KeyPairs, error) {
 	if issuerSeed == "" {
 		return nil, fmt.Errorf("issuer seed cannot be empty")
 	}
@@ -32,8 +44,44 @@ func Parse(issuerSeed, xkeySeed string) (*auth.KeyPairs, error) {
 	if !strings.HasPrefix(issuerSeed, "SA") {
 		return nil, fmt.Errorf("issuer seed %q must start with 'SA'", truncateSeed(issuerSeed))
 	}
+	if err := checkPublicKey(issuer, nkeys.IsValidPublicAccountKey, ErrNotAccountKey); err != nil {
+		return nil, fmt.Errorf("issuer seed %q: %w", truncateSeed(issuerSeed), err)
+	}
 	kp.Issuer = issuer
 
+	// Parse optional issuer account for scoped signing keys
+	if issuerAccount != "" {
+		if !nkeys.IsValidPublicAccountKey(issuerAccount) {
+			return nil, fmt.Errorf("issuer account %q is not a valid account public key", truncateSeed(issuerAccount))
+		}
+		issuerPub, err := issuer.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("reading issuer public key: %w", err)
+		}
+		if issuerPub == issuerAccount {
+			return nil, fmt.Errorf("issuer account %q matches the issuer key; leave it empty unless signing with a scoped key", truncateSeed(issuerAccount))
+		}
+		kp.IssuerAccount = issuerAccount
+	}
+
+	// Parse optional per-account issuer seeds
+	if len(accountSeeds) > 0 {
+		kp.AccountIssuers = make(map[string]nkeys.KeyPair, len(accountSeeds))
+		for account, seed := range accountSeeds {
+			accountKP, err := nkeys.FromSeed([]byte(seed))
+			if err != nil {
+				return nil, fmt.Errorf("parsing issuer seed %q of account %q: %w", truncateSeed(seed), account, err)
+			}
+			if !strings.HasPrefix(seed, "SA") {
+				return nil, fmt.Errorf("issuer seed %q of account %q must start with 'SA'", truncateSeed(seed), account)
+			}
+			if err := checkPublicKey(accountKP, nkeys.IsValidPublicAccountKey, ErrNotAccountKey); err != nil {
+				return nil, fmt.Errorf("issuer seed %q of account %q: %w", truncateSeed(seed), account, err)
+			}
+			kp.AccountIssuers[strings.ToLower(account)] = accountKP
+		}
+	}
+
 	// Parse optional xkey seed
 	if xkeySeed != "" {
 		curve, err := nkeys.FromSeed([]byte(xkeySeed))
@@ -43,6 +91,9 @@ func Parse(issuerSeed, xkeySeed string) (*auth.KeyPairs, error) {
 		if !strings.HasPrefix(xkeySeed, "SX") {
 			return nil, fmt.Errorf("xkey seed %q must start with 'SX'", truncateSeed(xkeySeed))
 		}
+		if err := checkPublicKey(curve, nkeys.IsValidPublicCurveKey, ErrNotCurveKey); err != nil {
+			return nil, fmt.Errorf("xkey seed %q: %w", truncateSeed(xkeySeed), err)
+		}
 		kp.Curve = curve
 		kp.HasXKey = true
 	}
@@ -50,6 +101,19 @@ func Parse(issuerSeed, xkeySeed string) (*auth.KeyPairs, error) {
 	return kp, nil
 }
 
+// checkPublicKey verifies the public key of kp with valid, so a seed that only
+// happens to carry the right prefix is not trusted as that kind of key.
+func checkPublicKey(kp nkeys.KeyPair, valid func(string) bool, errKind error) error {
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return fmt.Errorf("reading public key: %w", err)
+	}
+	if !valid(pub) {
+		return fmt.Errorf("%w: %s", errKind, truncateSeed(pub))
+	}
+	return nil
+}
+
 // truncateSeed returns a truncated version of the seed for safe error reporting.
 func truncateSeed(seed string) string {
 	if len(seed) > 3 {
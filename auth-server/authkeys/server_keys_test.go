@@ -1,6 +1,7 @@
 package authkeys
 
 import (
+	"errors"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
 	"strings"
 	"testing"
@@ -29,11 +30,30 @@ func TestParse(t *testing.T) {
 		t.Fatalf("Failed to get curve seed: %v", err)
 	}
 
+	identityKP, err := nkeys.CreatePair(nkeys.PrefixByteAccount)
+	if err != nil {
+		t.Fatalf("Failed to create account identity key pair: %v", err)
+	}
+	identityPub, err := identityKP.PublicKey()
+	if err != nil {
+		t.Fatalf("Failed to get account identity public key: %v", err)
+	}
+	identitySeed, err := identityKP.Seed()
+	if err != nil {
+		t.Fatalf("Failed to get account identity seed: %v", err)
+	}
+	accountPub, err := accountKP.PublicKey()
+	if err != nil {
+		t.Fatalf("Failed to get account public key: %v", err)
+	}
+
 	// Test cases
 	tests := []struct {
 		name          string
 		issuerSeed    string
 		xkeySeed      string
+		issuerAccount string
+		accountSeeds  map[string]string
 		expectError   bool
 		expectedError string
 		validateKP    func(t *testing.T, kp *auth.KeyPairs)
@@ -113,11 +133,57 @@ func TestParse(t *testing.T) {
 			expectError:   true,
 			expectedError: "xkey seed \"SAA...\" must start with 'SX'",
 		},
+		{
+			name:          "scoped signing key with issuer account",
+			issuerSeed:    string(accountSeed),
+			issuerAccount: identityPub,
+			expectError:   false,
+			validateKP: func(t *testing.T, kp *auth.KeyPairs) {
+				if kp.IssuerAccount != identityPub {
+					t.Errorf("Expected IssuerAccount %q, got %q", identityPub, kp.IssuerAccount)
+				}
+			},
+		},
+		{
+			name:          "invalid issuer account",
+			issuerSeed:    string(accountSeed),
+			issuerAccount: "UNOTANACCOUNT",
+			expectError:   true,
+			expectedError: "is not a valid account public key",
+		},
+		{
+			name:         "account issuers",
+			issuerSeed:   string(accountSeed),
+			accountSeeds: map[string]string{"Tenant-A": string(identitySeed)},
+			validateKP: func(t *testing.T, kp *auth.KeyPairs) {
+				issuer, ok := kp.AccountIssuers["tenant-a"]
+				if !ok {
+					t.Fatalf("Expected an issuer for tenant-a, got %v", kp.AccountIssuers)
+				}
+				if pub, _ := issuer.PublicKey(); pub != identityPub {
+					t.Errorf("Expected tenant-a issuer %s, got %s", identityPub, pub)
+				}
+			},
+		},
+		{
+			name:          "invalid account issuer seed",
+			issuerSeed:    string(accountSeed),
+			accountSeeds:  map[string]string{"tenant-a": string(curveSeed)},
+			expectError:   true,
+			expectedError: `of account "tenant-a" must start with 'SA'`,
+		},
+		{
+			name:          "issuer account equals issuer key",
+			issuerSeed:    string(accountSeed),
+			issuerAccount: accountPub,
+			expectError:   true,
+			expectedError: "matches the issuer key",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			kp, err := Parse(tt.issuerSeed, tt.xkeySeed)
+			kp, err := Parse(tt.issuerSeed, tt.xkeySeed, tt.issuerAccount, tt.accountSeeds)
 			if tt.expectError {
 				if err == nil {
 					t.Fatal("Expected an error, but got none")
@@ -136,3 +202,30 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+// TestCheckPublicKey tests that a key pair of the wrong kind is rejected with
+// the matching error. The SA and SX prefix checks in Parse already rule this out
+// for well-formed seeds, so the helper is exercised directly.
+func TestCheckPublicKey(t *testing.T) {
+	accountKP, err := nkeys.CreatePair(nkeys.PrefixByteAccount)
+	if err != nil {
+		t.Fatalf("Failed to create account key pair: %v", err)
+	}
+	curveKP, err := nkeys.CreatePair(nkeys.PrefixByteCurve)
+	if err != nil {
+		t.Fatalf("Failed to create curve key pair: %v", err)
+	}
+
+	if err := checkPublicKey(accountKP, nkeys.IsValidPublicAccountKey, ErrNotAccountKey); err != nil {
+		t.Errorf("Unexpected error for an account key: %v", err)
+	}
+	if err := checkPublicKey(curveKP, nkeys.IsValidPublicCurveKey, ErrNotCurveKey); err != nil {
+		t.Errorf("Unexpected error for a curve key: %v", err)
+	}
+	if err := checkPublicKey(curveKP, nkeys.IsValidPublicAccountKey, ErrNotAccountKey); !errors.Is(err, ErrNotAccountKey) {
+		t.Errorf("Expected ErrNotAccountKey for a curve key, got %v", err)
+	}
+	if err := checkPublicKey(accountKP, nkeys.IsValidPublicCurveKey, ErrNotCurveKey); !errors.Is(err, ErrNotCurveKey) {
+		t.Errorf("Expected ErrNotCurveKey for an account key, got %v", err)
+	}
+}
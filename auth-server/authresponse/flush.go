@@ -0,0 +1,75 @@
+package authresponse
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+
+	"github.com/nats-io/nats.go/micro"
+	"github.com/sirupsen/logrus"
+)
+
+// Flusher is an in-memory structure, such as a cache or a set of counters, that
+// can be cleared without restarting the server.
+type Flusher interface {
+	// Flush clears the structure and returns the number of entries removed.
+	Flush() int
+}
+
+// WithFlusher registers an in-memory structure cleared by the flush admin
+// endpoint under the given name.
+func WithFlusher(name string, f Flusher) Option {
+	return func(h *Handler) {
+		if h.flushers == nil {
+			h.flushers = make(map[string]Flusher)
+		}
+		h.flushers[name] = f
+	}
+}
+
+// FlushRequest asks the server to clear its in-memory structures.
+type FlushRequest struct {
+	AdminToken string `json:"admin_token"`
+}
+
+// FlushResponse reports the number of entries cleared per structure name.
+type FlushResponse struct {
+	Cleared map[string]int `json:"cleared,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// NewFlushHandler returns a micro handler answering FlushRequest messages by
+// clearing every structure registered with WithFlusher. Requests must carry
+// adminToken; the handler refuses every request when adminToken is empty.
+func (h *Handler) NewFlushHandler(adminToken string) micro.HandlerFunc {
+	return func(req micro.Request) {
+		resp := h.flush(req.Data(), adminToken)
+		if err := req.RespondJSON(resp); err != nil {
+			logrus.WithError(err).Error("Failed to send flush response")
+		}
+	}
+}
+
+// flush clears the registered structures after checking the admin credential.
+func (h *Handler) flush(data []byte, adminToken string) FlushResponse {
+	var fr FlushRequest
+	if err := json.Unmarshal(data, &fr); err != nil {
+		return FlushResponse{Error: "invalid flush request"}
+	}
+	if !adminAuthorized(fr.AdminToken, adminToken) {
+		logrus.Warn("Rejected flush with invalid admin credential")
+		return FlushResponse{Error: "unauthorized"}
+	}
+
+	cleared := make(map[string]int, len(h.flushers))
+	for name, f := range h.flushers {
+		cleared[name] = f.Flush()
+	}
+	logrus.WithField("cleared", cleared).Info("Flushed in-memory state")
+	return FlushResponse{Cleared: cleared}
+}
+
+// adminAuthorized compares the presented admin credential in constant time. An
+// empty configured token never authorizes.
+func adminAuthorized(presented, adminToken string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(adminToken)) == 1
+}
@@ -5,22 +5,241 @@
 package authresponse
 
 import (
-	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"os"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/audit"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/metrics"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/permissions"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/policy"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
 	"github.com/sirupsen/logrus"
 )
 
+// Rejection reason codes reported in auth.Decision.Reason.
+const (
+	ReasonBadRequest         = "bad_request"
+	ReasonXKeyUnsupported    = "xkey_unsupported"
+	ReasonUntrustedServer    = "untrusted_server"
+	ReasonInvalidToken       = "invalid_token"
+	ReasonTokenExpired       = "token_expired"
+	ReasonInvalidAccount     = "invalid_account"
+	ReasonNoCredentials      = "no_credentials"
+	ReasonMissingCredentials = "missing_credentials"
+	ReasonUserNotFound       = "user_not_found"
+	ReasonInvalidCredentials = "invalid_credentials"
+	ReasonAccountExpired     = "account_expired"
+	ReasonIncompleteUser     = "incomplete_user"
+	ReasonJWTError           = "jwt_error"
+	ReasonBlockedSubject     = "blocked_subject"
+	ReasonJWTTooLarge        = "jwt_too_large"
+	ReasonPolicyError        = "policy_error"
+	ReasonBroadWildcard      = "broad_wildcard"
+	ReasonMissingExpiry      = "missing_expiry"
+	ReasonNoAccountIssuer    = "no_account_issuer"
+	ReasonRateLimited        = "rate_limited"
+	ReasonBadPermissions     = "bad_permissions"
+	ReasonOutsideTimeWindow  = "outside_time_window"
+)
+
+// Rejection categories reported in auth.Decision.Category, telling clients
+// whether to fix the request, the credentials or the granted access.
+const (
+	CategoryBadRequest      = "bad_request"     // The request could not be parsed or accepted
+	CategoryUnauthenticated = "unauthenticated" // The credentials are missing or invalid
+	CategoryUnauthorized    = "unauthorized"    // The identity is valid but not permitted
+)
+
+// reasonCategories maps rejection reasons to their category. Failures to issue
+// a JWT for an established identity are reported as unauthorized.
+var reasonCategories = map[string]string{
+	ReasonBadRequest:         CategoryBadRequest,
+	ReasonXKeyUnsupported:    CategoryBadRequest,
+	ReasonUntrustedServer:    CategoryBadRequest,
+	ReasonInvalidToken:       CategoryUnauthenticated,
+	ReasonTokenExpired:       CategoryUnauthenticated,
+	ReasonNoCredentials:      CategoryUnauthenticated,
+	ReasonMissingCredentials: CategoryUnauthenticated,
+	ReasonUserNotFound:       CategoryUnauthenticated,
+	ReasonInvalidCredentials: CategoryUnauthenticated,
+	ReasonInvalidAccount:     CategoryUnauthorized,
+	ReasonAccountExpired:     CategoryUnauthorized,
+	ReasonIncompleteUser:     CategoryUnauthorized,
+	ReasonBlockedSubject:     CategoryUnauthorized,
+	ReasonJWTError:           CategoryUnauthorized,
+	ReasonJWTTooLarge:        CategoryUnauthorized,
+	ReasonPolicyError:        CategoryUnauthorized,
+	ReasonBroadWildcard:      CategoryUnauthorized,
+	ReasonMissingExpiry:      CategoryUnauthorized,
+	ReasonNoAccountIssuer:    CategoryUnauthorized,
+	ReasonRateLimited:        CategoryUnauthenticated,
+	ReasonBadPermissions:     CategoryBadRequest,
+	ReasonOutsideTimeWindow:  CategoryUnauthorized,
+}
+
+// CategoryOf returns the category of a rejection reason, or an empty string
+// for unknown reasons.
+func CategoryOf(reason string) string {
+	return reasonCategories[reason]
+}
+
+// DefaultErrorCodes maps rejection reasons to the stable codes prefixed to
+// response errors.
+var DefaultErrorCodes = map[string]string{
+	ReasonUserNotFound:       "ERR_USER_NOT_FOUND",
+	ReasonInvalidCredentials: "ERR_BAD_CREDS",
+	ReasonMissingCredentials: "ERR_MISSING_CREDS",
+	ReasonNoCredentials:      "ERR_NO_CREDS",
+	ReasonInvalidToken:       "ERR_INVALID_TOKEN",
+	ReasonInvalidAccount:     "ERR_INVALID_ACCOUNT",
+	ReasonIncompleteUser:     "ERR_INCOMPLETE_USER",
+	ReasonUntrustedServer:    "ERR_UNTRUSTED_SERVER",
+	ReasonBadRequest:         "ERR_BAD_REQUEST",
+	ReasonJWTError:           "ERR_JWT",
+	ReasonAccountExpired:     "ERR_ACCOUNT_EXPIRED",
+	ReasonBlockedSubject:     "ERR_BLOCKED_SUBJECT",
+	ReasonJWTTooLarge:        "ERR_JWT_TOO_LARGE",
+	ReasonPolicyError:        "ERR_POLICY",
+	ReasonBroadWildcard:      "ERR_BROAD_WILDCARD",
+	ReasonTokenExpired:       "ERR_TOKEN_EXPIRED",
+	ReasonMissingExpiry:      "ERR_MISSING_EXPIRY",
+	ReasonNoAccountIssuer:    "ERR_NO_ACCOUNT_ISSUER",
+	ReasonRateLimited:        "ERR_RATE_LIMITED",
+	ReasonBadPermissions:     "ERR_BAD_PERMISSIONS",
+	ReasonOutsideTimeWindow:  "ERR_OUTSIDE_TIME_WINDOW",
+	ReasonXKeyUnsupported:    "ERR_XKEY_UNSUPPORTED",
+}
+
+// Strategies combining a user's permission template with the user's inline
+// permissions, selected with WithPermissionTemplates.
+const (
+	TemplateMerge   = "merge"   // Template as base, inline subjects added on top, deny wins
+	TemplateReplace = "replace" // Inline permissions, if any, replace the template entirely
+)
+
+// InboxSubject is the reply subject space clients subscribe to for request-reply.
+const InboxSubject = "_INBOX.>"
+
+// DefaultNoCredentialsMessage is returned when a request carries neither a
+// token nor a username/password.
+const DefaultNoCredentialsMessage = "no credentials provided"
+
+// AuthError is a rejection carrying a stable, machine-readable code, e.g.
+// ERR_USER_NOT_FOUND, so callers can tell failures apart without parsing
+// Message. Reason is one of the Reason constants and Code its
+// DefaultErrorCodes entry; responses are formatted as "[CODE] message".
+type AuthError struct {
+	Reason  string
+	Code    string
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+// rejection creates an AuthError with a formatted message.
+func rejection(reason, format string, args ...any) error {
+	return &AuthError{Reason: reason, Code: DefaultErrorCodes[reason], Message: fmt.Sprintf(format, args...)}
+}
+
+// reasonOf returns the reason of the AuthError in err's chain, if any.
+func reasonOf(err error) string {
+	var ae *AuthError
+	if errors.As(err, &ae) {
+		return ae.Reason
+	}
+	return ""
+}
+
 // Handler processes NATS authorization requests.
 type Handler struct {
-	keyPairs *auth.KeyPairs
-	userRepo UserRepository
+	mu            sync.RWMutex // Guards keyPairs and tokenSecrets, which UpdateSecrets replaces
+	keyPairs      *auth.KeyPairs
+	userRepo      UserRepository
+	knownAccounts map[string]struct{}
+	recorders     []DecisionRecorder
+	logPerms      bool
+	noCredsMsg    string
+	serverInfo    bool
+	trustedIssuer map[string]struct{}
+	trustedIDs    map[string]struct{}
+	ceilings      map[string]permissions.Ceiling
+	connCeilings  map[string]permissions.Ceiling
+	tokenCeiling  *permissions.Ceiling
+	accountPerms  map[string]jwt.Permissions
+	autoInbox     bool
+	templates     map[string]*jwt.Permissions
+	templateMerge string
+	permCache     *permissionCache
+	policy        PermissionSource
+	emptyPerms    string
+	flushers      map[string]Flusher
+	tokenSecrets  []tokenvalidation.Secret
+	audience      string
+	issuer        string
+	tokenAuth     bool
+	tokenIdentity bool
+	metrics       *metrics.Metrics
+	maxJWTSize    int
+	blocklist     Blocklist
+	blockExempt   map[string]struct{}
+	wildcards     string
+	wildcardAdmin map[string]struct{}
+	categories    bool
+	userJWTTTL    time.Duration
+	jwtExpiry     string
+	defaultJWTTTL time.Duration
+	rehashCost    int
+	errorCodes    map[string]string
+	deprecatePass bool
+	responseTTL   time.Duration
+	echoHeaders   []string
+	slowThreshold time.Duration
+	rateLimit     *rateLimiter
+	ratePerHost   bool
+	tokenCache    *tokenvalidation.Cache
+	tokenLeeway   time.Duration
+	tokenIatSkew  time.Duration
+	auditor       audit.Auditor
+}
+
+// PermissionSource resolves the permissions of an authenticated user, e.g. from
+// a remote policy service. They replace the permissions of the user record.
+type PermissionSource interface {
+	Permissions(q policy.Query) (jwt.Permissions, error)
+}
+
+// DecisionRecorder receives the outcome of every authorization request.
+type DecisionRecorder interface {
+	Record(d auth.Decision)
+}
+
+// Option configures optional Handler behaviour.
+type Option func(*Handler)
+
+// WithKnownAccounts restricts the accounts a nats_token may request to the given
+// list. An empty list only enforces that the account claim names a single account.
+func WithKnownAccounts(accounts []string) Option {
+	return func(h *Handler) {
+		if len(accounts) == 0 {
+			return
+		}
+		h.knownAccounts = make(map[string]struct{}, len(accounts))
+		for _, account := range accounts {
+			h.knownAccounts[account] = struct{}{}
+		}
+	}
 }
 
 // UserRepository defines the interface for retrieving user information.
@@ -28,52 +247,735 @@ type UserRepository interface {
 	Get(username string) (*auth.User, bool)
 }
 
+// AliasResolver is implemented by user repositories that also find users by
+// alternate keys, such as email addresses. Repositories without alternate keys
+// simply do not implement it.
+type AliasResolver interface {
+	// Canonical returns the username an alternate key belongs to, or the key
+	// itself when it is not an alternate key.
+	Canonical(key string) string
+}
+
+// WithDecisionRecorder registers a recorder notified of every authorization decision.
+func WithDecisionRecorder(r DecisionRecorder) Option {
+	return func(h *Handler) {
+		h.recorders = append(h.recorders, r)
+	}
+}
+
+// WithAuditor sends an audit event for every authorization decision, including
+// renewals, to auditor.
+func WithAuditor(auditor audit.Auditor) Option {
+	return func(h *Handler) {
+		h.auditor = auditor
+	}
+}
+
+// WithPermissionLogging enables debug logging of the permissions placed into
+// every issued user JWT.
+func WithPermissionLogging(enabled bool) Option {
+	return func(h *Handler) {
+		h.logPerms = enabled
+	}
+}
+
+// WithNoCredentialsMessage overrides the rejection message used when a request
+// carries no credentials at all. An empty message keeps the default.
+func WithNoCredentialsMessage(msg string) Option {
+	return func(h *Handler) {
+		if msg != "" {
+			h.noCredsMsg = msg
+		}
+	}
+}
+
+// WithServerInfo includes the requesting server's name and cluster in every
+// recorded and audited decision, and counts failed requests per server, so
+// auth issues can be correlated to specific NATS nodes.
+func WithServerInfo(enabled bool) Option {
+	return func(h *Handler) {
+		h.serverInfo = enabled
+	}
+}
+
+// WithTrustedServers only accepts authorization requests signed by one of the
+// given NATS server public keys. An empty list accepts any server.
+func WithTrustedServers(keys []string) Option {
+	return func(h *Handler) {
+		if len(keys) == 0 {
+			return
+		}
+		h.trustedIssuer = make(map[string]struct{}, len(keys))
+		for _, key := range keys {
+			h.trustedIssuer[key] = struct{}{}
+		}
+	}
+}
+
+// WithTrustedServerIDs only accepts authorization requests from NATS servers
+// whose server ID is in ids. An empty list accepts any server ID.
+func WithTrustedServerIDs(ids []string) Option {
+	return func(h *Handler) {
+		if len(ids) == 0 {
+			return
+		}
+		h.trustedIDs = make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			h.trustedIDs[id] = struct{}{}
+		}
+	}
+}
+
+// WithPermissionSource resolves the permissions of every authenticated user
+// from src instead of the user record or token. Account defaults, ceilings and
+// the blocklist still apply on top. Users are rejected when src fails.
+func WithPermissionSource(src PermissionSource) Option {
+	return func(h *Handler) {
+		h.policy = src
+	}
+}
+
+// WithAccountCeilings intersects the permissions of every issued user JWT with
+// the ceiling of the user's account. Account names are matched case-insensitively.
+func WithAccountCeilings(ceilings map[string]permissions.Ceiling) Option {
+	return func(h *Handler) {
+		if len(ceilings) == 0 {
+			return
+		}
+		h.ceilings = make(map[string]permissions.Ceiling, len(ceilings))
+		for account, ceiling := range ceilings {
+			h.ceilings[strings.ToLower(account)] = ceiling
+		}
+	}
+}
+
+// WithTokenCeiling intersects the permissions carried by every nats_token with
+// ceiling, so even a token forged with a leaked secret cannot grant more. It
+// only applies to permissions supplied by the token itself; fallbacks for
+// tokens without permissions are bounded by the account ceilings instead.
+func WithTokenCeiling(ceiling permissions.Ceiling) Option {
+	return func(h *Handler) {
+		if len(ceiling.Pub) == 0 && len(ceiling.Sub) == 0 {
+			return
+		}
+		h.tokenCeiling = &ceiling
+	}
+}
+
+// WithConnectionTypeCeilings intersects the permissions of every issued user
+// JWT with the ceiling of the client's connection type (jwt.ConnectionTypeStandard,
+// jwt.ConnectionTypeWebsocket, ...), on top of any account ceiling. Connection
+// types are matched case-insensitively against the type mapped from the
+// server's client information by connectionType. When the connection type is
+// unknown, as on renewal, every configured ceiling applies.
+func WithConnectionTypeCeilings(ceilings map[string]permissions.Ceiling) Option {
+	return func(h *Handler) {
+		if len(ceilings) == 0 {
+			return
+		}
+		h.connCeilings = make(map[string]permissions.Ceiling, len(ceilings))
+		for connType, ceiling := range ceilings {
+			h.connCeilings[strings.ToUpper(connType)] = ceiling
+		}
+	}
+}
+
+// WithAccountPermissions grants every user the default permissions of their
+// account, merged beneath the user's own permissions with deny-wins semantics.
+// Account names are matched case-insensitively.
+func WithAccountPermissions(defaults map[string]jwt.Permissions) Option {
+	return func(h *Handler) {
+		if len(defaults) == 0 {
+			return
+		}
+		h.accountPerms = make(map[string]jwt.Permissions, len(defaults))
+		for account, perms := range defaults {
+			h.accountPerms[strings.ToLower(account)] = perms
+		}
+	}
+}
+
+// WithPermissionTemplates resolves the permission template named by a user
+// record and combines it with the user's inline permissions using strategy,
+// TemplateMerge or TemplateReplace. Template names are matched
+// case-insensitively; a user naming an unknown template is rejected. Templates
+// are compiled once here and shared by every user issued them.
+func WithPermissionTemplates(templates map[string]jwt.Permissions, strategy string) Option {
+	return func(h *Handler) {
+		h.templateMerge = strategy
+		if len(templates) == 0 {
+			return
+		}
+		h.templates = make(map[string]*jwt.Permissions, len(templates))
+		for name, perms := range templates {
+			// Merged into nothing, a template is in the form a merge returns
+			compiled := permissions.Merge(perms, jwt.Permissions{})
+			h.templates[strings.ToLower(name)] = &compiled
+		}
+	}
+}
+
+// WithPermissionCacheSize caches up to size merges of permission templates
+// with users' inline permissions, so users adding to a template are not merged
+// again on every request. Zero disables the cache.
+func WithPermissionCacheSize(size int) Option {
+	return func(h *Handler) {
+		if size > 0 {
+			h.permCache = newPermissionCache(size)
+		}
+	}
+}
+
+// WithTokenSecrets validates nats_tokens against the given labeled secrets in
+// order instead of NATS_TOKEN_SECRET, reporting the label of the matching
+// secret in logs and decisions.
+func WithTokenSecrets(secrets []tokenvalidation.Secret) Option {
+	return func(h *Handler) {
+		h.tokenSecrets = secrets
+	}
+}
+
+// WithTokenAuth enables or disables nats_token authentication. It is enabled
+// by default; when disabled, tokens supplied by clients are ignored and only
+// username/password authentication is attempted.
+func WithTokenAuth(enabled bool) Option {
+	return func(h *Handler) {
+		h.tokenAuth = enabled
+	}
+}
+
+// WithTokenIdentityOnly treats a valid nats_token purely as proof of identity:
+// its user_id is looked up in the user repository, whose account and
+// permissions are issued, and the token's own account and permissions claims
+// are ignored. Tokens for users missing from the repository are rejected.
+func WithTokenIdentityOnly(enabled bool) Option {
+	return func(h *Handler) {
+		h.tokenIdentity = enabled
+	}
+}
+
+// WithTokenCache caches validated nats_tokens in cache, so tokens presented
+// again before they expire skip parsing and the signature check. Audience,
+// issuer and claim checks still apply to every request. A nil cache disables
+// caching.
+func WithTokenCache(cache *tokenvalidation.Cache) Option {
+	return func(h *Handler) {
+		h.tokenCache = cache
+	}
+}
+
+// WithTokenLeeway sets the clock skew tolerated when checking the exp and nbf
+// times of nats_tokens, tokenvalidation.DefaultLeeway by default.
+func WithTokenLeeway(leeway time.Duration) Option {
+	return func(h *Handler) {
+		h.tokenLeeway = leeway
+	}
+}
+
+// WithTokenMaxIssuedAtSkew rejects nats_tokens issued more than skew in the
+// future. Zero, the default, does not check the iat time.
+func WithTokenMaxIssuedAtSkew(skew time.Duration) Option {
+	return func(h *Handler) {
+		h.tokenIatSkew = skew
+	}
+}
+
+// WithTokenAudience only accepts nats_tokens whose audience includes the
+// given service identifier. An empty audience accepts tokens for any service.
+func WithTokenAudience(audience string) Option {
+	return func(h *Handler) {
+		h.audience = audience
+	}
+}
+
+// WithTokenIssuer only accepts nats_tokens whose issuer is the given trusted
+// issuer. An empty issuer accepts tokens from any issuer.
+func WithTokenIssuer(issuer string) Option {
+	return func(h *Handler) {
+		h.issuer = issuer
+	}
+}
+
+// Modes for users granted root wildcards such as ">", see WithBroadWildcards.
+const (
+	BroadWildcardsOff    = "off"    // Issue the user JWT silently
+	BroadWildcardsWarn   = "warn"   // Issue the user JWT and log a warning
+	BroadWildcardsReject = "reject" // Reject the user
+)
+
+// WithBroadWildcards checks every issued user JWT for allow subjects starting
+// with a wildcard at the root, like ">" or "*.>", which are almost always a
+// mistake outside admin users. Depending on mode such users are logged with a
+// warning or rejected; admins, matched by username, are exempt.
+func WithBroadWildcards(mode string, admins []string) Option {
+	return func(h *Handler) {
+		h.wildcards = mode
+		h.wildcardAdmin = make(map[string]struct{}, len(admins))
+		for _, admin := range admins {
+			h.wildcardAdmin[admin] = struct{}{}
+		}
+	}
+}
+
+// Modes for nats_tokens carrying no permissions, see WithEmptyTokenPermissions.
+const (
+	EmptyPermissionsDeny    = "deny"    // Issue a deny-all user JWT
+	EmptyPermissionsInherit = "inherit" // Use the repository user's or account's defaults
+)
+
+// WithEmptyTokenPermissions selects how nats_tokens without permissions are
+// handled. EmptyPermissionsInherit takes the permissions of the repository user
+// with the token's user_id, or the account default permissions, and denies all
+// when neither exists. Any other mode denies all.
+func WithEmptyTokenPermissions(mode string) Option {
+	return func(h *Handler) {
+		h.emptyPerms = mode
+	}
+}
+
+// Blocklist lists subjects no user may be granted, whatever their account.
+type Blocklist struct {
+	Subjects       []string // Subjects never granted, wildcards allowed
+	ExemptAccounts []string // Accounts, e.g. the system account, not subject to the blocklist
+	Reject         bool     // Reject users requesting a blocked subject instead of stripping it
+}
+
+// WithBlocklist enforces the blocklist on every issued user JWT. Blocked
+// subjects are stripped from allow lists with a warning, or the user is
+// rejected when bl.Reject is set. Exempt accounts are matched case-insensitively.
+func WithBlocklist(bl Blocklist) Option {
+	return func(h *Handler) {
+		h.blocklist = bl
+		h.blockExempt = make(map[string]struct{}, len(bl.ExemptAccounts))
+		for _, account := range bl.ExemptAccounts {
+			h.blockExempt[strings.ToLower(account)] = struct{}{}
+		}
+	}
+}
+
+// WithErrorCategories prefixes response errors with the category of their
+// rejection reason, e.g. "unauthenticated: invalid credentials", so clients can
+// tell malformed requests from bad credentials and missing permissions.
+func WithErrorCategories(enabled bool) Option {
+	return func(h *Handler) {
+		h.categories = enabled
+	}
+}
+
+// WithErrorCodes replaces entries of DefaultErrorCodes, the codes prefixed to
+// response errors, with the codes from overrides, e.g. to report
+// "[ERR_NO_USER] user not found" for user_not_found.
+func WithErrorCodes(overrides map[string]string) Option {
+	return func(h *Handler) {
+		h.errorCodes = make(map[string]string, len(DefaultErrorCodes))
+		for reason, code := range DefaultErrorCodes {
+			h.errorCodes[reason] = code
+		}
+		for reason, code := range overrides {
+			h.errorCodes[reason] = code
+		}
+	}
+}
+
+// WithPasswordDeprecation logs every successful username/password login as
+// deprecated, to track down remaining clients while migrating to token auth.
+func WithPasswordDeprecation(enabled bool) Option {
+	return func(h *Handler) {
+		h.deprecatePass = enabled
+	}
+}
+
+// WithResponseTTL sets the expiry of authorization responses to the given
+// window after issuance so servers can tell how long a decision is fresh.
+// Zero leaves responses without an expiry.
+func WithResponseTTL(ttl time.Duration) Option {
+	return func(h *Handler) {
+		h.responseTTL = ttl
+	}
+}
+
+// WithAutoInboxSub adds InboxSubject to the subscribe allow list of every
+// issued user JWT that restricts subscriptions without covering it, so
+// request-reply works without listing the inbox for each user. An empty allow
+// list already permits the inbox and is left alone; account ceilings and the
+// blocklist still apply to the injected subject.
+func WithAutoInboxSub(enabled bool) Option {
+	return func(h *Handler) {
+		h.autoInbox = enabled
+	}
+}
+
+// WithEchoHeaders copies the named headers, such as a correlation ID, from each
+// authorization request onto its response so callers can match them up.
+// Header names are case-sensitive; headers missing from the request are left out.
+func WithEchoHeaders(names []string) Option {
+	return func(h *Handler) {
+		h.echoHeaders = names
+	}
+}
+
+// WithSlowRequestThreshold logs a warning with the decode, lookup and sign
+// timings of every request taking at least threshold. Zero disables it.
+func WithSlowRequestThreshold(threshold time.Duration) Option {
+	return func(h *Handler) {
+		h.slowThreshold = threshold
+	}
+}
+
+// WithMetrics records the handler's metrics, such as the number of allow
+// subjects of every issued user JWT.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(h *Handler) {
+		h.metrics = m
+	}
+}
+
+// WithMaxUserJWTSize rejects users whose encoded user JWT exceeds size bytes,
+// so an oversized permission set fails with a clear error instead of the NATS
+// server dropping the authorization response for exceeding its protocol
+// limits. Zero disables the check.
+func WithMaxUserJWTSize(size int) Option {
+	return func(h *Handler) {
+		h.maxJWTSize = size
+	}
+}
+
 // NewHandler creates a new Handler with the provided key pairs and user repository.
-func NewHandler(keyPairs *auth.KeyPairs, userRepo UserRepository) *Handler {
-	return &Handler{
-		keyPairs: keyPairs,
-		userRepo: userRepo,
+func NewHandler(keyPairs *auth.KeyPairs, userRepo UserRepository, opts ...Option) *Handler {
+	h := &Handler{
+		keyPairs:    keyPairs,
+		userRepo:    userRepo,
+		noCredsMsg:  DefaultNoCredentialsMessage,
+		tokenAuth:   true,
+		tokenLeeway: tokenvalidation.DefaultLeeway,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if !h.tokenAuth && (os.Getenv("NATS_TOKEN_SECRET") != "" || len(h.tokenSecrets) > 0) {
+		logrus.Warn("nats_token authentication is disabled but a token secret is configured; the secret is unused and can be removed")
+	}
+	return h
+}
+
+// UpdateSecrets replaces the signing keys and the labeled token secrets at
+// runtime, e.g. after the secrets were rotated in Vault. A nil keyPairs keeps
+// the current keys; nil secrets fall back to NATS_TOKEN_SECRET.
+func (h *Handler) UpdateSecrets(keyPairs *auth.KeyPairs, secrets []tokenvalidation.Secret) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if keyPairs != nil {
+		h.keyPairs = keyPairs
+	}
+	h.tokenSecrets = secrets
+	// Tokens validated by a retired secret must not outlive it in the cache
+	if h.tokenCache != nil {
+		h.tokenCache.Flush()
+	}
+}
+
+// keys returns the current key pairs.
+func (h *Handler) keys() *auth.KeyPairs {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.keyPairs
+}
+
+// secrets returns the current labeled token secrets.
+func (h *Handler) secrets() []tokenvalidation.Secret {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.tokenSecrets
 }
 
 // HandleRequest processes an incoming NATS authorization request.
 // It decodes the request, validates the user, generates a user JWT, and responds
 // with a signed authorization response, optionally encrypted with xkey.
 func (h *Handler) HandleRequest(req micro.Request) {
+	timing := newRequestTiming()
+	var decision auth.Decision
+	defer func() {
+		h.logSlow(timing, decision)
+		h.metrics.ObserveRequest(decision.Method, decision.Account, requestResult(decision), time.Since(timing.start))
+		if h.serverInfo && !decision.Allowed() {
+			h.metrics.ServerFailure(requestResult(decision), decision.ServerName, decision.ServerCluster)
+		}
+	}()
+
 	// Decode the request token, handling xkey decryption if present
 	token, err := h.decodeRequest(req)
 	if err != nil {
-		h.respond(req, "", "", "", err.Error())
+		decision = h.deny(req, auth.Decision{}, err)
 		return
 	}
 
 	// Decode authorization request claims
 	rc, err := jwt.DecodeAuthorizationRequestClaims(string(token))
 	if err != nil {
-		h.respond(req, "", "", "", fmt.Sprintf("decoding authorization request: %v", err))
+		decision = h.deny(req, auth.Decision{}, rejection(ReasonBadRequest, "decoding authorization request: %v", err))
+		return
+	}
+	timing.decode = timing.lap()
+
+	// Clients connecting with a credentials file present the nats_token as their user JWT
+	if token := credsToken(rc); token != "" {
+		rc.ConnectOptions.Token = token
+	}
+
+	// Identify users logging in with an alternate key by their canonical username,
+	// so the issued JWT, admin exemptions, rate limiting and audit agree
+	rc.ConnectOptions.Username = h.canonicalUsername(rc.ConnectOptions.Username)
+
+	decision = auth.Decision{
+		Username: rc.ConnectOptions.Username,
+		Method:   h.methodOf(rc),
+		ServerID: rc.Server.ID,
+		UserNkey: rc.UserNkey,
+	}
+	if decision.Method == auth.MethodToken {
+		decision.TokenHash = tokenvalidation.Fingerprint(rc.ConnectOptions.Token)
+	}
+	if h.serverInfo {
+		decision.ServerName = rc.Server.Name
+		decision.ServerCluster = rc.Server.Cluster
+	}
+
+	if h.trustedIDs != nil {
+		if _, ok := h.trustedIDs[rc.Server.ID]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"server_id":   rc.Server.ID,
+				"server_name": rc.Server.Name,
+			}).Error("Authorization request from untrusted server ID")
+			h.metrics.UntrustedServer(metrics.CheckServerID)
+			decision = h.deny(req, decision, rejection(ReasonUntrustedServer, "untrusted server ID %q", rc.Server.ID))
+			return
+		}
+	}
+	if h.trustedIssuer != nil {
+		if _, ok := h.trustedIssuer[rc.Issuer]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"issuer":    rc.Issuer,
+				"server_id": rc.Server.ID,
+			}).Error("Authorization request signed by untrusted server key")
+			h.metrics.UntrustedServer(metrics.CheckIssuer)
+			decision = h.deny(req, decision, rejection(ReasonUntrustedServer, "untrusted authorization request issuer"))
+			return
+		}
+	}
+
+	// Throttle password guessing before the user repository is consulted
+	if !h.allowAttempt(rc) {
+		logrus.WithFields(logrus.Fields{
+			"username": rc.ConnectOptions.Username,
+			"host":     rc.ClientInformation.Host,
+		}).Warn("Rate limited authorization request")
+		decision = h.deny(req, decision, rejection(ReasonRateLimited, "too many authorization requests, retry later"))
 		return
 	}
 
 	// Validate user credentials
 	user, userID, err := h.validateUser(rc)
 	if err != nil {
-		h.respond(req, rc.UserNkey, rc.Server.ID, "", err.Error())
+		decision = h.deny(req, decision, err)
 		return
 	}
 
+	// Refuse to issue a JWT for a partially populated user record
+	if err := checkUserRecord(user); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"username": rc.ConnectOptions.Username,
+			"user_id":  userID,
+		}).WithError(err).Error("Rejected incomplete user record")
+		decision = h.deny(req, decision, err)
+		return
+	}
+
+	timing.lookup = timing.lap()
+
 	// Generate user JWT, using userID from token or rc.ConnectOptions.Username
 	username := userID
 	if username == "" {
 		username = rc.ConnectOptions.Username
 	}
-	userJWT, err := h.generateUserJWT(rc.UserNkey, username, user)
+	decision.Username = username
+	decision.Account = user.Account
+	decision.KeyLabel = user.KeyLabel
+	user, err = h.policyUser(user, username, decision.Method, policy.Client{
+		Host: rc.ClientInformation.Host,
+		Name: rc.ClientInformation.Name,
+		Type: rc.ClientInformation.Type,
+		Kind: rc.ClientInformation.Kind,
+	})
 	if err != nil {
-		h.respond(req, rc.UserNkey, rc.Server.ID, "", fmt.Sprintf("generating user JWT: %v", err))
+		decision = h.deny(req, decision, err)
+		return
+	}
+	connType, ok := connectionType(rc.ClientInformation)
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"username": username,
+			"type":     rc.ClientInformation.Type,
+			"kind":     rc.ClientInformation.Kind,
+		}).Warn("Rejected client with an unsupported connection type")
+		decision = h.deny(req, decision, rejection(ReasonBadRequest, "unsupported connection type %q of kind %q", rc.ClientInformation.Type, rc.ClientInformation.Kind))
+		return
+	}
+	userJWT, err := h.generateUserJWT(rc.UserNkey, username, connType, user)
+	if err != nil {
+		if reasonOf(err) == "" {
+			err = rejection(ReasonJWTError, "generating user JWT: %v", err)
+		}
+		decision = h.deny(req, decision, err)
 		return
 	}
 
 	// Respond with the signed JWT
+	h.record(decision)
 	h.respond(req, rc.UserNkey, rc.Server.ID, userJWT, "")
+	timing.sign = timing.lap()
+}
+
+// requestTiming breaks the latency of one authorization request down into
+// its stages. Stages a rejected request never reached stay zero.
+type requestTiming struct {
+	start  time.Time
+	last   time.Time
+	decode time.Duration // Decrypting and decoding the request claims
+	lookup time.Duration // Validating credentials against the user backend
+	sign   time.Duration // Generating the user JWT and signing the response
+}
+
+func newRequestTiming() *requestTiming {
+	now := time.Now()
+	return &requestTiming{start: now, last: now}
+}
+
+// lap returns the time elapsed since the previous lap.
+func (t *requestTiming) lap() time.Duration {
+	now := time.Now()
+	elapsed := now.Sub(t.last)
+	t.last = now
+	return elapsed
+}
+
+// logSlow warns about a request that took at least the slow request threshold.
+func (h *Handler) logSlow(t *requestTiming, d auth.Decision) {
+	if h.slowThreshold <= 0 {
+		return
+	}
+	total := time.Since(t.start)
+	if total < h.slowThreshold {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"username":     d.Username,
+		"account":      d.Account,
+		"server_id":    d.ServerID,
+		"total_ms":     milliseconds(total),
+		"decode_ms":    milliseconds(t.decode),
+		"lookup_ms":    milliseconds(t.lookup),
+		"sign_ms":      milliseconds(t.sign),
+		"threshold_ms": milliseconds(h.slowThreshold),
+	}).Warn("Slow authorization request")
+}
+
+// milliseconds converts d to fractional milliseconds for log fields.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// deny records the rejected decision and responds with the rejection error,
+// prefixed with its error code and category when those are enabled.
+func (h *Handler) deny(req micro.Request, d auth.Decision, err error) auth.Decision {
+	d.Error = err.Error()
+	d.Reason = reasonOf(err)
+	d.Category = CategoryOf(d.Reason)
+	d.Code = h.codeOf(d.Reason)
+	h.record(d)
+
+	errMsg := d.Error
+	if d.Code != "" {
+		errMsg = "[" + d.Code + "] " + errMsg
+	}
+	if h.categories && d.Category != "" {
+		errMsg = d.Category + ": " + errMsg
+	}
+	h.respond(req, d.UserNkey, d.ServerID, "", errMsg)
+	return d
+}
+
+// allowAttempt reports whether the rate limit admits another request for the
+// username, and client host when limited per client. Requests without a
+// username, such as token logins, are not limited.
+func (h *Handler) allowAttempt(rc *jwt.AuthorizationRequestClaims) bool {
+	username := rc.ConnectOptions.Username
+	if h.rateLimit == nil || username == "" {
+		return true
+	}
+	key := username
+	if h.ratePerHost {
+		key += "\x00" + rc.ClientInformation.Host
+	}
+	return h.rateLimit.allow(key)
+}
+
+// requestResult classifies a decision for the request metrics: rejections of
+// the credentials or requested access are denials, failures to process the
+// request are errors.
+func requestResult(d auth.Decision) string {
+	if d.Error == "" {
+		return metrics.ResultSuccess
+	}
+	switch d.Reason {
+	case ReasonBadRequest, ReasonJWTError, ReasonPolicyError:
+		return metrics.ResultError
+	}
+	return metrics.ResultDenied
+}
+
+// record passes the decision to every registered recorder.
+func (h *Handler) record(d auth.Decision) {
+	for _, r := range h.recorders {
+		r.Record(d)
+	}
+	if h.auditor != nil {
+		h.auditor.Record(audit.NewEvent(d, time.Now()))
+	}
+}
+
+// codeOf returns the error code of a rejection reason: the configured code
+// when error codes are enabled, the default code otherwise.
+func (h *Handler) codeOf(reason string) string {
+	if h.errorCodes != nil {
+		return h.errorCodes[reason]
+	}
+	return DefaultErrorCodes[reason]
+}
+
+// methodOf returns the authentication method the client attempted. Tokens
+// do not count while token authentication is disabled.
+func (h *Handler) methodOf(rc *jwt.AuthorizationRequestClaims) string {
+	switch {
+	case rc.ConnectOptions.Token != "" && h.tokenAuth:
+		return auth.MethodToken
+	case rc.ConnectOptions.Username != "" || rc.ConnectOptions.Password != "":
+		return auth.MethodPassword
+	default:
+		return ""
+	}
+}
+
+// credsToken returns the nats_token a client presented as the user JWT of a
+// NATS credentials file, as written by generate_token -format creds, or an
+// empty string. Decodable NATS user JWTs are not nats_tokens.
+func credsToken(rc *jwt.AuthorizationRequestClaims) string {
+	if rc.ConnectOptions.Token != "" || rc.ConnectOptions.JWT == "" {
+		return ""
+	}
+	if _, err := jwt.DecodeGeneric(rc.ConnectOptions.JWT); err == nil {
+		return ""
+	}
+	return rc.ConnectOptions.JWT
 }
 
 // decodeRequest extracts and decodes the request token, handling xkey decryption if needed.
@@ -82,14 +984,18 @@ func (h *Handler) decodeRequest(req micro.Request) ([]byte, error) {
 	if xkey == "" {
 		return req.Data(), nil
 	}
+	if !nkeys.IsValidPublicCurveKey(xkey) {
+		return nil, rejection(ReasonBadRequest, "invalid server xkey")
+	}
 
-	if h.keyPairs.Curve == nil {
-		return nil, errors.New("xkey not supported")
+	keyPairs := h.keys()
+	if keyPairs.Curve == nil {
+		return nil, rejection(ReasonXKeyUnsupported, "xkey not supported")
 	}
 
-	token, err := h.keyPairs.Curve.Open(req.Data(), xkey)
+	token, err := keyPairs.Curve.Open(req.Data(), xkey)
 	if err != nil {
-		return nil, fmt.Errorf("decrypting message: %w", err)
+		return nil, rejection(ReasonBadRequest, "decrypting message: %v", err)
 	}
 	return token, nil
 }
@@ -101,130 +1007,576 @@ func (h *Handler) decodeRequest(req micro.Request) ([]byte, error) {
 func (h *Handler) validateUser(rc *jwt.AuthorizationRequestClaims) (*auth.User, string, error) {
 	// Token-based authentication
 	if rc.ConnectOptions.Token != "" {
-		// userID, permissions, err := tokenvalidation.ValidateNatsToken(rc.ConnectOptions.Token)
-		user, err := tokenvalidation.ValidateNatsToken(rc.ConnectOptions.Token)
-		if err != nil {
-			logrus.WithError(err).Error("Failed to validate nats_token")
-			return nil, "", fmt.Errorf("validating nats_token: %v", err)
-		}
-		userID := user.UserID
-		permissions := user.Permissions
-
-		// Convert permissions to jwt.Permissions
-		jwtPerms := jwt.Permissions{}
-		if pub, ok := permissions["pub"].(map[string]any); ok {
-			var pubPerm jwt.Permission
-			if allow, ok := pub["allow"].([]any); ok {
-				allowStrings := make([]string, len(allow))
-				for i, v := range allow {
-					allowStrings[i] = v.(string)
-				}
-				pubPerm.Allow = allowStrings
-			}
-			if deny, ok := pub["deny"].([]any); ok {
-				denyStrings := make([]string, len(deny))
-				for i, v := range deny {
-					denyStrings[i] = v.(string)
-				}
-				pubPerm.Deny = denyStrings
-			}
-			if len(pubPerm.Allow) > 0 || len(pubPerm.Deny) > 0 {
-				jwtPerms.Pub = pubPerm
-			}
+		if h.tokenAuth {
+			return h.tokenUser(rc.ConnectOptions.Token)
 		}
-		if sub, ok := permissions["sub"].(map[string]any); ok {
-			var subPerm jwt.Permission
-			if allow, ok := sub["allow"].([]any); ok {
-				allowStrings := make([]string, len(allow))
-				for i, v := range allow {
-					allowStrings[i] = v.(string)
-				}
-				subPerm.Allow = allowStrings
-			}
-			if deny, ok := sub["deny"].([]any); ok {
-				denyStrings := make([]string, len(deny))
-				for i, v := range deny {
-					denyStrings[i] = v.(string)
-				}
-				subPerm.Deny = denyStrings
-			}
-			if len(subPerm.Allow) > 0 || len(subPerm.Deny) > 0 {
-				jwtPerms.Sub = subPerm
-			}
-		}
-		if resp, ok := permissions["resp"].(map[string]any); ok {
-			if maxMsgs, ok := resp["max"].(float64); ok {
-				jwtPerms.Resp = &jwt.ResponsePermission{MaxMsgs: int(maxMsgs)}
-			}
-		}
-		logrus.WithFields(logrus.Fields{
-			"user_id":    userID,
-			"token_hash": fmt.Sprintf("%x", sha256.Sum256([]byte(rc.ConnectOptions.Token)))[:8],
-		}).Info("Validated nats_token")
-
-		return &auth.User{
-			Permissions: jwtPerms,
-			Pass:        "",           // Password not used for token auth
-			Account:     user.Account, // Match alice's account from New()
-		}, userID, nil
+		logrus.WithField("username", rc.ConnectOptions.Username).Debug("Ignoring nats_token: token authentication is disabled")
 	}
 
 	// Username/password authentication
+	if rc.ConnectOptions.Username == "" && rc.ConnectOptions.Password == "" {
+		logrus.Error("No credentials provided")
+		return nil, "", rejection(ReasonNoCredentials, "%s", h.noCredsMsg)
+	}
 	if rc.ConnectOptions.Username == "" || rc.ConnectOptions.Password == "" {
-		logrus.Error("Username or password missing")
-		return nil, "", errors.New("username or password missing")
+		logrus.WithField("username", rc.ConnectOptions.Username).Error("Username or password missing")
+		return nil, "", rejection(ReasonMissingCredentials, "username or password missing")
 	}
-	user, exists := h.userRepo.Get(rc.ConnectOptions.Username)
-	if !exists {
-		logrus.WithFields(logrus.Fields{
-			"username": rc.ConnectOptions.Username,
-		}).Error("User not found")
-		return nil, "", errors.New("user not found")
+	user, err := h.lookupUser(rc.ConnectOptions.Username)
+	if err != nil {
+		return nil, "", err
 	}
-	if user.Pass != rc.ConnectOptions.Password {
+	if !checkPassword(user.Pass, rc.ConnectOptions.Password) {
 		logrus.WithFields(logrus.Fields{
 			"username": rc.ConnectOptions.Username,
 		}).Error("Invalid credentials")
-		return nil, "", errors.New("invalid credentials")
+		return nil, "", rejection(ReasonInvalidCredentials, "invalid credentials")
+	}
+	if err := checkExpiry(rc.ConnectOptions.Username, user); err != nil {
+		return nil, "", err
 	}
 	logrus.WithFields(logrus.Fields{
 		"username": rc.ConnectOptions.Username,
-		"Pass":     rc.ConnectOptions.Password,
-		"Account":  user.Account,
+		"method":   auth.MethodPassword,
 	}).Info("Validated user login/pass")
+	h.rehashPassword(rc.ConnectOptions.Username, user.Pass, rc.ConnectOptions.Password)
+	if h.deprecatePass {
+		logrus.WithFields(logrus.Fields{
+			"username":  rc.ConnectOptions.Username,
+			"account":   user.Account,
+			"client_ip": rc.ClientInformation.Host,
+		}).Warn("Deprecated password authentication, migrate client to nats_token")
+	}
 
 	return user, "", nil
 }
 
-// generateUserJWT creates and signs a user JWT for the given user.
-func (h *Handler) generateUserJWT(userNkey, username string, user *auth.User) (string, error) {
+// canonicalUsername returns the username an alternate key such as an email
+// address belongs to when the user repository resolves aliases.
+func (h *Handler) canonicalUsername(username string) string {
+	if resolver, ok := h.userRepo.(AliasResolver); ok && username != "" {
+		return resolver.Canonical(username)
+	}
+	return username
+}
+
+// lookupUser finds the user record of a canonical username.
+func (h *Handler) lookupUser(username string) (*auth.User, error) {
+	user, exists := h.userRepo.Get(username)
+	if !exists {
+		logrus.WithFields(logrus.Fields{
+			"username": username,
+		}).Error("User not found")
+		return nil, rejection(ReasonUserNotFound, "user not found")
+	}
+	return user, nil
+}
+
+// checkExpiry rejects a user whose account has expired.
+func checkExpiry(username string, user *auth.User) error {
+	if user.Expired(time.Now()) {
+		logrus.WithFields(logrus.Fields{
+			"username":   username,
+			"expired_at": user.ExpiresAt,
+		}).Error("Account expired")
+		return rejection(ReasonAccountExpired, "account expired")
+	}
+	return nil
+}
+
+// validateToken validates a nats_token against the labeled secrets, or
+// NATS_TOKEN_SECRET when there are none, returning its claims and the label of
+// the matching secret. Tokens found in the token cache skip validation.
+func (h *Handler) validateToken(token string) (*tokenvalidation.NatsTokenClaims, string, error) {
+	if h.tokenCache != nil {
+		if claims, keyLabel, ok := h.tokenCache.Get(token); ok {
+			return claims, keyLabel, nil
+		}
+	}
+	var claims *tokenvalidation.NatsTokenClaims
+	var keyLabel string
+	var err error
+	opts := []tokenvalidation.Option{
+		tokenvalidation.WithLeeway(h.tokenLeeway),
+		tokenvalidation.WithMaxIssuedAtSkew(h.tokenIatSkew),
+	}
+	if secrets := h.secrets(); len(secrets) > 0 {
+		claims, keyLabel, err = tokenvalidation.ValidateWithSecrets(token, secrets, opts...)
+	} else {
+		claims, err = tokenvalidation.ValidateNatsToken(token, opts...)
+	}
+	if err == nil && h.tokenCache != nil {
+		h.tokenCache.Add(token, claims, keyLabel)
+	}
+	return claims, keyLabel, err
+}
+
+// tokenUser validates a nats_token and builds the user it authenticates along
+// with the token's user_id. Its permissions claim is parsed into
+// jwt.Permissions by tokenPermissions.
+func (h *Handler) tokenUser(token string) (*auth.User, string, error) {
+	// userID, permissions, err := tokenvalidation.ValidateNatsToken(token)
+	user, keyLabel, err := h.validateToken(token)
+	if err == nil && h.audience != "" {
+		err = tokenvalidation.CheckAudience(user, h.audience)
+	}
+	if err == nil && h.issuer != "" {
+		err = tokenvalidation.CheckIssuer(user, h.issuer)
+	}
+	if err != nil {
+		h.metrics.TokenValidationFailed(tokenvalidation.FailureReason(err))
+		logrus.WithError(err).WithField("key", keyLabel).Error("Failed to validate nats_token")
+		if tokenvalidation.FailureReason(err) == tokenvalidation.FailureExpired {
+			return nil, "", rejection(ReasonTokenExpired, "validating nats_token: %v", err)
+		}
+		return nil, "", rejection(ReasonInvalidToken, "validating nats_token: %v", err)
+	}
+	var notAfter time.Time
+	if user.ExpiresAt != nil {
+		notAfter = user.ExpiresAt.Time
+	}
+	if h.tokenIdentity {
+		identity, userID, err := h.identityUser(user.UserID, keyLabel)
+		if identity != nil {
+			identity.NotAfter = notAfter
+		}
+		return identity, userID, err
+	}
+	if err := h.validateTokenAccount(user.Account); err != nil {
+		logrus.WithError(err).WithField("user_id", user.UserID).Error("Rejected nats_token account")
+		return nil, "", rejection(ReasonInvalidAccount, "validating nats_token: %v", err)
+	}
+	userID := user.UserID
+	jwtPerms, err := tokenvalidation.ToJWTPermissions(user.Permissions)
+	if err != nil {
+		h.metrics.TokenValidationFailed(tokenvalidation.FailurePermissions)
+		logrus.WithError(err).WithField("user_id", userID).Error("Rejected nats_token permissions")
+		return nil, "", rejection(ReasonBadPermissions, "validating nats_token: %v", err)
+	}
+	var limits auth.Limits
+	if user.Limits != nil {
+		if err := user.Limits.Validate(); err != nil {
+			h.metrics.TokenValidationFailed(tokenvalidation.FailurePermissions)
+			logrus.WithError(err).WithField("user_id", userID).Error("Rejected nats_token limits")
+			return nil, "", rejection(ReasonInvalidToken, "validating nats_token: %v", err)
+		}
+		limits = *user.Limits
+	}
+	if err := auth.ValidateCIDRs(user.Src); err != nil {
+		h.metrics.TokenValidationFailed(tokenvalidation.FailurePermissions)
+		logrus.WithError(err).WithField("user_id", userID).Error("Rejected nats_token source networks")
+		return nil, "", rejection(ReasonInvalidToken, "validating nats_token: %v", err)
+	}
+	if emptyPermissions(jwtPerms) {
+		jwtPerms = h.emptyTokenPermissions(userID, user.Account)
+	} else if h.tokenCeiling != nil {
+		var stripped []string
+		jwtPerms, stripped = permissions.Apply(jwtPerms, *h.tokenCeiling)
+		if len(stripped) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"user_id":  userID,
+				"account":  user.Account,
+				"stripped": stripped,
+			}).Warn("Stripped nats_token subjects outside the token permission ceiling")
+		}
+	}
+	fields := logrus.Fields{
+		"user_id":    userID,
+		"token_hash": tokenvalidation.Fingerprint(token),
+	}
+	if keyLabel != "" {
+		fields["key"] = keyLabel
+	}
+	logrus.WithFields(fields).Info("Validated nats_token")
+
+	return &auth.User{
+		Permissions: jwtPerms,
+		Pass:        "",           // Password not used for token auth
+		Account:     user.Account, // Match alice's account from New()
+		KeyLabel:    keyLabel,
+		NotAfter:    notAfter,
+		Limits:      limits,
+		Src:         user.Src,
+	}, userID, nil
+}
+
+// emptyPermissions reports whether perms grant or deny nothing, which NATS
+// would otherwise treat as allowing every subject.
+func emptyPermissions(perms jwt.Permissions) bool {
+	return len(perms.Pub.Allow) == 0 && len(perms.Pub.Deny) == 0 &&
+		len(perms.Sub.Allow) == 0 && len(perms.Sub.Deny) == 0 && perms.Resp == nil
+}
+
+// identityUser builds the user authenticated by a nats_token in identity-only
+// mode: the token's user_id is looked up in the repository, whose account and
+// permissions are used instead of the token's own claims.
+func (h *Handler) identityUser(userID, keyLabel string) (*auth.User, string, error) {
+	repoUser, exists := h.userRepo.Get(userID)
+	if !exists {
+		logrus.WithField("user_id", userID).Error("nats_token user not found in repository")
+		return nil, "", rejection(ReasonUserNotFound, "user not found")
+	}
+	if repoUser.Expired(time.Now()) {
+		logrus.WithFields(logrus.Fields{
+			"user_id":    userID,
+			"expired_at": repoUser.ExpiresAt,
+		}).Error("Account expired")
+		return nil, "", rejection(ReasonAccountExpired, "account expired")
+	}
+	logrus.WithFields(logrus.Fields{
+		"user_id": userID,
+		"account": repoUser.Account,
+		"key":     keyLabel,
+	}).Info("Validated nats_token identity, using repository account and permissions")
+	// Copy the whole record so restrictions such as Template are never dropped;
+	// the token, not the password, proved the identity
+	user := *repoUser
+	user.Pass = ""
+	user.KeyLabel = keyLabel
+	return &user, userID, nil
+}
+
+// emptyTokenPermissions resolves the permissions of a nats_token that carries
+// none according to the configured mode.
+func (h *Handler) emptyTokenPermissions(userID, account string) jwt.Permissions {
+	if h.emptyPerms == EmptyPermissionsInherit {
+		if repoUser, ok := h.userRepo.Get(userID); ok && !emptyPermissions(repoUser.Permissions) {
+			logrus.WithField("user_id", userID).Info("nats_token has no permissions, inheriting repository user permissions")
+			h.metrics.FallbackApplied(metrics.FallbackTokenRepositoryPermissions, logrus.Fields{"user_id": userID})
+			return repoUser.Permissions
+		}
+		if _, ok := h.accountPerms[strings.ToLower(account)]; ok {
+			logrus.WithField("user_id", userID).Info("nats_token has no permissions, inheriting account default permissions")
+			h.metrics.FallbackApplied(metrics.FallbackTokenAccountPermissions, logrus.Fields{"user_id": userID})
+			return jwt.Permissions{}
+		}
+	}
+	logrus.WithField("user_id", userID).Warn("nats_token has no permissions, issuing deny-all user JWT")
+	h.metrics.FallbackApplied(metrics.FallbackTokenDenyAll, logrus.Fields{"user_id": userID})
+	return jwt.Permissions{
+		Pub: jwt.Permission{Deny: []string{">"}},
+		Sub: jwt.Permission{Deny: []string{">"}},
+	}
+}
+
+// validateTokenAccount ensures the account claim of a nats_token names exactly one
+// account and, when known accounts are configured, that the account is one of them.
+func (h *Handler) validateTokenAccount(account string) error {
+	if account == "" {
+		return errors.New("missing account in token")
+	}
+	if strings.ContainsAny(account, " \t,*>") {
+		return fmt.Errorf("account %q must name a single account", account)
+	}
+	if h.knownAccounts != nil {
+		if _, ok := h.knownAccounts[account]; !ok {
+			return fmt.Errorf("unknown account %q", account)
+		}
+	}
+	return nil
+}
+
+// policyUser returns the user with the permissions resolved by the permission
+// source, or the user unchanged when no source is configured. The user record
+// itself is not modified.
+func (h *Handler) policyUser(user *auth.User, username, method string, client policy.Client) (*auth.User, error) {
+	if h.policy == nil {
+		return user, nil
+	}
+	perms, err := h.policy.Permissions(policy.Query{
+		Username: username,
+		Account:  user.Account,
+		Method:   method,
+		Client:   client,
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"username": username,
+			"account":  user.Account,
+		}).WithError(err).Error("Failed to resolve permissions from the policy service")
+		return nil, rejection(ReasonPolicyError, "resolving permissions failed")
+	}
+	resolved := *user
+	resolved.Permissions = perms
+	resolved.Template = ""
+	return &resolved, nil
+}
+
+// checkUserRecord is a final backstop against backend data integrity issues: a
+// resolved user must name the account it is placed in before a JWT is issued.
+func checkUserRecord(user *auth.User) error {
+	if user == nil || strings.TrimSpace(user.Account) == "" {
+		return rejection(ReasonIncompleteUser, "incomplete user record")
+	}
+	return nil
+}
+
+// generateUserJWT creates and signs a user JWT for the given user connecting
+// with connType, which is empty when the connection type is unknown.
+func (h *Handler) generateUserJWT(userNkey, username, connType string, user *auth.User) (string, error) {
 	uc := jwt.NewUserClaims(userNkey)
 	uc.Name = username
 	uc.Audience = user.Account
 	uc.Permissions = user.Permissions
+	if user.Template != "" {
+		template, ok := h.templates[strings.ToLower(user.Template)]
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"username": username,
+				"template": user.Template,
+			}).Error("User references an unknown permission template")
+			return "", rejection(ReasonIncompleteUser, "unknown permission template %q", user.Template)
+		}
+		uc.Permissions = h.applyTemplate(strings.ToLower(user.Template), username, template, user.Permissions)
+	}
+	user.Limits.Apply(&uc.NatsLimits)
+	uc.AllowedConnectionTypes = user.ConnectionTypes
+	uc.BearerToken = user.BearerToken
+	uc.Src = jwt.CIDRList(user.Src)
+	// NATS time ranges apply every day, so only today's windows are issued
+	times, ok := auth.TimeRanges(user.Times, user.Locale, time.Now())
+	if !ok {
+		return "", rejection(ReasonOutsideTimeWindow, "no access window for user %q today", username)
+	}
+	uc.Times = times
+	uc.Locale = user.Locale
+	if h.userJWTTTL > 0 {
+		uc.Expires = time.Now().Add(h.userJWTTTL).Unix()
+	}
+	// A user JWT never outlives the nats_token it was issued for
+	if !user.NotAfter.IsZero() && (uc.Expires == 0 || uc.Expires > user.NotAfter.Unix()) {
+		uc.Expires = user.NotAfter.Unix()
+	}
+	if defaults, ok := h.accountPerms[strings.ToLower(user.Account)]; ok {
+		uc.Permissions = permissions.Merge(defaults, uc.Permissions)
+		h.metrics.FallbackApplied(metrics.FallbackAccountPermissions, logrus.Fields{
+			"username": username,
+			"account":  user.Account,
+		})
+	}
+	if h.autoInbox && len(uc.Permissions.Sub.Allow) > 0 && !slices.ContainsFunc(uc.Permissions.Sub.Allow, func(pattern string) bool {
+		return permissions.Covers(pattern, InboxSubject)
+	}) {
+		// Copy so the user record's allow list is never appended to
+		uc.Permissions.Sub.Allow = append(slices.Clone(uc.Permissions.Sub.Allow), InboxSubject)
+		logrus.WithFields(logrus.Fields{
+			"username": username,
+			"account":  user.Account,
+		}).Debug("Added the inbox to the subscribe permissions")
+	}
+	if ceiling, ok := h.ceilings[strings.ToLower(user.Account)]; ok {
+		var stripped []string
+		uc.Permissions, stripped = permissions.Apply(uc.Permissions, ceiling)
+		if len(stripped) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"username": username,
+				"account":  user.Account,
+				"stripped": stripped,
+			}).Warn("Stripped subjects outside the account permission ceiling")
+		}
+	}
+	for _, ceiling := range h.connectionCeilings(connType) {
+		var stripped []string
+		uc.Permissions, stripped = permissions.Apply(uc.Permissions, ceiling)
+		if len(stripped) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"username":        username,
+				"account":         user.Account,
+				"connection_type": connType,
+				"stripped":        stripped,
+			}).Warn("Stripped subjects outside the connection type permission ceiling")
+		}
+	}
+	if _, exempt := h.blockExempt[strings.ToLower(user.Account)]; len(h.blocklist.Subjects) > 0 && !exempt {
+		var offending []string
+		uc.Permissions, offending = permissions.Block(uc.Permissions, h.blocklist.Subjects)
+		if len(offending) > 0 {
+			fields := logrus.Fields{
+				"username":  username,
+				"account":   user.Account,
+				"offending": offending,
+			}
+			if h.blocklist.Reject {
+				logrus.WithFields(fields).Warn("Rejected user requesting blocked subjects")
+				return "", rejection(ReasonBlockedSubject, "permissions include blocked subjects")
+			}
+			logrus.WithFields(fields).Warn("Stripped blocked subjects from user permissions")
+		}
+	}
+	if _, admin := h.wildcardAdmin[username]; h.wildcards != "" && h.wildcards != BroadWildcardsOff && !admin {
+		if broad := permissions.BroadWildcards(uc.Permissions); len(broad) > 0 {
+			fields := logrus.Fields{
+				"username":  username,
+				"account":   user.Account,
+				"wildcards": broad,
+			}
+			if h.wildcards == BroadWildcardsReject {
+				logrus.WithFields(fields).Warn("Rejected user granted broad wildcard subjects")
+				return "", rejection(ReasonBroadWildcard, "permissions grant broad wildcard subjects")
+			}
+			logrus.WithFields(fields).Warn("User is granted broad wildcard subjects")
+		}
+	}
+	if uc.Expires == 0 {
+		switch h.jwtExpiry {
+		case JWTExpiryReject:
+			logrus.WithFields(logrus.Fields{
+				"username": username,
+				"account":  user.Account,
+			}).Warn("Rejected user whose JWT would never expire")
+			return "", rejection(ReasonMissingExpiry, "user JWT has no expiry")
+		case JWTExpiryDefault:
+			uc.Expires = time.Now().Add(h.defaultJWTTTL).Unix()
+		}
+	}
+	keyPairs := h.keys()
+	issuer := keyPairs.Issuer
+	if len(keyPairs.AccountIssuers) > 0 {
+		var ok bool
+		if issuer, ok = keyPairs.AccountIssuers[strings.ToLower(user.Account)]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"username": username,
+				"account":  user.Account,
+			}).Error("No issuer key configured for the user's account")
+			return "", rejection(ReasonNoAccountIssuer, "no issuer key configured for account %q", user.Account)
+		}
+	} else if keyPairs.IssuerAccount != "" {
+		uc.IssuerAccount = keyPairs.IssuerAccount
+	}
+	if h.logPerms && logrus.IsLevelEnabled(logrus.DebugLevel) {
+		perms, err := json.Marshal(uc.Permissions)
+		if err != nil {
+			logrus.WithError(err).Debug("Failed to serialize issued permissions")
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"username":    username,
+				"account":     user.Account,
+				"permissions": string(perms),
+			}).Debug("Issuing user JWT permissions")
+		}
+	}
 
+	uc.Permissions = permissions.Normalize(uc.Permissions)
 	vr := jwt.CreateValidationResults()
 	uc.Validate(vr)
 	if len(vr.Errors()) > 0 {
 		return "", errors.New("validating claims")
 	}
 
-	return uc.Encode(h.keyPairs.Issuer)
+	userJWT, err := uc.Encode(issuer)
+	if err != nil {
+		return "", err
+	}
+	if h.maxJWTSize > 0 && len(userJWT) > h.maxJWTSize {
+		logrus.WithFields(logrus.Fields{
+			"username": username,
+			"account":  user.Account,
+			"size":     len(userJWT),
+			"limit":    h.maxJWTSize,
+		}).Error("Issued user JWT exceeds the size limit, reduce the user's permissions")
+		return "", rejection(ReasonJWTTooLarge, "user JWT of %d bytes exceeds the limit of %d bytes", len(userJWT), h.maxJWTSize)
+	}
+	h.metrics.ObserveIssuedAllowSubjects(len(uc.Pub.Allow) + len(uc.Sub.Allow))
+	return userJWT, nil
+}
+
+// applyTemplate combines the permission template name with a user's inline
+// permissions according to the configured strategy. The template is returned
+// as is when there is nothing to merge, and merges are served from the
+// permission cache when enabled; the result must not be modified.
+func (h *Handler) applyTemplate(name, username string, template *jwt.Permissions, inline jwt.Permissions) jwt.Permissions {
+	if emptyPermissions(inline) {
+		return *template
+	}
+	if h.templateMerge == TemplateReplace {
+		return inline
+	}
+	if h.permCache == nil {
+		return permissions.Merge(*template, inline)
+	}
+	key := permissionKey{template: name, username: username}
+	if merged, ok := h.permCache.get(key, inline); ok {
+		return merged
+	}
+	merged := permissions.Merge(*template, inline)
+	h.permCache.add(key, inline, merged)
+	return merged
+}
+
+// connectionType maps the client type ("nats", "websocket", "mqtt") and kind
+// ("Client", "Leafnode") the server reports for a connection to a JWT
+// connection type such as jwt.ConnectionTypeWebsocket. It returns "" when the
+// server reports neither, and false for connections it cannot map, which must
+// not be authorized as if their type were unknown.
+func connectionType(info jwt.ClientInformation) (string, bool) {
+	clientType := strings.ToLower(info.Type)
+	switch strings.ToLower(info.Kind) {
+	case "", "client":
+		switch clientType {
+		case "":
+			return "", true
+		case "nats":
+			return jwt.ConnectionTypeStandard, true
+		case "websocket":
+			return jwt.ConnectionTypeWebsocket, true
+		case "mqtt":
+			return jwt.ConnectionTypeMqtt, true
+		}
+	case "leafnode":
+		switch clientType {
+		case "", "nats":
+			return jwt.ConnectionTypeLeafnode, true
+		case "websocket":
+			return jwt.ConnectionTypeLeafnodeWS, true
+		}
+	}
+	return "", false
+}
+
+// connectionCeilings returns the ceilings for a connection type: its own
+// ceiling if configured, or every ceiling when the type is unknown so a client
+// cannot escape its ceiling by hiding its connection type.
+func (h *Handler) connectionCeilings(connType string) []permissions.Ceiling {
+	if connType != "" {
+		if ceiling, ok := h.connCeilings[strings.ToUpper(connType)]; ok {
+			return []permissions.Ceiling{ceiling}
+		}
+		return nil
+	}
+	ceilings := make([]permissions.Ceiling, 0, len(h.connCeilings))
+	for _, ceiling := range h.connCeilings {
+		ceilings = append(ceilings, ceiling)
+	}
+	return ceilings
 }
 
 // respond sends an authorization response with the provided JWT or error message,
 // optionally encrypting with xkey.
 func (h *Handler) respond(req micro.Request, userNkey, serverID, userJwt, errMsg string) {
+	opts := h.responseOpts(req)
 	rc := jwt.NewAuthorizationResponseClaims(userNkey)
+	if rc == nil {
+		// The request was rejected before its user nkey was known
+		logrus.WithField("error", errMsg).Warn("No user nkey to address the response to")
+		if err := req.Respond([]byte(errMsg), opts...); err != nil {
+			logrus.WithError(err).Error("Failed to send response")
+		}
+		return
+	}
 	rc.Audience = serverID
 	rc.Error = errMsg
 	rc.Jwt = userJwt
+	// IssuedAt is stamped by Encode; Expires is only set when configured
+	if h.responseTTL > 0 {
+		rc.Expires = time.Now().Add(h.responseTTL).Unix()
+	}
 
-	data, err := rc.Encode(h.keyPairs.Issuer)
+	keyPairs := h.keys()
+	data, err := rc.Encode(keyPairs.Issuer)
 	if err != nil {
-		log.Printf("encoding response JWT: %v", err)
-		if err := req.Respond([]byte("Failed to encoding response JWT")); err != nil {
-			log.Printf("failed to send response: %v", err)
+		logrus.WithError(err).Error("Failed to encode response JWT")
+		if err := req.Respond([]byte("Failed to encoding response JWT"), opts...); err != nil {
+			logrus.WithError(err).Error("Failed to send response")
 		}
 		return
 	}
@@ -232,25 +1584,40 @@ func (h *Handler) respond(req micro.Request, userNkey, serverID, userJwt, errMsg
 	// Encrypt response if xkey is present
 	xkey := req.Headers().Get("Nats-Server-Xkey")
 	if xkey != "" {
-		if h.keyPairs.Curve == nil {
-			log.Printf("xkey encryption not supported: no curve key pair")
-			if err := req.Respond([]byte("Encryption not supported: missing curve key pair")); err != nil {
-				log.Printf("failed to send response: %v", err)
+		if keyPairs.Curve == nil {
+			logrus.Error("Xkey encryption not supported: no curve key pair")
+			if err := req.Respond([]byte("Encryption not supported: missing curve key pair"), opts...); err != nil {
+				logrus.WithError(err).Error("Failed to send response")
 			}
 			return
 		}
-		encrypted, err := h.keyPairs.Curve.Seal([]byte(data), xkey)
+		encrypted, err := keyPairs.Curve.Seal([]byte(data), xkey)
 		if err != nil {
-			log.Printf("encrypting response JWT: %v", err)
-			if err := req.Respond([]byte("Failed to encrypt response")); err != nil {
-				log.Printf("failed to send response: %v", err)
+			logrus.WithError(err).Error("Failed to encrypt response JWT")
+			if err := req.Respond([]byte("Failed to encrypt response"), opts...); err != nil {
+				logrus.WithError(err).Error("Failed to send response")
 			}
 			return
 		}
 		data = string(encrypted)
 	}
 	// Send the final response
-	if err := req.Respond([]byte(data)); err != nil {
-		log.Printf("failed to send response: %v", err)
+	if err := req.Respond([]byte(data), opts...); err != nil {
+		logrus.WithError(err).Error("Failed to send response")
+	}
+}
+
+// responseOpts returns the options attaching the configured echo headers of req
+// to its response.
+func (h *Handler) responseOpts(req micro.Request) []micro.RespondOpt {
+	headers := make(micro.Headers)
+	for _, name := range h.echoHeaders {
+		if values := req.Headers().Values(name); len(values) > 0 {
+			headers[name] = values
+		}
+	}
+	if len(headers) == 0 {
+		return nil
 	}
+	return []micro.RespondOpt{micro.WithHeaders(headers)}
 }
@@ -1,17 +1,35 @@
 package authresponse_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/audit"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/authresponse"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/cloudevents"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/metrics"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/permissions"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/policy"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
 	"strings"
 	"testing"
+	"time"
 
+	gojwt "github.com/golang-jwt/jwt/v4"
 	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/micro"
 	"github.com/nats-io/nkeys"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // MockUserRepository implements UserRepository for testing
@@ -24,6 +42,29 @@ func (m *MockUserRepository) Get(username string) (*auth.User, bool) {
 	return args.Get(0).(*auth.User), args.Bool(1)
 }
 
+// MockWritableUserRepository implements UserRepository and PasswordUpdater for testing
+type MockWritableUserRepository struct {
+	MockUserRepository
+}
+
+func (m *MockWritableUserRepository) UpdatePassword(username, hash string) error {
+	args := m.Called(username, hash)
+	return args.Error(0)
+}
+
+// MockAliasUserRepository implements UserRepository and AliasResolver for testing
+type MockAliasUserRepository struct {
+	MockUserRepository
+	aliases map[string]string
+}
+
+func (m *MockAliasUserRepository) Canonical(key string) string {
+	if username, ok := m.aliases[key]; ok {
+		return username
+	}
+	return key
+}
+
 // MockRequest implements micro.Request for testing
 type MockRequest struct {
 	mock.Mock
@@ -62,12 +103,62 @@ func (m *MockRequest) Subject() string {
 	return m.subject
 }
 
+// recordingSink collects decisions passed to it.
+type recordingSink struct {
+	decisions []auth.Decision
+}
+
+func (s *recordingSink) Record(d auth.Decision) {
+	s.decisions = append(s.decisions, d)
+}
+
 func createTestKeyPair(t *testing.T, prefix nkeys.PrefixByte) nkeys.KeyPair {
 	kp, err := nkeys.CreatePair(prefix)
 	require.NoError(t, err)
 	return kp
 }
 
+// signNatsToken signs nats_token claims with the given secret.
+func signNatsToken(t *testing.T, secret string, claims *tokenvalidation.NatsTokenClaims) string {
+	t.Helper()
+	if claims.ExpiresAt == nil {
+		claims.ExpiresAt = gojwt.NewNumericDate(time.Now().Add(time.Hour))
+	}
+	token, err := gojwt.NewWithClaims(gojwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	require.NoError(t, err)
+	return token
+}
+
+// authorize sends the authorization request through the handler and returns the
+// decoded authorization response claims.
+// errorMessage strips the "[CODE] " prefix from a response error.
+func errorMessage(responseError string) string {
+	if strings.HasPrefix(responseError, "[") {
+		if _, msg, ok := strings.Cut(responseError, "] "); ok {
+			return msg
+		}
+	}
+	return responseError
+}
+
+func authorize(t *testing.T, handler *authresponse.Handler, serverKP nkeys.KeyPair, arc *jwt.AuthorizationRequestClaims) *jwt.AuthorizationResponseClaims {
+	t.Helper()
+	token, err := arc.Encode(serverKP)
+	require.NoError(t, err)
+
+	var response []byte
+	req := &MockRequest{data: []byte(token), headers: map[string][]string{}}
+	req.On("Respond", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		response = args.Get(0).([]byte)
+	}).Return(nil)
+
+	handler.HandleRequest(req)
+
+	rc, err := jwt.DecodeAuthorizationResponseClaims(string(response))
+	require.NoError(t, err, "decoding response %q", response)
+	return rc
+}
+
 func TestNewHandler(t *testing.T) {
 	kp := &auth.KeyPairs{}
 	repo := new(MockUserRepository)
@@ -208,3 +299,3575 @@ func TestHandler_UserClaims(t *testing.T) {
 		require.Equal(t, testUser.Permissions.Pub.Allow, decoded.Pub.Allow, "Expected permissions to match")
 	})
 }
+
+func TestHandler_TokenAccount(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	keyPairs := &auth.KeyPairs{Issuer: issuerKP}
+	handler := authresponse.NewHandler(keyPairs, new(MockUserRepository),
+		authresponse.WithKnownAccounts([]string{"DEVELOPMENT", "TEST"}),
+	)
+
+	tests := []struct {
+		name      string
+		account   string
+		expectErr string
+	}{
+		{name: "known account", account: "DEVELOPMENT"},
+		{name: "empty account", account: "", expectErr: "missing account in token"},
+		{name: "unknown account", account: "PRODUCTION", expectErr: `unknown account "PRODUCTION"`},
+		{name: "multiple accounts", account: "DEVELOPMENT,TEST", expectErr: "must name a single account"},
+		{name: "wildcard account", account: "*", expectErr: "must name a single account"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID:  "bob",
+				Account: tt.account,
+			})
+
+			rc := authorize(t, handler, serverKP, arc)
+			if tt.expectErr == "" {
+				assert.Empty(t, rc.Error)
+				assert.NotEmpty(t, rc.Jwt)
+				return
+			}
+			assert.Contains(t, rc.Error, tt.expectErr)
+			assert.Empty(t, rc.Jwt)
+		})
+	}
+}
+
+func TestHandler_IssuerAccount(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	signingKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	identityKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+
+	signingPub, err := signingKP.PublicKey()
+	require.NoError(t, err)
+	identityPub, err := identityKP.PublicKey()
+	require.NoError(t, err)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		issuerAccount string
+	}{
+		{name: "account identity key", issuerAccount: ""},
+		{name: "scoped signing key", issuerAccount: identityPub},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyPairs := &auth.KeyPairs{Issuer: signingKP, IssuerAccount: tt.issuerAccount}
+			handler := authresponse.NewHandler(keyPairs, new(MockUserRepository))
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID:  "bob",
+				Account: "DEVELOPMENT",
+			})
+
+			rc := authorize(t, handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, signingPub, uc.Issuer)
+			assert.Equal(t, tt.issuerAccount, uc.IssuerAccount)
+		})
+	}
+}
+
+func TestHandler_AccountIssuers(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	calloutKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	tenantKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+
+	calloutPub, err := calloutKP.PublicKey()
+	require.NoError(t, err)
+	tenantPub, err := tenantKP.PublicKey()
+	require.NoError(t, err)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	keyPairs := &auth.KeyPairs{
+		Issuer:         calloutKP,
+		AccountIssuers: map[string]nkeys.KeyPair{"tenant-a": tenantKP},
+	}
+	handler := authresponse.NewHandler(keyPairs, new(MockUserRepository))
+
+	tests := []struct {
+		name       string
+		account    string
+		wantIssuer string
+		wantError  string
+	}{
+		{name: "account with an issuer", account: "TENANT-A", wantIssuer: tenantPub},
+		{name: "account without an issuer", account: "TENANT-B", wantError: `no issuer key configured for account "TENANT-B"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID:      "bob",
+				Account:     tt.account,
+				Permissions: map[string]any{"sub": map[string]any{"allow": []string{"_INBOX.>"}}},
+			})
+
+			rc := authorize(t, handler, serverKP, arc)
+			assert.Equal(t, calloutPub, rc.Issuer, "responses are signed by the callout issuer")
+			if tt.wantError != "" {
+				assert.Equal(t, tt.wantError, errorMessage(rc.Error))
+				return
+			}
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantIssuer, uc.Issuer)
+			assert.Equal(t, tt.account, uc.Audience)
+		})
+	}
+}
+
+func TestHandler_DecisionRecorder(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	serverPubKey, err := serverKP.PublicKey()
+	require.NoError(t, err)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+	repo.On("Get", "mallory").Return((*auth.User)(nil), false)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     auth.Decision
+	}{
+		{
+			name:     "granted",
+			username: "alice",
+			password: "alice",
+			want: auth.Decision{
+				Username: "alice",
+				Method:   auth.MethodPassword,
+				Account:  "DEVELOPMENT",
+				ServerID: serverPubKey,
+				UserNkey: userPubKey,
+			},
+		},
+		{
+			name:     "rejected",
+			username: "mallory",
+			password: "secret",
+			want: auth.Decision{
+				Username: "mallory",
+				Method:   auth.MethodPassword,
+				ServerID: serverPubKey,
+				UserNkey: userPubKey,
+				Error:    "user not found",
+				Reason:   authresponse.ReasonUserNotFound,
+				Category: authresponse.CategoryUnauthenticated,
+				Code:     "ERR_USER_NOT_FOUND",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithDecisionRecorder(sink),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.Server = jwt.ServerID{ID: serverPubKey}
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.password
+
+			authorize(t, handler, serverKP, arc)
+
+			require.Len(t, sink.decisions, 1)
+			assert.Equal(t, tt.want, sink.decisions[0])
+		})
+	}
+}
+
+// recordingAuditor captures audit events.
+type recordingAuditor struct {
+	events []audit.Event
+}
+
+func (a *recordingAuditor) Record(e audit.Event) {
+	a.events = append(a.events, e)
+}
+
+// recordingPublisher captures published CloudEvents.
+type recordingPublisher struct {
+	messages [][]byte
+}
+
+func (p *recordingPublisher) Publish(_ string, data []byte) error {
+	p.messages = append(p.messages, data)
+	return nil
+}
+
+func TestHandler_CredsFileToken(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository))
+
+	t.Run("nats_token as the user JWT", func(t *testing.T) {
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.JWT = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+			UserID: "svc", Account: "DEVELOPMENT",
+			Permissions: map[string]any{"sub": map[string]any{"allow": []string{"_INBOX.>"}}},
+		})
+
+		rc := authorize(t, handler, serverKP, arc)
+		require.Empty(t, rc.Error)
+		uc, err := jwt.DecodeUserClaims(rc.Jwt)
+		require.NoError(t, err)
+		assert.Equal(t, "svc", uc.Name)
+	})
+
+	t.Run("NATS user JWT is not a nats_token", func(t *testing.T) {
+		userJWT, err := jwt.NewUserClaims(userPubKey).Encode(issuerKP)
+		require.NoError(t, err)
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.JWT = userJWT
+
+		rc := authorize(t, handler, serverKP, arc)
+		assert.Equal(t, authresponse.DefaultNoCredentialsMessage, errorMessage(rc.Error))
+	})
+}
+
+func TestHandler_KeyLabelInEvents(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	auditor := &recordingAuditor{}
+	pub := &recordingPublisher{}
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+		authresponse.WithTokenSecrets([]tokenvalidation.Secret{
+			{Label: "2025-key", Value: "new-secret-1234567890"},
+			{Label: "2024-key", Value: "old-secret-1234567890"},
+		}),
+		authresponse.WithAuditor(auditor),
+		authresponse.WithDecisionRecorder(cloudevents.NewSink(pub, "auth.events", "")),
+	)
+
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Token = signNatsToken(t, "old-secret-1234567890", &tokenvalidation.NatsTokenClaims{
+		UserID: "svc", Account: "DEVELOPMENT",
+		Permissions: map[string]any{"sub": map[string]any{"allow": []string{"_INBOX.>"}}},
+	})
+	require.Empty(t, authorize(t, handler, serverKP, arc).Error)
+
+	require.Len(t, auditor.events, 1)
+	assert.Equal(t, "2024-key", auditor.events[0].KeyLabel)
+	require.Len(t, pub.messages, 1)
+	var event cloudevents.Event
+	require.NoError(t, json.Unmarshal(pub.messages[0], &event))
+	assert.Equal(t, "2024-key", event.Data.KeyLabel)
+}
+
+func TestHandler_Auditor(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	serverPubKey, err := serverKP.PublicKey()
+	require.NoError(t, err)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "mallory").Return((*auth.User)(nil), false)
+	auditor := &recordingAuditor{}
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithAuditor(auditor),
+		authresponse.WithErrorCodes(map[string]string{authresponse.ReasonUserNotFound: "ERR_NO_USER"}),
+	)
+
+	token := signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+		UserID: "svc", Account: "DEVELOPMENT",
+		Permissions: map[string]any{"sub": map[string]any{"allow": []string{"_INBOX.>"}}},
+	})
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.Server = jwt.ServerID{ID: serverPubKey}
+	arc.ConnectOptions.Token = token
+	require.Empty(t, authorize(t, handler, serverKP, arc).Error)
+
+	arc.ConnectOptions.Token = ""
+	arc.ConnectOptions.Username = "mallory"
+	arc.ConnectOptions.Password = "secret"
+	require.NotEmpty(t, authorize(t, handler, serverKP, arc).Error)
+
+	require.Len(t, auditor.events, 2)
+	granted, rejected := auditor.events[0], auditor.events[1]
+	assert.Equal(t, "svc", granted.Username)
+	assert.Equal(t, "DEVELOPMENT", granted.Account)
+	assert.Equal(t, serverPubKey, granted.ServerID)
+	assert.Equal(t, audit.ResultAllowed, granted.Result)
+	assert.Equal(t, tokenvalidation.Fingerprint(token), granted.TokenHash)
+	assert.WithinDuration(t, time.Now(), granted.Time, time.Minute)
+
+	assert.Equal(t, "mallory", rejected.Username)
+	assert.Equal(t, audit.ResultDenied, rejected.Result)
+	assert.Equal(t, "ERR_NO_USER", rejected.ErrorCode)
+	assert.Equal(t, authresponse.ReasonUserNotFound, rejected.Reason)
+	assert.Empty(t, rejected.TokenHash)
+}
+
+func TestHandler_PermissionLogging(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(level)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:    "alice",
+		Account: "DEVELOPMENT",
+		Permissions: jwt.Permissions{
+			Pub: jwt.Permission{Allow: []string{"orders.>"}},
+			Sub: jwt.Permission{Allow: []string{"_INBOX.>"}, Deny: []string{"orders.secret"}},
+		},
+	}, true)
+
+	issuedPermissions := func(hook *logtest.Hook) (string, bool) {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Issuing user JWT permissions" {
+				return entry.Data["permissions"].(string), true
+			}
+		}
+		return "", false
+	}
+
+	hook := logtest.NewGlobal()
+	for _, enabled := range []bool{true, false} {
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithPermissionLogging(enabled),
+		)
+
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Username = "alice"
+		arc.ConnectOptions.Password = "alice"
+		rc := authorize(t, handler, serverKP, arc)
+		require.Empty(t, rc.Error)
+
+		perms, found := issuedPermissions(hook)
+		assert.Equal(t, enabled, found)
+		if enabled {
+			assert.JSONEq(t, `{"pub":{"allow":["orders.>"]},"sub":{"allow":["_INBOX.>"],"deny":["orders.secret"]}}`, perms)
+			assert.NotContains(t, perms, "alice")
+		}
+		hook.Reset()
+	}
+}
+
+func TestHandler_IncompleteUserRecord(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		user *auth.User
+	}{
+		{name: "missing account and permissions", user: &auth.User{Pass: "secret"}},
+		{name: "blank account with permissions", user: &auth.User{
+			Pass:        "secret",
+			Account:     "  ",
+			Permissions: jwt.Permissions{Pub: jwt.Permission{Allow: []string{">"}}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := new(MockUserRepository)
+			repo.On("Get", "partial").Return(tt.user, true)
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = "partial"
+			arc.ConnectOptions.Password = "secret"
+
+			rc := authorize(t, handler, serverKP, arc)
+			assert.Equal(t, "incomplete user record", errorMessage(rc.Error))
+			assert.Empty(t, rc.Jwt)
+		})
+	}
+}
+
+func TestHandler_MissingCredentials(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		opts       []authresponse.Option
+		username   string
+		password   string
+		wantError  string
+		wantReason string
+	}{
+		{
+			name:       "no credentials",
+			wantError:  authresponse.DefaultNoCredentialsMessage,
+			wantReason: authresponse.ReasonNoCredentials,
+		},
+		{
+			name:       "no credentials with custom message",
+			opts:       []authresponse.Option{authresponse.WithNoCredentialsMessage("token or user/password required")},
+			wantError:  "token or user/password required",
+			wantReason: authresponse.ReasonNoCredentials,
+		},
+		{
+			name:       "username without password",
+			username:   "alice",
+			wantError:  "username or password missing",
+			wantReason: authresponse.ReasonMissingCredentials,
+		},
+		{
+			name:       "password without username",
+			password:   "alice",
+			wantError:  "username or password missing",
+			wantReason: authresponse.ReasonMissingCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			opts := append([]authresponse.Option{authresponse.WithDecisionRecorder(sink)}, tt.opts...)
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository), opts...)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.password
+
+			rc := authorize(t, handler, serverKP, arc)
+			assert.Equal(t, tt.wantError, errorMessage(rc.Error))
+			require.Len(t, sink.decisions, 1)
+			assert.Equal(t, tt.wantReason, sink.decisions[0].Reason)
+		})
+	}
+}
+
+func TestHandler_ServerInfo(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	serverPubKey, err := serverKP.PublicKey()
+	require.NoError(t, err)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		wantName    string
+		wantCluster string
+	}{
+		{name: "enabled", enabled: true, wantName: "nats-1", wantCluster: "east"},
+		{name: "disabled", enabled: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			auditor := &recordingAuditor{}
+			reg := prometheus.NewRegistry()
+			m := metrics.New(reg)
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+				authresponse.WithDecisionRecorder(sink),
+				authresponse.WithAuditor(auditor),
+				authresponse.WithMetrics(m),
+				authresponse.WithServerInfo(tt.enabled),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.Server = jwt.ServerID{ID: serverPubKey, Name: "nats-1", Cluster: "east"}
+
+			authorize(t, handler, serverKP, arc)
+
+			require.Len(t, sink.decisions, 1)
+			assert.Equal(t, serverPubKey, sink.decisions[0].ServerID)
+			assert.Equal(t, tt.wantName, sink.decisions[0].ServerName)
+			assert.Equal(t, tt.wantCluster, sink.decisions[0].ServerCluster)
+			require.Len(t, auditor.events, 1)
+			assert.Equal(t, tt.wantName, auditor.events[0].ServerName)
+			assert.Equal(t, tt.wantCluster, auditor.events[0].ServerCluster)
+
+			failures, err := testutil.GatherAndCount(reg, "auth_server_request_failures_total")
+			require.NoError(t, err)
+			if tt.enabled {
+				assert.Equal(t, 1, failures)
+			} else {
+				assert.Zero(t, failures, "failures are not labeled by server unless enabled")
+			}
+		})
+	}
+}
+
+func TestHandler_TrustedServers(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	trustedKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	spoofedKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	trustedPubKey, err := trustedKP.PublicKey()
+	require.NoError(t, err)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithTrustedServers([]string{trustedPubKey}),
+	)
+
+	tests := []struct {
+		name      string
+		serverKP  nkeys.KeyPair
+		expectErr string
+	}{
+		{name: "trusted server", serverKP: trustedKP},
+		{name: "spoofed server", serverKP: spoofedKP, expectErr: "untrusted authorization request issuer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = "alice"
+			arc.ConnectOptions.Password = "alice"
+
+			rc := authorize(t, handler, tt.serverKP, arc)
+			assert.Equal(t, tt.expectErr, errorMessage(rc.Error))
+			assert.Equal(t, tt.expectErr == "", rc.Jwt != "")
+		})
+	}
+}
+
+func TestHandler_TrustedServerIDs(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+	reg := prometheus.NewRegistry()
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithTrustedServerIDs([]string{"NODE-A", "NODE-B"}),
+		authresponse.WithMetrics(metrics.New(reg)),
+	)
+
+	tests := []struct {
+		name      string
+		serverID  string
+		expectErr string
+	}{
+		{name: "trusted server ID", serverID: "NODE-B"},
+		{name: "untrusted server ID", serverID: "ROGUE", expectErr: `untrusted server ID "ROGUE"`},
+		{name: "missing server ID", expectErr: `untrusted server ID ""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.Server.ID = tt.serverID
+			arc.ConnectOptions.Username = "alice"
+			arc.ConnectOptions.Password = "alice"
+
+			rc := authorize(t, handler, serverKP, arc)
+			assert.Equal(t, tt.expectErr, errorMessage(rc.Error))
+			assert.Equal(t, tt.expectErr == "", rc.Jwt != "")
+		})
+	}
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	rejected := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "auth_untrusted_server_requests_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			rejected[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{metrics.CheckIssuer: 0, metrics.CheckServerID: 2}, rejected)
+}
+
+func TestHandler_TokenDecision(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		token string
+		want  auth.Decision
+	}{
+		{
+			name:  "allowed",
+			token: signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{UserID: "bob", Account: "DEVELOPMENT"}),
+			want:  auth.Decision{Username: "bob", Method: auth.MethodToken, Account: "DEVELOPMENT"},
+		},
+		{
+			name:  "invalid signature",
+			token: signNatsToken(t, "another-secret", &tokenvalidation.NatsTokenClaims{UserID: "bob", Account: "DEVELOPMENT"}),
+			want:  auth.Decision{Method: auth.MethodToken, Reason: authresponse.ReasonInvalidToken},
+		},
+		{
+			name:  "unknown account",
+			token: signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{UserID: "bob", Account: "PRODUCTION"}),
+			want:  auth.Decision{Method: auth.MethodToken, Reason: authresponse.ReasonInvalidAccount},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+				authresponse.WithDecisionRecorder(sink),
+				authresponse.WithKnownAccounts([]string{"DEVELOPMENT"}),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Token = tt.token
+			authorize(t, handler, serverKP, arc)
+
+			require.Len(t, sink.decisions, 1)
+			got := sink.decisions[0]
+			assert.Equal(t, tt.want.Reason == "", got.Allowed())
+			assert.Equal(t, tt.want.Username, got.Username)
+			assert.Equal(t, tt.want.Method, got.Method)
+			assert.Equal(t, tt.want.Account, got.Account)
+			assert.Equal(t, tt.want.Reason, got.Reason)
+		})
+	}
+}
+
+func TestHandler_TokenSecretLabels(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	secrets := []tokenvalidation.Secret{
+		{Label: "2025-key", Value: "secret-2025"},
+		{Label: "2024-key", Value: "secret-2024"},
+	}
+	perms := map[string]any{"sub": map[string]any{"allow": []any{"_INBOX.>"}}}
+
+	tests := []struct {
+		name      string
+		secret    string
+		wantLabel string
+		wantErr   bool
+	}{
+		{name: "current secret", secret: "secret-2025", wantLabel: "2025-key"},
+		{name: "previous secret", secret: "secret-2024", wantLabel: "2024-key"},
+		{name: "unknown secret", secret: "secret-2023", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+				authresponse.WithTokenSecrets(secrets),
+				authresponse.WithDecisionRecorder(sink),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Token = signNatsToken(t, tt.secret, &tokenvalidation.NatsTokenClaims{
+				UserID: "bob", Account: "DEVELOPMENT", Permissions: perms,
+			})
+			rc := authorize(t, handler, serverKP, arc)
+
+			require.Len(t, sink.decisions, 1)
+			if tt.wantErr {
+				assert.Contains(t, rc.Error, "invalid token signature")
+				assert.Equal(t, authresponse.ReasonInvalidToken, sink.decisions[0].Reason)
+				return
+			}
+			require.Empty(t, rc.Error)
+			assert.Equal(t, tt.wantLabel, sink.decisions[0].KeyLabel)
+		})
+	}
+}
+
+func TestHandler_TokenAudienceAndIssuer(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	secrets := []tokenvalidation.Secret{{Label: "2025-key", Value: "secret-2025"}}
+	perms := map[string]any{"sub": map[string]any{"allow": []any{"_INBOX.>"}}}
+
+	const idp = "https://idp.example.com"
+
+	tests := []struct {
+		name     string
+		audience []string
+		issuer   string
+		wantErr  string
+	}{
+		{name: "token for this service", audience: []string{"orders"}, issuer: idp},
+		{name: "token for another service", audience: []string{"billing"}, issuer: idp, wantErr: `token audience does not include "orders"`},
+		{name: "token without audience", issuer: idp, wantErr: `token audience does not include "orders"`},
+		{name: "token from another issuer", audience: []string{"orders"}, issuer: "https://evil.example.com", wantErr: `token issuer is not "https://idp.example.com"`},
+		{name: "token without issuer", audience: []string{"orders"}, wantErr: `token issuer is not "https://idp.example.com"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+				authresponse.WithTokenSecrets(secrets),
+				authresponse.WithTokenAudience("orders"),
+				authresponse.WithTokenIssuer(idp),
+				authresponse.WithDecisionRecorder(sink),
+			)
+
+			claims := &tokenvalidation.NatsTokenClaims{UserID: "bob", Account: "DEVELOPMENT", Permissions: perms}
+			claims.Audience = tt.audience
+			claims.Issuer = tt.issuer
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Token = signNatsToken(t, "secret-2025", claims)
+			rc := authorize(t, handler, serverKP, arc)
+
+			require.Len(t, sink.decisions, 1)
+			if tt.wantErr != "" {
+				assert.Contains(t, rc.Error, tt.wantErr)
+				assert.Equal(t, authresponse.ReasonInvalidToken, sink.decisions[0].Reason)
+				return
+			}
+			require.Empty(t, rc.Error)
+		})
+	}
+}
+
+func TestHandler_TokenAuthDisabled(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+	token := signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+		UserID:      "bob",
+		Account:     "DEVELOPMENT",
+		Permissions: map[string]any{"sub": map[string]any{"allow": []any{"_INBOX.>"}}},
+	})
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:        "alice",
+		Account:     "DEVELOPMENT",
+		Permissions: jwt.Permissions{Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+	}, true)
+
+	unusedSecretWarnings := func(hook *logtest.Hook) int {
+		count := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "secret is unused") {
+				count++
+			}
+		}
+		return count
+	}
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	sink := &recordingSink{}
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithTokenAuth(false),
+		authresponse.WithDecisionRecorder(sink),
+	)
+	assert.Equal(t, 1, unusedSecretWarnings(hook))
+
+	t.Run("token only is ignored", func(t *testing.T) {
+		sink.decisions = nil
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Token = token
+		rc := authorize(t, handler, serverKP, arc)
+
+		assert.Equal(t, authresponse.DefaultNoCredentialsMessage, errorMessage(rc.Error))
+		require.Len(t, sink.decisions, 1)
+		assert.Equal(t, authresponse.ReasonNoCredentials, sink.decisions[0].Reason)
+		assert.Empty(t, sink.decisions[0].Method)
+	})
+
+	t.Run("token with password falls back to password", func(t *testing.T) {
+		sink.decisions = nil
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Token = token
+		arc.ConnectOptions.Username = "alice"
+		arc.ConnectOptions.Password = "alice"
+		rc := authorize(t, handler, serverKP, arc)
+		require.Empty(t, rc.Error)
+
+		uc, err := jwt.DecodeUserClaims(rc.Jwt)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", uc.Name)
+		require.Len(t, sink.decisions, 1)
+		assert.Equal(t, auth.MethodPassword, sink.decisions[0].Method)
+	})
+
+	assert.Equal(t, 1, unusedSecretWarnings(hook), "the unused secret is only warned about once")
+
+	t.Run("no warning without a secret", func(t *testing.T) {
+		hook.Reset()
+		t.Setenv("NATS_TOKEN_SECRET", "")
+		authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo, authresponse.WithTokenAuth(false))
+		assert.Zero(t, unusedSecretWarnings(hook))
+	})
+}
+
+func TestHandler_TokenPermissionsShape(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+	sink := &recordingSink{}
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+		authresponse.WithDecisionRecorder(sink))
+	sub := map[string]any{"allow": []any{"_INBOX.>"}}
+
+	tests := []struct {
+		name        string
+		permissions map[string]any
+		wantResp    *jwt.ResponsePermission
+		wantErr     string
+	}{
+		{
+			name:        "allow_responses true",
+			permissions: map[string]any{"sub": sub, "allow_responses": true},
+			wantResp:    &jwt.ResponsePermission{MaxMsgs: 1, Expires: 2 * time.Minute},
+		},
+		{
+			name:        "allow_responses limits",
+			permissions: map[string]any{"sub": sub, "allow_responses": map[string]any{"max": 5, "expires": "30s"}},
+			wantResp:    &jwt.ResponsePermission{MaxMsgs: 5, Expires: 30 * time.Second},
+		},
+		{
+			name:        "allow_responses false",
+			permissions: map[string]any{"sub": sub, "allow_responses": false},
+		},
+		{
+			name:        "resp with ttl in seconds",
+			permissions: map[string]any{"sub": sub, "resp": map[string]any{"max": 3, "ttl": 60}},
+			wantResp:    &jwt.ResponsePermission{MaxMsgs: 3, Expires: time.Minute},
+		},
+		{
+			name:        "resp with ttl duration",
+			permissions: map[string]any{"sub": sub, "resp": map[string]any{"max": 3, "ttl": "1m30s"}},
+			wantResp:    &jwt.ResponsePermission{MaxMsgs: 3, Expires: 90 * time.Second},
+		},
+		{
+			name:        "resp takes precedence over allow_responses",
+			permissions: map[string]any{"sub": sub, "resp": map[string]any{"max": 3}, "allow_responses": true},
+			wantResp:    &jwt.ResponsePermission{MaxMsgs: 3},
+		},
+		{
+			name:        "non-string subject",
+			permissions: map[string]any{"sub": map[string]any{"allow": []any{42}}},
+			wantErr:     "invalid permissions",
+		},
+		{
+			name:        "non-string publish subject",
+			permissions: map[string]any{"pub": map[string]any{"allow": []any{"orders.>", 7}}, "sub": sub},
+			wantErr:     "invalid permissions",
+		},
+		{
+			name:        "invalid allow_responses expires",
+			permissions: map[string]any{"sub": sub, "allow_responses": map[string]any{"expires": "soon"}},
+			wantErr:     "invalid allow_responses expires",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID: "bob", Account: "DEVELOPMENT", Permissions: tt.permissions,
+			})
+			sink.decisions = nil
+			rc := authorize(t, handler, serverKP, arc)
+			if tt.wantErr != "" {
+				assert.Contains(t, rc.Error, tt.wantErr)
+				require.Len(t, sink.decisions, 1)
+				assert.Equal(t, authresponse.ReasonBadPermissions, sink.decisions[0].Reason)
+				return
+			}
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, jwt.StringList{"_INBOX.>"}, uc.Sub.Allow)
+			assert.Equal(t, tt.wantResp, uc.Resp)
+		})
+	}
+}
+
+func TestHandler_IssuedAllowSubjectsMetric(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:    "alice",
+		Account: "DEVELOPMENT",
+		Permissions: jwt.Permissions{
+			Pub: jwt.Permission{Allow: []string{"orders.created"}, Deny: []string{"orders.secret"}},
+			Sub: jwt.Permission{Allow: []string{"_INBOX.>", "orders.>"}},
+		},
+	}, true)
+
+	reg := prometheus.NewRegistry()
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithMetrics(metrics.New(reg)),
+	)
+
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Username = "alice"
+	arc.ConnectOptions.Password = "alice"
+	rc := authorize(t, handler, serverKP, arc)
+	require.Empty(t, rc.Error)
+
+	// A rejected request issues no JWT and is not observed
+	arc.ConnectOptions.Password = "wrong"
+	rc = authorize(t, handler, serverKP, arc)
+	require.NotEmpty(t, rc.Error)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	var found bool
+	for _, family := range families {
+		if family.GetName() != "auth_issued_allow_subjects" {
+			continue
+		}
+		found = true
+		histogram := family.GetMetric()[0].GetHistogram()
+		assert.Equal(t, uint64(1), histogram.GetSampleCount())
+		assert.Equal(t, float64(3), histogram.GetSampleSum())
+	}
+	assert.True(t, found, "histogram auth_issued_allow_subjects not registered")
+}
+
+func TestHandler_TokenIdentityOnly(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	repoPerms := jwt.Permissions{
+		Pub: jwt.Permission{Allow: []string{"orders.created"}},
+		Sub: jwt.Permission{Allow: []string{"_INBOX.>"}},
+	}
+	repo := new(MockUserRepository)
+	repo.On("Get", "bob").Return(&auth.User{Account: "ORDERS", Permissions: repoPerms}, true)
+	repo.On("Get", "old").Return(&auth.User{Account: "ORDERS", Permissions: repoPerms, ExpiresAt: time.Now().Add(-time.Hour)}, true)
+	repo.On("Get", "ghost").Return((*auth.User)(nil), false)
+	repo.On("Get", "reader").Return(&auth.User{Account: "ORDERS", Template: "readonly"}, true)
+	templates := map[string]jwt.Permissions{"readonly": {
+		Pub: jwt.Permission{Deny: []string{">"}},
+		Sub: jwt.Permission{Allow: []string{"ro.>"}},
+	}}
+
+	tests := []struct {
+		name       string
+		userID     string
+		wantPerms  jwt.Permissions
+		wantReason string
+	}{
+		{name: "repository account and permissions", userID: "bob", wantPerms: repoPerms},
+		{name: "repository permission template", userID: "reader", wantPerms: jwt.Permissions{
+			Pub: jwt.Permission{Deny: jwt.StringList{">"}},
+			Sub: jwt.Permission{Allow: jwt.StringList{"ro.>"}},
+		}},
+		{name: "user missing from repository", userID: "ghost", wantReason: authresponse.ReasonUserNotFound},
+		{name: "expired repository user", userID: "old", wantReason: authresponse.ReasonAccountExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithTokenIdentityOnly(true),
+				authresponse.WithKnownAccounts([]string{"ORDERS"}),
+				authresponse.WithPermissionTemplates(templates, authresponse.TemplateMerge),
+				authresponse.WithDecisionRecorder(sink),
+			)
+
+			// The token's own account and permissions must be ignored
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID:      tt.userID,
+				Account:     "ADMIN",
+				Permissions: map[string]any{"pub": map[string]any{"allow": []any{">"}}},
+			})
+			rc := authorize(t, handler, serverKP, arc)
+
+			require.Len(t, sink.decisions, 1)
+			if tt.wantReason != "" {
+				assert.NotEmpty(t, rc.Error)
+				assert.Equal(t, tt.wantReason, sink.decisions[0].Reason)
+				return
+			}
+			require.Empty(t, rc.Error)
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.userID, uc.Name)
+			assert.Equal(t, "ORDERS", uc.Audience)
+			assert.Equal(t, tt.wantPerms, uc.Permissions)
+			assert.Equal(t, "ORDERS", sink.decisions[0].Account)
+		})
+	}
+}
+
+func TestHandler_FallbackMetrics(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:        "alice",
+		Account:     "DEVELOPMENT",
+		Permissions: jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.created"}}},
+	}, true)
+
+	reg := prometheus.NewRegistry()
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithMetrics(metrics.New(reg)),
+		authresponse.WithAccountPermissions(map[string]jwt.Permissions{
+			"DEVELOPMENT": {Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+		}),
+	)
+
+	// Password user of an account with default permissions
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Username = "alice"
+	arc.ConnectOptions.Password = "alice"
+	require.Empty(t, authorize(t, handler, serverKP, arc).Error)
+
+	// Token without permissions in an account without defaults
+	arc = jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{UserID: "bob", Account: "TEST"})
+	require.Empty(t, authorize(t, handler, serverKP, arc).Error)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	applied := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "auth_fallbacks_applied_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			applied[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		metrics.FallbackDefaultUsers:               0,
+		metrics.FallbackAccountPermissions:         1,
+		metrics.FallbackTokenRepositoryPermissions: 0,
+		metrics.FallbackTokenAccountPermissions:    0,
+		metrics.FallbackTokenDenyAll:               1,
+	}, applied)
+}
+
+func TestHandler_RequestMetrics(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+	repo.On("Get", "bob").Return(&auth.User{Pass: "bob", Account: "TENANT-42"}, true)
+	reg := prometheus.NewRegistry()
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithMetrics(metrics.New(reg, "DEVELOPMENT", "PRODUCTION")),
+	)
+
+	requests := []func(arc *jwt.AuthorizationRequestClaims){
+		func(arc *jwt.AuthorizationRequestClaims) {
+			arc.ConnectOptions.Username = "alice"
+			arc.ConnectOptions.Password = "alice"
+		},
+		func(arc *jwt.AuthorizationRequestClaims) {
+			arc.ConnectOptions.Username = "alice"
+			arc.ConnectOptions.Password = "wrong"
+		},
+		func(arc *jwt.AuthorizationRequestClaims) {
+			arc.ConnectOptions.Username = "bob"
+			arc.ConnectOptions.Password = "bob"
+		},
+		func(arc *jwt.AuthorizationRequestClaims) {
+			arc.ConnectOptions.Token = signNatsToken(t, "another-secret", &tokenvalidation.NatsTokenClaims{UserID: "bob", Account: "TEST"})
+		},
+		func(arc *jwt.AuthorizationRequestClaims) {
+			arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID:           "bob",
+				Account:          "TEST",
+				RegisteredClaims: gojwt.RegisteredClaims{ExpiresAt: gojwt.NewNumericDate(time.Now().Add(-time.Minute))},
+			})
+		},
+		func(arc *jwt.AuthorizationRequestClaims) {},
+	}
+	for _, setup := range requests {
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		setup(arc)
+		authorize(t, handler, serverKP, arc)
+	}
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	answered := make(map[string]float64)
+	observed := make(map[string]uint64)
+	failures := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			switch family.GetName() {
+			case "auth_requests_total":
+				if v := m.GetCounter().GetValue(); v > 0 {
+					answered[labels["result"]+"/"+labels["method"]+"/"+labels["account"]] = v
+				}
+			case "auth_request_duration_seconds":
+				observed[labels["method"]] = m.GetHistogram().GetSampleCount()
+			case "auth_token_validation_failures_total":
+				if v := m.GetCounter().GetValue(); v > 0 {
+					failures[labels["reason"]] = v
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"success/password/DEVELOPMENT": 1,
+		"denied/password/none":         1,
+		"success/password/other":       1,
+		"denied/token/none":            2,
+		"denied/none/none":             1,
+	}, answered)
+	assert.Equal(t, map[string]uint64{"password": 3, "token": 2, "none": 1}, observed)
+	assert.Equal(t, map[string]float64{
+		tokenvalidation.FailureSignature: 1,
+		tokenvalidation.FailureExpired:   1,
+	}, failures)
+}
+
+func TestHandler_MaxUserJWTSize(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	broad := make([]string, 200)
+	for i := range broad {
+		broad[i] = fmt.Sprintf("orders.region%03d.>", i)
+	}
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:        "alice",
+		Account:     "DEVELOPMENT",
+		Permissions: jwt.Permissions{Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+	}, true)
+	repo.On("Get", "broad").Return(&auth.User{
+		Pass:        "broad",
+		Account:     "DEVELOPMENT",
+		Permissions: jwt.Permissions{Sub: jwt.Permission{Allow: broad}},
+	}, true)
+
+	tests := []struct {
+		username string
+		wantErr  bool
+	}{
+		{username: "alice"},
+		{username: "broad", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			sink := &recordingSink{}
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithMaxUserJWTSize(2048),
+				authresponse.WithDecisionRecorder(sink),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			rc := authorize(t, handler, serverKP, arc)
+
+			require.Len(t, sink.decisions, 1)
+			if !tt.wantErr {
+				require.Empty(t, rc.Error)
+				assert.LessOrEqual(t, len(rc.Jwt), 2048)
+				return
+			}
+			assert.Empty(t, rc.Jwt)
+			assert.Regexp(t, `^user JWT of \d+ bytes exceeds the limit of 2048 bytes$`, errorMessage(rc.Error))
+			assert.Equal(t, authresponse.ReasonJWTTooLarge, sink.decisions[0].Reason)
+		})
+	}
+}
+
+func TestHandler_UpdateSecrets(t *testing.T) {
+	oldIssuer := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	newIssuer := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	newIssuerPub, err := newIssuer.PublicKey()
+	require.NoError(t, err)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: oldIssuer}, new(MockUserRepository),
+		authresponse.WithTokenSecrets([]tokenvalidation.Secret{{Label: "old", Value: "old-secret"}}),
+	)
+	handler.UpdateSecrets(&auth.KeyPairs{Issuer: newIssuer}, []tokenvalidation.Secret{{Label: "vault", Value: "new-secret"}})
+
+	login := func(secret string) *jwt.AuthorizationResponseClaims {
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+			UserID:      "bob",
+			Account:     "DEVELOPMENT",
+			Permissions: map[string]any{"sub": map[string]any{"allow": []any{"_INBOX.>"}}},
+		})
+		return authorize(t, handler, serverKP, arc)
+	}
+
+	rc := login("new-secret")
+	require.Empty(t, rc.Error)
+	assert.Equal(t, newIssuerPub, rc.Issuer)
+	uc, err := jwt.DecodeUserClaims(rc.Jwt)
+	require.NoError(t, err)
+	assert.Equal(t, newIssuerPub, uc.Issuer)
+
+	rc = login("old-secret")
+	assert.Contains(t, rc.Error, "invalid token signature")
+}
+
+func TestHandler_EmptyTokenPermissions(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	denyAll := jwt.Permissions{
+		Pub: jwt.Permission{Deny: []string{">"}},
+		Sub: jwt.Permission{Deny: []string{">"}},
+	}
+	repoPerms := jwt.Permissions{Sub: jwt.Permission{Allow: []string{"TEST.>"}}}
+	accountPerms := jwt.Permissions{Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}}
+
+	tests := []struct {
+		name     string
+		mode     string
+		userID   string
+		account  string
+		wantPerm jwt.Permissions
+	}{
+		{name: "deny mode", mode: authresponse.EmptyPermissionsDeny, userID: "alice", account: "DEVELOPMENT", wantPerm: denyAll},
+		{name: "inherit from repository user", mode: authresponse.EmptyPermissionsInherit, userID: "alice", account: "DEVELOPMENT", wantPerm: repoPerms},
+		{name: "inherit from account defaults", mode: authresponse.EmptyPermissionsInherit, userID: "bob", account: "STAGING", wantPerm: accountPerms},
+		{name: "inherit without defaults denies all", mode: authresponse.EmptyPermissionsInherit, userID: "bob", account: "DEVELOPMENT", wantPerm: denyAll},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := new(MockUserRepository)
+			repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT", Permissions: repoPerms}, true).Maybe()
+			repo.On("Get", "bob").Return((*auth.User)(nil), false).Maybe()
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithEmptyTokenPermissions(tt.mode),
+				authresponse.WithAccountPermissions(map[string]jwt.Permissions{"staging": accountPerms}),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{UserID: tt.userID, Account: tt.account})
+			rc := authorize(t, handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPerm.Pub, uc.Pub)
+			assert.Equal(t, tt.wantPerm.Sub, uc.Sub)
+		})
+	}
+}
+
+func TestHandler_AccountCeiling(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:    "alice",
+		Account: "DEVELOPMENT",
+		Permissions: jwt.Permissions{
+			Pub: jwt.Permission{Allow: []string{"orders.created", "billing.charge"}},
+			Sub: jwt.Permission{Allow: []string{"_INBOX.>"}},
+		},
+	}, true)
+
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithAccountCeilings(map[string]permissions.Ceiling{
+			"development": {Pub: []string{"orders.>"}},
+		}),
+	)
+
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Username = "alice"
+	arc.ConnectOptions.Password = "alice"
+	rc := authorize(t, handler, serverKP, arc)
+	require.Empty(t, rc.Error)
+
+	uc, err := jwt.DecodeUserClaims(rc.Jwt)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.StringList{"orders.created"}, uc.Pub.Allow)
+	assert.Equal(t, jwt.StringList{"_INBOX.>"}, uc.Sub.Allow)
+}
+
+func TestHandler_TokenCeiling(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:        "alice",
+		Account:     "DEVELOPMENT",
+		Permissions: jwt.Permissions{Pub: jwt.Permission{Allow: []string{"billing.charge"}}},
+	}, true)
+	repo.On("Get", "bob").Return((*auth.User)(nil), false).Maybe()
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithTokenCeiling(permissions.Ceiling{
+			Pub: []string{"orders.>"},
+			Sub: []string{"_INBOX.>", "orders.>"},
+		}),
+	)
+
+	t.Run("broad token permissions are narrowed", func(t *testing.T) {
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+			UserID:  "bob",
+			Account: "DEVELOPMENT",
+			Permissions: map[string]any{
+				"pub": map[string]any{"allow": []string{">"}},
+				"sub": map[string]any{"allow": []string{"orders.created", "$SYS.>"}, "deny": []string{"orders.secret"}},
+			},
+		})
+		rc := authorize(t, handler, serverKP, arc)
+		require.Empty(t, rc.Error)
+
+		uc, err := jwt.DecodeUserClaims(rc.Jwt)
+		require.NoError(t, err)
+		assert.Equal(t, jwt.StringList{"orders.>"}, uc.Pub.Allow)
+		assert.Equal(t, jwt.StringList{"orders.created"}, uc.Sub.Allow)
+		assert.Equal(t, jwt.StringList{"orders.secret"}, uc.Sub.Deny)
+	})
+
+	t.Run("password users are not capped", func(t *testing.T) {
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Username = "alice"
+		arc.ConnectOptions.Password = "alice"
+		rc := authorize(t, handler, serverKP, arc)
+		require.Empty(t, rc.Error)
+
+		uc, err := jwt.DecodeUserClaims(rc.Jwt)
+		require.NoError(t, err)
+		assert.Equal(t, jwt.StringList{"billing.charge"}, uc.Pub.Allow)
+	})
+}
+
+func TestHandler_ConnectionTypeCeiling(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:    "alice",
+		Account: "DEVELOPMENT",
+		Permissions: jwt.Permissions{
+			Pub: jwt.Permission{Allow: []string{"PUBLIC.chat", "orders.created"}},
+			Sub: jwt.Permission{Allow: []string{"_INBOX.>", "orders.>"}},
+		},
+	}, true)
+
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithConnectionTypeCeilings(map[string]permissions.Ceiling{
+			"websocket":   {Pub: []string{"PUBLIC.>"}, Sub: []string{"_INBOX.>", "PUBLIC.>"}},
+			"mqtt":        {Pub: []string{"PUBLIC.>", "orders.>"}, Sub: []string{"_INBOX.>"}},
+			"leafnode_ws": {Pub: []string{"PUBLIC.>"}, Sub: []string{"_INBOX.>", "orders.>"}},
+		}),
+	)
+
+	// Type and kind as reported by nats-server in the authorization request
+	tests := []struct {
+		name      string
+		connType  string
+		kind      string
+		wantPub   jwt.StringList
+		wantSub   jwt.StringList
+		expectErr string
+	}{
+		{
+			name:     "websocket client is narrowed",
+			connType: "websocket",
+			kind:     "Client",
+			wantPub:  jwt.StringList{"PUBLIC.chat"},
+			wantSub:  jwt.StringList{"_INBOX.>"},
+		},
+		{
+			name:     "standard client keeps its permissions",
+			connType: "nats",
+			kind:     "Client",
+			wantPub:  jwt.StringList{"PUBLIC.chat", "orders.created"},
+			wantSub:  jwt.StringList{"_INBOX.>", "orders.>"},
+		},
+		{
+			name:     "mqtt client is narrowed",
+			connType: "mqtt",
+			kind:     "Client",
+			wantPub:  jwt.StringList{"PUBLIC.chat", "orders.created"},
+			wantSub:  jwt.StringList{"_INBOX.>"},
+		},
+		{
+			name:     "leafnode over websocket is narrowed",
+			connType: "websocket",
+			kind:     "Leafnode",
+			wantPub:  jwt.StringList{"PUBLIC.chat"},
+			wantSub:  jwt.StringList{"_INBOX.>", "orders.>"},
+		},
+		{
+			name:    "leafnode keeps its permissions",
+			kind:    "Leafnode",
+			wantPub: jwt.StringList{"PUBLIC.chat", "orders.created"},
+			wantSub: jwt.StringList{"_INBOX.>", "orders.>"},
+		},
+		{
+			name:     "unknown connection type gets every ceiling",
+			connType: "",
+			wantPub:  jwt.StringList{"PUBLIC.chat"},
+			wantSub:  jwt.StringList{"_INBOX.>"},
+		},
+		{
+			name:      "unmapped connection type is rejected",
+			connType:  "quic",
+			kind:      "Client",
+			expectErr: `unsupported connection type "quic" of kind "Client"`,
+		},
+		{
+			name:      "unmapped kind is rejected",
+			connType:  "nats",
+			kind:      "Router",
+			expectErr: `unsupported connection type "nats" of kind "Router"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = "alice"
+			arc.ConnectOptions.Password = "alice"
+			arc.ClientInformation.Type = tt.connType
+			arc.ClientInformation.Kind = tt.kind
+			rc := authorize(t, handler, serverKP, arc)
+			require.Equal(t, tt.expectErr, errorMessage(rc.Error))
+			if tt.expectErr != "" {
+				return
+			}
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPub, uc.Pub.Allow)
+			assert.Equal(t, tt.wantSub, uc.Sub.Allow)
+		})
+	}
+}
+
+func TestHandler_PolicyPermissions(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	var queries []policy.Query
+	policyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var q policy.Query
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&q))
+		queries = append(queries, q)
+		switch q.Username {
+		case "bob":
+			http.Error(w, "policy engine down", http.StatusInternalServerError)
+			return
+		case "carol":
+			_, _ = w.Write([]byte(`null`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"pub": {"allow": ["policy.` + q.Account + `.>"]}, "sub": {"allow": ["_INBOX.>"]}}`))
+	}))
+	defer policyServer.Close()
+
+	alice := &auth.User{
+		Pass:        "alice",
+		Account:     "DEVELOPMENT",
+		Permissions: jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.>"}}},
+	}
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(alice, true)
+	repo.On("Get", "bob").Return(&auth.User{Pass: "bob", Account: "DEVELOPMENT"}, true)
+	repo.On("Get", "carol").Return(&auth.User{Pass: "carol", Account: "DEVELOPMENT"}, true)
+
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithPermissionSource(policy.NewService(policyServer.URL, time.Minute, time.Second)),
+	)
+
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Username = "alice"
+	arc.ConnectOptions.Password = "alice"
+	arc.ClientInformation.Host = "10.0.0.7"
+	arc.ClientInformation.Type = jwt.ConnectionTypeWebsocket
+	rc := authorize(t, handler, serverKP, arc)
+	require.Empty(t, rc.Error)
+
+	uc, err := jwt.DecodeUserClaims(rc.Jwt)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.StringList{"policy.DEVELOPMENT.>"}, uc.Pub.Allow, "the policy permissions replace the user's")
+	assert.Equal(t, jwt.StringList{"_INBOX.>"}, uc.Sub.Allow)
+	assert.Equal(t, jwt.StringList{"orders.>"}, alice.Permissions.Pub.Allow, "the user record is not modified")
+	require.Len(t, queries, 1)
+	assert.Equal(t, policy.Query{
+		Username: "alice",
+		Account:  "DEVELOPMENT",
+		Method:   auth.MethodPassword,
+		Client:   policy.Client{Host: "10.0.0.7", Type: jwt.ConnectionTypeWebsocket},
+	}, queries[0])
+
+	// Answers are cached
+	require.Empty(t, authorize(t, handler, serverKP, arc).Error)
+	assert.Len(t, queries, 1)
+
+	// A failing policy service rejects the user
+	arc.ConnectOptions.Username = "bob"
+	arc.ConnectOptions.Password = "bob"
+	rc = authorize(t, handler, serverKP, arc)
+	assert.Equal(t, "resolving permissions failed", errorMessage(rc.Error))
+	assert.Empty(t, rc.Jwt)
+
+	// A null answer rejects the user instead of allowing every subject
+	arc.ConnectOptions.Username = "carol"
+	arc.ConnectOptions.Password = "carol"
+	rc = authorize(t, handler, serverKP, arc)
+	assert.Equal(t, "resolving permissions failed", errorMessage(rc.Error))
+	assert.Empty(t, rc.Jwt)
+}
+
+func TestHandler_PermissionTemplates(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:     "alice",
+		Account:  "DEVELOPMENT",
+		Template: "Reader",
+		Permissions: jwt.Permissions{
+			Pub: jwt.Permission{Allow: []string{"orders.created", "orders.internal"}},
+			Sub: jwt.Permission{Deny: []string{"orders.audit"}},
+		},
+	}, true)
+	repo.On("Get", "bob").Return(&auth.User{Pass: "bob", Account: "DEVELOPMENT", Template: "reader"}, true)
+	repo.On("Get", "carol").Return(&auth.User{Pass: "carol", Account: "DEVELOPMENT", Template: "writer"}, true)
+	templates := map[string]jwt.Permissions{
+		"reader": {
+			Pub: jwt.Permission{Allow: []string{"$JS.API.INFO"}, Deny: []string{"orders.internal"}},
+			Sub: jwt.Permission{Allow: []string{"_INBOX.>", "orders.>"}},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		strategy  string
+		username  string
+		wantPub   jwt.Permission
+		wantSub   jwt.Permission
+		expectErr string
+	}{
+		{
+			name:     "merge: template as base, inline on top, deny wins",
+			strategy: authresponse.TemplateMerge,
+			username: "alice",
+			wantPub:  jwt.Permission{Allow: []string{"$JS.API.INFO", "orders.created"}, Deny: []string{"orders.internal"}},
+			wantSub:  jwt.Permission{Allow: []string{"_INBOX.>", "orders.>"}, Deny: []string{"orders.audit"}},
+		},
+		{
+			name:     "replace: inline permissions replace the template",
+			strategy: authresponse.TemplateReplace,
+			username: "alice",
+			wantPub:  jwt.Permission{Allow: []string{"orders.created", "orders.internal"}},
+			wantSub:  jwt.Permission{Deny: []string{"orders.audit"}},
+		},
+		{
+			name:     "replace: template only without inline permissions",
+			strategy: authresponse.TemplateReplace,
+			username: "bob",
+			wantPub:  jwt.Permission{Allow: []string{"$JS.API.INFO"}, Deny: []string{"orders.internal"}},
+			wantSub:  jwt.Permission{Allow: []string{"_INBOX.>", "orders.>"}},
+		},
+		{
+			name:      "unknown template",
+			strategy:  authresponse.TemplateMerge,
+			username:  "carol",
+			expectErr: `unknown permission template "writer"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithPermissionTemplates(templates, tt.strategy),
+			)
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			rc := authorize(t, handler, serverKP, arc)
+			require.Equal(t, tt.expectErr, errorMessage(rc.Error))
+			if tt.expectErr != "" {
+				return
+			}
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPub, uc.Pub)
+			assert.Equal(t, tt.wantSub, uc.Sub)
+		})
+	}
+}
+
+func TestHandler_NormalizedPermissions(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	replier := &auth.User{
+		Pass:    "replier",
+		Account: "DEVELOPMENT",
+		Permissions: jwt.Permissions{
+			Sub:  jwt.Permission{Allow: []string{"orders.>", "orders.>"}},
+			Resp: &jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute},
+		},
+	}
+	repo := new(MockUserRepository)
+	repo.On("Get", "replier").Return(replier, true)
+	repo.On("Get", "plain").Return(&auth.User{Pass: "plain", Account: "DEVELOPMENT"}, true)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithAccountPermissions(map[string]jwt.Permissions{
+			"DEVELOPMENT": {Resp: &jwt.ResponsePermission{MaxMsgs: 10}},
+		}),
+	)
+	plainHandler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+
+	tests := []struct {
+		name     string
+		handler  *authresponse.Handler
+		username string
+		wantSub  jwt.Permission
+		wantResp *jwt.ResponsePermission
+	}{
+		{
+			name:     "with response permissions",
+			handler:  handler,
+			username: "replier",
+			wantSub:  jwt.Permission{Allow: jwt.StringList{"orders.>"}},
+			wantResp: &jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute},
+		},
+		{
+			name:     "without response permissions",
+			handler:  plainHandler,
+			username: "plain",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			rc := authorize(t, tt.handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			vr := jwt.CreateValidationResults()
+			uc.Validate(vr)
+			assert.Empty(t, vr.Issues)
+			assert.Equal(t, tt.wantSub, uc.Sub)
+			assert.Equal(t, tt.wantResp, uc.Resp)
+		})
+	}
+	assert.Equal(t, &jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute}, replier.Permissions.Resp, "the user record is not modified")
+}
+
+func TestHandler_AutoInboxSub(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	orders := &auth.User{Pass: "orders", Account: "DEVELOPMENT", Permissions: jwt.Permissions{
+		Sub: jwt.Permission{Allow: []string{"orders.>"}},
+	}}
+	repo := new(MockUserRepository)
+	repo.On("Get", "orders").Return(orders, true)
+	repo.On("Get", "inbox").Return(&auth.User{Pass: "inbox", Account: "DEVELOPMENT", Permissions: jwt.Permissions{
+		Sub: jwt.Permission{Allow: []string{"_INBOX.>", "orders.>"}},
+	}}, true)
+	repo.On("Get", "everything").Return(&auth.User{Pass: "everything", Account: "DEVELOPMENT", Permissions: jwt.Permissions{
+		Sub: jwt.Permission{Allow: []string{">"}},
+	}}, true)
+	repo.On("Get", "open").Return(&auth.User{Pass: "open", Account: "DEVELOPMENT"}, true)
+
+	enabled := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo, authresponse.WithAutoInboxSub(true))
+	disabled := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+
+	tests := []struct {
+		name      string
+		handler   *authresponse.Handler
+		username  string
+		wantAllow jwt.StringList
+	}{
+		{name: "inbox injected", handler: enabled, username: "orders", wantAllow: jwt.StringList{"orders.>", "_INBOX.>"}},
+		{name: "inbox already present", handler: enabled, username: "inbox", wantAllow: jwt.StringList{"_INBOX.>", "orders.>"}},
+		{name: "inbox covered by a wildcard", handler: enabled, username: "everything", wantAllow: jwt.StringList{">"}},
+		{name: "unrestricted subscriptions", handler: enabled, username: "open"},
+		{name: "disabled", handler: disabled, username: "orders", wantAllow: jwt.StringList{"orders.>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			rc := authorize(t, tt.handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tt.wantAllow, uc.Sub.Allow)
+		})
+	}
+	assert.Equal(t, jwt.StringList{"orders.>"}, orders.Permissions.Sub.Allow, "the user record is not modified")
+}
+
+func TestHandler_AlternateKeyLogin(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	fullAccess := jwt.Permissions{Pub: jwt.Permission{Allow: []string{">"}}, Sub: jwt.Permission{Allow: []string{">"}}}
+	repo := &MockAliasUserRepository{aliases: map[string]string{"alice@example.com": "alice"}}
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT", Permissions: fullAccess}, true)
+
+	login := func(handler *authresponse.Handler, username, password string) *jwt.AuthorizationResponseClaims {
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Username = username
+		arc.ConnectOptions.Password = password
+		return authorize(t, handler, serverKP, arc)
+	}
+
+	t.Run("issued and recorded under the canonical username", func(t *testing.T) {
+		sink := &recordingSink{}
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithDecisionRecorder(sink),
+			authresponse.WithBroadWildcards(authresponse.BroadWildcardsReject, []string{"alice"}),
+		)
+
+		rc := login(handler, "alice@example.com", "alice")
+		require.Empty(t, rc.Error, "admin exemption applies to the canonical username")
+		uc, err := jwt.DecodeUserClaims(rc.Jwt)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", uc.Name)
+		require.Len(t, sink.decisions, 1)
+		assert.Equal(t, "alice", sink.decisions[0].Username)
+	})
+
+	t.Run("rate limited together with the canonical username", func(t *testing.T) {
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithRateLimit(0.001, 1, false),
+		)
+
+		assert.Contains(t, login(handler, "alice", "wrong").Error, "invalid credentials")
+		assert.Contains(t, login(handler, "alice@example.com", "wrong").Error, "too many authorization requests")
+	})
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const burst = 3
+	login := func(handler *authresponse.Handler, username, host string) *jwt.AuthorizationResponseClaims {
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Username = username
+		arc.ConnectOptions.Password = "wrong"
+		arc.ClientInformation.Host = host
+		return authorize(t, handler, serverKP, arc)
+	}
+
+	t.Run("per username", func(t *testing.T) {
+		repo := new(MockUserRepository)
+		repo.On("Get", mock.Anything).Return(&auth.User{Pass: "secret", Account: "DEVELOPMENT"}, true)
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithRateLimit(0.001, burst, false))
+
+		for i := 0; i < burst; i++ {
+			rc := login(handler, "alice", "10.0.0.1")
+			assert.Contains(t, rc.Error, "invalid credentials", "attempt %d", i+1)
+		}
+		rc := login(handler, "alice", "10.0.0.2")
+		assert.Equal(t, "[ERR_RATE_LIMITED] too many authorization requests, retry later", rc.Error)
+		repo.AssertNumberOfCalls(t, "Get", burst)
+
+		rc = login(handler, "bob", "10.0.0.1")
+		assert.Contains(t, rc.Error, "invalid credentials", "other usernames are not limited")
+	})
+
+	t.Run("per client", func(t *testing.T) {
+		repo := new(MockUserRepository)
+		repo.On("Get", mock.Anything).Return(&auth.User{Pass: "secret", Account: "DEVELOPMENT"}, true)
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithRateLimit(0.001, burst, true))
+
+		for i := 0; i < burst; i++ {
+			login(handler, "alice", "10.0.0.1")
+		}
+		rc := login(handler, "alice", "10.0.0.1")
+		assert.Contains(t, rc.Error, "too many authorization requests")
+		rc = login(handler, "alice", "10.0.0.2")
+		assert.Contains(t, rc.Error, "invalid credentials", "other hosts are not limited")
+	})
+
+	t.Run("flushed by the admin endpoint", func(t *testing.T) {
+		repo := new(MockUserRepository)
+		repo.On("Get", mock.Anything).Return(&auth.User{Pass: "secret", Account: "DEVELOPMENT"}, true)
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithRateLimit(0.001, burst, false))
+
+		for i := 0; i < burst; i++ {
+			login(handler, "alice", "10.0.0.1")
+		}
+		login(handler, "bob", "10.0.0.1")
+		require.Contains(t, login(handler, "alice", "10.0.0.1").Error, "too many authorization requests")
+
+		var resp authresponse.FlushResponse
+		req := &MockRequest{data: []byte(`{"admin_token":"admin-secret"}`)}
+		req.On("RespondJSON", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			resp = args.Get(0).(authresponse.FlushResponse)
+		}).Return(nil)
+		handler.NewFlushHandler("admin-secret").Handle(req)
+		require.Empty(t, resp.Error)
+		assert.Equal(t, map[string]int{"rate_limit": 2}, resp.Cleared)
+
+		assert.Contains(t, login(handler, "alice", "10.0.0.1").Error, "invalid credentials", "the limit is lifted")
+	})
+}
+
+func TestHandler_BroadWildcards(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	fullAccess := jwt.Permissions{Pub: jwt.Permission{Allow: []string{">"}}, Sub: jwt.Permission{Allow: []string{">"}}}
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT", Permissions: fullAccess}, true)
+	repo.On("Get", "sys").Return(&auth.User{Pass: "sys", Account: "SYS", Permissions: fullAccess}, true)
+	repo.On("Get", "open").Return(&auth.User{Pass: "open", Account: "DEVELOPMENT"}, true)
+
+	wildcardWarnings := func(hook *logtest.Hook) int {
+		count := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "broad wildcard") {
+				count++
+			}
+		}
+		return count
+	}
+
+	tests := []struct {
+		name         string
+		mode         string
+		username     string
+		expectErr    string
+		wantWarnings int
+	}{
+		{name: "warn", mode: authresponse.BroadWildcardsWarn, username: "alice", wantWarnings: 1},
+		{
+			name:         "reject",
+			mode:         authresponse.BroadWildcardsReject,
+			username:     "alice",
+			expectErr:    "permissions grant broad wildcard subjects",
+			wantWarnings: 1,
+		},
+		{
+			name:         "empty permissions allow everything",
+			mode:         authresponse.BroadWildcardsReject,
+			username:     "open",
+			expectErr:    "permissions grant broad wildcard subjects",
+			wantWarnings: 1,
+		},
+		{name: "off", mode: authresponse.BroadWildcardsOff, username: "alice"},
+		{name: "admin is exempt", mode: authresponse.BroadWildcardsReject, username: "sys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithBroadWildcards(tt.mode, []string{"sys"}),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			rc := authorize(t, handler, serverKP, arc)
+			assert.Equal(t, tt.expectErr, errorMessage(rc.Error))
+			assert.Equal(t, tt.expectErr == "", rc.Jwt != "")
+			assert.Equal(t, tt.wantWarnings, wildcardWarnings(hook))
+		})
+	}
+}
+
+func TestHandler_AccountPermissions(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:    "alice",
+		Account: "STAGING",
+		Permissions: jwt.Permissions{
+			Pub:  jwt.Permission{Allow: []string{"orders.created", "orders.secret"}},
+			Sub:  jwt.Permission{Allow: []string{"orders.>"}},
+			Resp: &jwt.ResponsePermission{MaxMsgs: 5},
+		},
+	}, true)
+	repo.On("Get", "bob").Return(&auth.User{Pass: "bob", Account: "STAGING"}, true)
+
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithAccountPermissions(map[string]jwt.Permissions{
+			"staging": {
+				Pub:  jwt.Permission{Deny: []string{"orders.secret"}},
+				Sub:  jwt.Permission{Allow: []string{"_INBOX.>"}},
+				Resp: &jwt.ResponsePermission{MaxMsgs: 1},
+			},
+		}),
+	)
+
+	tests := []struct {
+		name     string
+		username string
+		want     jwt.Permissions
+	}{
+		{
+			name:     "user extends defaults",
+			username: "alice",
+			want: jwt.Permissions{
+				Pub:  jwt.Permission{Allow: jwt.StringList{"orders.created"}, Deny: jwt.StringList{"orders.secret"}},
+				Sub:  jwt.Permission{Allow: jwt.StringList{"_INBOX.>", "orders.>"}},
+				Resp: &jwt.ResponsePermission{MaxMsgs: 5},
+			},
+		},
+		{
+			name:     "user has no permissions",
+			username: "bob",
+			want: jwt.Permissions{
+				Pub:  jwt.Permission{Deny: jwt.StringList{"orders.secret"}},
+				Sub:  jwt.Permission{Allow: jwt.StringList{"_INBOX.>"}},
+				Resp: &jwt.ResponsePermission{MaxMsgs: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			rc := authorize(t, handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, uc.Permissions)
+		})
+	}
+}
+
+func TestHandler_Blocklist(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	perms := jwt.Permissions{
+		Pub: jwt.Permission{Allow: []string{"orders.created", "$SYS.REQ.SERVER.PING"}},
+		Sub: jwt.Permission{Allow: []string{"_INBOX.>"}},
+	}
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT", Permissions: perms}, true)
+	repo.On("Get", "sys").Return(&auth.User{Pass: "sys", Account: "SYS", Permissions: perms}, true)
+
+	tests := []struct {
+		name      string
+		username  string
+		reject    bool
+		wantPub   jwt.StringList
+		wantError string
+	}{
+		{name: "strip", username: "alice", wantPub: jwt.StringList{"orders.created"}},
+		{name: "reject", username: "alice", reject: true, wantError: "permissions include blocked subjects"},
+		{name: "exempt account", username: "sys", reject: true, wantPub: jwt.StringList{"orders.created", "$SYS.REQ.SERVER.PING"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithDecisionRecorder(sink),
+				authresponse.WithBlocklist(authresponse.Blocklist{
+					Subjects:       []string{"$SYS.>"},
+					ExemptAccounts: []string{"sys"},
+					Reject:         tt.reject,
+				}),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			rc := authorize(t, handler, serverKP, arc)
+
+			require.Len(t, sink.decisions, 1)
+			if tt.wantError != "" {
+				assert.Equal(t, tt.wantError, errorMessage(rc.Error))
+				assert.Equal(t, authresponse.ReasonBlockedSubject, sink.decisions[0].Reason)
+				return
+			}
+			require.Empty(t, rc.Error)
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPub, uc.Pub.Allow)
+		})
+	}
+}
+
+func TestHandler_PasswordRehash(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	hashWithCost := func(cost int) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte("alice"), cost)
+		require.NoError(t, err)
+		return string(hash)
+	}
+	login := func(t *testing.T, handler *authresponse.Handler, password string) *jwt.AuthorizationResponseClaims {
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Username = "alice"
+		arc.ConnectOptions.Password = password
+		return authorize(t, handler, serverKP, arc)
+	}
+
+	t.Run("rehashes below target cost", func(t *testing.T) {
+		repo := new(MockWritableUserRepository)
+		repo.On("Get", "alice").Return(&auth.User{Pass: hashWithCost(bcrypt.MinCost), Account: "DEVELOPMENT"}, true)
+		repo.On("UpdatePassword", "alice", mock.Anything).Return(nil)
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithRehashCost(bcrypt.MinCost+1),
+		)
+
+		rc := login(t, handler, "alice")
+		require.Empty(t, rc.Error)
+
+		repo.AssertCalled(t, "UpdatePassword", "alice", mock.Anything)
+		hash := repo.Calls[len(repo.Calls)-1].Arguments.String(1)
+		cost, err := bcrypt.Cost([]byte(hash))
+		require.NoError(t, err)
+		assert.Equal(t, bcrypt.MinCost+1, cost)
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("alice")))
+	})
+
+	t.Run("keeps hash at target cost", func(t *testing.T) {
+		repo := new(MockWritableUserRepository)
+		repo.On("Get", "alice").Return(&auth.User{Pass: hashWithCost(bcrypt.MinCost), Account: "DEVELOPMENT"}, true)
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithRehashCost(bcrypt.MinCost),
+		)
+
+		rc := login(t, handler, "alice")
+		require.Empty(t, rc.Error)
+		repo.AssertNotCalled(t, "UpdatePassword", mock.Anything, mock.Anything)
+	})
+
+	t.Run("no rehash on failed login", func(t *testing.T) {
+		repo := new(MockWritableUserRepository)
+		repo.On("Get", "alice").Return(&auth.User{Pass: hashWithCost(bcrypt.MinCost), Account: "DEVELOPMENT"}, true)
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithRehashCost(bcrypt.MinCost+1),
+		)
+
+		rc := login(t, handler, "wrong")
+		assert.Equal(t, "invalid credentials", errorMessage(rc.Error))
+		repo.AssertNotCalled(t, "UpdatePassword", mock.Anything, mock.Anything)
+	})
+
+	t.Run("read-only repository is a no-op", func(t *testing.T) {
+		repo := new(MockUserRepository)
+		repo.On("Get", "alice").Return(&auth.User{Pass: hashWithCost(bcrypt.MinCost), Account: "DEVELOPMENT"}, true)
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithRehashCost(bcrypt.MinCost+1),
+		)
+
+		rc := login(t, handler, "alice")
+		assert.Empty(t, rc.Error)
+	})
+}
+
+func TestHandler_ErrorCodes(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+	repo.On("Get", "mallory").Return((*auth.User)(nil), false)
+
+	tests := []struct {
+		name      string
+		opts      []authresponse.Option
+		username  string
+		password  string
+		token     string
+		wantError string
+		wantCode  string
+	}{
+		{
+			name:      "user not found",
+			username:  "mallory",
+			password:  "secret",
+			wantError: "[ERR_USER_NOT_FOUND] user not found",
+			wantCode:  authresponse.ReasonUserNotFound,
+		},
+		{
+			name:      "invalid credentials",
+			username:  "alice",
+			password:  "wrong",
+			wantError: "[ERR_BAD_CREDS] invalid credentials",
+			wantCode:  authresponse.ReasonInvalidCredentials,
+		},
+		{
+			name: "expired token",
+			token: signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID:           "bob",
+				Account:          "DEVELOPMENT",
+				RegisteredClaims: gojwt.RegisteredClaims{ExpiresAt: gojwt.NewNumericDate(time.Now().Add(-time.Minute))},
+			}),
+			wantError: "[ERR_TOKEN_EXPIRED] validating nats_token: token is expired",
+			wantCode:  authresponse.ReasonTokenExpired,
+		},
+		{
+			name:      "overridden code",
+			opts:      []authresponse.Option{authresponse.WithErrorCodes(map[string]string{authresponse.ReasonNoCredentials: "E_NOCREDS"})},
+			wantError: "[E_NOCREDS] " + authresponse.DefaultNoCredentialsMessage,
+			wantCode:  authresponse.ReasonNoCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			opts := append([]authresponse.Option{authresponse.WithDecisionRecorder(sink)}, tt.opts...)
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo, opts...)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.password
+			arc.ConnectOptions.Token = tt.token
+
+			rc := authorize(t, handler, serverKP, arc)
+			// The expiry message ends with how long ago the token expired
+			assert.True(t, strings.HasPrefix(rc.Error, tt.wantError), "error %q, want prefix %q", rc.Error, tt.wantError)
+			require.Len(t, sink.decisions, 1)
+			assert.NotContains(t, sink.decisions[0].Error, "[")
+			if tt.wantCode != "" {
+				assert.Equal(t, tt.wantCode, sink.decisions[0].Reason)
+			}
+		})
+	}
+}
+
+func TestHandler_PasswordDeprecation(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+
+	deprecations := func(hook *logtest.Hook) []*logrus.Entry {
+		var found []*logrus.Entry
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, "Deprecated password authentication") {
+				found = append(found, entry)
+			}
+		}
+		return found
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		token   bool
+		want    bool
+	}{
+		{name: "password auth", enabled: true, want: true},
+		{name: "token auth", enabled: true, token: true},
+		{name: "disabled", enabled: false},
+	}
+
+	hook := logtest.NewGlobal()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithPasswordDeprecation(tt.enabled),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			if tt.token {
+				arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{UserID: "bob", Account: "DEVELOPMENT"})
+			} else {
+				arc.ConnectOptions.Username = "alice"
+				arc.ConnectOptions.Password = "alice"
+			}
+			rc := authorize(t, handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			found := deprecations(hook)
+			if !tt.want {
+				assert.Empty(t, found)
+				return
+			}
+			require.Len(t, found, 1)
+			assert.Equal(t, logrus.WarnLevel, found[0].Level)
+			assert.Equal(t, "alice", found[0].Data["username"])
+		})
+	}
+}
+
+func TestHandler_LoginLogOmitsPassword(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const password = "s3cret-pass"
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: password, Account: "DEVELOPMENT"}, true)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+
+	hook := logtest.NewGlobal()
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Username = "alice"
+	arc.ConnectOptions.Password = password
+	require.Empty(t, authorize(t, handler, serverKP, arc).Error)
+
+	var validated *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		assert.NotContains(t, fmt.Sprint(entry.Message, entry.Data), password)
+		if entry.Message == "Validated user login/pass" {
+			validated = entry
+		}
+	}
+	require.NotNil(t, validated)
+	assert.Equal(t, logrus.Fields{"username": "alice", "method": auth.MethodPassword}, validated.Data)
+}
+
+func TestHandler_ExpiredUser(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		wantError string
+	}{
+		{name: "expired record", expiresAt: time.Now().Add(-time.Hour), wantError: "account expired"},
+		{name: "valid record", expiresAt: time.Now().Add(time.Hour)},
+		{name: "no expiry", expiresAt: time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := new(MockUserRepository)
+			repo.On("Get", "contractor").Return(&auth.User{
+				Pass:      "secret",
+				Account:   "DEVELOPMENT",
+				ExpiresAt: tt.expiresAt,
+			}, true)
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = "contractor"
+			arc.ConnectOptions.Password = "secret"
+
+			rc := authorize(t, handler, serverKP, arc)
+			assert.Equal(t, tt.wantError, errorMessage(rc.Error))
+			assert.Equal(t, tt.wantError == "", rc.Jwt != "")
+		})
+	}
+}
+
+func TestHandler_Preview(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	issuerPubKey, err := issuerKP.PublicKey()
+	require.NoError(t, err)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := &MockAliasUserRepository{aliases: map[string]string{"alice@example.com": "alice"}}
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:        "alice",
+		Account:     "DEVELOPMENT",
+		Permissions: jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.>"}}},
+	}, true)
+	repo.On("Get", "contractor").Return(&auth.User{Pass: "contractor", Account: "DEVELOPMENT", ExpiresAt: time.Now().Add(-time.Hour)}, true)
+	repo.On("Get", "mallory").Return((*auth.User)(nil), false)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+	preview := handler.NewPreviewHandler("admin-secret")
+
+	send := func(t *testing.T, pr authresponse.PreviewRequest) authresponse.PreviewResponse {
+		t.Helper()
+		data, err := json.Marshal(pr)
+		require.NoError(t, err)
+
+		var resp authresponse.PreviewResponse
+		req := &MockRequest{data: data}
+		req.On("RespondJSON", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			resp = args.Get(0).(authresponse.PreviewResponse)
+		}).Return(nil)
+		preview.Handle(req)
+		return resp
+	}
+
+	t.Run("username", func(t *testing.T) {
+		resp := send(t, authresponse.PreviewRequest{AdminToken: "admin-secret", Username: "alice", UserNkey: userPubKey})
+		require.Empty(t, resp.Error)
+
+		uc, err := jwt.DecodeUserClaims(resp.JWT)
+		require.NoError(t, err)
+		assert.Equal(t, userPubKey, uc.Subject)
+		assert.Equal(t, issuerPubKey, uc.Issuer)
+		assert.Equal(t, "alice", uc.Name)
+		assert.Equal(t, "DEVELOPMENT", uc.Audience)
+		assert.Equal(t, jwt.StringList{"orders.>"}, uc.Pub.Allow)
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		resp := send(t, authresponse.PreviewRequest{AdminToken: "admin-secret", Username: "alice@example.com"})
+		require.Empty(t, resp.Error)
+
+		uc, err := jwt.DecodeUserClaims(resp.JWT)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", uc.Name, "the JWT is issued to the canonical username")
+		assert.Equal(t, jwt.StringList{"orders.>"}, uc.Pub.Allow)
+	})
+
+	t.Run("token without user nkey", func(t *testing.T) {
+		token := signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+			UserID:      "bob",
+			Account:     "TEST",
+			Permissions: map[string]any{"sub": map[string]any{"allow": []any{"_INBOX.>"}}},
+		})
+		resp := send(t, authresponse.PreviewRequest{AdminToken: "admin-secret", Token: token})
+		require.Empty(t, resp.Error)
+
+		uc, err := jwt.DecodeUserClaims(resp.JWT)
+		require.NoError(t, err)
+		assert.True(t, nkeys.IsValidPublicUserKey(uc.Subject))
+		assert.Equal(t, "bob", uc.Name)
+		assert.Equal(t, "TEST", uc.Audience)
+		assert.Equal(t, jwt.StringList{"_INBOX.>"}, uc.Sub.Allow)
+	})
+
+	t.Run("rejections", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			pr        authresponse.PreviewRequest
+			wantError string
+		}{
+			{name: "wrong admin token", pr: authresponse.PreviewRequest{AdminToken: "guess", Username: "alice"}, wantError: "unauthorized"},
+			{name: "missing admin token", pr: authresponse.PreviewRequest{Username: "alice"}, wantError: "unauthorized"},
+			{name: "unknown user", pr: authresponse.PreviewRequest{AdminToken: "admin-secret", Username: "mallory"}, wantError: "user not found"},
+			{name: "expired user", pr: authresponse.PreviewRequest{AdminToken: "admin-secret", Username: "contractor"}, wantError: "account expired"},
+			{name: "no subject", pr: authresponse.PreviewRequest{AdminToken: "admin-secret"}, wantError: "username or token required"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				resp := send(t, tt.pr)
+				assert.Equal(t, tt.wantError, resp.Error)
+				assert.Empty(t, resp.JWT)
+			})
+		}
+	})
+}
+
+func TestHandler_TokenExpiry(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+	tokenExpiry := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+
+	tests := []struct {
+		name       string
+		opts       []authresponse.Option
+		password   bool
+		wantExpiry func(before time.Time) int64
+	}{
+		{
+			name:       "token expiry without a TTL",
+			wantExpiry: func(time.Time) int64 { return tokenExpiry.Unix() },
+		},
+		{
+			name:       "TTL longer than the token",
+			opts:       []authresponse.Option{authresponse.WithUserJWTTTL(time.Hour)},
+			wantExpiry: func(time.Time) int64 { return tokenExpiry.Unix() },
+		},
+		{
+			name:       "TTL shorter than the token",
+			opts:       []authresponse.Option{authresponse.WithUserJWTTTL(5 * time.Minute)},
+			wantExpiry: func(before time.Time) int64 { return before.Add(5 * time.Minute).Unix() },
+		},
+		{
+			name:       "token identity",
+			opts:       []authresponse.Option{authresponse.WithTokenIdentityOnly(true)},
+			wantExpiry: func(time.Time) int64 { return tokenExpiry.Unix() },
+		},
+		{
+			name:       "password user with a TTL",
+			opts:       []authresponse.Option{authresponse.WithUserJWTTTL(5 * time.Minute)},
+			password:   true,
+			wantExpiry: func(before time.Time) int64 { return before.Add(5 * time.Minute).Unix() },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo, tt.opts...)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			if tt.password {
+				arc.ConnectOptions.Username = "alice"
+				arc.ConnectOptions.Password = "alice"
+			} else {
+				arc.ConnectOptions.Token = signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+					UserID:           "alice",
+					Account:          "DEVELOPMENT",
+					Permissions:      map[string]any{"sub": map[string]any{"allow": []string{"_INBOX.>"}}},
+					RegisteredClaims: gojwt.RegisteredClaims{ExpiresAt: gojwt.NewNumericDate(tokenExpiry)},
+				})
+			}
+			before := time.Now().Truncate(time.Second)
+			rc := authorize(t, handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.NotZero(t, uc.Expires)
+			assert.InDelta(t, tt.wantExpiry(before), uc.Expires, 1)
+		})
+	}
+}
+
+func TestHandler_UserLimits(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	subs, payload, invalid := int64(10), int64(0), int64(-2)
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{
+		Pass:    "alice",
+		Account: "DEVELOPMENT",
+		Limits:  auth.Limits{Subs: &subs, Payload: &payload},
+	}, true)
+	repo.On("Get", "bob").Return(&auth.User{Pass: "bob", Account: "DEVELOPMENT"}, true)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+
+	perms := map[string]any{"sub": map[string]any{"allow": []string{"_INBOX.>"}}}
+	tests := []struct {
+		name       string
+		username   string
+		token      string
+		wantError  string
+		wantLimits jwt.NatsLimits
+	}{
+		{
+			name:       "user limits",
+			username:   "alice",
+			wantLimits: jwt.NatsLimits{Subs: 10, Data: jwt.NoLimit, Payload: 0},
+		},
+		{
+			name:       "unset limits stay unlimited",
+			username:   "bob",
+			wantLimits: jwt.NatsLimits{Subs: jwt.NoLimit, Data: jwt.NoLimit, Payload: jwt.NoLimit},
+		},
+		{
+			name: "token limits",
+			token: signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID: "carol", Account: "DEVELOPMENT", Permissions: perms,
+				Limits: &auth.Limits{Data: &subs},
+			}),
+			wantLimits: jwt.NatsLimits{Subs: jwt.NoLimit, Data: 10, Payload: jwt.NoLimit},
+		},
+		{
+			name: "invalid token limits",
+			token: signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID: "carol", Account: "DEVELOPMENT", Permissions: perms,
+				Limits: &auth.Limits{Payload: &invalid},
+			}),
+			wantError: "validating nats_token: limit payload must be -1 (unlimited) or more, got -2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			arc.ConnectOptions.Token = tt.token
+			rc := authorize(t, handler, serverKP, arc)
+			if tt.wantError != "" {
+				assert.Equal(t, tt.wantError, errorMessage(rc.Error))
+				return
+			}
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantLimits, uc.NatsLimits)
+		})
+	}
+}
+
+func TestHandler_ConnectionTypes(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "browser").Return(&auth.User{
+		Pass:            "browser",
+		Account:         "DEVELOPMENT",
+		ConnectionTypes: []string{jwt.ConnectionTypeWebsocket},
+	}, true)
+	repo.On("Get", "anywhere").Return(&auth.User{Pass: "anywhere", Account: "DEVELOPMENT"}, true)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+
+	tests := []struct {
+		username string
+		want     jwt.StringList
+	}{
+		{username: "browser", want: jwt.StringList{jwt.ConnectionTypeWebsocket}},
+		{username: "anywhere"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			rc := authorize(t, handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, uc.AllowedConnectionTypes)
+		})
+	}
+}
+
+func TestHandler_BearerToken(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "service").Return(&auth.User{Pass: "service", Account: "DEVELOPMENT", BearerToken: true}, true)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+
+	for username, want := range map[string]bool{"service": true, "alice": false} {
+		t.Run(username, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = username
+			arc.ConnectOptions.Password = username
+			rc := authorize(t, handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, want, uc.BearerToken)
+		})
+	}
+}
+
+func TestHandler_SourceNetworks(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "office").Return(&auth.User{Pass: "office", Account: "DEVELOPMENT", Src: []string{"10.0.0.0/8"}}, true)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo)
+
+	perms := map[string]any{"sub": map[string]any{"allow": []string{"_INBOX.>"}}}
+	tests := []struct {
+		name      string
+		username  string
+		token     string
+		wantError string
+		wantSrc   jwt.CIDRList
+	}{
+		{name: "user networks", username: "office", wantSrc: jwt.CIDRList{"10.0.0.0/8"}},
+		{
+			name: "token networks",
+			token: signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID: "svc", Account: "DEVELOPMENT", Permissions: perms, Src: []string{"192.168.1.0/24", "2001:db8::/32"},
+			}),
+			wantSrc: jwt.CIDRList{"192.168.1.0/24", "2001:db8::/32"},
+		},
+		{
+			name: "malformed token network",
+			token: signNatsToken(t, secret, &tokenvalidation.NatsTokenClaims{
+				UserID: "svc", Account: "DEVELOPMENT", Permissions: perms, Src: []string{"192.168.1.1"},
+			}),
+			wantError: `validating nats_token: invalid source CIDR "192.168.1.1"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			arc.ConnectOptions.Token = tt.token
+			rc := authorize(t, handler, serverKP, arc)
+			if tt.wantError != "" {
+				assert.Equal(t, tt.wantError, errorMessage(rc.Error))
+				return
+			}
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantSrc, uc.Src)
+		})
+	}
+}
+
+func TestHandler_TokenCache(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	cache := tokenvalidation.NewCache(8)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+		authresponse.WithTokenCache(cache),
+		authresponse.WithTokenAudience("orders"),
+	)
+	claims := &tokenvalidation.NatsTokenClaims{
+		UserID: "svc", Account: "DEVELOPMENT",
+		Permissions: map[string]any{"sub": map[string]any{"allow": []string{"_INBOX.>"}}},
+	}
+	claims.Audience = gojwt.ClaimStrings{"orders"}
+	token := signNatsToken(t, secret, claims)
+
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Token = token
+	require.Empty(t, authorize(t, handler, serverKP, arc).Error)
+	assert.Equal(t, 1, cache.Len())
+
+	// A cached token is not verified against the secret again
+	t.Setenv("NATS_TOKEN_SECRET", "another-secret-0987654321")
+	require.Empty(t, authorize(t, handler, serverKP, arc).Error)
+
+	// Rotating the secrets drops tokens validated by the old ones
+	handler.UpdateSecrets(nil, nil)
+	assert.Zero(t, cache.Len())
+	assert.Contains(t, authorize(t, handler, serverKP, arc).Error, "signature is invalid")
+
+	// The audience still applies to cached tokens
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+	require.Empty(t, authorize(t, handler, serverKP, arc).Error)
+	billing := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+		authresponse.WithTokenCache(cache),
+		authresponse.WithTokenAudience("billing"),
+	)
+	assert.Contains(t, authorize(t, billing, serverKP, arc).Error, "token audience does not include")
+}
+
+func TestHandler_TokenLeeway(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	claims := &tokenvalidation.NatsTokenClaims{
+		UserID: "svc", Account: "DEVELOPMENT",
+		Permissions: map[string]any{"sub": map[string]any{"allow": []string{"_INBOX.>"}}},
+	}
+	claims.ExpiresAt = gojwt.NewNumericDate(time.Now().Add(-10 * time.Second))
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Token = signNatsToken(t, secret, claims)
+
+	t.Run("expired within the default leeway", func(t *testing.T) {
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository))
+		assert.Empty(t, authorize(t, handler, serverKP, arc).Error)
+	})
+
+	t.Run("expired past the configured leeway", func(t *testing.T) {
+		sink := &recordingSink{}
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+			authresponse.WithTokenLeeway(5*time.Second),
+			authresponse.WithDecisionRecorder(sink),
+		)
+		assert.Contains(t, authorize(t, handler, serverKP, arc).Error, "token is expired")
+		require.Len(t, sink.decisions, 1)
+		assert.Equal(t, authresponse.ReasonTokenExpired, sink.decisions[0].Reason)
+	})
+
+	t.Run("issued beyond the maximum iat skew", func(t *testing.T) {
+		future := &tokenvalidation.NatsTokenClaims{UserID: "svc", Account: "DEVELOPMENT", Permissions: claims.Permissions}
+		future.IssuedAt = gojwt.NewNumericDate(time.Now().Add(time.Hour))
+		arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+		arc.UserNkey = userPubKey
+		arc.ConnectOptions.Token = signNatsToken(t, secret, future)
+
+		lenient := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository))
+		assert.Empty(t, authorize(t, lenient, serverKP, arc).Error, "iat is not checked by default")
+		strict := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+			authresponse.WithTokenMaxIssuedAtSkew(time.Minute),
+		)
+		assert.Contains(t, authorize(t, strict, serverKP, arc).Error, "token used before issued")
+	})
+}
+
+func TestHandler_TimeWindows(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const locale = "Europe/Berlin"
+	loc, err := time.LoadLocation(locale)
+	require.NoError(t, err)
+	today := time.Now().In(loc).Weekday()
+	tomorrow := (today + 1) % 7
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "office").Return(&auth.User{Pass: "office", Account: "DEVELOPMENT", Locale: locale, Times: []auth.TimeWindow{
+		{Start: "08:00", End: "12:00"},
+		{Start: "13:00", End: "17:30:15", Weekdays: []string{today.String()}},
+		{Start: "18:00", End: "20:00", Weekdays: []string{tomorrow.String()[:3]}},
+	}}, true)
+	repo.On("Get", "weekend").Return(&auth.User{Pass: "weekend", Account: "DEVELOPMENT", Times: []auth.TimeWindow{
+		{Start: "10:00", End: "16:00", Weekdays: []string{tomorrow.String()}},
+	}, Locale: locale}, true)
+	repo.On("Get", "anytime").Return(&auth.User{Pass: "anytime", Account: "DEVELOPMENT"}, true)
+
+	tests := []struct {
+		name       string
+		username   string
+		wantError  string
+		wantTimes  []jwt.TimeRange
+		wantLocale string
+	}{
+		{
+			name:       "windows open today",
+			username:   "office",
+			wantTimes:  []jwt.TimeRange{{Start: "08:00:00", End: "12:00:00"}, {Start: "13:00:00", End: "17:30:15"}},
+			wantLocale: locale,
+		},
+		{name: "no window today", username: "weekend", wantError: `no access window for user "weekend" today`},
+		{name: "unrestricted", username: "anytime"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo, authresponse.WithDecisionRecorder(sink))
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.username
+			rc := authorize(t, handler, serverKP, arc)
+			if tt.wantError != "" {
+				assert.Equal(t, tt.wantError, errorMessage(rc.Error))
+				require.Len(t, sink.decisions, 1)
+				assert.Equal(t, authresponse.ReasonOutsideTimeWindow, sink.decisions[0].Reason)
+				return
+			}
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantTimes, uc.Times)
+			assert.Equal(t, tt.wantLocale, uc.Locale)
+		})
+	}
+}
+
+func TestHandler_RequiredJWTExpiry(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+
+	tests := []struct {
+		name       string
+		opts       []authresponse.Option
+		wantError  string
+		wantExpiry time.Duration
+	}{
+		{name: "off", opts: []authresponse.Option{authresponse.WithRequiredJWTExpiry(authresponse.JWTExpiryOff, time.Hour)}},
+		{
+			name:      "reject",
+			opts:      []authresponse.Option{authresponse.WithRequiredJWTExpiry(authresponse.JWTExpiryReject, time.Hour)},
+			wantError: "user JWT has no expiry",
+		},
+		{
+			name:       "default",
+			opts:       []authresponse.Option{authresponse.WithRequiredJWTExpiry(authresponse.JWTExpiryDefault, time.Hour)},
+			wantExpiry: time.Hour,
+		},
+		{
+			name: "configured TTL wins",
+			opts: []authresponse.Option{
+				authresponse.WithUserJWTTTL(15 * time.Minute),
+				authresponse.WithRequiredJWTExpiry(authresponse.JWTExpiryReject, time.Hour),
+			},
+			wantExpiry: 15 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			opts := append([]authresponse.Option{authresponse.WithDecisionRecorder(sink)}, tt.opts...)
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo, opts...)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = "alice"
+			arc.ConnectOptions.Password = "alice"
+			before := time.Now()
+			rc := authorize(t, handler, serverKP, arc)
+			if tt.wantError != "" {
+				assert.Equal(t, tt.wantError, errorMessage(rc.Error))
+				require.Len(t, sink.decisions, 1)
+				assert.Equal(t, authresponse.ReasonMissingExpiry, sink.decisions[0].Reason)
+				return
+			}
+			require.Empty(t, rc.Error)
+
+			uc, err := jwt.DecodeUserClaims(rc.Jwt)
+			require.NoError(t, err)
+			if tt.wantExpiry == 0 {
+				assert.Zero(t, uc.Expires)
+				return
+			}
+			assert.GreaterOrEqual(t, uc.Expires, before.Add(tt.wantExpiry).Unix())
+			assert.LessOrEqual(t, uc.Expires, time.Now().Add(tt.wantExpiry).Unix())
+		})
+	}
+}
+
+func TestHandler_ResponseTimestamps(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{name: "without expiry", ttl: 0},
+		{name: "with expiry", ttl: 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithResponseTTL(tt.ttl),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = "alice"
+			arc.ConnectOptions.Password = "alice"
+
+			before := time.Now().Unix()
+			rc := authorize(t, handler, serverKP, arc)
+			after := time.Now().Unix()
+
+			require.Empty(t, rc.Error)
+			assert.GreaterOrEqual(t, rc.IssuedAt, before)
+			assert.LessOrEqual(t, rc.IssuedAt, after)
+			if tt.ttl == 0 {
+				assert.Zero(t, rc.Expires)
+				return
+			}
+			assert.GreaterOrEqual(t, rc.Expires, before+int64(tt.ttl.Seconds()))
+			assert.LessOrEqual(t, rc.Expires, after+int64(tt.ttl.Seconds()))
+		})
+	}
+}
+
+// countingFlusher is an in-memory structure holding a number of entries.
+type countingFlusher struct {
+	entries int
+}
+
+func (f *countingFlusher) Flush() int {
+	n := f.entries
+	f.entries = 0
+	return n
+}
+
+func TestHandler_Flush(t *testing.T) {
+	tokens := &countingFlusher{entries: 3}
+	lockouts := &countingFlusher{entries: 1}
+	handler := authresponse.NewHandler(&auth.KeyPairs{}, new(MockUserRepository),
+		authresponse.WithFlusher("token_cache", tokens),
+		authresponse.WithFlusher("lockouts", lockouts),
+	)
+	flush := handler.NewFlushHandler("admin-secret")
+
+	send := func(t *testing.T, data []byte) authresponse.FlushResponse {
+		t.Helper()
+		var resp authresponse.FlushResponse
+		req := &MockRequest{data: data}
+		req.On("RespondJSON", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			resp = args.Get(0).(authresponse.FlushResponse)
+		}).Return(nil)
+		flush.Handle(req)
+		return resp
+	}
+
+	t.Run("rejections", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			data      string
+			wantError string
+		}{
+			{name: "wrong admin token", data: `{"admin_token":"guess"}`, wantError: "unauthorized"},
+			{name: "missing admin token", data: `{}`, wantError: "unauthorized"},
+			{name: "malformed request", data: `not json`, wantError: "invalid flush request"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				resp := send(t, []byte(tt.data))
+				assert.Equal(t, tt.wantError, resp.Error)
+				assert.Empty(t, resp.Cleared)
+			})
+		}
+		assert.Equal(t, 3, tokens.entries)
+		assert.Equal(t, 1, lockouts.entries)
+	})
+
+	t.Run("clears every structure", func(t *testing.T) {
+		resp := send(t, []byte(`{"admin_token":"admin-secret"}`))
+		require.Empty(t, resp.Error)
+		assert.Equal(t, map[string]int{"token_cache": 3, "lockouts": 1}, resp.Cleared)
+		assert.Zero(t, tokens.entries)
+		assert.Zero(t, lockouts.entries)
+	})
+}
+
+func TestHandler_ServerXKey(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	curveKP, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+	curvePub, err := curveKP.PublicKey()
+	require.NoError(t, err)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	serverCurveKP, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+	serverXKey, err := serverCurveKP.PublicKey()
+	require.NoError(t, err)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Username = "alice"
+	arc.ConnectOptions.Password = "alice"
+	token, err := arc.Encode(serverKP)
+	require.NoError(t, err)
+	sealed, err := serverCurveKP.Seal([]byte(token), curvePub)
+	require.NoError(t, err)
+
+	send := func(t *testing.T, keyPairs *auth.KeyPairs, xkey string) (*recordingSink, []byte) {
+		t.Helper()
+		sink := &recordingSink{}
+		handler := authresponse.NewHandler(keyPairs, repo,
+			authresponse.WithDecisionRecorder(sink),
+		)
+		var response []byte
+		req := &MockRequest{data: sealed, headers: map[string][]string{"Nats-Server-Xkey": {xkey}}}
+		req.On("Respond", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			response = args.Get(0).([]byte)
+		}).Return(nil)
+		handler.HandleRequest(req)
+		return sink, response
+	}
+
+	t.Run("valid xkey", func(t *testing.T) {
+		sink, response := send(t, &auth.KeyPairs{Issuer: issuerKP, Curve: curveKP, HasXKey: true}, serverXKey)
+		require.Len(t, sink.decisions, 1)
+		assert.True(t, sink.decisions[0].Allowed())
+
+		opened, err := serverCurveKP.Open(response, curvePub)
+		require.NoError(t, err)
+		rc, err := jwt.DecodeAuthorizationResponseClaims(string(opened))
+		require.NoError(t, err)
+		assert.Empty(t, rc.Error)
+		assert.NotEmpty(t, rc.Jwt)
+	})
+
+	t.Run("malformed xkey", func(t *testing.T) {
+		sink, response := send(t, &auth.KeyPairs{Issuer: issuerKP, Curve: curveKP, HasXKey: true}, "XNOTACURVEKEY")
+		assert.Equal(t, "[ERR_BAD_REQUEST] invalid server xkey", string(response))
+		require.Len(t, sink.decisions, 1)
+		assert.Equal(t, "invalid server xkey", sink.decisions[0].Error)
+		assert.Equal(t, authresponse.ReasonBadRequest, sink.decisions[0].Reason)
+	})
+
+	t.Run("no curve key pair", func(t *testing.T) {
+		sink, response := send(t, &auth.KeyPairs{Issuer: issuerKP}, serverXKey)
+		assert.Equal(t, "[ERR_XKEY_UNSUPPORTED] xkey not supported", string(response))
+		require.Len(t, sink.decisions, 1)
+		assert.False(t, sink.decisions[0].Allowed())
+		assert.Equal(t, "xkey not supported", sink.decisions[0].Error)
+		assert.Equal(t, authresponse.ReasonXKeyUnsupported, sink.decisions[0].Reason)
+		assert.Equal(t, "ERR_XKEY_UNSUPPORTED", sink.decisions[0].Code)
+	})
+}
+
+func TestHandler_ErrorCategories(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+	repo.On("Get", "contractor").Return(&auth.User{Pass: "contractor", Account: "DEVELOPMENT", ExpiresAt: time.Now().Add(-time.Hour)}, true)
+	repo.On("Get", "mallory").Return((*auth.User)(nil), false)
+
+	tests := []struct {
+		name         string
+		username     string
+		password     string
+		wantCategory string
+		wantError    string
+	}{
+		{name: "unknown user", username: "mallory", password: "secret", wantCategory: authresponse.CategoryUnauthenticated, wantError: "unauthenticated: [ERR_USER_NOT_FOUND] user not found"},
+		{name: "wrong password", username: "alice", password: "wrong", wantCategory: authresponse.CategoryUnauthenticated, wantError: "unauthenticated: [ERR_BAD_CREDS] invalid credentials"},
+		{name: "expired user", username: "contractor", password: "contractor", wantCategory: authresponse.CategoryUnauthorized, wantError: "unauthorized: [ERR_ACCOUNT_EXPIRED] account expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithDecisionRecorder(sink),
+				authresponse.WithErrorCategories(true),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = tt.username
+			arc.ConnectOptions.Password = tt.password
+			rc := authorize(t, handler, serverKP, arc)
+
+			assert.Equal(t, tt.wantError, errorMessage(rc.Error))
+			require.Len(t, sink.decisions, 1)
+			assert.Equal(t, tt.wantCategory, sink.decisions[0].Category)
+		})
+	}
+
+	t.Run("garbled request", func(t *testing.T) {
+		sink := &recordingSink{}
+		handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+			authresponse.WithDecisionRecorder(sink),
+			authresponse.WithErrorCategories(true),
+		)
+		var response []byte
+		req := &MockRequest{data: []byte("not-a-jwt"), headers: map[string][]string{}}
+		req.On("Respond", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			response = args.Get(0).([]byte)
+		}).Return(nil)
+		handler.HandleRequest(req)
+
+		assert.True(t, strings.HasPrefix(string(response), "bad_request: "), "got %q", response)
+		require.Len(t, sink.decisions, 1)
+		assert.Equal(t, authresponse.CategoryBadRequest, sink.decisions[0].Category)
+	})
+
+	t.Run("every reason is categorized", func(t *testing.T) {
+		for reason := range authresponse.DefaultErrorCodes {
+			assert.NotEmpty(t, authresponse.CategoryOf(reason), reason)
+		}
+	})
+}
+
+func TestHandler_Renew(t *testing.T) {
+	const secret = "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	sink := &recordingSink{}
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, new(MockUserRepository),
+		authresponse.WithUserJWTTTL(15*time.Minute),
+		authresponse.WithDecisionRecorder(sink),
+	)
+	renew := handler.NewRenewHandler()
+
+	send := func(t *testing.T, rr authresponse.RenewRequest) authresponse.RenewResponse {
+		t.Helper()
+		data, err := json.Marshal(rr)
+		require.NoError(t, err)
+
+		var resp authresponse.RenewResponse
+		req := &MockRequest{data: data}
+		req.On("RespondJSON", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			resp = args.Get(0).(authresponse.RenewResponse)
+		}).Return(nil)
+		renew.Handle(req)
+		return resp
+	}
+	token := func(exp time.Time) string {
+		claims := &tokenvalidation.NatsTokenClaims{
+			UserID:      "bob",
+			Account:     "DEVELOPMENT",
+			Permissions: map[string]any{"sub": map[string]any{"allow": []any{"_INBOX.>"}}},
+		}
+		claims.ExpiresAt = gojwt.NewNumericDate(exp)
+		return signNatsToken(t, secret, claims)
+	}
+
+	t.Run("valid token", func(t *testing.T) {
+		sink.decisions = nil
+		before := time.Now()
+		resp := send(t, authresponse.RenewRequest{Token: token(time.Now().Add(time.Hour)), UserNkey: userPubKey})
+		require.Empty(t, resp.Error)
+
+		uc, err := jwt.DecodeUserClaims(resp.JWT)
+		require.NoError(t, err)
+		assert.Equal(t, userPubKey, uc.Subject)
+		assert.Equal(t, "bob", uc.Name)
+		assert.Equal(t, jwt.StringList{"_INBOX.>"}, uc.Sub.Allow)
+		assert.GreaterOrEqual(t, uc.Expires, before.Add(15*time.Minute).Unix())
+		require.Len(t, sink.decisions, 1)
+		assert.True(t, sink.decisions[0].Allowed())
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		sink.decisions = nil
+		resp := send(t, authresponse.RenewRequest{Token: token(time.Now().Add(-time.Minute)), UserNkey: userPubKey})
+		assert.Contains(t, resp.Error, "token is expired")
+		assert.Empty(t, resp.JWT)
+		require.Len(t, sink.decisions, 1)
+		assert.Equal(t, authresponse.ReasonTokenExpired, sink.decisions[0].Reason)
+	})
+
+	t.Run("malformed requests", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			rr        authresponse.RenewRequest
+			wantError string
+		}{
+			{name: "missing token", rr: authresponse.RenewRequest{UserNkey: userPubKey}, wantError: "token required"},
+			{name: "invalid user nkey", rr: authresponse.RenewRequest{Token: token(time.Now().Add(time.Hour)), UserNkey: "UNOTAKEY"}, wantError: "invalid user nkey"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				assert.Equal(t, tt.wantError, send(t, tt.rr).Error)
+			})
+		}
+	})
+}
+
+func TestHandler_EchoHeaders(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Return(&auth.User{Pass: "alice", Account: "DEVELOPMENT"}, true)
+	handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+		authresponse.WithEchoHeaders([]string{"Nats-Correlation-Id", "Traceparent"}),
+	)
+
+	arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+	arc.UserNkey = userPubKey
+	arc.ConnectOptions.Username = "alice"
+	arc.ConnectOptions.Password = "alice"
+	token, err := arc.Encode(serverKP)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		want    nats.Header
+	}{
+		{
+			name:    "correlation ID is echoed",
+			headers: map[string][]string{"Nats-Correlation-Id": {"req-42"}, "Other": {"x"}},
+			want:    nats.Header{"Nats-Correlation-Id": {"req-42"}},
+		},
+		{name: "no headers to echo", headers: map[string][]string{"Other": {"x"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &nats.Msg{}
+			req := &MockRequest{data: []byte(token), headers: tt.headers}
+			req.On("Respond", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				for _, opt := range args.Get(1).([]micro.RespondOpt) {
+					opt(msg)
+				}
+			}).Return(nil)
+
+			handler.HandleRequest(req)
+
+			req.AssertCalled(t, "Respond", mock.Anything, mock.Anything)
+			assert.Equal(t, tt.want, msg.Header)
+		})
+	}
+}
+
+func TestHandler_SlowRequestLogging(t *testing.T) {
+	issuerKP := createTestKeyPair(t, nkeys.PrefixByteAccount)
+	serverKP := createTestKeyPair(t, nkeys.PrefixByteServer)
+	userKP := createTestKeyPair(t, nkeys.PrefixByteUser)
+	userPubKey, err := userKP.PublicKey()
+	require.NoError(t, err)
+
+	const backendDelay = 50 * time.Millisecond
+	repo := new(MockUserRepository)
+	repo.On("Get", "alice").Run(func(mock.Arguments) {
+		time.Sleep(backendDelay)
+	}).Return(&auth.User{
+		Pass:        "alice",
+		Account:     "DEVELOPMENT",
+		Permissions: jwt.Permissions{Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+	}, true)
+
+	slowRequests := func(hook *logtest.Hook) []*logrus.Entry {
+		var found []*logrus.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Slow authorization request" {
+				found = append(found, entry)
+			}
+		}
+		return found
+	}
+
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		wantSlow  bool
+	}{
+		{name: "slow backend exceeds threshold", threshold: 20 * time.Millisecond, wantSlow: true},
+		{name: "below threshold", threshold: time.Hour},
+		{name: "disabled", threshold: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+			handler := authresponse.NewHandler(&auth.KeyPairs{Issuer: issuerKP}, repo,
+				authresponse.WithSlowRequestThreshold(tt.threshold),
+			)
+
+			arc := jwt.NewAuthorizationRequestClaims(userPubKey)
+			arc.UserNkey = userPubKey
+			arc.ConnectOptions.Username = "alice"
+			arc.ConnectOptions.Password = "alice"
+			rc := authorize(t, handler, serverKP, arc)
+			require.Empty(t, rc.Error)
+
+			entries := slowRequests(hook)
+			if !tt.wantSlow {
+				assert.Empty(t, entries)
+				return
+			}
+			require.Len(t, entries, 1)
+			entry := entries[0]
+			assert.Equal(t, logrus.WarnLevel, entry.Level)
+			assert.Equal(t, "alice", entry.Data["username"])
+			assert.Equal(t, "DEVELOPMENT", entry.Data["account"])
+			assert.GreaterOrEqual(t, entry.Data["lookup_ms"], milliseconds(backendDelay))
+			assert.GreaterOrEqual(t, entry.Data["total_ms"], entry.Data["lookup_ms"])
+			assert.Contains(t, entry.Data, "decode_ms")
+			assert.Contains(t, entry.Data, "sign_ms")
+		})
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
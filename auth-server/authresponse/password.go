@@ -0,0 +1,71 @@
+package authresponse
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordUpdater is implemented by writable user repositories that can persist
+// a new password hash. Read-only repositories simply do not implement it.
+type PasswordUpdater interface {
+	UpdatePassword(username, hash string) error
+}
+
+// WithRehashCost enables rehashing bcrypt passwords stored below cost on a
+// successful login. It only takes effect for repositories implementing
+// PasswordUpdater; zero disables rehashing.
+func WithRehashCost(cost int) Option {
+	return func(h *Handler) {
+		h.rehashCost = cost
+	}
+}
+
+// isBcryptHash reports whether the stored password is a bcrypt hash.
+func isBcryptHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword compares the given password with the stored one, which is either
+// a bcrypt hash or a plaintext password.
+func checkPassword(stored, given string) bool {
+	if isBcryptHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(given)) == nil
+	}
+	return stored == given
+}
+
+// rehashPassword upgrades a bcrypt hash stored below the configured cost. It must
+// only be called after the password was verified. Failures are logged and never
+// affect the login.
+func (h *Handler) rehashPassword(username, stored, password string) {
+	if h.rehashCost == 0 || !isBcryptHash(stored) {
+		return
+	}
+	updater, ok := h.userRepo.(PasswordUpdater)
+	if !ok {
+		return
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil || cost >= h.rehashCost {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.rehashCost)
+	if err != nil {
+		logrus.WithError(err).WithField("username", username).Error("Failed to rehash password")
+		return
+	}
+	if err := updater.UpdatePassword(username, string(hash)); err != nil {
+		logrus.WithError(err).WithField("username", username).Error("Failed to store rehashed password")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"username": username,
+		"from":     cost,
+		"to":       h.rehashCost,
+	}).Info("Rehashed password")
+}
@@ -0,0 +1,99 @@
+package authresponse
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// permissionKey identifies the merge of a template into one user's inline
+// permissions.
+type permissionKey struct {
+	template string
+	username string
+}
+
+// permissionEntry is a cached merge and the inline permissions it was merged
+// from, so a user whose permissions changed on reload is merged again.
+type permissionEntry struct {
+	key    permissionKey
+	inline jwt.Permissions
+	merged jwt.Permissions
+}
+
+// permissionCache is a fixed-size LRU of template merges, sparing the merge
+// on every request of users that add inline permissions to a template. The
+// cached permissions are shared between requests and must not be modified.
+// A permissionCache is safe for concurrent use.
+type permissionCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Front is the most recently used entry
+	entries map[permissionKey]*list.Element
+}
+
+// newPermissionCache returns a cache holding up to size merges, at least one.
+func newPermissionCache(size int) *permissionCache {
+	return &permissionCache{
+		size:    max(size, 1),
+		order:   list.New(),
+		entries: make(map[permissionKey]*list.Element),
+	}
+}
+
+// get returns the cached merge for key if it was merged from inline.
+func (c *permissionCache) get(key permissionKey, inline jwt.Permissions) (jwt.Permissions, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return jwt.Permissions{}, false
+	}
+	e := el.Value.(*permissionEntry)
+	if !samePermissions(e.inline, inline) {
+		return jwt.Permissions{}, false
+	}
+	c.order.MoveToFront(el)
+	return e.merged, true
+}
+
+// add caches the merge of inline for key, evicting the least recently used
+// merge when the cache is full.
+func (c *permissionCache) add(key permissionKey, inline, merged jwt.Permissions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &permissionEntry{key: key, inline: inline, merged: merged}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*permissionEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+}
+
+// len returns the number of cached merges.
+func (c *permissionCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// samePermissions reports whether a and b grant and deny the same subjects in
+// the same order with the same response permission.
+func samePermissions(a, b jwt.Permissions) bool {
+	if !slices.Equal(a.Pub.Allow, b.Pub.Allow) || !slices.Equal(a.Pub.Deny, b.Pub.Deny) ||
+		!slices.Equal(a.Sub.Allow, b.Sub.Allow) || !slices.Equal(a.Sub.Deny, b.Sub.Deny) {
+		return false
+	}
+	if a.Resp == nil || b.Resp == nil {
+		return a.Resp == b.Resp
+	}
+	return *a.Resp == *b.Resp
+}
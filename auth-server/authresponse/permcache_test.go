@@ -0,0 +1,114 @@
+package authresponse
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// readerTemplates returns a template shared by many users and an inline
+// addition of one of them.
+func readerTemplates() (map[string]jwt.Permissions, jwt.Permissions) {
+	templates := map[string]jwt.Permissions{
+		"reader": {
+			Pub: jwt.Permission{Allow: []string{"$JS.API.INFO"}, Deny: []string{"orders.internal"}},
+			Sub: jwt.Permission{Allow: []string{"_INBOX.>", "orders.>"}},
+		},
+	}
+	inline := jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.created"}}}
+	return templates, inline
+}
+
+func TestPermissionCache(t *testing.T) {
+	key := permissionKey{template: "reader", username: "alice"}
+	inline := jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.created"}}}
+	merged := jwt.Permissions{Pub: jwt.Permission{Allow: []string{"$JS.API.INFO", "orders.created"}}}
+
+	cache := newPermissionCache(2)
+	if _, ok := cache.get(key, inline); ok {
+		t.Fatal("get() hit on an empty cache")
+	}
+	cache.add(key, inline, merged)
+	if got, ok := cache.get(key, inline); !ok || !samePermissions(got, merged) {
+		t.Errorf("get() = %v, %v, want the cached merge", got, ok)
+	}
+
+	// A user whose inline permissions changed on reload is merged again
+	changed := jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.updated"}}}
+	if _, ok := cache.get(key, changed); ok {
+		t.Error("get() hit for changed inline permissions, want miss")
+	}
+	resp := inline
+	resp.Resp = &jwt.ResponsePermission{MaxMsgs: 1}
+	if _, ok := cache.get(key, resp); ok {
+		t.Error("get() hit for an added response permission, want miss")
+	}
+
+	// The least recently used merge is evicted at the size limit
+	cache.add(permissionKey{template: "reader", username: "bob"}, inline, merged)
+	cache.get(key, inline)
+	cache.add(permissionKey{template: "reader", username: "carol"}, inline, merged)
+	if got := cache.len(); got != 2 {
+		t.Errorf("len() = %d, want 2", got)
+	}
+	if _, ok := cache.get(permissionKey{template: "reader", username: "bob"}, inline); ok {
+		t.Error("get() hit for the least recently used merge, want it evicted")
+	}
+	if _, ok := cache.get(key, inline); !ok {
+		t.Error("get() missed the recently used merge")
+	}
+}
+
+func TestApplyTemplate_Allocations(t *testing.T) {
+	templates, inline := readerTemplates()
+	tests := []struct {
+		name   string
+		opts   []Option
+		inline jwt.Permissions
+		want   float64
+	}{
+		{
+			name: "template only is shared",
+			opts: []Option{WithPermissionTemplates(templates, TemplateMerge)},
+			want: 0,
+		},
+		{
+			name:   "cached merge is shared",
+			opts:   []Option{WithPermissionTemplates(templates, TemplateMerge), WithPermissionCacheSize(16)},
+			inline: inline,
+			want:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(nil, nil, tt.opts...)
+			template := h.templates["reader"]
+			want := h.applyTemplate("reader", "alice", template, tt.inline)
+			allocs := testing.AllocsPerRun(100, func() {
+				if got := h.applyTemplate("reader", "alice", template, tt.inline); !samePermissions(got, want) {
+					t.Fatalf("applyTemplate() = %v, want %v", got, want)
+				}
+			})
+			if allocs > tt.want {
+				t.Errorf("applyTemplate() allocates %v times per request, want %v", allocs, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkApplyTemplate compares merging a template per request with a
+// permission cache hit
+func BenchmarkApplyTemplate(b *testing.B) {
+	templates, inline := readerTemplates()
+	for _, size := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("cache size %d", size), func(b *testing.B) {
+			h := NewHandler(nil, nil, WithPermissionTemplates(templates, TemplateMerge), WithPermissionCacheSize(size))
+			template := h.templates["reader"]
+			b.ReportAllocs()
+			for b.Loop() {
+				h.applyTemplate("reader", "alice", template, inline)
+			}
+		})
+	}
+}
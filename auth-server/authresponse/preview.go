@@ -0,0 +1,112 @@
+package authresponse
+
+import (
+	"encoding/json"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/policy"
+
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// PreviewRequest asks for the user JWT that would be issued right now for a
+// username or a nats_token. UserNkey is optional; a throwaway user key is used
+// as the JWT subject when it is empty. ConnectionType (e.g. "WEBSOCKET") selects
+// the connection type ceiling; when empty, every ceiling applies.
+type PreviewRequest struct {
+	AdminToken     string `json:"admin_token"`
+	Username       string `json:"username,omitempty"`
+	Token          string `json:"token,omitempty"`
+	UserNkey       string `json:"user_nkey,omitempty"`
+	ConnectionType string `json:"connection_type,omitempty"`
+}
+
+// PreviewResponse carries the encoded user JWT or the reason it would not be issued.
+type PreviewResponse struct {
+	JWT   string `json:"jwt,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewPreviewHandler returns a micro handler answering PreviewRequest messages.
+// Requests must carry adminToken; the handler refuses every request when
+// adminToken is empty. Passwords are not checked, so the endpoint must only be
+// reachable by administrators.
+func (h *Handler) NewPreviewHandler(adminToken string) micro.HandlerFunc {
+	return func(req micro.Request) {
+		resp := h.preview(req.Data(), adminToken)
+		if err := req.RespondJSON(resp); err != nil {
+			logrus.WithError(err).Error("Failed to send preview response")
+		}
+	}
+}
+
+// preview resolves the user and encodes the user JWT without a client
+// connection. Usernames are looked up like a login, alternate keys and expiry
+// included, but without the password check.
+func (h *Handler) preview(data []byte, adminToken string) PreviewResponse {
+	var pr PreviewRequest
+	if err := json.Unmarshal(data, &pr); err != nil {
+		return PreviewResponse{Error: "invalid preview request"}
+	}
+	if !adminAuthorized(pr.AdminToken, adminToken) {
+		logrus.Warn("Rejected user JWT preview with invalid admin credential")
+		return PreviewResponse{Error: "unauthorized"}
+	}
+
+	var user *auth.User
+	username := pr.Username
+	switch {
+	case pr.Token != "":
+		if !h.tokenAuth {
+			return PreviewResponse{Error: "token authentication disabled"}
+		}
+		var userID string
+		var err error
+		user, userID, err = h.tokenUser(pr.Token)
+		if err != nil {
+			return PreviewResponse{Error: err.Error()}
+		}
+		username = userID
+	case pr.Username != "":
+		username = h.canonicalUsername(pr.Username)
+		var err error
+		if user, err = h.lookupUser(username); err != nil {
+			return PreviewResponse{Error: err.Error()}
+		}
+		if err := checkExpiry(username, user); err != nil {
+			return PreviewResponse{Error: err.Error()}
+		}
+	default:
+		return PreviewResponse{Error: "username or token required"}
+	}
+	if err := checkUserRecord(user); err != nil {
+		return PreviewResponse{Error: err.Error()}
+	}
+
+	userNkey := pr.UserNkey
+	if userNkey == "" {
+		kp, err := nkeys.CreateUser()
+		if err != nil {
+			return PreviewResponse{Error: "creating preview user key"}
+		}
+		if userNkey, err = kp.PublicKey(); err != nil {
+			return PreviewResponse{Error: "creating preview user key"}
+		}
+	}
+
+	method := auth.MethodPassword
+	if pr.Token != "" {
+		method = auth.MethodToken
+	}
+	user, err := h.policyUser(user, username, method, policy.Client{Type: pr.ConnectionType})
+	if err != nil {
+		return PreviewResponse{Error: err.Error()}
+	}
+	userJWT, err := h.generateUserJWT(userNkey, username, pr.ConnectionType, user)
+	if err != nil {
+		return PreviewResponse{Error: "generating user JWT: " + err.Error()}
+	}
+	logrus.WithField("username", username).Info("Previewed user JWT")
+	return PreviewResponse{JWT: userJWT}
+}
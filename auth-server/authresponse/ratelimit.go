@@ -0,0 +1,98 @@
+package authresponse
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxRateBuckets bounds the buckets kept, so a stream of made-up usernames
+// cannot grow the limiter without bound.
+const maxRateBuckets = 10000
+
+// WithRateLimit limits username/password authorization requests to rps per
+// username with bursts of up to burst requests, so brute-force attempts are
+// rejected before the user repository is consulted. With perClient the limit
+// applies to each username and client host pair instead. A zero rps disables
+// the limit. The limiter is registered with the flush admin endpoint as
+// "rate_limit".
+func WithRateLimit(rps float64, burst int, perClient bool) Option {
+	return func(h *Handler) {
+		if rps <= 0 {
+			return
+		}
+		h.rateLimit = newRateLimiter(rps, burst)
+		h.ratePerHost = perClient
+		WithFlusher("rate_limit", h.rateLimit)(h)
+	}
+}
+
+// rateLimiter is a set of token buckets keyed by an arbitrary string. Once
+// size buckets are held, the least recently used bucket is evicted for a new
+// key; it is the one most likely to have refilled anyway.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // Tokens added per second
+	burst   float64 // Capacity of each bucket
+	size    int
+	order   *list.List // Front is the most recently used bucket
+	buckets map[string]*list.Element
+	now     func() time.Time
+}
+
+// rateBucket holds the tokens left in the bucket of key as of last.
+type rateBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rps,
+		burst:   float64(max(burst, 1)),
+		size:    maxRateBuckets,
+		order:   list.New(),
+		buckets: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from the bucket of key, reporting false when it is empty.
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var b *rateBucket
+	if el, ok := l.buckets[key]; ok {
+		l.order.MoveToFront(el)
+		b = el.Value.(*rateBucket)
+	} else {
+		if l.order.Len() >= l.size {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*rateBucket).key)
+		}
+		b = &rateBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.order.PushFront(b)
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Flush drops every bucket, lifting the limit for all keys, and returns the
+// number of buckets dropped.
+func (l *rateLimiter) Flush() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.order.Len()
+	l.order.Init()
+	clear(l.buckets)
+	return n
+}
@@ -0,0 +1,42 @@
+package authresponse
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_BoundedBuckets(t *testing.T) {
+	l := newRateLimiter(0.001, 1)
+	l.size = 100
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	if !l.allow("alice") {
+		t.Fatal("allow(alice) = false on a new bucket")
+	}
+	for i := range 10 * l.size {
+		// Keep alice's bucket in use while made-up usernames flood the limiter
+		if i%10 == 0 && l.allow("alice") {
+			t.Fatal("allow(alice) = true, want her empty bucket kept")
+		}
+		l.allow(fmt.Sprintf("user-%d", i))
+		if got := len(l.buckets); got > l.size {
+			t.Fatalf("len(buckets) = %d after %d keys, want at most %d", got, i+1, l.size)
+		}
+	}
+	if got := l.order.Len(); got != l.size {
+		t.Errorf("order.Len() = %d, want %d", got, l.size)
+	}
+
+	// The least recently used bucket was evicted and starts full again
+	if !l.allow("user-0") {
+		t.Error("allow(user-0) = false, want its bucket evicted")
+	}
+	if got := l.Flush(); got != l.size {
+		t.Errorf("Flush() = %d, want %d", got, l.size)
+	}
+	if len(l.buckets) != 0 || l.order.Len() != 0 {
+		t.Errorf("Flush() left %d buckets, %d ordered", len(l.buckets), l.order.Len())
+	}
+}
@@ -0,0 +1,122 @@
+package authresponse
+
+import (
+	"encoding/json"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/policy"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// WithUserJWTTTL limits the lifetime of issued user JWTs, so long-lived
+// connections renew them through the renewal endpoint. Zero issues JWTs
+// without an expiry.
+func WithUserJWTTTL(ttl time.Duration) Option {
+	return func(h *Handler) {
+		h.userJWTTTL = ttl
+	}
+}
+
+// Modes for user JWTs left without an expiry, see WithRequiredJWTExpiry.
+const (
+	JWTExpiryOff     = "off"     // Issue user JWTs without an expiry
+	JWTExpiryReject  = "reject"  // Reject the user
+	JWTExpiryDefault = "default" // Apply the default lifetime
+)
+
+// WithRequiredJWTExpiry guards against issuing user JWTs that never expire,
+// once every other option had its say. Depending on mode such users are
+// rejected or their JWT expires defaultTTL after issuance.
+func WithRequiredJWTExpiry(mode string, defaultTTL time.Duration) Option {
+	return func(h *Handler) {
+		h.jwtExpiry = mode
+		h.defaultJWTTTL = defaultTTL
+	}
+}
+
+// RenewRequest asks for a fresh user JWT for an established connection. The
+// nats_token the client connected with is validated again.
+type RenewRequest struct {
+	Token    string `json:"token"`
+	UserNkey string `json:"user_nkey"`
+}
+
+// RenewResponse carries the renewed user JWT or the reason it was refused.
+type RenewResponse struct {
+	JWT   string `json:"jwt,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewRenewHandler returns a micro handler answering RenewRequest messages with a
+// user JWT carrying a fresh expiry, provided the token is still valid.
+func (h *Handler) NewRenewHandler() micro.HandlerFunc {
+	return func(req micro.Request) {
+		resp := h.renew(req.Data())
+		if err := req.RespondJSON(resp); err != nil {
+			logrus.WithError(err).Error("Failed to send renewal response")
+		}
+	}
+}
+
+// renew validates the token again and issues a new user JWT for the nkey.
+func (h *Handler) renew(data []byte) RenewResponse {
+	var rr RenewRequest
+	if err := json.Unmarshal(data, &rr); err != nil {
+		return RenewResponse{Error: "invalid renewal request"}
+	}
+	if rr.Token == "" {
+		return RenewResponse{Error: "token required"}
+	}
+	if !h.tokenAuth {
+		return RenewResponse{Error: "token authentication disabled"}
+	}
+	if !nkeys.IsValidPublicUserKey(rr.UserNkey) {
+		return RenewResponse{Error: "invalid user nkey"}
+	}
+
+	decision := auth.Decision{Method: auth.MethodToken, UserNkey: rr.UserNkey, TokenHash: tokenvalidation.Fingerprint(rr.Token)}
+	rc := jwt.NewAuthorizationRequestClaims(rr.UserNkey)
+	rc.UserNkey = rr.UserNkey
+	rc.ConnectOptions.Token = rr.Token
+
+	user, userID, err := h.validateUser(rc)
+	if err == nil {
+		err = checkUserRecord(user)
+	}
+	if err != nil {
+		return h.refuseRenewal(decision, err)
+	}
+	decision.Username = userID
+	decision.Account = user.Account
+	decision.KeyLabel = user.KeyLabel
+
+	user, err = h.policyUser(user, userID, auth.MethodToken, policy.Client{})
+	if err != nil {
+		return h.refuseRenewal(decision, err)
+	}
+	userJWT, err := h.generateUserJWT(rr.UserNkey, userID, "", user)
+	if err != nil {
+		if reasonOf(err) == "" {
+			err = rejection(ReasonJWTError, "generating user JWT: %v", err)
+		}
+		return h.refuseRenewal(decision, err)
+	}
+	h.record(decision)
+	logrus.WithField("user_id", userID).Info("Renewed user JWT")
+	return RenewResponse{JWT: userJWT}
+}
+
+// refuseRenewal records the refused renewal and builds its response.
+func (h *Handler) refuseRenewal(d auth.Decision, err error) RenewResponse {
+	d.Error = err.Error()
+	d.Reason = reasonOf(err)
+	d.Category = CategoryOf(d.Reason)
+	d.Code = h.codeOf(d.Reason)
+	h.record(d)
+	return RenewResponse{Error: d.Error}
+}
@@ -0,0 +1,72 @@
+package authresponse
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/usersdebug"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/usershttp"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/userssql"
+
+	"github.com/sirupsen/logrus"
+)
+
+// User repository types selected with RepoConfig.Type, matching auth.backend.
+const (
+	RepoYAML = "yaml" // Users files, or the insecure embedded users without any
+	RepoSQL  = "sql"  // SQL database
+	RepoHTTP = "http" // HTTP users service
+)
+
+// RepoConfig selects a user repository by Type and configures it. Only the
+// settings of the selected type are used.
+type RepoConfig struct {
+	Type string
+
+	// Files are the users files merged in order, resolving repeated usernames
+	// by Duplicates; none loads the insecure embedded users
+	Files      []string
+	Duplicates usersdebug.DuplicatePolicy
+
+	// DB is the users database, owned by the caller, and Query looks a user up
+	DB    *sql.DB
+	Query string
+
+	// HTTP configures the users service client
+	HTTP usershttp.Config
+}
+
+// NewRepository creates the user repository selected by cfg.Type. A new
+// backend is added here with its own case.
+func NewRepository(cfg RepoConfig) (UserRepository, error) {
+	switch cfg.Type {
+	case RepoYAML:
+		var repo *usersdebug.Repository
+		var err error
+		if len(cfg.Files) == 0 {
+			logrus.Warn("!!! auth.users_file is not configured: using INSECURE embedded default users, do not run this in production !!!")
+			repo, err = usersdebug.NewDefault()
+		} else {
+			logrus.WithField("files", cfg.Files).Info("Loading users")
+			repo, err = usersdebug.NewFromFiles(cfg.Files, cfg.Duplicates)
+		}
+		// Never wrap a nil *usersdebug.Repository in a non-nil interface
+		if err != nil {
+			return nil, err
+		}
+		return repo, nil
+	case RepoSQL:
+		if cfg.DB == nil {
+			return nil, errors.New("sql user repository needs a database")
+		}
+		logrus.Info("Loading users from the database")
+		return userssql.New(cfg.DB, cfg.Query), nil
+	case RepoHTTP:
+		if cfg.HTTP.URL == "" {
+			return nil, errors.New("http user repository needs a URL")
+		}
+		logrus.WithField("url", cfg.HTTP.URL).Info("Looking users up in the users service")
+		return usershttp.New(cfg.HTTP), nil
+	}
+	return nil, fmt.Errorf("unknown user repository type %q", cfg.Type)
+}
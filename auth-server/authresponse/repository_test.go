@@ -0,0 +1,101 @@
+package authresponse_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path/filepath"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/authresponse"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/usersdebug"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/usershttp"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/userssql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubDriver lets sql.Open succeed without a database; it never connects.
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) { return nil, errors.New("not connected") }
+
+func init() {
+	sql.Register("authresponse-stub", stubDriver{})
+}
+
+func TestNewRepository(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.yaml")
+	require.NoError(t, os.WriteFile(usersFile, []byte("alice:\n  Pass: alice\n  Account: DEVELOPMENT\n"), 0o600))
+	db, err := sql.Open("authresponse-stub", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	tests := []struct {
+		name     string
+		cfg      authresponse.RepoConfig
+		wantType any
+		wantErr  string
+	}{
+		{
+			name:     "yaml users files",
+			cfg:      authresponse.RepoConfig{Type: authresponse.RepoYAML, Files: []string{usersFile}, Duplicates: usersdebug.ErrorOnDuplicate},
+			wantType: &usersdebug.Repository{},
+		},
+		{
+			name:     "yaml embedded users",
+			cfg:      authresponse.RepoConfig{Type: authresponse.RepoYAML},
+			wantType: &usersdebug.Repository{},
+		},
+		{
+			name:    "yaml missing file",
+			cfg:     authresponse.RepoConfig{Type: authresponse.RepoYAML, Files: []string{filepath.Join(t.TempDir(), "missing.yaml")}, Duplicates: usersdebug.ErrorOnDuplicate},
+			wantErr: "missing.yaml",
+		},
+		{
+			name:     "sql",
+			cfg:      authresponse.RepoConfig{Type: authresponse.RepoSQL, DB: db, Query: userssql.DefaultQuery},
+			wantType: &userssql.Repository{},
+		},
+		{
+			name:    "sql without database",
+			cfg:     authresponse.RepoConfig{Type: authresponse.RepoSQL},
+			wantErr: "sql user repository needs a database",
+		},
+		{
+			name:     "http",
+			cfg:      authresponse.RepoConfig{Type: authresponse.RepoHTTP, HTTP: usershttp.Config{URL: "http://users.internal/lookup"}},
+			wantType: &usershttp.Repository{},
+		},
+		{
+			name:    "http without URL",
+			cfg:     authresponse.RepoConfig{Type: authresponse.RepoHTTP},
+			wantErr: "http user repository needs a URL",
+		},
+		{
+			name:    "unknown type",
+			cfg:     authresponse.RepoConfig{Type: "ldap"},
+			wantErr: `unknown user repository type "ldap"`,
+		},
+		{
+			name:    "empty type",
+			cfg:     authresponse.RepoConfig{},
+			wantErr: `unknown user repository type ""`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := authresponse.NewRepository(tt.cfg)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				assert.True(t, repo == nil, "repository must be a nil interface on error")
+				return
+			}
+			require.NoError(t, err)
+			assert.IsType(t, tt.wantType, repo)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Package cloudevents publishes authorization decisions as CloudEvents in the
+// structured JSON format (CloudEvents spec v1.0) to a NATS subject. It lets the
+// auth server feed existing event buses without exposing credentials: only the
+// username, account, server and rejection reason are included in the payload.
+package cloudevents
+
+import (
+	"encoding/json"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"time"
+
+	"github.com/nats-io/nuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SpecVersion is the CloudEvents specification version emitted.
+	SpecVersion = "1.0"
+	// TypeSuccess is the event type for granted authorization requests.
+	TypeSuccess = "auth.success"
+	// TypeFailure is the event type for rejected authorization requests.
+	TypeFailure = "auth.failure"
+	// DefaultSource is the event source used when none is configured.
+	DefaultSource = "/nats-auth-callout-server"
+)
+
+// Event is a CloudEvent in structured JSON mode.
+type Event struct {
+	SpecVersion     string       `json:"specversion"`
+	ID              string       `json:"id"`
+	Source          string       `json:"source"`
+	Type            string       `json:"type"`
+	Subject         string       `json:"subject,omitempty"`
+	Time            time.Time    `json:"time"`
+	DataContentType string       `json:"datacontenttype"`
+	Data            DecisionData `json:"data"`
+}
+
+// DecisionData is the event payload describing an authorization decision.
+type DecisionData struct {
+	Method        string `json:"method,omitempty"`
+	Account       string `json:"account,omitempty"`
+	ServerID      string `json:"server_id,omitempty"`
+	ServerName    string `json:"server_name,omitempty"`
+	ServerCluster string `json:"server_cluster,omitempty"`
+	UserNkey      string `json:"user_nkey,omitempty"`
+	KeyLabel      string `json:"key_label,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+	Code          string `json:"code,omitempty"`
+	Category      string `json:"category,omitempty"`
+}
+
+// Publisher sends raw messages to a NATS subject. *nats.Conn satisfies it.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Sink publishes a CloudEvent for every recorded decision.
+type Sink struct {
+	pub     Publisher
+	subject string
+	source  string
+	now     func() time.Time
+}
+
+// NewSink creates a Sink publishing to subject. An empty source falls back to
+// DefaultSource.
+func NewSink(pub Publisher, subject, source string) *Sink {
+	if source == "" {
+		source = DefaultSource
+	}
+	return &Sink{
+		pub:     pub,
+		subject: subject,
+		source:  source,
+		now:     time.Now,
+	}
+}
+
+// NewEvent builds the CloudEvent describing the decision.
+func (s *Sink) NewEvent(d auth.Decision) Event {
+	eventType := TypeSuccess
+	if !d.Allowed() {
+		eventType = TypeFailure
+	}
+	return Event{
+		SpecVersion:     SpecVersion,
+		ID:              nuid.Next(),
+		Source:          s.source,
+		Type:            eventType,
+		Subject:         d.Username,
+		Time:            s.now().UTC(),
+		DataContentType: "application/json",
+		Data: DecisionData{
+			Method:        d.Method,
+			Account:       d.Account,
+			ServerID:      d.ServerID,
+			ServerName:    d.ServerName,
+			ServerCluster: d.ServerCluster,
+			UserNkey:      d.UserNkey,
+			KeyLabel:      d.KeyLabel,
+			Reason:        d.Reason,
+			Code:          d.Code,
+			Category:      d.Category,
+		},
+	}
+}
+
+// Record publishes the decision as a CloudEvent. Publishing errors are logged
+// and never affect the authorization response.
+func (s *Sink) Record(d auth.Decision) {
+	data, err := json.Marshal(s.NewEvent(d))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode CloudEvent")
+		return
+	}
+	if err := s.pub.Publish(s.subject, data); err != nil {
+		logrus.WithError(err).WithField("subject", s.subject).Error("Failed to publish CloudEvent")
+	}
+}
@@ -0,0 +1,123 @@
+package cloudevents
+
+import (
+	"encoding/json"
+	"errors"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePublisher captures published messages.
+type fakePublisher struct {
+	subjects []string
+	messages [][]byte
+	err      error
+}
+
+func (p *fakePublisher) Publish(subject string, data []byte) error {
+	p.subjects = append(p.subjects, subject)
+	p.messages = append(p.messages, data)
+	return p.err
+}
+
+func TestSink_Record(t *testing.T) {
+	fixed := time.Date(2025, 5, 2, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		decision auth.Decision
+		wantType string
+		wantData DecisionData
+	}{
+		{
+			name: "success",
+			decision: auth.Decision{
+				Username:      "alice",
+				Method:        auth.MethodPassword,
+				Account:       "DEVELOPMENT",
+				ServerID:      "NSERVER",
+				ServerName:    "nats-1",
+				ServerCluster: "east",
+				UserNkey:      "UUSER",
+			},
+			wantType: TypeSuccess,
+			wantData: DecisionData{
+				Method:        auth.MethodPassword,
+				Account:       "DEVELOPMENT",
+				ServerID:      "NSERVER",
+				ServerName:    "nats-1",
+				ServerCluster: "east",
+				UserNkey:      "UUSER",
+			},
+		},
+		{
+			name: "token login",
+			decision: auth.Decision{
+				Username: "svc",
+				Method:   auth.MethodToken,
+				KeyLabel: "2025-key",
+			},
+			wantType: TypeSuccess,
+			wantData: DecisionData{Method: auth.MethodToken, KeyLabel: "2025-key"},
+		},
+		{
+			name: "failure",
+			decision: auth.Decision{
+				Username: "bob",
+				ServerID: "NSERVER",
+				Error:    "invalid credentials",
+				Reason:   "invalid_credentials",
+				Code:     "ERR_BAD_CREDS",
+				Category: "unauthenticated",
+			},
+			wantType: TypeFailure,
+			wantData: DecisionData{ServerID: "NSERVER", Reason: "invalid_credentials", Code: "ERR_BAD_CREDS", Category: "unauthenticated"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub := &fakePublisher{}
+			sink := NewSink(pub, "auth.events", "")
+			sink.now = func() time.Time { return fixed }
+
+			sink.Record(tt.decision)
+
+			require.Len(t, pub.messages, 1)
+			assert.Equal(t, "auth.events", pub.subjects[0])
+
+			var raw map[string]any
+			require.NoError(t, json.Unmarshal(pub.messages[0], &raw))
+			for _, attr := range []string{"specversion", "id", "source", "type", "time", "datacontenttype", "data"} {
+				assert.Contains(t, raw, attr)
+			}
+
+			var event Event
+			require.NoError(t, json.Unmarshal(pub.messages[0], &event))
+			assert.Equal(t, SpecVersion, event.SpecVersion)
+			assert.NotEmpty(t, event.ID)
+			assert.Equal(t, DefaultSource, event.Source)
+			assert.Equal(t, tt.wantType, event.Type)
+			assert.Equal(t, tt.decision.Username, event.Subject)
+			assert.True(t, fixed.Equal(event.Time))
+			assert.Equal(t, "application/json", event.DataContentType)
+			assert.Equal(t, tt.wantData, event.Data)
+		})
+	}
+}
+
+func TestSink_RecordPublishError(t *testing.T) {
+	pub := &fakePublisher{err: errors.New("connection closed")}
+	sink := NewSink(pub, "auth.events", "/custom")
+
+	assert.NotPanics(t, func() { sink.Record(auth.Decision{Username: "alice"}) })
+	require.Len(t, pub.messages, 1)
+
+	var event Event
+	require.NoError(t, json.Unmarshal(pub.messages[0], &event))
+	assert.Equal(t, "/custom", event.Source)
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/permissions"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// AccountPermissions are the default permissions granted to every user of an
+// account. Inherits names a parent account whose defaults are merged first.
+type AccountPermissions struct {
+	Inherits string         `mapstructure:"inherits"`
+	Pub      PermissionList `mapstructure:"pub"`
+	Sub      PermissionList `mapstructure:"sub"`
+}
+
+// PermissionList holds the allowed and denied subjects for one direction.
+type PermissionList struct {
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+}
+
+// Permissions converts the account defaults to NATS JWT permissions.
+func (a AccountPermissions) Permissions() jwt.Permissions {
+	return jwt.Permissions{
+		Pub: jwt.Permission{Allow: a.Pub.Allow, Deny: a.Pub.Deny},
+		Sub: jwt.Permission{Allow: a.Sub.Allow, Deny: a.Sub.Deny},
+	}
+}
+
+// PermissionTemplate is a named set of permissions users reference with
+// Template in the users file.
+type PermissionTemplate struct {
+	Pub PermissionList `mapstructure:"pub"`
+	Sub PermissionList `mapstructure:"sub"`
+}
+
+// Permissions converts the template to NATS JWT permissions.
+func (t PermissionTemplate) Permissions() jwt.Permissions {
+	return jwt.Permissions{
+		Pub: jwt.Permission{Allow: t.Pub.Allow, Deny: t.Pub.Deny},
+		Sub: jwt.Permission{Allow: t.Sub.Allow, Deny: t.Sub.Deny},
+	}
+}
+
+// resolveInheritance flattens the inheritance chains of accounts in place, so
+// every entry holds its parents' permissions merged with its own (deny wins).
+// Unknown parents and inheritance cycles are rejected.
+func resolveInheritance(accounts map[string]AccountPermissions) error {
+	const (
+		visiting = iota + 1
+		resolved
+	)
+	state := make(map[string]int, len(accounts))
+
+	var resolve func(name string, chain []string) error
+	resolve = func(name string, chain []string) error {
+		switch state[name] {
+		case resolved:
+			return nil
+		case visiting:
+			return fmt.Errorf("account permission inheritance cycle: %s", strings.Join(append(chain, name), " -> "))
+		}
+		account := accounts[name]
+		if account.Inherits == "" {
+			state[name] = resolved
+			return nil
+		}
+		parentName := strings.ToLower(account.Inherits)
+		if _, ok := accounts[parentName]; !ok {
+			return fmt.Errorf("account %q inherits unknown account %q", name, account.Inherits)
+		}
+
+		state[name] = visiting
+		if err := resolve(parentName, append(chain, name)); err != nil {
+			return err
+		}
+		merged := permissions.Merge(accounts[parentName].Permissions(), account.Permissions())
+		account.Pub = PermissionList{Allow: merged.Pub.Allow, Deny: merged.Pub.Deny}
+		account.Sub = PermissionList{Allow: merged.Sub.Allow, Deny: merged.Sub.Deny}
+		accounts[name] = account
+		state[name] = resolved
+		return nil
+	}
+
+	for name := range accounts {
+		if err := resolve(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,34 +5,342 @@ package config
 
 import (
 	"fmt"
-	"log"
+	"math"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/userssql"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Config defines the structure for the application configuration.
 type Config struct {
 	Nats struct {
-		URL  string `mapstructure:"url"`
-		User string `mapstructure:"user"`
-		Pass string `mapstructure:"pass"`
+		URL  string    `mapstructure:"url"`
+		User string    `mapstructure:"user"`
+		Pass string    `mapstructure:"pass"`
+		TLS  TLSConfig `mapstructure:"tls"`
+
+		// ConnectRetries retries a failed startup connection this many times,
+		// waiting ConnectBackoff before the first retry and doubling it after each
+		ConnectRetries int           `mapstructure:"connect_retries"`
+		ConnectBackoff time.Duration `mapstructure:"connect_backoff"`
+
+		// MaxReconnects gives up on a lost connection after this many attempts
+		// (0 or -1 reconnect forever), waiting ReconnectWait between them
+		MaxReconnects int           `mapstructure:"max_reconnects"`
+		ReconnectWait time.Duration `mapstructure:"reconnect_wait"`
 	} `mapstructure:"nats"`
 
 	Auth struct {
-		IssuerSeed string `mapstructure:"issuer_seed"`
-		XKeySeed   string `mapstructure:"xkey_seed"`
-		UsersFile  string `mapstructure:"users_file"`
+		IssuerSeed    string   `mapstructure:"issuer_seed"`
+		IssuerAccount string   `mapstructure:"issuer_account"`
+		XKeySeed      string   `mapstructure:"xkey_seed"`
+		UsersFile     string   `mapstructure:"users_file"`
+		Accounts      []string `mapstructure:"accounts"`
+
+		// AccountIssuers maps account names to the account seeds signing their
+		// user JWTs, for operator mode with several target accounts
+		AccountIssuers map[string]string `mapstructure:"account_issuers"`
+
+		// UsersFiles are merged after UsersFile; DuplicateUsers picks the
+		// resolution policy (first-wins, last-wins or error) for repeated usernames
+		UsersFiles     []string `mapstructure:"users_files"`
+		DuplicateUsers string   `mapstructure:"duplicate_users"`
+
+		// UsersDSN loads users from a SQL database instead of the users files;
+		// UsersQuery takes the username and returns pass hash, account and permissions JSON
+		UsersDSN    string `mapstructure:"users_dsn"`
+		UsersDriver string `mapstructure:"users_driver"`
+		UsersQuery  string `mapstructure:"users_query"`
+
+		// Backend selects the user backend: yaml (users files), sql (UsersDSN) or
+		// http (UsersHTTP); defaults to sql when UsersDSN is set, yaml otherwise
+		Backend string `mapstructure:"backend"`
+
+		// UsersHTTP looks users up by POSTing the username to an HTTP users service
+		UsersHTTP struct {
+			URL     string        `mapstructure:"url"`
+			Token   string        `mapstructure:"token"`
+			Timeout time.Duration `mapstructure:"timeout"`
+			Retries int           `mapstructure:"retries"`
+			Backoff time.Duration `mapstructure:"backoff"`
+		} `mapstructure:"users_http"`
+
+		// AccountPermissions are default permissions per account, optionally
+		// inherited from a parent account; users' own permissions are merged on top
+		AccountPermissions map[string]AccountPermissions `mapstructure:"account_permissions"`
+
+		// PermissionTemplates are named permission sets users reference with Template;
+		// TemplateMerge combines them with inline permissions: merge (template as base,
+		// inline added on top, deny wins) or replace (inline, if set, replaces the template)
+		PermissionTemplates map[string]PermissionTemplate `mapstructure:"permission_templates"`
+		TemplateMerge       string                        `mapstructure:"template_merge"`
+
+		// PermissionCacheSize caches up to this many merges of a template with a
+		// user's inline permissions (0 disables)
+		PermissionCacheSize int `mapstructure:"permission_cache_size"`
+
+		// AccountCeilings caps the subjects any user of an account may be granted
+		AccountCeilings map[string]AccountCeiling `mapstructure:"account_ceilings"`
+
+		// Policy resolves the permissions of authenticated users from a remote
+		// policy service instead of the user record or token when URL is set
+		Policy struct {
+			URL      string        `mapstructure:"url"`
+			CacheTTL time.Duration `mapstructure:"cache_ttl"`
+			Timeout  time.Duration `mapstructure:"timeout"`
+		} `mapstructure:"policy"`
+
+		// ConnectionTypeCeilings caps the subjects granted to clients connecting
+		// with a connection type such as websocket, on top of the account ceiling
+		ConnectionTypeCeilings map[string]AccountCeiling `mapstructure:"connection_type_ceilings"`
+
+		// TokenCeiling caps the subjects the permissions of a nats_token may grant
+		TokenCeiling AccountCeiling `mapstructure:"token_ceiling"`
+
+		// Blocklist lists subjects no user may be granted, stripped or rejected
+		Blocklist struct {
+			Subjects       []string `mapstructure:"subjects"`
+			ExemptAccounts []string `mapstructure:"exempt_accounts"`
+			Reject         bool     `mapstructure:"reject"`
+		} `mapstructure:"blocklist"`
+
+		// BroadWildcards warns about or rejects users granted root wildcards such
+		// as ">" (mode off, warn or reject); Admins are exempt by username
+		BroadWildcards struct {
+			Mode   string   `mapstructure:"mode"`
+			Admins []string `mapstructure:"admins"`
+		} `mapstructure:"broad_wildcards"`
+
+		// BcryptCost rehashes weaker bcrypt passwords on login for writable backends (0 disables)
+		BcryptCost int `mapstructure:"bcrypt_cost"`
+
+		// ErrorCodes overrides the stable codes prefixed to response errors per reason
+		ErrorCodes struct {
+			Overrides map[string]string `mapstructure:"overrides"`
+		} `mapstructure:"error_codes"`
+
+		// ErrorCategories prefixes response errors with bad_request, unauthenticated or unauthorized
+		ErrorCategories bool `mapstructure:"error_categories"`
+
+		// AutoInboxSub adds _INBOX.> to the subscribe allow list of issued user JWTs lacking it
+		AutoInboxSub bool `mapstructure:"auto_inbox_sub"`
+
+		// DeprecatePasswords logs password logins as deprecated during migration to tokens
+		DeprecatePasswords bool `mapstructure:"deprecate_passwords"`
+
+		// TokenSecrets are labeled nats_token secrets tried in order, replacing
+		// NATS_TOKEN_SECRET when set; the matching label is logged for rotation
+		TokenSecrets []TokenSecret `mapstructure:"token_secrets"`
+
+		// DisableTokenAuth ignores nats_tokens so only username/password logins are accepted
+		DisableTokenAuth bool `mapstructure:"disable_token_auth"`
+
+		// TokenIdentityOnly takes account and permissions of nats_token users from
+		// the users file, using the token only as proof of the user_id
+		TokenIdentityOnly bool `mapstructure:"token_identity_only"`
+
+		// TokenAudience rejects nats_tokens not minted for this service identifier when set
+		TokenAudience string `mapstructure:"token_audience"`
+
+		// TokenIssuer rejects nats_tokens not minted by this trusted issuer when set
+		TokenIssuer string `mapstructure:"token_issuer"`
+
+		// TokenCacheSize caches up to this many validated nats_tokens until they expire (0 disables)
+		TokenCacheSize int `mapstructure:"token_cache_size"`
+
+		// TokenLeeway tolerates clock skew when checking the exp and nbf times of nats_tokens
+		TokenLeeway time.Duration `mapstructure:"token_leeway"`
+
+		// TokenMaxIatSkew rejects nats_tokens issued further in the future (0 disables the check)
+		TokenMaxIatSkew time.Duration `mapstructure:"token_max_iat_skew"`
+
+		// EmptyTokenPermissions handles nats_tokens without permissions: "deny" or "inherit"
+		EmptyTokenPermissions string `mapstructure:"empty_token_permissions"`
+
+		// UserJWTTTL limits the lifetime of issued user JWTs (0 issues them without expiry)
+		UserJWTTTL time.Duration `mapstructure:"user_jwt_ttl"`
+
+		// RequireJWTExpiry guards against user JWTs without an expiry (mode off,
+		// reject or default); default mode applies DefaultTTL
+		RequireJWTExpiry struct {
+			Mode       string        `mapstructure:"mode"`
+			DefaultTTL time.Duration `mapstructure:"default_ttl"`
+		} `mapstructure:"require_jwt_expiry"`
+
+		// RateLimit throttles username/password requests per username, and client
+		// host with PerClient, to resist credential stuffing (0 disables)
+		RateLimit struct {
+			RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+			Burst             int     `mapstructure:"burst"`
+			PerClient         bool    `mapstructure:"per_client"`
+		} `mapstructure:"rate_limit"`
+
+		// RenewSubject enables renewing user JWTs with a still valid nats_token when set
+		RenewSubject string `mapstructure:"renew_subject"`
+
+		// ResponseTTL sets the expiry of authorization responses (0 leaves it unset)
+		ResponseTTL time.Duration `mapstructure:"response_ttl"`
+
+		// EchoHeaders lists request headers, such as a correlation ID, copied onto responses
+		EchoHeaders []string `mapstructure:"echo_headers"`
+
+		// MaxUserJWTSize rejects users whose encoded user JWT is larger, in bytes (0 disables)
+		MaxUserJWTSize int `mapstructure:"max_user_jwt_size"`
+
+		// MaxAccounts fails loading users referencing more distinct accounts (0 disables)
+		MaxAccounts int `mapstructure:"max_accounts"`
+
+		// SlowRequestThreshold logs auth requests slower than this with a timing breakdown (0 disables)
+		SlowRequestThreshold time.Duration `mapstructure:"slow_request_threshold"`
+
+		// TrustedServers lists NATS server public keys allowed to send authorization requests
+		TrustedServers []string `mapstructure:"trusted_servers"`
+
+		// TrustedServerIDs lists NATS server IDs allowed to send authorization requests
+		TrustedServerIDs []string `mapstructure:"trusted_server_ids"`
+
+		// NoCredentialsMessage is returned when a client supplies no credentials at all
+		NoCredentialsMessage string `mapstructure:"no_credentials_message"`
+
+		// Environments overrides user backend settings per environment name
+		Environments map[string]EnvironmentConfig `mapstructure:"environments"`
 	} `mapstructure:"auth"`
 
+	// Vault optionally fetches secrets at startup and on SIGHUP; references are
+	// "path#key" and override the direct values when set
+	Vault struct {
+		Enabled     bool   `mapstructure:"enabled"`
+		Address     string `mapstructure:"address"`
+		Token       string `mapstructure:"token"`
+		IssuerSeed  string `mapstructure:"issuer_seed"`
+		XKeySeed    string `mapstructure:"xkey_seed"`
+		TokenSecret string `mapstructure:"token_secret"`
+		NatsPass    string `mapstructure:"nats_pass"`
+	} `mapstructure:"vault"`
+
+	Admin struct {
+		Token          string `mapstructure:"token"`
+		PreviewSubject string `mapstructure:"preview_subject"`
+		FlushSubject   string `mapstructure:"flush_subject"`
+	} `mapstructure:"admin"`
+
+	Log struct {
+		Format      string `mapstructure:"format"` // "text" or "json"
+		Level       string `mapstructure:"level"`  // A logrus level such as "info" or "debug"
+		Permissions bool   `mapstructure:"permissions"`
+		ServerInfo  bool   `mapstructure:"server_info"`
+	} `mapstructure:"log"`
+
+	Metrics struct {
+		// Addr is the address serving Prometheus metrics on /metrics, e.g. ":9100" (empty disables)
+		Addr string `mapstructure:"addr"`
+	} `mapstructure:"metrics"`
+
+	Events struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Subject string `mapstructure:"subject"`
+		Source  string `mapstructure:"source"`
+	} `mapstructure:"events"`
+
+	// Audit appends every authorization decision to File as JSON lines when set;
+	// the file is reopened on SIGHUP for rotation
+	Audit struct {
+		File string `mapstructure:"file"`
+	} `mapstructure:"audit"`
+
 	Environment string `mapstructure:"environment"`
 }
 
+// User backends selected with auth.backend.
+const (
+	BackendYAML = "yaml"
+	BackendSQL  = "sql"
+	BackendHTTP = "http"
+)
+
+// EnvironmentConfig holds user backend settings that apply to a single environment.
+// Set fields override the auth settings of the same name.
+type EnvironmentConfig struct {
+	UsersFile  string `mapstructure:"users_file"`
+	Backend    string `mapstructure:"backend"`
+	UsersDSN   string `mapstructure:"users_dsn"`
+	UsersQuery string `mapstructure:"users_query"`
+}
+
+// TokenSecret is a labeled HMAC secret used to validate nats_tokens.
+type TokenSecret struct {
+	Label string `mapstructure:"label"`
+	Value string `mapstructure:"value"`
+}
+
+// AccountCeiling lists the publish and subscribe subjects users of an account, or
+// clients of a connection type, may be granted at most. An empty list leaves that
+// direction unrestricted.
+type AccountCeiling struct {
+	Pub []string `mapstructure:"pub"`
+	Sub []string `mapstructure:"sub"`
+}
+
+// UsersFile returns the users file for the configured environment, falling back
+// to auth.users_file when the environment has no override.
+func (c *Config) UsersFile() string {
+	if env, ok := c.Auth.Environments[strings.ToLower(c.Environment)]; ok && env.UsersFile != "" {
+		return env.UsersFile
+	}
+	return c.Auth.UsersFile
+}
+
+// applyEnvironment overrides the user backend settings with those set for the
+// configured environment. UsersFile is resolved separately by UsersFile.
+func (c *Config) applyEnvironment() {
+	env, ok := c.Auth.Environments[strings.ToLower(c.Environment)]
+	if !ok {
+		return
+	}
+	if env.Backend != "" {
+		c.Auth.Backend = env.Backend
+	}
+	if env.UsersDSN != "" {
+		c.Auth.UsersDSN = env.UsersDSN
+	}
+	if env.UsersQuery != "" {
+		c.Auth.UsersQuery = env.UsersQuery
+	}
+}
+
+// UsersFiles returns every users file to merge, in order: the environment's
+// users file (see UsersFile) followed by auth.users_files.
+func (c *Config) UsersFiles() []string {
+	var files []string
+	if f := c.UsersFile(); f != "" {
+		files = append(files, f)
+	}
+	return append(files, c.Auth.UsersFiles...)
+}
+
+// fromVault reports whether a secret is fetched from Vault by the given reference.
+func (c *Config) fromVault(ref string) bool {
+	return c.Vault.Enabled && ref != ""
+}
+
 // Load loads the configuration using viper, supporting YAML and environment variables.
-func Load(configPath string) (*Config, error) {
+// Several files may be given; they are read in order with later files overriding
+// earlier ones, and environment variables override the merged result.
+func Load(configPaths ...string) (*Config, error) {
+	if len(configPaths) == 0 {
+		return nil, fmt.Errorf("no config file given")
+	}
+
 	// Initialize viper
 	v := viper.New()
-	v.SetConfigFile(configPath)
+	v.SetConfigFile(configPaths[0])
 	v.SetConfigType("yaml")
 
 	// Enable environment variable overrides without prefix
@@ -44,30 +352,246 @@ func Load(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	// Merge additional config files in order
+	for _, path := range configPaths[1:] {
+		v.SetConfigFile(path)
+		if err := v.MergeInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to merge config file %s: %w", path, err)
+		}
+	}
+
 	// Unmarshal into Config struct
 	var cfg Config
 	if err := v.Unmarshal(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config into struct: %w", err)
 	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, err
+	}
 
 	// Validation
-	if cfg.Auth.IssuerSeed == "" {
+	if cfg.Vault.Enabled && cfg.Vault.Address == "" {
+		return nil, fmt.Errorf("vault.address is required when vault is enabled")
+	}
+	if cfg.Auth.IssuerSeed == "" && !cfg.fromVault(cfg.Vault.IssuerSeed) {
 		return nil, fmt.Errorf("auth.issuer_seed is required")
 	}
-	if cfg.Auth.XKeySeed == "" {
+	if cfg.Auth.XKeySeed == "" && !cfg.fromVault(cfg.Vault.XKeySeed) {
 		return nil, fmt.Errorf("auth.xkey_seed is required")
 	}
+	if cfg.Auth.BcryptCost != 0 && (cfg.Auth.BcryptCost < bcrypt.MinCost || cfg.Auth.BcryptCost > bcrypt.MaxCost) {
+		return nil, fmt.Errorf("auth.bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if err := resolveInheritance(cfg.Auth.AccountPermissions); err != nil {
+		return nil, fmt.Errorf("auth.account_permissions: %w", err)
+	}
+	if cfg.Auth.ResponseTTL < 0 {
+		return nil, fmt.Errorf("auth.response_ttl must not be negative")
+	}
+	if cfg.Auth.UserJWTTTL < 0 {
+		return nil, fmt.Errorf("auth.user_jwt_ttl must not be negative")
+	}
+	switch cfg.Auth.RequireJWTExpiry.Mode {
+	case "":
+		cfg.Auth.RequireJWTExpiry.Mode = "off" // Default value
+	case "off", "reject", "default":
+	default:
+		return nil, fmt.Errorf("auth.require_jwt_expiry.mode must be off, reject or default, got %q", cfg.Auth.RequireJWTExpiry.Mode)
+	}
+	if cfg.Auth.RequireJWTExpiry.DefaultTTL == 0 {
+		cfg.Auth.RequireJWTExpiry.DefaultTTL = time.Hour // Default value
+	}
+	if cfg.Auth.RequireJWTExpiry.DefaultTTL < 0 {
+		return nil, fmt.Errorf("auth.require_jwt_expiry.default_ttl must be positive")
+	}
+	if cfg.Auth.TokenCacheSize < 0 {
+		return nil, fmt.Errorf("auth.token_cache_size must not be negative")
+	}
+	if cfg.Auth.TokenLeeway < 0 {
+		return nil, fmt.Errorf("auth.token_leeway must not be negative")
+	}
+	if cfg.Auth.TokenMaxIatSkew < 0 {
+		return nil, fmt.Errorf("auth.token_max_iat_skew must not be negative")
+	}
+	// An explicit 0 disables the leeway, so only default an unset value
+	if !v.IsSet("auth.token_leeway") {
+		cfg.Auth.TokenLeeway = 30 * time.Second // Default value
+	}
+	if cfg.Auth.RateLimit.RequestsPerSecond < 0 {
+		return nil, fmt.Errorf("auth.rate_limit.requests_per_second must not be negative")
+	}
+	if cfg.Auth.RateLimit.Burst < 0 {
+		return nil, fmt.Errorf("auth.rate_limit.burst must not be negative")
+	}
+	if cfg.Auth.RateLimit.Burst == 0 {
+		cfg.Auth.RateLimit.Burst = int(math.Ceil(cfg.Auth.RateLimit.RequestsPerSecond)) // Default value
+	}
+	if cfg.Nats.ConnectRetries < 0 {
+		return nil, fmt.Errorf("nats.connect_retries must not be negative")
+	}
+	if cfg.Nats.ConnectBackoff < 0 {
+		return nil, fmt.Errorf("nats.connect_backoff must not be negative")
+	}
+	if cfg.Nats.ConnectBackoff == 0 {
+		cfg.Nats.ConnectBackoff = time.Second // Default value
+	}
+	if cfg.Nats.MaxReconnects < -1 {
+		return nil, fmt.Errorf("nats.max_reconnects must be -1 or more")
+	}
+	if cfg.Nats.MaxReconnects == 0 {
+		cfg.Nats.MaxReconnects = -1 // Default value
+	}
+	if cfg.Nats.ReconnectWait < 0 {
+		return nil, fmt.Errorf("nats.reconnect_wait must not be negative")
+	}
+	if cfg.Nats.ReconnectWait == 0 {
+		cfg.Nats.ReconnectWait = 2 * time.Second // Default value
+	}
+	if cfg.Auth.MaxUserJWTSize < 0 {
+		return nil, fmt.Errorf("auth.max_user_jwt_size must not be negative")
+	}
+	if cfg.Auth.MaxAccounts < 0 {
+		return nil, fmt.Errorf("auth.max_accounts must not be negative")
+	}
+	if cfg.Auth.SlowRequestThreshold < 0 {
+		return nil, fmt.Errorf("auth.slow_request_threshold must not be negative")
+	}
 	if cfg.Environment == "" {
 		cfg.Environment = "development" // Default value
 	}
+	cfg.applyEnvironment()
+	switch cfg.Auth.Backend {
+	case "":
+		cfg.Auth.Backend = BackendYAML // Default value
+		if cfg.Auth.UsersDSN != "" {
+			cfg.Auth.Backend = BackendSQL
+		}
+	case BackendYAML, BackendSQL, BackendHTTP:
+	default:
+		return nil, fmt.Errorf("auth.backend must be yaml, sql or http, got %q", cfg.Auth.Backend)
+	}
+	if cfg.Auth.Backend == BackendSQL && cfg.Auth.UsersDSN == "" {
+		return nil, fmt.Errorf("auth.users_dsn is required with auth.backend sql")
+	}
+	if cfg.Auth.Backend == BackendHTTP && cfg.Auth.UsersHTTP.URL == "" {
+		return nil, fmt.Errorf("auth.users_http.url is required with auth.backend http")
+	}
+	if cfg.Auth.UsersHTTP.Timeout < 0 {
+		return nil, fmt.Errorf("auth.users_http.timeout must not be negative")
+	}
+	if cfg.Auth.UsersHTTP.Timeout == 0 {
+		cfg.Auth.UsersHTTP.Timeout = 5 * time.Second // Default value
+	}
+	if cfg.Auth.UsersHTTP.Retries < 0 {
+		return nil, fmt.Errorf("auth.users_http.retries must not be negative")
+	}
+	if cfg.Auth.UsersHTTP.Backoff < 0 {
+		return nil, fmt.Errorf("auth.users_http.backoff must not be negative")
+	}
+	if cfg.Auth.UsersHTTP.Backoff == 0 {
+		cfg.Auth.UsersHTTP.Backoff = 200 * time.Millisecond // Default value
+	}
+	if cfg.Auth.UsersDriver == "" {
+		cfg.Auth.UsersDriver = "postgres" // Default value
+	}
+	if cfg.Auth.UsersQuery == "" {
+		cfg.Auth.UsersQuery = userssql.DefaultQuery // Default value
+	}
+	if cfg.Auth.Policy.CacheTTL < 0 {
+		return nil, fmt.Errorf("auth.policy.cache_ttl must not be negative")
+	}
+	if cfg.Auth.Policy.CacheTTL == 0 {
+		cfg.Auth.Policy.CacheTTL = 10 * time.Second // Default value
+	}
+	if cfg.Auth.Policy.Timeout < 0 {
+		return nil, fmt.Errorf("auth.policy.timeout must not be negative")
+	}
+	if cfg.Auth.Policy.Timeout == 0 {
+		cfg.Auth.Policy.Timeout = 5 * time.Second // Default value
+	}
+	switch cfg.Auth.DuplicateUsers {
+	case "":
+		cfg.Auth.DuplicateUsers = "error" // Default value
+	case "first-wins", "last-wins", "error":
+	default:
+		return nil, fmt.Errorf("auth.duplicate_users must be first-wins, last-wins or error, got %q", cfg.Auth.DuplicateUsers)
+	}
+	labels := make(map[string]struct{}, len(cfg.Auth.TokenSecrets))
+	for i, secret := range cfg.Auth.TokenSecrets {
+		if secret.Label == "" || secret.Value == "" {
+			return nil, fmt.Errorf("auth.token_secrets[%d]: label and value are required", i)
+		}
+		if _, ok := labels[secret.Label]; ok {
+			return nil, fmt.Errorf("auth.token_secrets: duplicate label %q", secret.Label)
+		}
+		labels[secret.Label] = struct{}{}
+	}
+	switch cfg.Auth.BroadWildcards.Mode {
+	case "":
+		cfg.Auth.BroadWildcards.Mode = "warn" // Default value
+	case "off", "warn", "reject":
+	default:
+		return nil, fmt.Errorf("auth.broad_wildcards.mode must be off, warn or reject, got %q", cfg.Auth.BroadWildcards.Mode)
+	}
+	switch cfg.Auth.TemplateMerge {
+	case "":
+		cfg.Auth.TemplateMerge = "merge" // Default value
+	case "merge", "replace":
+	default:
+		return nil, fmt.Errorf("auth.template_merge must be merge or replace, got %q", cfg.Auth.TemplateMerge)
+	}
+	if cfg.Auth.PermissionCacheSize < 0 {
+		return nil, fmt.Errorf("auth.permission_cache_size must not be negative")
+	}
+	switch cfg.Auth.EmptyTokenPermissions {
+	case "":
+		cfg.Auth.EmptyTokenPermissions = "deny" // Default value
+	case "deny", "inherit":
+	default:
+		return nil, fmt.Errorf("auth.empty_token_permissions must be deny or inherit, got %q", cfg.Auth.EmptyTokenPermissions)
+	}
+	for _, key := range cfg.Auth.TrustedServers {
+		if !nkeys.IsValidPublicServerKey(key) {
+			return nil, fmt.Errorf("auth.trusted_servers: %q is not a valid server public key", key)
+		}
+	}
+	for connType := range cfg.Auth.ConnectionTypeCeilings {
+		if !slices.Contains(auth.ConnectionTypes, strings.ToUpper(connType)) {
+			return nil, fmt.Errorf("auth.connection_type_ceilings: unknown connection type %q", connType)
+		}
+	}
+	if _, err := cfg.Nats.TLS.Build(); err != nil {
+		return nil, fmt.Errorf("nats.tls: %w", err)
+	}
+	if cfg.Admin.PreviewSubject == "" {
+		cfg.Admin.PreviewSubject = "auth.admin.preview" // Default value
+	}
+	if cfg.Admin.FlushSubject == "" {
+		cfg.Admin.FlushSubject = "auth.admin.flush" // Default value
+	}
+	switch cfg.Log.Format {
+	case "":
+		cfg.Log.Format = "text" // Default value
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("log.format must be text or json, got %q", cfg.Log.Format)
+	}
+	if cfg.Log.Level == "" {
+		cfg.Log.Level = "info" // Default value
+	}
+	if _, err := logrus.ParseLevel(cfg.Log.Level); err != nil {
+		return nil, fmt.Errorf("log.level: %w", err)
+	}
+	if cfg.Events.Enabled && cfg.Events.Subject == "" {
+		cfg.Events.Subject = "auth.events" // Default value
+	}
 
-	log.Printf("Loaded config: %+v", cfg)
 	return &cfg, nil
 }
 
 // MustLoad loads the configuration and panics on error.
-func MustLoad(configPath string) *Config {
-	cfg, err := Load(configPath)
+func MustLoad(configPaths ...string) *Config {
+	cfg, err := Load(configPaths...)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to load config: %v", err))
 	}
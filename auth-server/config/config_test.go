@@ -3,8 +3,11 @@ package config_test
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/config"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/userssql"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -61,6 +64,60 @@ auth:
 		assert.Equal(t, "SAAGTESTSEED", cfg.Auth.IssuerSeed)
 		assert.Equal(t, "SXAKTESTSEED", cfg.Auth.XKeySeed)
 		assert.Equal(t, "/tmp/users.json", cfg.Auth.UsersFile)
+		assert.Equal(t, "off", cfg.Auth.RequireJWTExpiry.Mode)
+		assert.Equal(t, time.Hour, cfg.Auth.RequireJWTExpiry.DefaultTTL)
+		assert.Zero(t, cfg.Auth.RateLimit.Burst)
+		assert.Equal(t, config.BackendYAML, cfg.Auth.Backend)
+		assert.Equal(t, 5*time.Second, cfg.Auth.UsersHTTP.Timeout)
+		assert.Equal(t, 200*time.Millisecond, cfg.Auth.UsersHTTP.Backoff)
+		assert.Equal(t, -1, cfg.Nats.MaxReconnects)
+		assert.Equal(t, 2*time.Second, cfg.Nats.ReconnectWait)
+		assert.Equal(t, 30*time.Second, cfg.Auth.TokenLeeway)
+		assert.Zero(t, cfg.Auth.TokenMaxIatSkew)
+		assert.Equal(t, "info", cfg.Log.Level)
+	})
+
+	t.Run("users_dsn selects the sql backend", func(t *testing.T) {
+		tmpFile := createTempConfigFile(t, `
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+  users_dsn: postgres://localhost/nats
+`)
+		defer removeTmpFile(tmpFile)
+
+		cfg, err := config.Load(tmpFile.Name())
+		require.NoError(t, err)
+		assert.Equal(t, config.BackendSQL, cfg.Auth.Backend)
+	})
+
+	t.Run("explicit zero token leeway is kept", func(t *testing.T) {
+		tmpFile := createTempConfigFile(t, `
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+  token_leeway: 0
+`)
+		defer removeTmpFile(tmpFile)
+
+		cfg, err := config.Load(tmpFile.Name())
+		require.NoError(t, err)
+		assert.Zero(t, cfg.Auth.TokenLeeway)
+	})
+
+	t.Run("rate limit burst defaults to the rate", func(t *testing.T) {
+		tmpFile := createTempConfigFile(t, `
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+  rate_limit:
+    requests_per_second: 2.5
+`)
+		defer removeTmpFile(tmpFile)
+
+		cfg, err := config.Load(tmpFile.Name())
+		require.NoError(t, err)
+		assert.Equal(t, 3, cfg.Auth.RateLimit.Burst)
 	})
 
 	t.Run("successful load with environment variables", func(t *testing.T) {
@@ -120,6 +177,187 @@ environment: test`,
 environment: test`,
 				"auth.xkey_seed is required",
 			},
+			{
+				"invalid duplicate users policy",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  duplicate_users: "random"
+environment: test`,
+				`auth.duplicate_users must be first-wins, last-wins or error, got "random"`,
+			},
+			{
+				"invalid trusted server key",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  trusted_servers: ["NOTAKEY"]
+environment: test`,
+				`auth.trusted_servers: "NOTAKEY" is not a valid server public key`,
+			},
+			{
+				"invalid broad wildcards mode",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  broad_wildcards:
+    mode: "panic"
+environment: test`,
+				`auth.broad_wildcards.mode must be off, warn or reject, got "panic"`,
+			},
+			{
+				"invalid JWT expiry mode",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  require_jwt_expiry:
+    mode: "always"
+environment: test`,
+				`auth.require_jwt_expiry.mode must be off, reject or default, got "always"`,
+			},
+			{
+				"unknown backend",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  backend: ldap
+environment: test`,
+				`auth.backend must be yaml, sql or http, got "ldap"`,
+			},
+			{
+				"sql backend without dsn",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  backend: sql
+environment: test`,
+				`auth.users_dsn is required with auth.backend sql`,
+			},
+			{
+				"http backend without url",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  backend: http
+environment: test`,
+				`auth.users_http.url is required with auth.backend http`,
+			},
+			{
+				"negative users service retries",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  users_http:
+    retries: -1
+environment: test`,
+				`auth.users_http.retries must not be negative`,
+			},
+			{
+				"max reconnects below -1",
+				`nats:
+  max_reconnects: -2
+auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+environment: test`,
+				`nats.max_reconnects must be -1 or more`,
+			},
+			{
+				"negative reconnect wait",
+				`nats:
+  reconnect_wait: -1s
+auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+environment: test`,
+				`nats.reconnect_wait must not be negative`,
+			},
+			{
+				"negative token cache size",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  token_cache_size: -1
+environment: test`,
+				`auth.token_cache_size must not be negative`,
+			},
+			{
+				"negative token leeway",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  token_leeway: -1s
+environment: test`,
+				`auth.token_leeway must not be negative`,
+			},
+			{
+				"negative token iat skew",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  token_max_iat_skew: -1m
+environment: test`,
+				`auth.token_max_iat_skew must not be negative`,
+			},
+			{
+				"negative rate limit",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  rate_limit:
+    requests_per_second: -1
+environment: test`,
+				`auth.rate_limit.requests_per_second must not be negative`,
+			},
+			{
+				"invalid template merge strategy",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  template_merge: "union"
+environment: test`,
+				`auth.template_merge must be merge or replace, got "union"`,
+			},
+			{
+				"negative permission cache size",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  permission_cache_size: -1
+environment: test`,
+				`auth.permission_cache_size must not be negative`,
+			},
+			{
+				"unknown connection type ceiling",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+  connection_type_ceilings:
+    carrier_pigeon:
+      pub: ["PUBLIC.>"]
+environment: test`,
+				`auth.connection_type_ceilings: unknown connection type "carrier_pigeon"`,
+			},
+			{
+				"invalid log format",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+log:
+  format: "xml"
+environment: test`,
+				`log.format must be text or json, got "xml"`,
+			},
+			{
+				"invalid log level",
+				`auth:
+  issuer_seed: "SAAG..."
+  xkey_seed: "SXAK..."
+log:
+  level: "verbose"
+environment: test`,
+				`log.level: not a valid logrus Level: "verbose"`,
+			},
 		}
 
 		for _, tt := range tests {
@@ -176,7 +414,246 @@ auth:
 		cfg, err := config.Load(tmpFile.Name())
 		require.NoError(t, err)
 		assert.Equal(t, "development", cfg.Environment)
+		assert.Equal(t, "text", cfg.Log.Format)
+		assert.False(t, cfg.Events.Enabled)
+	})
+
+	t.Run("default events subject", func(t *testing.T) {
+		tmpFile := createTempConfigFile(t, `
+auth:
+  issuer_seed: SAAGDEFAULT
+  xkey_seed: SXAKDEFAULT
+events:
+  enabled: true
+`)
+		defer removeTmpFile(tmpFile)
+
+		cfg, err := config.Load(tmpFile.Name())
+		require.NoError(t, err)
+		assert.True(t, cfg.Events.Enabled)
+		assert.Equal(t, "auth.events", cfg.Events.Subject)
+	})
+}
+
+func TestLoadMultipleFiles(t *testing.T) {
+	base := createTempConfigFile(t, `
+environment: development
+nats:
+  url: nats://base:4222
+  user: base_user
+  pass: base_pass
+auth:
+  issuer_seed: SAAGPLACEHOLDER
+  xkey_seed: SXAKPLACEHOLDER
+`)
+	defer removeTmpFile(base)
+	secrets := createTempConfigFile(t, `
+nats:
+  pass: secret_pass
+auth:
+  issuer_seed: SAAGSECRET
+  xkey_seed: SXAKSECRET
+`)
+	defer removeTmpFile(secrets)
+
+	t.Run("later file overrides earlier", func(t *testing.T) {
+		cfg, err := config.Load(base.Name(), secrets.Name())
+		require.NoError(t, err)
+		assert.Equal(t, "nats://base:4222", cfg.Nats.URL)
+		assert.Equal(t, "base_user", cfg.Nats.User)
+		assert.Equal(t, "secret_pass", cfg.Nats.Pass)
+		assert.Equal(t, "SAAGSECRET", cfg.Auth.IssuerSeed)
+		assert.Equal(t, "SXAKSECRET", cfg.Auth.XKeySeed)
+	})
+
+	t.Run("environment overrides files", func(t *testing.T) {
+		t.Setenv("NATS_PASS", "env_pass")
+		cfg, err := config.Load(base.Name(), secrets.Name())
+		require.NoError(t, err)
+		assert.Equal(t, "env_pass", cfg.Nats.Pass)
+	})
+
+	t.Run("missing second file", func(t *testing.T) {
+		_, err := config.Load(base.Name(), "nonexistent_file.yml")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to merge config file nonexistent_file.yml")
+	})
+
+	t.Run("no files", func(t *testing.T) {
+		_, err := config.Load()
+		require.Error(t, err)
+	})
+}
+
+func TestSecretIndirection(t *testing.T) {
+	seedFile := filepath.Join(t.TempDir(), "xkey.seed")
+	require.NoError(t, os.WriteFile(seedFile, []byte("SXAKFROMFILE\n"), 0600))
+	t.Setenv("TEST_ISSUER_SEED", "SAAGFROMENV")
+
+	t.Run("env, file and literal values", func(t *testing.T) {
+		tmpFile := createTempConfigFile(t, `
+nats:
+  pass: literal_pass
+auth:
+  issuer_seed: env:TEST_ISSUER_SEED
+  xkey_seed: file:`+seedFile+`
+`)
+		defer removeTmpFile(tmpFile)
+
+		cfg, err := config.Load(tmpFile.Name())
+		require.NoError(t, err)
+		assert.Equal(t, "SAAGFROMENV", cfg.Auth.IssuerSeed)
+		assert.Equal(t, "SXAKFROMFILE", cfg.Auth.XKeySeed, "trailing newline is trimmed")
+		assert.Equal(t, "literal_pass", cfg.Nats.Pass)
+	})
+
+	t.Run("token secret values", func(t *testing.T) {
+		secretFile := filepath.Join(t.TempDir(), "token.secret")
+		require.NoError(t, os.WriteFile(secretFile, []byte("from-file\n"), 0600))
+		t.Setenv("TEST_TOKEN_SECRET", "from-env")
+		tmpFile := createTempConfigFile(t, `
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+  token_secrets:
+    - label: current
+      value: env:TEST_TOKEN_SECRET
+    - label: previous
+      value: file:`+secretFile+`
+`)
+		defer removeTmpFile(tmpFile)
+
+		cfg, err := config.Load(tmpFile.Name())
+		require.NoError(t, err)
+		require.Len(t, cfg.Auth.TokenSecrets, 2)
+		assert.Equal(t, "from-env", cfg.Auth.TokenSecrets[0].Value)
+		assert.Equal(t, "from-file", cfg.Auth.TokenSecrets[1].Value)
+	})
+
+	t.Run("unset token secret variable", func(t *testing.T) {
+		tmpFile := createTempConfigFile(t, `
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+  token_secrets:
+    - label: current
+      value: env:TEST_UNSET_TOKEN_SECRET
+`)
+		defer removeTmpFile(tmpFile)
+
+		_, err := config.Load(tmpFile.Name())
+		assert.EqualError(t, err, "auth.token_secrets[0].value: environment variable TEST_UNSET_TOKEN_SECRET is not set")
+	})
+
+	t.Run("unset environment variable", func(t *testing.T) {
+		tmpFile := createTempConfigFile(t, `
+nats:
+  pass: env:TEST_UNSET_NATS_PASS
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+`)
+		defer removeTmpFile(tmpFile)
+
+		_, err := config.Load(tmpFile.Name())
+		assert.EqualError(t, err, "nats.pass: environment variable TEST_UNSET_NATS_PASS is not set")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		tmpFile := createTempConfigFile(t, `
+auth:
+  issuer_seed: file:/nonexistent/issuer.seed
+  xkey_seed: SXAKTESTSEED
+`)
+		defer removeTmpFile(tmpFile)
+
+		_, err := config.Load(tmpFile.Name())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "auth.issuer_seed: reading secret file")
+	})
+}
+
+func TestUsersFile(t *testing.T) {
+	tmpFile := createTempConfigFile(t, `
+environment: development
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+  users_file: users.yaml
+  environments:
+    production:
+      users_file: /etc/nats-auth/users.yaml
+`)
+	defer removeTmpFile(tmpFile)
+
+	tests := []struct {
+		environment string
+		want        string
+	}{
+		{environment: "development", want: "users.yaml"},
+		{environment: "production", want: "/etc/nats-auth/users.yaml"},
+		{environment: "Production", want: "/etc/nats-auth/users.yaml"},
+		{environment: "staging", want: "users.yaml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.environment, func(t *testing.T) {
+			t.Setenv("ENVIRONMENT", tt.environment)
+			cfg, err := config.Load(tmpFile.Name())
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg.UsersFile())
+		})
+	}
+}
+
+func TestEnvironmentBackend(t *testing.T) {
+	tmpFile := createTempConfigFile(t, `
+environment: development
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+  users_file: users.yaml
+  environments:
+    production:
+      backend: sql
+      users_dsn: postgres://db/nats
+      users_query: SELECT pass_hash, account, permissions FROM prod_users WHERE username = $1
+`)
+	defer removeTmpFile(tmpFile)
+
+	t.Run("development", func(t *testing.T) {
+		t.Setenv("ENVIRONMENT", "development")
+		cfg, err := config.Load(tmpFile.Name())
+		require.NoError(t, err)
+		assert.Equal(t, config.BackendYAML, cfg.Auth.Backend)
+		assert.Empty(t, cfg.Auth.UsersDSN)
+		assert.Equal(t, userssql.DefaultQuery, cfg.Auth.UsersQuery)
 	})
+
+	t.Run("production", func(t *testing.T) {
+		t.Setenv("ENVIRONMENT", "production")
+		cfg, err := config.Load(tmpFile.Name())
+		require.NoError(t, err)
+		assert.Equal(t, config.BackendSQL, cfg.Auth.Backend)
+		assert.Equal(t, "postgres://db/nats", cfg.Auth.UsersDSN)
+		assert.Contains(t, cfg.Auth.UsersQuery, "prod_users")
+	})
+}
+
+func TestUsersFiles(t *testing.T) {
+	tmpFile := createTempConfigFile(t, `
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+  users_file: users.yaml
+  users_files: [users.local.yaml]
+`)
+	defer removeTmpFile(tmpFile)
+
+	cfg, err := config.Load(tmpFile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"users.yaml", "users.local.yaml"}, cfg.UsersFiles())
+	assert.Equal(t, "error", cfg.Auth.DuplicateUsers)
 }
 
 func TestMustLoad(t *testing.T) {
@@ -212,3 +689,106 @@ auth:
 		}, "MustLoad should return valid config without panicking")
 	})
 }
+
+func TestAccountPermissionsInheritance(t *testing.T) {
+	const base = `
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+  account_permissions:
+`
+
+	tests := []struct {
+		name      string
+		accounts  string
+		want      map[string]config.AccountPermissions
+		expectErr string
+	}{
+		{
+			name: "single level",
+			accounts: `
+    DEVELOPMENT:
+      pub: { allow: ["TEST.>"], deny: ["TEST.secret"] }
+      sub: { allow: ["_INBOX.>"] }
+    STAGING:
+      inherits: DEVELOPMENT
+      pub: { allow: ["STAGING.>", "TEST.secret"] }
+`,
+			want: map[string]config.AccountPermissions{
+				"development": {
+					Pub: config.PermissionList{Allow: []string{"TEST.>"}, Deny: []string{"TEST.secret"}},
+					Sub: config.PermissionList{Allow: []string{"_INBOX.>"}},
+				},
+				"staging": {
+					Inherits: "DEVELOPMENT",
+					Pub:      config.PermissionList{Allow: []string{"TEST.>", "STAGING.>"}, Deny: []string{"TEST.secret"}},
+					Sub:      config.PermissionList{Allow: []string{"_INBOX.>"}},
+				},
+			},
+		},
+		{
+			name: "multi level",
+			accounts: `
+    DEVELOPMENT:
+      sub: { allow: ["_INBOX.>"] }
+    STAGING:
+      inherits: DEVELOPMENT
+      pub: { allow: ["STAGING.>"] }
+    PRODUCTION:
+      inherits: STAGING
+      pub: { allow: ["PROD.>"], deny: ["STAGING.>"] }
+`,
+			want: map[string]config.AccountPermissions{
+				"development": {
+					Sub: config.PermissionList{Allow: []string{"_INBOX.>"}},
+				},
+				"staging": {
+					Inherits: "DEVELOPMENT",
+					Pub:      config.PermissionList{Allow: []string{"STAGING.>"}},
+					Sub:      config.PermissionList{Allow: []string{"_INBOX.>"}},
+				},
+				"production": {
+					Inherits: "STAGING",
+					Pub:      config.PermissionList{Allow: []string{"PROD.>"}, Deny: []string{"STAGING.>"}},
+					Sub:      config.PermissionList{Allow: []string{"_INBOX.>"}},
+				},
+			},
+		},
+		{
+			name: "cycle",
+			accounts: `
+    A:
+      inherits: C
+    B:
+      inherits: A
+    C:
+      inherits: B
+`,
+			expectErr: "inheritance cycle",
+		},
+		{
+			name: "unknown parent",
+			accounts: `
+    STAGING:
+      inherits: MISSING
+`,
+			expectErr: `inherits unknown account "MISSING"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile := createTempConfigFile(t, base+tt.accounts)
+			defer removeTmpFile(tmpFile)
+
+			cfg, err := config.Load(tmpFile.Name())
+			if tt.expectErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg.Auth.AccountPermissions)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefixes of secret values that are resolved at load time instead of being
+// used literally.
+const (
+	envSecretPrefix  = "env:"
+	fileSecretPrefix = "file:"
+)
+
+// resolveSecret resolves a secret value of the form "env:VAR_NAME" from the
+// environment variable and "file:/path" from the file contents, with trailing
+// newlines trimmed. Other values are returned unchanged.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, envSecretPrefix):
+		name := strings.TrimPrefix(value, envSecretPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, fileSecretPrefix):
+		path := strings.TrimPrefix(value, fileSecretPrefix)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	default:
+		return value, nil
+	}
+}
+
+// resolveSecrets resolves the env: and file: indirections of the secret fields.
+func (c *Config) resolveSecrets() error {
+	fields := []struct {
+		key   string
+		value *string
+	}{
+		{"auth.issuer_seed", &c.Auth.IssuerSeed},
+		{"auth.xkey_seed", &c.Auth.XKeySeed},
+		{"nats.pass", &c.Nats.Pass},
+		{"auth.users_http.token", &c.Auth.UsersHTTP.Token},
+	}
+	for _, f := range fields {
+		secret, err := resolveSecret(*f.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.key, err)
+		}
+		*f.value = secret
+	}
+	for account, seed := range c.Auth.AccountIssuers {
+		secret, err := resolveSecret(seed)
+		if err != nil {
+			return fmt.Errorf("auth.account_issuers.%s: %w", account, err)
+		}
+		c.Auth.AccountIssuers[account] = secret
+	}
+	for i := range c.Auth.TokenSecrets {
+		secret, err := resolveSecret(c.Auth.TokenSecrets[i].Value)
+		if err != nil {
+			return fmt.Errorf("auth.token_secrets[%d].value: %w", i, err)
+		}
+		c.Auth.TokenSecrets[i].Value = secret
+	}
+	return nil
+}
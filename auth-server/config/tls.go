@@ -0,0 +1,67 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// tlsVersions maps supported config values to TLS protocol versions.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig defines TLS settings for the NATS connection.
+type TLSConfig struct {
+	MinVersion   string   `mapstructure:"min_version"`
+	CipherSuites []string `mapstructure:"cipher_suites"`
+
+	// CAFile verifies the server against these PEM CAs instead of the system roots
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile present a client certificate, e.g. for TLS verify on the server
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// InsecureSkipVerify accepts any server certificate; for testing only
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+}
+
+// Enabled reports whether any TLS setting is configured.
+func (c TLSConfig) Enabled() bool {
+	return c.MinVersion != "" || len(c.CipherSuites) > 0 || c.CAFile != "" ||
+		c.CertFile != "" || c.KeyFile != "" || c.InsecureSkipVerify
+}
+
+// Build creates a tls.Config from the configured values. The minimum version
+// defaults to TLS 1.2. Cipher suites are given by their Go names (for example
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256") and only apply to TLS 1.2; TLS 1.3
+// suites are not configurable. The CA and client certificate files are loaded
+// by the NATS connection options, not here.
+func (c TLSConfig) Build() (*tls.Config, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS min_version %q (expected 1.2 or 1.3)", c.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+	if len(c.CipherSuites) == 0 {
+		return tc, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, name := range c.CipherSuites {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+	return tc, nil
+}
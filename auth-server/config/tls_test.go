@@ -0,0 +1,104 @@
+package config_test
+
+import (
+	"crypto/tls"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSConfigBuild(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         config.TLSConfig
+		wantMin     uint16
+		wantCiphers []uint16
+		expectErr   string
+	}{
+		{
+			name:    "defaults to TLS 1.2",
+			cfg:     config.TLSConfig{},
+			wantMin: tls.VersionTLS12,
+		},
+		{
+			name:    "TLS 1.3",
+			cfg:     config.TLSConfig{MinVersion: "1.3"},
+			wantMin: tls.VersionTLS13,
+		},
+		{
+			name: "restricted cipher suites",
+			cfg: config.TLSConfig{
+				MinVersion: "1.2",
+				CipherSuites: []string{
+					"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+					"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+				},
+			},
+			wantMin: tls.VersionTLS12,
+			wantCiphers: []uint16{
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			},
+		},
+		{
+			name:    "skip verification",
+			cfg:     config.TLSConfig{InsecureSkipVerify: true},
+			wantMin: tls.VersionTLS12,
+		},
+		{
+			name:      "client cert without key",
+			cfg:       config.TLSConfig{CertFile: "/etc/nats/client.pem"},
+			expectErr: "cert_file and key_file must be set together",
+		},
+		{
+			name:      "client key without cert",
+			cfg:       config.TLSConfig{KeyFile: "/etc/nats/client-key.pem"},
+			expectErr: "cert_file and key_file must be set together",
+		},
+		{
+			name:      "unsupported version",
+			cfg:       config.TLSConfig{MinVersion: "1.0"},
+			expectErr: `unsupported TLS min_version "1.0"`,
+		},
+		{
+			name:      "unknown cipher suite",
+			cfg:       config.TLSConfig{CipherSuites: []string{"TLS_FAKE_CIPHER"}},
+			expectErr: `unknown TLS cipher suite "TLS_FAKE_CIPHER"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := tt.cfg.Build()
+			if tt.expectErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantMin, tc.MinVersion)
+			assert.Equal(t, tt.wantCiphers, tc.CipherSuites)
+			assert.Equal(t, tt.cfg.InsecureSkipVerify, tc.InsecureSkipVerify)
+		})
+	}
+}
+
+func TestLoadRejectsUnknownCipherSuite(t *testing.T) {
+	tmpFile := createTempConfigFile(t, `
+nats:
+  url: nats://localhost:4222
+  tls:
+    min_version: "1.2"
+    cipher_suites: ["TLS_FAKE_CIPHER"]
+auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+`)
+	defer removeTmpFile(tmpFile)
+
+	_, err := config.Load(tmpFile.Name())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `nats.tls: unknown TLS cipher suite "TLS_FAKE_CIPHER"`)
+}
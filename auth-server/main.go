@@ -3,38 +3,384 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/audit"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/authkeys"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/authresponse"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/cloudevents"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/config"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/metrics"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/permissions"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/policy"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/reload"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/usersdebug"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/usershttp"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/vault"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	_ "time/tzdata" // Time zones for user Locales on images without zoneinfo
 
+	_ "github.com/lib/pq" // PostgreSQL driver for auth.users_dsn
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/micro"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
-	logrus.SetLevel(logrus.DebugLevel) // Включаем Debug
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// newLogFormatter returns the formatter for the configured log format: one JSON
+// object per line for log aggregation, or human-readable text.
+func newLogFormatter(format string) logrus.Formatter {
+	if format == "json" {
+		return &logrus.JSONFormatter{}
+	}
+	return &logrus.TextFormatter{}
+}
+
+// configFiles collects config file paths from a repeated or comma-separated flag.
+type configFiles []string
+
+func (f *configFiles) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *configFiles) Set(value string) error {
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			*f = append(*f, path)
+		}
+	}
+	return nil
+}
+
+// calloutSubject is the subject NATS servers send authorization requests to.
+const calloutSubject = "$SYS.REQ.USER.AUTH"
+
+// service is the part of micro.Service used to register endpoints.
+type service interface {
+	AddGroup(string, ...micro.GroupOpt) micro.Group
+	AddEndpoint(string, micro.Handler, ...micro.EndpointOpt) error
+	Stop() error
+}
+
+// registerEndpoints adds the auth callout endpoint, the user JWT renewal
+// endpoint when its subject is configured and, when an admin token is
+// configured, the JWT preview and flush endpoints. The service is stopped if any endpoint
+// fails to register so no half-configured service keeps running.
+func registerEndpoints(srv service, authHandler *authresponse.Handler, cfg *config.Config) error {
+	err := srv.
+		AddGroup("$SYS").
+		AddGroup("REQ").
+		AddGroup("USER").
+		AddEndpoint("AUTH", micro.HandlerFunc(authHandler.HandleRequest))
+	if err != nil {
+		stopService(srv)
+		return fmt.Errorf("register auth callout endpoint on %q (subject already served by another instance or malformed?): %w", calloutSubject, err)
+	}
+	if cfg.Auth.RenewSubject != "" {
+		err = srv.AddEndpoint("RENEW", authHandler.NewRenewHandler(),
+			micro.WithEndpointSubject(cfg.Auth.RenewSubject))
+		if err != nil {
+			stopService(srv)
+			return fmt.Errorf("register renewal endpoint on %q: %w", cfg.Auth.RenewSubject, err)
+		}
+		logrus.WithField("subject", cfg.Auth.RenewSubject).Info("User JWT renewal available")
+	}
+	if cfg.Admin.Token != "" {
+		err = srv.AddEndpoint("PREVIEW", authHandler.NewPreviewHandler(cfg.Admin.Token),
+			micro.WithEndpointSubject(cfg.Admin.PreviewSubject))
+		if err != nil {
+			stopService(srv)
+			return fmt.Errorf("register preview endpoint on %q: %w", cfg.Admin.PreviewSubject, err)
+		}
+		logrus.WithField("subject", cfg.Admin.PreviewSubject).Info("User JWT preview available")
+
+		err = srv.AddEndpoint("FLUSH", authHandler.NewFlushHandler(cfg.Admin.Token),
+			micro.WithEndpointSubject(cfg.Admin.FlushSubject))
+		if err != nil {
+			stopService(srv)
+			return fmt.Errorf("register flush endpoint on %q: %w", cfg.Admin.FlushSubject, err)
+		}
+		logrus.WithField("subject", cfg.Admin.FlushSubject).Info("In-memory state flush available")
+	}
+	return nil
+}
+
+// stopService stops the service, logging rather than returning a failure so the
+// registration error stays the one reported.
+func stopService(srv service) {
+	if err := srv.Stop(); err != nil {
+		logrus.WithError(err).Error("Failed to stop service")
+	}
+}
+
+// maxConnectBackoff caps the wait between startup connection attempts.
+const maxConnectBackoff = 30 * time.Second
+
+// connectWithRetry calls connect until it succeeds or retries further attempts
+// have failed, sleeping backoff before the first retry and doubling it after
+// each one up to maxConnectBackoff. The last connection error is returned.
+func connectWithRetry(connect func() (*nats.Conn, error), retries int, backoff time.Duration, sleep func(time.Duration)) (*nats.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		nc, err := connect()
+		if err == nil || attempt >= retries {
+			return nc, err
+		}
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"attempt": attempt + 1,
+			"retries": retries,
+			"backoff": backoff.String(),
+		}).Warn("NATS connection failed, retrying")
+		sleep(backoff)
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+// reconnectOptions makes the connection survive NATS server restarts: it
+// reconnects up to maxReconnects times (-1 for forever), waiting wait between
+// attempts, and logs every connection state change.
+func reconnectOptions(maxReconnects int, wait time.Duration) []nats.Option {
+	return []nats.Option{
+		nats.MaxReconnects(maxReconnects),
+		nats.ReconnectWait(wait),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			logrus.WithError(err).WithField("url", nc.ConnectedUrlRedacted()).Warn("NATS connection lost, reconnecting")
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logrus.WithFields(logrus.Fields{
+				"url":        nc.ConnectedUrlRedacted(),
+				"reconnects": nc.Stats().Reconnects,
+			}).Info("NATS connection restored")
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			entry := logrus.WithField("reconnects", nc.Stats().Reconnects)
+			if err := nc.LastError(); err != nil {
+				entry.WithError(err).Error("NATS connection closed, no longer serving authorization requests")
+				return
+			}
+			entry.Info("NATS connection closed")
+		}),
+	}
+}
+
+// tlsOptions translates the TLS settings into NATS connection options. The CA
+// and client certificate files are re-read on every reconnect, so renewed
+// certificates are picked up without a restart.
+func tlsOptions(c config.TLSConfig) ([]nats.Option, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	tlsConfig, err := c.Build()
+	if err != nil {
+		return nil, fmt.Errorf("build tls config: %w", err)
+	}
+	opts := []nats.Option{nats.Secure(tlsConfig)}
+	if c.CAFile != "" {
+		opts = append(opts, nats.RootCAs(c.CAFile))
+	}
+	if c.CertFile != "" {
+		opts = append(opts, nats.ClientCert(c.CertFile, c.KeyFile))
+	}
+	if c.InsecureSkipVerify {
+		logrus.Warn("NATS server certificate verification is disabled, do not use in production")
+	}
+	return opts, nil
+}
+
+// userRepository is a user backend that reports whether it serves the insecure
+// embedded users.
+type userRepository interface {
+	authresponse.UserRepository
+	Insecure() bool
+}
+
+// openUsersDB connects to the users database configured with auth.users_dsn.
+func openUsersDB(cfg *config.Config) (*sql.DB, error) {
+	db, err := sql.Open(cfg.Auth.UsersDriver, cfg.Auth.UsersDSN)
+	if err != nil {
+		return nil, fmt.Errorf("open users database: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		if closeErr := db.Close(); closeErr != nil {
+			logrus.WithError(closeErr).Debug("Failed to close users database")
+		}
+		return nil, fmt.Errorf("connect users database: %w", err)
+	}
+	return db, nil
+}
+
+// newUserRepository creates the user backend selected by auth.backend and
+// checks the users files against the configured limits and templates. The
+// insecure embedded users, loaded when no users files are configured, are
+// refused in production so a real user backend must be configured there.
+func newUserRepository(cfg *config.Config, db *sql.DB) (userRepository, error) {
+	repo, err := authresponse.NewRepository(authresponse.RepoConfig{
+		Type:       cfg.Auth.Backend,
+		Files:      cfg.UsersFiles(),
+		Duplicates: usersdebug.DuplicatePolicy(cfg.Auth.DuplicateUsers),
+		DB:         db,
+		Query:      cfg.Auth.UsersQuery,
+		HTTP: usershttp.Config{
+			URL:     cfg.Auth.UsersHTTP.URL,
+			Token:   cfg.Auth.UsersHTTP.Token,
+			Timeout: cfg.Auth.UsersHTTP.Timeout,
+			Retries: cfg.Auth.UsersHTTP.Retries,
+			Backoff: cfg.Auth.UsersHTTP.Backoff,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create userRepo: %w", err)
+	}
+	fileRepo, ok := repo.(*usersdebug.Repository)
+	if !ok {
+		userRepo, ok := repo.(userRepository)
+		if !ok {
+			return nil, fmt.Errorf("user repository %T does not report whether it is insecure", repo)
+		}
+		return userRepo, nil
+	}
+	if err := fileRepo.CheckMaxAccounts(cfg.Auth.MaxAccounts); err != nil {
+		return nil, fmt.Errorf("auth.max_accounts: %w", err)
+	}
+	templates := make([]string, 0, len(cfg.Auth.PermissionTemplates))
+	for name := range cfg.Auth.PermissionTemplates {
+		templates = append(templates, name)
+	}
+	if err := fileRepo.CheckTemplates(templates); err != nil {
+		return nil, fmt.Errorf("auth.permission_templates: %w", err)
+	}
+	fileRepo.ValidateReloads(cfg.Auth.MaxAccounts, templates)
+	if fileRepo.Insecure() && strings.EqualFold(cfg.Environment, "production") {
+		return nil, fmt.Errorf("refusing to start in production with the insecure embedded users: configure auth.users_file")
+	}
+	return fileRepo, nil
+}
+
+// tokenSecretsOf converts the configured labeled token secrets.
+func tokenSecretsOf(cfg *config.Config) []tokenvalidation.Secret {
+	if len(cfg.Auth.TokenSecrets) == 0 {
+		return nil
+	}
+	secrets := make([]tokenvalidation.Secret, 0, len(cfg.Auth.TokenSecrets))
+	for _, secret := range cfg.Auth.TokenSecrets {
+		secrets = append(secrets, tokenvalidation.Secret{Label: secret.Label, Value: secret.Value})
+	}
+	return secrets
+}
+
+// applyVaultSecrets fetches the secrets referenced in the vault section and
+// stores them in cfg, overriding the direct values. A Vault token secret is
+// tried first, labeled "vault", before any configured token secrets.
+func applyVaultSecrets(cfg *config.Config, r vault.Reader) error {
+	secrets, err := vault.Fetch(r, vault.Refs{
+		IssuerSeed:  cfg.Vault.IssuerSeed,
+		XKeySeed:    cfg.Vault.XKeySeed,
+		TokenSecret: cfg.Vault.TokenSecret,
+		NatsPass:    cfg.Vault.NatsPass,
+	})
+	if err != nil {
+		return fmt.Errorf("fetch vault secrets: %w", err)
+	}
+	if secrets.IssuerSeed != "" {
+		cfg.Auth.IssuerSeed = secrets.IssuerSeed
+	}
+	if secrets.XKeySeed != "" {
+		cfg.Auth.XKeySeed = secrets.XKeySeed
+	}
+	if secrets.NatsPass != "" {
+		cfg.Nats.Pass = secrets.NatsPass
+	}
+	if secrets.TokenSecret != "" {
+		cfg.Auth.TokenSecrets = append([]config.TokenSecret{{Label: "vault", Value: secrets.TokenSecret}}, cfg.Auth.TokenSecrets...)
+	}
+	return nil
+}
+
+// refreshSecrets fetches the Vault secrets again on top of base and hands the
+// new keys and token secrets to the handler. The NATS password takes effect on
+// the next reconnect.
+func refreshSecrets(base *config.Config, r vault.Reader, h *authresponse.Handler, natsPass *atomic.Pointer[string]) error {
+	cfg := *base
+	if err := applyVaultSecrets(&cfg, r); err != nil {
+		return err
+	}
+	keyPairs, err := authkeys.Parse(cfg.Auth.IssuerSeed, cfg.Auth.XKeySeed, cfg.Auth.IssuerAccount, cfg.Auth.AccountIssuers)
+	if err != nil {
+		return fmt.Errorf("parse auth keys: %w", err)
+	}
+	h.UpdateSecrets(keyPairs, tokenSecretsOf(&cfg))
+	natsPass.Store(&cfg.Nats.Pass)
+	return nil
+}
+
 func run() error {
 	// Configuration
-	configFile := flag.String("config", "config.yml", "Path to config file")
+	var configPaths configFiles
+	flag.Var(&configPaths, "config", "Path to config file; repeat or comma-separate to merge several, later files win (default config.yml)")
+	validateOnly := flag.Bool("validate", false, "Check the config, keys and users, print a report and exit")
+	asJSON := flag.Bool("json", false, "With -validate, print the report as JSON")
+	showVersion := flag.Bool("version", false, "Print the version, commit and build date and exit")
 	flag.Parse()
+	if *showVersion {
+		fmt.Println(currentBuild())
+		return nil
+	}
+	if len(configPaths) == 0 {
+		configPaths = configFiles{"config.yml"}
+	}
+	if *validateOnly {
+		report := validate(configPaths)
+		if err := writeReport(os.Stdout, report, *asJSON); err != nil {
+			return fmt.Errorf("write report: %w", err)
+		}
+		if !report.Valid {
+			return fmt.Errorf("configuration is invalid")
+		}
+		return nil
+	}
 
-	cfg, err := config.Load(*configFile)
+	cfg, err := config.Load(configPaths...)
 	if err != nil {
 		return fmt.Errorf("load config: %w", err)
 	}
+	logrus.SetFormatter(newLogFormatter(cfg.Log.Format))
+	level, err := logrus.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	logrus.SetLevel(level)
+	// The config holds seeds and secrets, so only its files are logged
+	logrus.WithField("files", configPaths).Debug("Loaded config")
+
+	// Secrets from Vault override the direct values; base keeps the config
+	// without them so refreshes on SIGHUP start from the same values
+	base := *cfg
+	var vaultClient vault.Reader
+	if cfg.Vault.Enabled {
+		vaultClient = vault.NewClient(cfg.Vault.Address, cfg.Vault.Token)
+		if err := applyVaultSecrets(cfg, vaultClient); err != nil {
+			return err
+		}
+		logrus.WithField("address", cfg.Vault.Address).Info("Loaded secrets from Vault")
+	}
 
 	// Validation
 	if cfg.Nats.URL == "" || cfg.Auth.IssuerSeed == "" {
@@ -42,63 +388,239 @@ func run() error {
 	}
 
 	// Initialize auth
-	keyPairs, err := authkeys.Parse(cfg.Auth.IssuerSeed, cfg.Auth.XKeySeed)
+	keyPairs, err := authkeys.Parse(cfg.Auth.IssuerSeed, cfg.Auth.XKeySeed, cfg.Auth.IssuerAccount, cfg.Auth.AccountIssuers)
 	if err != nil {
 		return fmt.Errorf("parse auth keys: %w", err)
 	}
+	var usersDB *sql.DB
+	if cfg.Auth.Backend == config.BackendSQL {
+		if usersDB, err = openUsersDB(cfg); err != nil {
+			return err
+		}
+		defer func() {
+			if err := usersDB.Close(); err != nil {
+				logrus.WithError(err).Error("Failed to close users database")
+			}
+		}()
+	}
+	userRepo, err := newUserRepository(cfg, usersDB)
+	if err != nil {
+		return err
+	}
+	logrus.WithField("insecure", userRepo.Insecure()).Info("Loaded user repository")
+
 	// NATS Connection
-	nc, err := nats.Connect(
-		cfg.Nats.URL,
-		nats.UserInfo(cfg.Nats.User, cfg.Nats.Pass),
+	var natsPass atomic.Pointer[string]
+	natsPass.Store(&cfg.Nats.Pass)
+	natsOpts := []nats.Option{
+		nats.UserInfoHandler(func() (string, string) {
+			return cfg.Nats.User, *natsPass.Load()
+		}),
 		nats.Name("auth-service"),
-	)
+	}
+	natsOpts = append(natsOpts, reconnectOptions(cfg.Nats.MaxReconnects, cfg.Nats.ReconnectWait)...)
+	tlsOpts, err := tlsOptions(cfg.Nats.TLS)
+	if err != nil {
+		return err
+	}
+	natsOpts = append(natsOpts, tlsOpts...)
+	nc, err := connectWithRetry(func() (*nats.Conn, error) {
+		return nats.Connect(cfg.Nats.URL, natsOpts...)
+	}, cfg.Nats.ConnectRetries, cfg.Nats.ConnectBackoff, time.Sleep)
 	if err != nil {
 		return fmt.Errorf("nats connect: %w", err)
 	}
 	defer func() {
 		if err := nc.Drain(); err != nil {
-			log.Printf("failed to drain NATS connection: %v", err)
+			logrus.WithError(err).Error("Failed to drain NATS connection")
 		}
 	}()
 
 	// Microservice setup
+	build := currentBuild()
+	metadata := build.metadata()
+	metadata["env"] = cfg.Environment
+	metadata["region"] = "Russia" // Optional additional metadata
 	srv, err := micro.AddService(nc, micro.Config{
 		Name:        "auth-callout",
-		Version:     "0.0.1",
+		Version:     build.serviceVersion(),
 		Description: "Authentication service",
-		Metadata: map[string]string{
-			"env":    cfg.Environment,
-			"region": "Russia", // Optional additional metadata},
-		},
+		Metadata:    metadata,
 	})
 	if err != nil {
 		return fmt.Errorf("create service: %w", err)
 	}
 
 	// Endpoint setup
-	userRepo, err := usersdebug.New()
-	if err != nil {
-		return fmt.Errorf("cannot create userRepo: %w", err)
-	}
-	log.Print("Repo %w", userRepo)
 
-	authHandler := authresponse.NewHandler(keyPairs, userRepo)
+	ceilings := make(map[string]permissions.Ceiling, len(cfg.Auth.AccountCeilings))
+	for account, c := range cfg.Auth.AccountCeilings {
+		ceilings[account] = permissions.Ceiling{Pub: c.Pub, Sub: c.Sub}
+	}
+	connCeilings := make(map[string]permissions.Ceiling, len(cfg.Auth.ConnectionTypeCeilings))
+	for connType, c := range cfg.Auth.ConnectionTypeCeilings {
+		connCeilings[connType] = permissions.Ceiling{Pub: c.Pub, Sub: c.Sub}
+	}
+	templates := make(map[string]jwt.Permissions, len(cfg.Auth.PermissionTemplates))
+	for name, t := range cfg.Auth.PermissionTemplates {
+		templates[name] = t.Permissions()
+	}
+	accountPerms := make(map[string]jwt.Permissions, len(cfg.Auth.AccountPermissions))
+	for account, p := range cfg.Auth.AccountPermissions {
+		accountPerms[account] = p.Permissions()
+	}
+	opts := []authresponse.Option{
+		authresponse.WithKnownAccounts(cfg.Auth.Accounts),
+		authresponse.WithPermissionLogging(cfg.Log.Permissions),
+		authresponse.WithNoCredentialsMessage(cfg.Auth.NoCredentialsMessage),
+		authresponse.WithServerInfo(cfg.Log.ServerInfo),
+		authresponse.WithTrustedServers(cfg.Auth.TrustedServers),
+		authresponse.WithTrustedServerIDs(cfg.Auth.TrustedServerIDs),
+		authresponse.WithAccountPermissions(accountPerms),
+		authresponse.WithPermissionTemplates(templates, cfg.Auth.TemplateMerge),
+		authresponse.WithPermissionCacheSize(cfg.Auth.PermissionCacheSize),
+		authresponse.WithAccountCeilings(ceilings),
+		authresponse.WithConnectionTypeCeilings(connCeilings),
+		authresponse.WithTokenCeiling(permissions.Ceiling{Pub: cfg.Auth.TokenCeiling.Pub, Sub: cfg.Auth.TokenCeiling.Sub}),
+		authresponse.WithBlocklist(authresponse.Blocklist{
+			Subjects:       cfg.Auth.Blocklist.Subjects,
+			ExemptAccounts: cfg.Auth.Blocklist.ExemptAccounts,
+			Reject:         cfg.Auth.Blocklist.Reject,
+		}),
+		authresponse.WithBroadWildcards(cfg.Auth.BroadWildcards.Mode, cfg.Auth.BroadWildcards.Admins),
+		authresponse.WithEmptyTokenPermissions(cfg.Auth.EmptyTokenPermissions),
+		authresponse.WithTokenSecrets(tokenSecretsOf(cfg)),
+		authresponse.WithTokenAudience(cfg.Auth.TokenAudience),
+		authresponse.WithTokenIssuer(cfg.Auth.TokenIssuer),
+		authresponse.WithTokenLeeway(cfg.Auth.TokenLeeway),
+		authresponse.WithTokenMaxIssuedAtSkew(cfg.Auth.TokenMaxIatSkew),
+		authresponse.WithTokenAuth(!cfg.Auth.DisableTokenAuth),
+		authresponse.WithTokenIdentityOnly(cfg.Auth.TokenIdentityOnly),
+		authresponse.WithRehashCost(cfg.Auth.BcryptCost),
+		authresponse.WithErrorCategories(cfg.Auth.ErrorCategories),
+		authresponse.WithAutoInboxSub(cfg.Auth.AutoInboxSub),
+		authresponse.WithPasswordDeprecation(cfg.Auth.DeprecatePasswords),
+		authresponse.WithResponseTTL(cfg.Auth.ResponseTTL),
+		authresponse.WithEchoHeaders(cfg.Auth.EchoHeaders),
+		authresponse.WithSlowRequestThreshold(cfg.Auth.SlowRequestThreshold),
+		authresponse.WithUserJWTTTL(cfg.Auth.UserJWTTTL),
+		authresponse.WithRequiredJWTExpiry(cfg.Auth.RequireJWTExpiry.Mode, cfg.Auth.RequireJWTExpiry.DefaultTTL),
+		authresponse.WithMaxUserJWTSize(cfg.Auth.MaxUserJWTSize),
+		authresponse.WithRateLimit(cfg.Auth.RateLimit.RequestsPerSecond, cfg.Auth.RateLimit.Burst, cfg.Auth.RateLimit.PerClient),
+		authresponse.WithErrorCodes(cfg.Auth.ErrorCodes.Overrides),
+	}
+	if cfg.Events.Enabled {
+		sink := cloudevents.NewSink(nc, cfg.Events.Subject, cfg.Events.Source)
+		opts = append(opts, authresponse.WithDecisionRecorder(sink))
+		logrus.WithField("subject", cfg.Events.Subject).Info("Publishing auth decisions as CloudEvents")
+	}
+	if cfg.Auth.TokenCacheSize > 0 {
+		tokenCache := tokenvalidation.NewCache(cfg.Auth.TokenCacheSize)
+		opts = append(opts,
+			authresponse.WithTokenCache(tokenCache),
+			authresponse.WithFlusher("token_cache", tokenCache),
+		)
+		logrus.WithField("size", cfg.Auth.TokenCacheSize).Info("Caching validated nats_tokens")
+	}
+	var auditFile *audit.File
+	if cfg.Audit.File != "" {
+		auditFile, err = audit.OpenFile(cfg.Audit.File)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := auditFile.Close(); err != nil {
+				logrus.WithError(err).Error("Failed to close audit file")
+			}
+		}()
+		opts = append(opts, authresponse.WithAuditor(auditFile))
+		logrus.WithField("file", cfg.Audit.File).Info("Writing audit trail")
+	}
+	if cfg.Auth.Policy.URL != "" {
+		policyService := policy.NewService(cfg.Auth.Policy.URL, cfg.Auth.Policy.CacheTTL, cfg.Auth.Policy.Timeout)
+		opts = append(opts,
+			authresponse.WithPermissionSource(policyService),
+			authresponse.WithFlusher("policy_cache", policyService),
+		)
+		logrus.WithField("url", cfg.Auth.Policy.URL).Info("Resolving permissions from the policy service")
+	}
+	var m *metrics.Metrics
+	if cfg.Metrics.Addr != "" {
+		reg := prometheus.NewRegistry()
+		m = metrics.New(reg, cfg.Auth.Accounts...)
+		metricsServer := metrics.NewServer(cfg.Metrics.Addr, reg)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.WithError(err).Error("Metrics server failed")
+			}
+		}()
+		defer func() {
+			if err := metricsServer.Close(); err != nil {
+				logrus.WithError(err).Error("Failed to close metrics server")
+			}
+		}()
+		logrus.WithField("address", cfg.Metrics.Addr).Info("Serving Prometheus metrics on /metrics")
+	}
+	opts = append(opts, authresponse.WithMetrics(m))
+	if userRepo.Insecure() {
+		m.FallbackApplied(metrics.FallbackDefaultUsers, logrus.Fields{"environment": cfg.Environment})
+	}
+	authHandler := authresponse.NewHandler(keyPairs, userRepo, opts...)
 
-	err = srv.
-		AddGroup("$SYS").
-		AddGroup("REQ").
-		AddGroup("USER").
-		AddEndpoint("AUTH", micro.HandlerFunc(authHandler.HandleRequest))
-	if err != nil {
-		return fmt.Errorf("add endpoint: %w", err)
+	if err := registerEndpoints(srv, authHandler, cfg); err != nil {
+		return err
 	}
 	// Graceful shutdown
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	log.Printf("Service started, waiting for shutdown signal")
-	<-ctx.Done()
-	log.Printf("Shutting down")
+	// Users files are reloaded on change and on SIGHUP, one reload at a time
+	var usersReloader *reload.Reloader
+	if fileRepo, ok := userRepo.(*usersdebug.Repository); ok && !fileRepo.Insecure() {
+		usersReloader = reload.New(fileRepo.Reload)
+		go func() {
+			if err := fileRepo.Watch(ctx, usersReloader.Trigger); err != nil {
+				logrus.WithError(err).Error("Stopped watching users files, changes need a restart")
+			}
+		}()
+	}
 
-	return nil
+	// Reloads run one at a time; signals arriving during a reload are coalesced
+	reloader := reload.New(func() error {
+		if auditFile != nil {
+			if err := auditFile.Reopen(); err != nil {
+				return fmt.Errorf("reopen audit file: %w", err)
+			}
+			logrus.Info("Reopened audit file")
+		}
+		if vaultClient == nil {
+			return nil
+		}
+		if err := refreshSecrets(&base, vaultClient, authHandler, &natsPass); err != nil {
+			return fmt.Errorf("refresh secrets from Vault: %w", err)
+		}
+		logrus.Info("Refreshed secrets from Vault")
+		return nil
+	})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	logrus.WithFields(logrus.Fields{
+		"version":    build.Version,
+		"commit":     build.Commit,
+		"build_date": build.BuildDate,
+	}).Info("Service started, waiting for shutdown signal")
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Info("Shutting down")
+			return nil
+		case <-hup:
+			go reloader.Trigger()
+			if usersReloader != nil {
+				go usersReloader.Trigger()
+			}
+		}
+	}
 }
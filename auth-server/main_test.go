@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/authresponse"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/config"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLogFormatter(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(newLogFormatter("json"))
+
+	logger.WithField("subject", "auth.renew").Info("User JWT renewal available")
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry), "log line must be JSON: %s", out.String())
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "User JWT renewal available", entry["msg"])
+	assert.Equal(t, "auth.renew", entry["subject"])
+	assert.Contains(t, entry, "time")
+
+	out.Reset()
+	logger.SetFormatter(newLogFormatter("text"))
+	logger.Info("Service started")
+	assert.Contains(t, out.String(), `msg="Service started"`)
+	assert.Error(t, json.Unmarshal(out.Bytes(), &entry))
+}
+
+// fakeService fails registration of the configured endpoint subjects and
+// records whether the service was stopped.
+type fakeService struct {
+	prefix  string
+	failOn  map[string]error
+	stopped *bool
+}
+
+func newFakeService(failOn map[string]error) *fakeService {
+	return &fakeService{failOn: failOn, stopped: new(bool)}
+}
+
+func (s *fakeService) AddGroup(name string, _ ...micro.GroupOpt) micro.Group {
+	return &fakeService{prefix: s.prefix + name + ".", failOn: s.failOn, stopped: s.stopped}
+}
+
+func (s *fakeService) AddEndpoint(name string, _ micro.Handler, _ ...micro.EndpointOpt) error {
+	subject := s.prefix + name
+	if err, ok := s.failOn[subject]; ok {
+		return err
+	}
+	return nil
+}
+
+func (s *fakeService) Stop() error {
+	*s.stopped = true
+	return nil
+}
+
+func TestRegisterEndpoints(t *testing.T) {
+	handler := authresponse.NewHandler(&auth.KeyPairs{}, nil)
+	registerErr := errors.New("nats: invalid subject")
+
+	tests := []struct {
+		name         string
+		adminToken   string
+		renewSubject string
+		failOn       map[string]error
+		wantErr      string
+		wantStopped  bool
+	}{
+		{name: "auth endpoint only"},
+		{name: "with preview endpoint", adminToken: "secret"},
+		{
+			name:        "auth endpoint fails",
+			failOn:      map[string]error{calloutSubject: registerErr},
+			wantErr:     `register auth callout endpoint on "$SYS.REQ.USER.AUTH"`,
+			wantStopped: true,
+		},
+		{
+			name:        "preview endpoint fails",
+			adminToken:  "secret",
+			failOn:      map[string]error{"PREVIEW": registerErr},
+			wantErr:     `register preview endpoint on "auth.admin.preview"`,
+			wantStopped: true,
+		},
+		{
+			name:         "renewal endpoint fails",
+			renewSubject: "auth.renew",
+			failOn:       map[string]error{"RENEW": registerErr},
+			wantErr:      `register renewal endpoint on "auth.renew"`,
+			wantStopped:  true,
+		},
+		{
+			name:        "flush endpoint fails",
+			adminToken:  "secret",
+			failOn:      map[string]error{"FLUSH": registerErr},
+			wantErr:     `register flush endpoint on "auth.admin.flush"`,
+			wantStopped: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Admin.Token = tt.adminToken
+			cfg.Auth.RenewSubject = tt.renewSubject
+			cfg.Admin.PreviewSubject = "auth.admin.preview"
+			cfg.Admin.FlushSubject = "auth.admin.flush"
+			srv := newFakeService(tt.failOn)
+
+			err := registerEndpoints(srv, handler, cfg)
+
+			assert.Equal(t, tt.wantStopped, *srv.stopped)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				assert.ErrorIs(t, err, registerErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestNewUserRepository(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.yaml")
+	require.NoError(t, os.WriteFile(usersFile, []byte("alice:\n  Pass: alice\n  Account: PRODUCTION\nsys:\n  Pass: sys\n  Account: SYS\n"), 0o600))
+
+	tests := []struct {
+		name         string
+		environment  string
+		backend      string
+		usersFile    string
+		maxAccounts  int
+		wantErr      string
+		wantInsecure bool
+	}{
+		{name: "development with embedded users", environment: "development", wantInsecure: true},
+		{name: "production with embedded users", environment: "production", wantErr: "refusing to start in production"},
+		{name: "production with embedded users, any case", environment: "PRODUCTION", wantErr: "refusing to start in production"},
+		{name: "production with users file", environment: "production", usersFile: usersFile},
+		{name: "users over the account cap", environment: "production", usersFile: usersFile, maxAccounts: 1, wantErr: "auth.max_accounts: users reference"},
+		{name: "production with users service", environment: "production", backend: config.BackendHTTP},
+		// A mistyped users file path must fail rather than fall back to the embedded users
+		{name: "development with missing users file", environment: "development", usersFile: usersFile + ".typo", wantErr: "users.yaml.typo"},
+		{name: "production with missing users file", environment: "production", usersFile: usersFile + ".typo", wantErr: "users.yaml.typo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Environment: tt.environment}
+			cfg.Auth.Backend = tt.backend
+			if cfg.Auth.Backend == "" {
+				cfg.Auth.Backend = config.BackendYAML // As defaulted by config.Load
+			}
+			cfg.Auth.UsersHTTP.URL = "http://users.internal/lookup"
+			cfg.Auth.UsersFile = tt.usersFile
+			cfg.Auth.DuplicateUsers = "error"
+			cfg.Auth.MaxAccounts = tt.maxAccounts
+
+			repo, err := newUserRepository(cfg, nil)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantInsecure, repo.Insecure())
+		})
+	}
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	connectErr := errors.New("nats: no servers available for connection")
+
+	tests := []struct {
+		name         string
+		failures     int
+		retries      int
+		wantAttempts int
+		wantSleeps   []time.Duration
+		wantErr      bool
+	}{
+		{name: "connects at once", failures: 0, retries: 3, wantAttempts: 1},
+		{name: "no retries configured", failures: 1, retries: 0, wantAttempts: 1, wantErr: true},
+		{
+			name:         "connects after retries",
+			failures:     2,
+			retries:      3,
+			wantAttempts: 3,
+			wantSleeps:   []time.Duration{10 * time.Second, 20 * time.Second},
+		},
+		{
+			name:         "gives up after the last retry",
+			failures:     10,
+			retries:      4,
+			wantAttempts: 5,
+			wantSleeps:   []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second},
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			connect := func() (*nats.Conn, error) {
+				attempts++
+				if attempts <= tt.failures {
+					return nil, connectErr
+				}
+				return &nats.Conn{}, nil
+			}
+			var sleeps []time.Duration
+			sleep := func(d time.Duration) { sleeps = append(sleeps, d) }
+
+			nc, err := connectWithRetry(connect, tt.retries, 10*time.Second, sleep)
+
+			assert.Equal(t, tt.wantAttempts, attempts)
+			assert.Equal(t, tt.wantSleeps, sleeps)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, connectErr)
+				assert.Nil(t, nc)
+				return
+			}
+			require.NoError(t, err)
+			assert.NotNil(t, nc)
+		})
+	}
+}
+
+func TestReconnectOptions(t *testing.T) {
+	opts := nats.GetDefaultOptions()
+	for _, opt := range reconnectOptions(-1, 5*time.Second) {
+		require.NoError(t, opt(&opts))
+	}
+	assert.Equal(t, -1, opts.MaxReconnect)
+	assert.Equal(t, 5*time.Second, opts.ReconnectWait)
+	assert.NotNil(t, opts.DisconnectedErrCB)
+	assert.NotNil(t, opts.ReconnectedCB)
+	assert.NotNil(t, opts.ClosedCB)
+}
+
+// writeTestCert writes a self-signed certificate and its key to dir, returning
+// both file names.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "auth-service"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestTLSOptions(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+
+	t.Run("disabled", func(t *testing.T) {
+		opts, err := tlsOptions(config.TLSConfig{})
+		require.NoError(t, err)
+		assert.Empty(t, opts)
+	})
+
+	t.Run("CA, client certificate and skipped verification", func(t *testing.T) {
+		natsOpts, err := tlsOptions(config.TLSConfig{
+			MinVersion:         "1.3",
+			CAFile:             certFile,
+			CertFile:           certFile,
+			KeyFile:            keyFile,
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		require.Len(t, natsOpts, 3)
+
+		opts := nats.GetDefaultOptions()
+		for _, opt := range natsOpts {
+			require.NoError(t, opt(&opts))
+		}
+		assert.True(t, opts.Secure)
+		require.NotNil(t, opts.TLSConfig)
+		assert.True(t, opts.TLSConfig.InsecureSkipVerify)
+		assert.Equal(t, uint16(tls.VersionTLS13), opts.TLSConfig.MinVersion)
+		assert.NotNil(t, opts.RootCAsCB)
+		assert.NotNil(t, opts.TLSCertCB)
+	})
+
+	t.Run("only the CA", func(t *testing.T) {
+		natsOpts, err := tlsOptions(config.TLSConfig{CAFile: certFile})
+		require.NoError(t, err)
+		opts := nats.GetDefaultOptions()
+		for _, opt := range natsOpts {
+			require.NoError(t, opt(&opts))
+		}
+		assert.True(t, opts.Secure)
+		assert.NotNil(t, opts.RootCAsCB)
+		assert.Nil(t, opts.TLSCertCB)
+	})
+
+	t.Run("certificate without key", func(t *testing.T) {
+		_, err := tlsOptions(config.TLSConfig{CertFile: certFile})
+		assert.EqualError(t, err, "build tls config: cert_file and key_file must be set together")
+	})
+}
+
+// fakeVault serves secrets from memory.
+type fakeVault map[string]map[string]any
+
+func (v fakeVault) Read(path string) (map[string]any, error) {
+	data, ok := v[path]
+	if !ok {
+		return nil, errors.New("vault responded 404 Not Found")
+	}
+	return data, nil
+}
+
+// newVaultSeeds returns freshly generated issuer and xkey seeds.
+func newVaultSeeds(t *testing.T) (string, string) {
+	t.Helper()
+	issuer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	issuerSeed, err := issuer.Seed()
+	require.NoError(t, err)
+	curve, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+	xkeySeed, err := curve.Seed()
+	require.NoError(t, err)
+	return string(issuerSeed), string(xkeySeed)
+}
+
+func vaultConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Nats.Pass = "direct-pass"
+	cfg.Auth.IssuerSeed = "SADIRECT"
+	cfg.Auth.XKeySeed = "SXDIRECT"
+	cfg.Auth.TokenSecrets = []config.TokenSecret{{Label: "2024-key", Value: "direct-secret"}}
+	cfg.Vault.Enabled = true
+	cfg.Vault.IssuerSeed = "secret/data/nats#issuer_seed"
+	cfg.Vault.XKeySeed = "secret/data/nats#xkey_seed"
+	cfg.Vault.TokenSecret = "secret/data/nats#token_secret"
+	cfg.Vault.NatsPass = "secret/data/nats#nats_pass"
+	return cfg
+}
+
+func TestApplyVaultSecrets(t *testing.T) {
+	issuerSeed, xkeySeed := newVaultSeeds(t)
+	vault := fakeVault{"secret/data/nats": {
+		"issuer_seed":  issuerSeed,
+		"xkey_seed":    xkeySeed,
+		"token_secret": "vault-secret",
+		"nats_pass":    "vault-pass",
+	}}
+
+	cfg := vaultConfig()
+	require.NoError(t, applyVaultSecrets(cfg, vault))
+	assert.Equal(t, issuerSeed, cfg.Auth.IssuerSeed)
+	assert.Equal(t, xkeySeed, cfg.Auth.XKeySeed)
+	assert.Equal(t, "vault-pass", cfg.Nats.Pass)
+	assert.Equal(t, []config.TokenSecret{
+		{Label: "vault", Value: "vault-secret"},
+		{Label: "2024-key", Value: "direct-secret"},
+	}, cfg.Auth.TokenSecrets)
+
+	cfg = vaultConfig()
+	err := applyVaultSecrets(cfg, fakeVault{})
+	require.Error(t, err)
+	assert.Equal(t, "direct-pass", cfg.Nats.Pass)
+}
+
+func TestRefreshSecrets(t *testing.T) {
+	issuerSeed, xkeySeed := newVaultSeeds(t)
+	vault := fakeVault{"secret/data/nats": {
+		"issuer_seed":  issuerSeed,
+		"xkey_seed":    xkeySeed,
+		"token_secret": "vault-secret",
+		"nats_pass":    "rotated-pass",
+	}}
+	base := vaultConfig()
+	handler := authresponse.NewHandler(&auth.KeyPairs{}, nil)
+	var natsPass atomic.Pointer[string]
+	natsPass.Store(&base.Nats.Pass)
+
+	require.NoError(t, refreshSecrets(base, vault, handler, &natsPass))
+	assert.Equal(t, "rotated-pass", *natsPass.Load())
+	assert.Equal(t, "direct-pass", base.Nats.Pass, "base config must stay untouched")
+	require.Len(t, base.Auth.TokenSecrets, 1)
+
+	// A failed refresh keeps the current secrets
+	require.Error(t, refreshSecrets(base, fakeVault{}, handler, &natsPass))
+	assert.Equal(t, "rotated-pass", *natsPass.Load())
+}
@@ -0,0 +1,207 @@
+// Package metrics defines the Prometheus metrics of the auth callout service
+// and serves them over HTTP for scraping.
+package metrics
+
+import (
+	"net/http"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// Fallbacks reported by FallbackApplied.
+const (
+	FallbackDefaultUsers               = "default_users"                // Embedded users instead of a users file
+	FallbackAccountPermissions         = "account_permissions"          // Account default permissions merged into a user's
+	FallbackTokenRepositoryPermissions = "token_repository_permissions" // Permission-less token inherited the repository user's
+	FallbackTokenAccountPermissions    = "token_account_permissions"    // Permission-less token inherited the account defaults
+	FallbackTokenDenyAll               = "token_deny_all"               // Permission-less token issued a deny-all JWT
+)
+
+// Results of authorization requests reported by ObserveRequest.
+const (
+	ResultSuccess = "success" // A user JWT was issued
+	ResultDenied  = "denied"  // The credentials or requested access were refused
+	ResultError   = "error"   // The request could not be processed
+)
+
+// methods are the authentication methods requests are labeled with; requests
+// without credentials are labeled "none".
+var methods = []string{"token", "password", "none"}
+
+// Account labels of requests whose account is not one of the configured ones.
+const (
+	AccountNone  = "none"  // No account was resolved, e.g. the credentials were rejected
+	AccountOther = "other" // The account is not configured, capping label cardinality
+)
+
+// Checks reported by UntrustedServer.
+const (
+	CheckIssuer   = "issuer"    // Request signed by a key not in auth.trusted_servers
+	CheckServerID = "server_id" // Request from a server ID not in auth.trusted_server_ids
+)
+
+// Metrics holds the service metrics. A nil *Metrics is valid and records nothing,
+// so callers need not check whether metrics are enabled.
+type Metrics struct {
+	issuedAllowSubjects prometheus.Histogram
+	fallbacks           *prometheus.CounterVec
+	untrustedServers    *prometheus.CounterVec
+	requests            *prometheus.CounterVec
+	requestDuration     *prometheus.HistogramVec
+	tokenFailures       *prometheus.CounterVec
+	serverFailures      *prometheus.CounterVec
+	accounts            map[string]struct{}
+}
+
+// New creates the metrics and registers them with reg. Requests are labeled
+// with their account only for the given accounts; any other account is
+// labeled AccountOther so clients cannot inflate the number of series.
+func New(reg prometheus.Registerer, accounts ...string) *Metrics {
+	m := &Metrics{
+		accounts: make(map[string]struct{}, len(accounts)),
+		issuedAllowSubjects: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "auth_issued_allow_subjects",
+			Help:    "Number of publish and subscribe allow subjects in issued user JWTs.",
+			Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100, 200},
+		}),
+		fallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_fallbacks_applied_total",
+			Help: "Number of times a fallback or default was applied, by fallback.",
+		}, []string{"fallback"}),
+		untrustedServers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_untrusted_server_requests_total",
+			Help: "Number of authorization requests rejected as coming from an untrusted server, by failed check.",
+		}, []string{"check"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_requests_total",
+			Help: "Number of authorization requests, by result, authentication method and account.",
+		}, []string{"result", "method", "account"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "auth_request_duration_seconds",
+			Help:    "Time taken to answer authorization requests, by authentication method.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"method"}),
+		tokenFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_token_validation_failures_total",
+			Help: "Number of nats_tokens that failed validation, by reason.",
+		}, []string{"reason"}),
+		serverFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_server_request_failures_total",
+			Help: "Number of denied or failed authorization requests, by result and requesting server name and cluster.",
+		}, []string{"result", "server_name", "server_cluster"}),
+	}
+	// Export every known fallback from zero so alerts see the first increase
+	for _, fallback := range []string{
+		FallbackDefaultUsers,
+		FallbackAccountPermissions,
+		FallbackTokenRepositoryPermissions,
+		FallbackTokenAccountPermissions,
+		FallbackTokenDenyAll,
+	} {
+		m.fallbacks.WithLabelValues(fallback)
+	}
+	for _, check := range []string{CheckIssuer, CheckServerID} {
+		m.untrustedServers.WithLabelValues(check)
+	}
+	for _, account := range accounts {
+		m.accounts[account] = struct{}{}
+	}
+	for _, method := range methods {
+		for _, result := range []string{ResultSuccess, ResultDenied, ResultError} {
+			for _, account := range append([]string{AccountNone, AccountOther}, accounts...) {
+				m.requests.WithLabelValues(result, method, account)
+			}
+		}
+	}
+	for _, reason := range tokenvalidation.FailureReasons {
+		m.tokenFailures.WithLabelValues(reason)
+	}
+	reg.MustRegister(m.issuedAllowSubjects, m.fallbacks, m.untrustedServers, m.requests, m.requestDuration, m.tokenFailures, m.serverFailures)
+	return m
+}
+
+// ObserveIssuedAllowSubjects records the number of allow subjects of an issued user JWT.
+func (m *Metrics) ObserveIssuedAllowSubjects(n int) {
+	if m == nil {
+		return
+	}
+	m.issuedAllowSubjects.Observe(float64(n))
+}
+
+// FallbackApplied debug-logs and counts an application of the named fallback.
+// Defaults kicking in often are a sign of misconfiguration.
+func (m *Metrics) FallbackApplied(fallback string, fields logrus.Fields) {
+	logrus.WithFields(fields).WithField("fallback", fallback).Debug("Applied fallback")
+	if m == nil {
+		return
+	}
+	m.fallbacks.WithLabelValues(fallback).Inc()
+}
+
+// UntrustedServer counts an authorization request rejected because the
+// requesting server failed the given check.
+func (m *Metrics) UntrustedServer(check string) {
+	if m == nil {
+		return
+	}
+	m.untrustedServers.WithLabelValues(check).Inc()
+}
+
+// ObserveRequest counts an answered authorization request with its result,
+// authentication method, empty when the request carried no credentials, and
+// account, empty when none was resolved, and records how long it took.
+func (m *Metrics) ObserveRequest(method, account, result string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	if method == "" {
+		method = "none"
+	}
+	m.requests.WithLabelValues(result, method, m.accountLabel(account)).Inc()
+	m.requestDuration.WithLabelValues(method).Observe(d.Seconds())
+}
+
+// ServerFailure counts a denied or failed authorization request by the name and
+// cluster of the NATS server that sent it.
+func (m *Metrics) ServerFailure(result, serverName, serverCluster string) {
+	if m == nil {
+		return
+	}
+	m.serverFailures.WithLabelValues(result, serverName, serverCluster).Inc()
+}
+
+// accountLabel bounds account to the configured accounts.
+func (m *Metrics) accountLabel(account string) string {
+	if account == "" {
+		return AccountNone
+	}
+	if _, ok := m.accounts[account]; !ok {
+		return AccountOther
+	}
+	return account
+}
+
+// TokenValidationFailed counts a nats_token rejected for the given reason, one
+// of tokenvalidation.FailureReasons.
+func (m *Metrics) TokenValidationFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.tokenFailures.WithLabelValues(reason).Inc()
+}
+
+// NewServer returns an HTTP server exposing the metrics gathered from g on
+// /metrics at addr. The caller starts and shuts it down.
+func NewServer(addr string, g prometheus.Gatherer) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
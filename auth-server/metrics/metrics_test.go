@@ -0,0 +1,115 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/metrics"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_ObserveRequest(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := metrics.New(reg, "DEVELOPMENT")
+
+	m.ObserveRequest("token", "DEVELOPMENT", metrics.ResultSuccess, 2*time.Millisecond)
+	m.ObserveRequest("password", "STAGING", metrics.ResultDenied, time.Millisecond)
+	m.ObserveRequest("", "", metrics.ResultError, time.Millisecond)
+
+	expected := `
+# HELP auth_requests_total Number of authorization requests, by result, authentication method and account.
+# TYPE auth_requests_total counter
+`
+	var lines []string
+	for _, method := range []string{"none", "password", "token"} {
+		for _, result := range []string{metrics.ResultDenied, metrics.ResultError, metrics.ResultSuccess} {
+			for _, account := range []string{"DEVELOPMENT", metrics.AccountNone, metrics.AccountOther} {
+				value := "0"
+				switch {
+				case method == "token" && result == metrics.ResultSuccess && account == "DEVELOPMENT",
+					method == "password" && result == metrics.ResultDenied && account == metrics.AccountOther,
+					method == "none" && result == metrics.ResultError && account == metrics.AccountNone:
+					value = "1"
+				}
+				lines = append(lines, `auth_requests_total{account="`+account+`",method="`+method+`",result="`+result+`"} `+value)
+			}
+		}
+	}
+	expected += strings.Join(lines, "\n") + "\n"
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "auth_requests_total"))
+
+	durations, err := testutil.GatherAndCount(reg, "auth_request_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 3, durations, "one duration series per method")
+}
+
+func TestMetrics_Failures(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := metrics.New(reg)
+
+	failures, err := testutil.GatherAndCount(reg, "auth_token_validation_failures_total")
+	require.NoError(t, err)
+	assert.Equal(t, len(tokenvalidation.FailureReasons), failures, "every reason is exported from zero")
+
+	m.TokenValidationFailed(tokenvalidation.FailureExpired)
+	m.TokenValidationFailed(tokenvalidation.FailureExpired)
+	m.UntrustedServer(metrics.CheckServerID)
+	m.ServerFailure(metrics.ResultDenied, "nats-1", "east")
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.GetCounter() == nil {
+				continue
+			}
+			name := family.GetName()
+			for _, label := range metric.GetLabel() {
+				name += "," + label.GetValue()
+			}
+			values[name] = metric.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, 2.0, values["auth_token_validation_failures_total,expired"])
+	assert.Equal(t, 0.0, values["auth_token_validation_failures_total,signature"])
+	assert.Equal(t, 1.0, values["auth_untrusted_server_requests_total,server_id"])
+	assert.Equal(t, 0.0, values["auth_untrusted_server_requests_total,issuer"])
+	assert.Equal(t, 1.0, values["auth_server_request_failures_total,denied,east,nats-1"])
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *metrics.Metrics
+	assert.NotPanics(t, func() {
+		m.ObserveRequest("token", "DEVELOPMENT", metrics.ResultSuccess, time.Millisecond)
+		m.ObserveIssuedAllowSubjects(3)
+		m.FallbackApplied(metrics.FallbackDefaultUsers, nil)
+		m.UntrustedServer(metrics.CheckIssuer)
+		m.TokenValidationFailed(tokenvalidation.FailureExpired)
+		m.ServerFailure(metrics.ResultError, "nats-1", "east")
+	})
+}
+
+func TestNewServer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics.New(reg).ObserveRequest("password", "", metrics.ResultDenied, time.Millisecond)
+
+	srv := metrics.NewServer(":9100", reg)
+	assert.Equal(t, ":9100", srv.Addr)
+
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `auth_requests_total{account="none",method="password",result="denied"} 1`)
+
+	rec = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,313 @@
+// Package permissions provides helpers for reasoning about NATS subject
+// permissions: wildcard-aware subject matching, intersection of issued
+// permissions with an account-wide ceiling, and diffs between two grants.
+package permissions
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// Ceiling is the maximum set of subjects any user of an account may be granted.
+// An empty list leaves that direction unrestricted.
+type Ceiling struct {
+	Pub []string // Subjects users may be allowed to publish to
+	Sub []string // Subjects users may be allowed to subscribe to
+}
+
+// Covers reports whether every subject matched by subject is also matched by
+// pattern. Both may contain the NATS wildcards '*' and '>'.
+func Covers(pattern, subject string) bool {
+	pt := strings.Split(pattern, ".")
+	st := strings.Split(subject, ".")
+	for i, p := range pt {
+		if p == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) {
+			return false
+		}
+		switch {
+		case st[i] == ">":
+			return false
+		case p == "*":
+			continue
+		case p != st[i]:
+			return false
+		}
+	}
+	return len(pt) == len(st)
+}
+
+// Apply intersects the permissions with the ceiling and returns the result
+// together with the allow subjects that were removed. Deny lists and response
+// permissions are kept untouched.
+func Apply(perms jwt.Permissions, ceiling Ceiling) (jwt.Permissions, []string) {
+	var stripped, s []string
+	perms.Pub, stripped = intersect(perms.Pub, ceiling.Pub)
+	perms.Sub, s = intersect(perms.Sub, ceiling.Sub)
+	return perms, append(stripped, s...)
+}
+
+// intersect narrows the allow list of p to the ceiling subjects.
+func intersect(p jwt.Permission, ceiling []string) (jwt.Permission, []string) {
+	if len(ceiling) == 0 {
+		return p, nil
+	}
+
+	// An empty allow list grants everything, so the ceiling becomes the allow list
+	if len(p.Allow) == 0 {
+		p.Allow = append(jwt.StringList{}, ceiling...)
+		return p, nil
+	}
+
+	var allow jwt.StringList
+	var stripped []string
+	for _, subject := range p.Allow {
+		if coveredBy(ceiling, subject) {
+			allow.Add(subject)
+			continue
+		}
+		// A subject broader than the ceiling is narrowed to the ceiling subjects it spans
+		narrowed := false
+		for _, limit := range ceiling {
+			if Covers(subject, limit) {
+				allow.Add(limit)
+				narrowed = true
+			}
+		}
+		if !narrowed {
+			stripped = append(stripped, subject)
+		}
+	}
+
+	// Nothing left to allow: an empty allow list would grant everything
+	if len(allow) == 0 {
+		p.Deny = append(jwt.StringList{}, p.Deny...)
+		p.Deny.Add(">")
+	}
+	p.Allow = allow
+	return p, stripped
+}
+
+// coveredBy reports whether any of the patterns covers subject.
+func coveredBy(patterns []string, subject string) bool {
+	for _, pattern := range patterns {
+		if Covers(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge layers the permissions of child over those of parent. Allow and deny
+// lists are united per direction and deny wins: an allow subject covered by any
+// deny subject is dropped. Response permissions of the child take precedence.
+func Merge(parent, child jwt.Permissions) jwt.Permissions {
+	merged := jwt.Permissions{
+		Pub:  merge(parent.Pub, child.Pub),
+		Sub:  merge(parent.Sub, child.Sub),
+		Resp: parent.Resp,
+	}
+	if child.Resp != nil {
+		merged.Resp = child.Resp
+	}
+	return merged
+}
+
+// merge unites two permission lists, dropping allow subjects that are denied.
+func merge(parent, child jwt.Permission) jwt.Permission {
+	var p jwt.Permission
+	p.Deny.Add(parent.Deny...)
+	p.Deny.Add(child.Deny...)
+	for _, subject := range append(append([]string{}, parent.Allow...), child.Allow...) {
+		if !coveredBy(p.Deny, subject) {
+			p.Allow.Add(subject)
+		}
+	}
+	return p
+}
+
+// Normalize returns a copy of perms in a canonical form: allow and deny lists
+// are non-nil with duplicates removed in order, and the response permission is
+// copied so the result shares no memory with perms. A nil Resp stays nil, as
+// a non-nil one enables response permissions.
+func Normalize(perms jwt.Permissions) jwt.Permissions {
+	normalized := jwt.Permissions{
+		Pub: normalize(perms.Pub),
+		Sub: normalize(perms.Sub),
+	}
+	if perms.Resp != nil {
+		resp := *perms.Resp
+		normalized.Resp = &resp
+	}
+	return normalized
+}
+
+// normalize copies p into non-nil, duplicate-free allow and deny lists.
+func normalize(p jwt.Permission) jwt.Permission {
+	return jwt.Permission{
+		Allow: dedupe(p.Allow),
+		Deny:  dedupe(p.Deny),
+	}
+}
+
+// dedupe returns a non-nil copy of subjects without repeated entries.
+func dedupe(subjects []string) jwt.StringList {
+	list := make(jwt.StringList, 0, len(subjects))
+	for _, subject := range subjects {
+		if !slices.Contains(list, subject) {
+			list = append(list, subject)
+		}
+	}
+	return list
+}
+
+// BroadWildcards returns the publish and subscribe allow subjects starting with
+// a wildcard at the root, such as ">" or "*.>", which grant nearly every subject.
+// A direction with neither allow nor deny subjects grants every subject and is
+// reported as ">".
+func BroadWildcards(perms jwt.Permissions) []string {
+	var broad []string
+	for _, p := range []jwt.Permission{perms.Pub, perms.Sub} {
+		if len(p.Allow) == 0 && len(p.Deny) == 0 {
+			broad = append(broad, ">")
+			continue
+		}
+		for _, subject := range p.Allow {
+			root, _, _ := strings.Cut(subject, ".")
+			if root == ">" || root == "*" {
+				broad = append(broad, subject)
+			}
+		}
+	}
+	return broad
+}
+
+// Block keeps the permissions from granting any of the blocked subjects. Allow
+// subjects covered by a blocked subject are removed; allow subjects broader than
+// a blocked subject are kept and the blocked subject is denied instead. An empty
+// allow list, which grants everything, gets every blocked subject denied. It
+// returns the result together with the allow subjects that overlapped a blocked
+// subject.
+func Block(perms jwt.Permissions, blocked []string) (jwt.Permissions, []string) {
+	var offending, s []string
+	perms.Pub, offending = block(perms.Pub, blocked)
+	perms.Sub, s = block(perms.Sub, blocked)
+	return perms, append(offending, s...)
+}
+
+// block removes blocked subjects from the allow list of p.
+func block(p jwt.Permission, blocked []string) (jwt.Permission, []string) {
+	if len(blocked) == 0 {
+		return p, nil
+	}
+
+	var deny jwt.StringList
+	deny.Add(p.Deny...)
+	if len(p.Allow) == 0 {
+		deny.Add(blocked...)
+		p.Deny = deny
+		return p, nil
+	}
+
+	var allow jwt.StringList
+	var offending []string
+	for _, subject := range p.Allow {
+		if coveredBy(blocked, subject) {
+			offending = append(offending, subject)
+			continue
+		}
+		for _, b := range blocked {
+			if Covers(subject, b) {
+				deny.Add(b)
+				offending = append(offending, subject)
+			}
+		}
+		allow.Add(subject)
+	}
+
+	// Nothing left to allow: an empty allow list would grant everything
+	if len(allow) == 0 {
+		deny.Add(">")
+	}
+	p.Allow = allow
+	p.Deny = deny
+	return p, offending
+}
+
+// SubjectDiff lists the subjects of one permission list present on only one
+// side of a comparison.
+type SubjectDiff struct {
+	Added   []string `json:"added,omitempty"`   // Only in the compared-to permissions
+	Removed []string `json:"removed,omitempty"` // Only in the compared-from permissions
+}
+
+// RespDiff records changed response permission limits; a nil side has no
+// response permission.
+type RespDiff struct {
+	From *jwt.ResponsePermission `json:"from"`
+	To   *jwt.ResponsePermission `json:"to"`
+}
+
+// Diff is a structured comparison of two sets of permissions.
+type Diff struct {
+	PubAllow SubjectDiff `json:"pub_allow"`
+	PubDeny  SubjectDiff `json:"pub_deny"`
+	SubAllow SubjectDiff `json:"sub_allow"`
+	SubDeny  SubjectDiff `json:"sub_deny"`
+	Resp     *RespDiff   `json:"resp,omitempty"`
+}
+
+// Empty reports whether both sides grant exactly the same permissions.
+func (d Diff) Empty() bool {
+	for _, s := range []SubjectDiff{d.PubAllow, d.PubDeny, d.SubAllow, d.SubDeny} {
+		if len(s.Added) > 0 || len(s.Removed) > 0 {
+			return false
+		}
+	}
+	return d.Resp == nil
+}
+
+// Compare returns the subjects and limits to grants that from does not and
+// vice versa. Subjects are compared literally, so "orders.>" and "orders.*"
+// are reported as different even where they overlap.
+func Compare(from, to jwt.Permissions) Diff {
+	d := Diff{
+		PubAllow: compareSubjects(from.Pub.Allow, to.Pub.Allow),
+		PubDeny:  compareSubjects(from.Pub.Deny, to.Pub.Deny),
+		SubAllow: compareSubjects(from.Sub.Allow, to.Sub.Allow),
+		SubDeny:  compareSubjects(from.Sub.Deny, to.Sub.Deny),
+	}
+	if !sameResp(from.Resp, to.Resp) {
+		d.Resp = &RespDiff{From: from.Resp, To: to.Resp}
+	}
+	return d
+}
+
+// compareSubjects returns the sorted subjects only in to and only in from.
+func compareSubjects(from, to []string) SubjectDiff {
+	var d SubjectDiff
+	for _, subject := range to {
+		if !slices.Contains(from, subject) && !slices.Contains(d.Added, subject) {
+			d.Added = append(d.Added, subject)
+		}
+	}
+	for _, subject := range from {
+		if !slices.Contains(to, subject) && !slices.Contains(d.Removed, subject) {
+			d.Removed = append(d.Removed, subject)
+		}
+	}
+	slices.Sort(d.Added)
+	slices.Sort(d.Removed)
+	return d
+}
+
+func sameResp(a, b *jwt.ResponsePermission) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
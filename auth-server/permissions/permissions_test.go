@@ -0,0 +1,338 @@
+package permissions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		want    bool
+	}{
+		{"orders.>", "orders.created", true},
+		{"orders.>", "orders.*.eu", true},
+		{"orders.>", "orders", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.created.eu", false},
+		{"orders.*", "orders.>", false},
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.*", false},
+		{">", "anything.at.all", true},
+		{"*.created", "orders.created", true},
+		{"billing.>", "orders.created", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.subject, func(t *testing.T) {
+			assert.Equal(t, tt.want, Covers(tt.pattern, tt.subject))
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	ceiling := Ceiling{
+		Pub: []string{"orders.>"},
+		Sub: []string{"orders.>", "_INBOX.>"},
+	}
+
+	tests := []struct {
+		name         string
+		perms        jwt.Permissions
+		want         jwt.Permissions
+		wantStripped []string
+	}{
+		{
+			name: "subject outside ceiling is stripped",
+			perms: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"orders.created", "billing.charge"}},
+				Sub: jwt.Permission{Allow: []string{"_INBOX.>"}, Deny: []string{"orders.secret"}},
+			},
+			want: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"orders.created"}},
+				Sub: jwt.Permission{Allow: []string{"_INBOX.>"}, Deny: []string{"orders.secret"}},
+			},
+			wantStripped: []string{"billing.charge"},
+		},
+		{
+			name: "broad subject is narrowed to the ceiling",
+			perms: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{">"}},
+				Sub: jwt.Permission{Allow: []string{">"}},
+			},
+			want: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"orders.>"}},
+				Sub: jwt.Permission{Allow: []string{"orders.>", "_INBOX.>"}},
+			},
+		},
+		{
+			name:  "empty allow list takes the ceiling",
+			perms: jwt.Permissions{},
+			want: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"orders.>"}},
+				Sub: jwt.Permission{Allow: []string{"orders.>", "_INBOX.>"}},
+			},
+		},
+		{
+			name: "nothing left denies all",
+			perms: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"billing.>"}},
+				Sub: jwt.Permission{Allow: []string{"_INBOX.>"}},
+			},
+			want: jwt.Permissions{
+				Pub: jwt.Permission{Deny: []string{">"}},
+				Sub: jwt.Permission{Allow: []string{"_INBOX.>"}},
+			},
+			wantStripped: []string{"billing.>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stripped := Apply(tt.perms, ceiling)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantStripped, stripped)
+		})
+	}
+
+	t.Run("no ceiling keeps permissions", func(t *testing.T) {
+		perms := jwt.Permissions{Pub: jwt.Permission{Allow: []string{">"}}}
+		got, stripped := Apply(perms, Ceiling{})
+		assert.Equal(t, perms, got)
+		assert.Empty(t, stripped)
+	})
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		parent jwt.Permissions
+		child  jwt.Permissions
+		want   jwt.Permissions
+	}{
+		{
+			name:   "allow lists are united",
+			parent: jwt.Permissions{Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+			child:  jwt.Permissions{Sub: jwt.Permission{Allow: []string{"orders.>", "_INBOX.>"}}},
+			want:   jwt.Permissions{Sub: jwt.Permission{Allow: []string{"_INBOX.>", "orders.>"}}},
+		},
+		{
+			name:   "parent deny wins over child allow",
+			parent: jwt.Permissions{Pub: jwt.Permission{Deny: []string{"orders.secret.>"}}},
+			child:  jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.created", "orders.secret.keys"}}},
+			want: jwt.Permissions{Pub: jwt.Permission{
+				Allow: []string{"orders.created"},
+				Deny:  []string{"orders.secret.>"},
+			}},
+		},
+		{
+			name:   "child deny wins over parent allow",
+			parent: jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.created", "billing.charge"}}},
+			child:  jwt.Permissions{Pub: jwt.Permission{Deny: []string{"billing.*"}}},
+			want: jwt.Permissions{Pub: jwt.Permission{
+				Allow: []string{"orders.created"},
+				Deny:  []string{"billing.*"},
+			}},
+		},
+		{
+			name:   "child response permissions take precedence",
+			parent: jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 1}},
+			child:  jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 5}},
+			want:   jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 5}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Merge(tt.parent, tt.child))
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	t.Run("without response permissions", func(t *testing.T) {
+		got := Normalize(jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.>", "orders.>"}}})
+		assert.Equal(t, jwt.Permissions{
+			Pub: jwt.Permission{Allow: jwt.StringList{"orders.>"}, Deny: jwt.StringList{}},
+			Sub: jwt.Permission{Allow: jwt.StringList{}, Deny: jwt.StringList{}},
+		}, got)
+		assert.Nil(t, got.Resp)
+	})
+
+	t.Run("with response permissions", func(t *testing.T) {
+		perms := jwt.Permissions{
+			Sub:  jwt.Permission{Allow: []string{"_INBOX.>"}},
+			Resp: &jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute},
+		}
+		got := Normalize(perms)
+		assert.Equal(t, &jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute}, got.Resp)
+
+		// The result shares no memory with the input
+		got.Resp.MaxMsgs = 5
+		got.Sub.Allow[0] = "orders.>"
+		assert.Equal(t, 1, perms.Resp.MaxMsgs)
+		assert.Equal(t, jwt.StringList{"_INBOX.>"}, perms.Sub.Allow)
+	})
+}
+
+func TestBroadWildcards(t *testing.T) {
+	tests := []struct {
+		name  string
+		perms jwt.Permissions
+		want  []string
+	}{
+		{
+			name: "narrow subjects",
+			perms: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"orders.>", "orders.*.created"}},
+				Sub: jwt.Permission{Allow: []string{"_INBOX.>"}},
+			},
+		},
+		{
+			name: "root wildcards",
+			perms: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"orders.>", ">"}},
+				Sub: jwt.Permission{Allow: []string{"*.>", "*"}},
+			},
+			want: []string{">", "*.>", "*"},
+		},
+		{
+			name: "denied wildcards are not grants",
+			perms: jwt.Permissions{
+				Pub: jwt.Permission{Deny: []string{">"}},
+				Sub: jwt.Permission{Allow: []string{"_INBOX.>"}},
+			},
+		},
+		{
+			name: "empty allow list without deny grants everything",
+			perms: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"orders.>"}},
+			},
+			want: []string{">"},
+		},
+		{
+			name: "empty allow list with deny is not reported",
+			perms: jwt.Permissions{
+				Pub: jwt.Permission{Deny: []string{"$SYS.>"}},
+				Sub: jwt.Permission{Allow: []string{"_INBOX.>"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, BroadWildcards(tt.perms))
+		})
+	}
+}
+
+func TestBlock(t *testing.T) {
+	blocked := []string{"$SYS.>"}
+
+	tests := []struct {
+		name          string
+		perms         jwt.Permissions
+		want          jwt.Permissions
+		wantOffending []string
+	}{
+		{
+			name:  "unrelated subjects are untouched",
+			perms: jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.>"}}, Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+			want:  jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.>"}}, Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+		},
+		{
+			name:          "blocked subject is stripped",
+			perms:         jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.>", "$SYS.REQ.SERVER.PING"}}, Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+			want:          jwt.Permissions{Pub: jwt.Permission{Allow: []string{"orders.>"}}, Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+			wantOffending: []string{"$SYS.REQ.SERVER.PING"},
+		},
+		{
+			name:          "broader subject denies the blocked subject",
+			perms:         jwt.Permissions{Pub: jwt.Permission{Allow: []string{"_INBOX.>"}}, Sub: jwt.Permission{Allow: []string{">"}}},
+			want:          jwt.Permissions{Pub: jwt.Permission{Allow: []string{"_INBOX.>"}}, Sub: jwt.Permission{Allow: []string{">"}, Deny: []string{"$SYS.>"}}},
+			wantOffending: []string{">"},
+		},
+		{
+			name:  "empty allow list denies the blocked subject",
+			perms: jwt.Permissions{Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+			want:  jwt.Permissions{Pub: jwt.Permission{Deny: []string{"$SYS.>"}}, Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+		},
+		{
+			name:          "only blocked subjects deny everything",
+			perms:         jwt.Permissions{Pub: jwt.Permission{Allow: []string{"$SYS.>"}}, Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+			want:          jwt.Permissions{Pub: jwt.Permission{Deny: []string{">"}}, Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+			wantOffending: []string{"$SYS.>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, offending := Block(tt.perms, blocked)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantOffending, offending)
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		from jwt.Permissions
+		to   jwt.Permissions
+		want Diff
+	}{
+		{
+			name: "identical permissions",
+			from: jwt.Permissions{Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+			to:   jwt.Permissions{Sub: jwt.Permission{Allow: []string{"_INBOX.>"}}},
+			want: Diff{},
+		},
+		{
+			name: "added and removed subjects",
+			from: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"orders.created", "orders.cancelled"}},
+				Sub: jwt.Permission{Allow: []string{"_INBOX.>"}, Deny: []string{"orders.secret"}},
+			},
+			to: jwt.Permissions{
+				Pub: jwt.Permission{Allow: []string{"orders.created", "billing.>", "audit.>"}, Deny: []string{"billing.refund"}},
+				Sub: jwt.Permission{Allow: []string{"_INBOX.>"}},
+			},
+			want: Diff{
+				PubAllow: SubjectDiff{Added: []string{"audit.>", "billing.>"}, Removed: []string{"orders.cancelled"}},
+				PubDeny:  SubjectDiff{Added: []string{"billing.refund"}},
+				SubDeny:  SubjectDiff{Removed: []string{"orders.secret"}},
+			},
+		},
+		{
+			name: "overlapping wildcards are compared literally",
+			from: jwt.Permissions{Sub: jwt.Permission{Allow: []string{"orders.*"}}},
+			to:   jwt.Permissions{Sub: jwt.Permission{Allow: []string{"orders.>"}}},
+			want: Diff{SubAllow: SubjectDiff{Added: []string{"orders.>"}, Removed: []string{"orders.*"}}},
+		},
+		{
+			name: "changed response limits",
+			from: jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 1}},
+			to:   jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 5}},
+			want: Diff{Resp: &RespDiff{
+				From: &jwt.ResponsePermission{MaxMsgs: 1},
+				To:   &jwt.ResponsePermission{MaxMsgs: 5},
+			}},
+		},
+		{
+			name: "removed response permission",
+			from: jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 1}},
+			want: Diff{Resp: &RespDiff{From: &jwt.ResponsePermission{MaxMsgs: 1}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Compare(tt.from, tt.to)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	assert.True(t, Compare(jwt.Permissions{}, jwt.Permissions{}).Empty())
+}
@@ -0,0 +1,152 @@
+// Package policy resolves user permissions from a remote policy service over
+// HTTP. After a user is authenticated, the identity and client information are
+// POSTed as JSON to the service, which answers with the jwt.Permissions to
+// embed in the user JWT. Answers are cached briefly per query.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// sweepSize is the cache size above which expired entries are removed on insert.
+const sweepSize = 1024
+
+// Query describes an authenticated identity and the connecting client.
+type Query struct {
+	Username string `json:"username"`
+	Account  string `json:"account"`
+	Method   string `json:"method"`
+	Client   Client `json:"client"`
+}
+
+// Client is the connecting client as reported in the authorization request.
+// It is empty when there is no client connection, e.g. on JWT renewal.
+type Client struct {
+	Host string `json:"host,omitempty"`
+	Name string `json:"name,omitempty"`
+	Type string `json:"type,omitempty"`
+	Kind string `json:"kind,omitempty"`
+}
+
+// entry is a cached policy answer.
+type entry struct {
+	perms   jwt.Permissions
+	expires time.Time
+}
+
+// Service queries a remote policy endpoint and caches its answers for a TTL.
+type Service struct {
+	url  string
+	ttl  time.Duration
+	http *http.Client
+	now  func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]entry
+}
+
+// NewService creates a Service posting queries to url, waiting at most timeout
+// for an answer and caching answers for ttl. A zero ttl disables caching.
+func NewService(url string, ttl, timeout time.Duration) *Service {
+	return &Service{
+		url:   url,
+		ttl:   ttl,
+		http:  &http.Client{Timeout: timeout},
+		now:   time.Now,
+		cache: make(map[string]entry),
+	}
+}
+
+// Permissions returns the permissions the policy service grants for q. An
+// empty or null answer is an error rather than no permissions, which NATS would
+// treat as allowing every subject; a policy denying everything must say so with
+// deny subjects.
+func (s *Service) Permissions(q Query) (jwt.Permissions, error) {
+	body, err := json.Marshal(q)
+	if err != nil {
+		return jwt.Permissions{}, err
+	}
+	key := string(body)
+	if perms, ok := s.cached(key); ok {
+		return perms, nil
+	}
+
+	resp, err := s.http.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return jwt.Permissions{}, fmt.Errorf("querying policy service: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close policy response body")
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return jwt.Permissions{}, fmt.Errorf("querying policy service: responded %s", resp.Status)
+	}
+
+	var perms jwt.Permissions
+	if err := json.NewDecoder(resp.Body).Decode(&perms); err != nil {
+		return jwt.Permissions{}, fmt.Errorf("decoding policy response: %w", err)
+	}
+	if empty(perms) {
+		return jwt.Permissions{}, fmt.Errorf("policy service answered no permissions")
+	}
+	s.store(key, perms)
+	return perms, nil
+}
+
+// empty reports whether perms grant or deny nothing.
+func empty(perms jwt.Permissions) bool {
+	return len(perms.Pub.Allow) == 0 && len(perms.Pub.Deny) == 0 &&
+		len(perms.Sub.Allow) == 0 && len(perms.Sub.Deny) == 0 && perms.Resp == nil
+}
+
+// cached returns the unexpired answer for key.
+func (s *Service) cached(key string) (jwt.Permissions, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.cache[key]
+	if !ok {
+		return jwt.Permissions{}, false
+	}
+	if !s.now().Before(e.expires) {
+		delete(s.cache, key)
+		return jwt.Permissions{}, false
+	}
+	return e.perms, true
+}
+
+// store caches the answer for key, sweeping expired entries once the cache grows.
+func (s *Service) store(key string, perms jwt.Permissions) {
+	if s.ttl <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if len(s.cache) >= sweepSize {
+		for k, e := range s.cache {
+			if !now.Before(e.expires) {
+				delete(s.cache, k)
+			}
+		}
+	}
+	s.cache[key] = entry{perms: perms, expires: now.Add(s.ttl)}
+}
+
+// Flush drops every cached answer and returns the number removed.
+func (s *Service) Flush() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.cache)
+	s.cache = make(map[string]entry)
+	return n
+}
@@ -0,0 +1,82 @@
+package policy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Permissions(t *testing.T) {
+	var queries []Query
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var q Query
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&q))
+		queries = append(queries, q)
+		switch q.Username {
+		case "mallory":
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		case "nobody":
+			_, _ = w.Write([]byte(`null`))
+			return
+		case "anybody":
+			_, _ = w.Write([]byte(`{"pub": {}, "sub": {"allow": []}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"pub": {"allow": ["orders.` + q.Account + `"]}, "sub": {"allow": ["_INBOX.>"]}}`))
+	}))
+	defer srv.Close()
+
+	s := NewService(srv.URL, time.Minute, time.Second)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	q := Query{Username: "alice", Account: "DEV", Method: "password", Client: Client{Host: "10.0.0.1", Type: "WEBSOCKET"}}
+	perms, err := s.Permissions(q)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.StringList{"orders.DEV"}, perms.Pub.Allow)
+	assert.Equal(t, jwt.StringList{"_INBOX.>"}, perms.Sub.Allow)
+	require.Len(t, queries, 1)
+	assert.Equal(t, q, queries[0], "the identity and client are sent to the policy service")
+
+	t.Run("answers are cached", func(t *testing.T) {
+		cached, err := s.Permissions(q)
+		require.NoError(t, err)
+		assert.Equal(t, perms, cached)
+		assert.Len(t, queries, 1)
+	})
+
+	t.Run("cache expires", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		_, err := s.Permissions(q)
+		require.NoError(t, err)
+		assert.Len(t, queries, 2)
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		assert.Equal(t, 1, s.Flush())
+		_, err := s.Permissions(q)
+		require.NoError(t, err)
+		assert.Len(t, queries, 3)
+	})
+
+	t.Run("error status", func(t *testing.T) {
+		_, err := s.Permissions(Query{Username: "mallory"})
+		assert.EqualError(t, err, "querying policy service: responded 403 Forbidden")
+	})
+
+	t.Run("empty answers deny", func(t *testing.T) {
+		s.Flush()
+		for _, username := range []string{"nobody", "anybody"} {
+			_, err := s.Permissions(Query{Username: username})
+			assert.EqualError(t, err, "policy service answered no permissions", username)
+		}
+		assert.Equal(t, 0, s.Flush(), "empty answers are not cached")
+	})
+}
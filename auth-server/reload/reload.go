@@ -0,0 +1,42 @@
+// Package reload serializes configuration and secret reloads. Reload triggers
+// may come from several sources at once, e.g. SIGHUP and file watches; a
+// Reloader runs one reload at a time and coalesces triggers arriving during a
+// reload into a single follow-up run, so the latest content always wins.
+package reload
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reloader runs a reload function one at a time.
+type Reloader struct {
+	reload  func() error
+	mu      sync.Mutex  // Held while a reload runs
+	pending atomic.Bool // Set by triggers not yet picked up by a reload
+}
+
+// New creates a Reloader running fn on every coalesced trigger.
+func New(fn func() error) *Reloader {
+	return &Reloader{reload: fn}
+}
+
+// Trigger requests a reload. When no reload is running it reloads in the
+// calling goroutine; otherwise it returns immediately and the running reload
+// runs once more afterwards. Reload errors are logged and leave the current
+// state in place.
+func (r *Reloader) Trigger() {
+	r.pending.Store(true)
+	// Re-check after unlocking: a trigger may have arrived after the last run
+	// but before the lock was released, and failed to take it
+	for r.pending.Load() && r.mu.TryLock() {
+		for r.pending.Swap(false) {
+			if err := r.reload(); err != nil {
+				logrus.WithError(err).Error("Reload failed, keeping current state")
+			}
+		}
+		r.mu.Unlock()
+	}
+}
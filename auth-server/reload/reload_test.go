@@ -0,0 +1,74 @@
+package reload
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloaderConcurrentTriggers(t *testing.T) {
+	// source is the content reloads read; state is what a reload applies in two
+	// non-atomic steps, which would tear if reloads overlapped
+	var source atomic.Int64
+	var state struct{ first, second int64 }
+	var running, overlaps, runs atomic.Int64
+
+	r := New(func() error {
+		if running.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		defer running.Add(-1)
+		runs.Add(1)
+
+		version := source.Load()
+		state.first = version
+		state.second = version
+		return nil
+	})
+
+	const triggers = 200
+	var wg sync.WaitGroup
+	for i := 1; i <= triggers; i++ {
+		wg.Add(1)
+		go func(version int64) {
+			defer wg.Done()
+			source.Store(version)
+			r.Trigger()
+		}(int64(i))
+	}
+	wg.Wait()
+
+	assert.Zero(t, overlaps.Load(), "reloads must not run concurrently")
+	assert.Equal(t, state.first, state.second, "reload state must not be partial")
+	assert.Equal(t, source.Load(), state.first, "the latest content must win")
+	assert.LessOrEqual(t, runs.Load(), int64(triggers))
+}
+
+func TestReloaderKeepsStateOnError(t *testing.T) {
+	calls := 0
+	applied := "initial"
+	next := []struct {
+		value string
+		err   error
+	}{
+		{value: "first"},
+		{err: errors.New("backend unavailable")},
+	}
+	r := New(func() error {
+		step := next[calls]
+		calls++
+		if step.err != nil {
+			return step.err
+		}
+		applied = step.value
+		return nil
+	})
+
+	r.Trigger()
+	r.Trigger()
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, "first", applied)
+}
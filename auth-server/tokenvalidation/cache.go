@@ -0,0 +1,97 @@
+package tokenvalidation
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// Cache is a fixed-size LRU of validated tokens, sparing the signature check
+// when the same token is presented repeatedly, e.g. in a reconnect storm.
+// Entries are keyed by the SHA-256 hash of the token, so the cache holds no
+// usable credentials, and are dropped once the token expires. A Cache is safe
+// for concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Front is the most recently used entry
+	entries map[[sha256.Size]byte]*list.Element
+	now     func() time.Time
+}
+
+// cacheEntry is a validated token's claims and the label of the secret that
+// validated it.
+type cacheEntry struct {
+	key    [sha256.Size]byte
+	claims NatsTokenClaims
+	label  string
+}
+
+// NewCache returns a cache holding up to size tokens, at least one.
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:    max(size, 1),
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Get returns a copy of the cached claims of token and the label of the secret
+// that validated it. Expired tokens, past the leeway they were validated with,
+// are evicted and reported as misses so validating them again reports the expiry.
+func (c *Cache) Get(token string) (*NatsTokenClaims, string, bool) {
+	key := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+	e := el.Value.(*cacheEntry)
+	if e.claims.ExpiresAt != nil && !c.now().Before(e.claims.ExpiresAt.Add(e.claims.leeway)) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, "", false
+	}
+	c.order.MoveToFront(el)
+	claims := e.claims
+	return &claims, e.label, true
+}
+
+// Add caches the claims of a validated token, evicting the least recently used
+// token when the cache is full.
+func (c *Cache) Add(token string, claims *NatsTokenClaims, label string) {
+	key := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cacheEntry{key: key, claims: *claims, label: label}
+		c.order.MoveToFront(el)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, claims: *claims, label: label})
+}
+
+// Len returns the number of cached tokens.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Flush drops every cached token and returns the number removed.
+func (c *Cache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.order.Len()
+	c.order.Init()
+	c.entries = make(map[[sha256.Size]byte]*list.Element)
+	return n
+}
@@ -0,0 +1,125 @@
+package tokenvalidation
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// cachedClaims returns claims for userID expiring at exp, nil for none.
+func cachedClaims(userID string, exp *time.Time) *NatsTokenClaims {
+	claims := &NatsTokenClaims{UserID: userID, Account: "DEVELOPMENT"}
+	if exp != nil {
+		claims.ExpiresAt = jwt.NewNumericDate(*exp)
+	}
+	return claims
+}
+
+func TestCache(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	inHour := now.Add(time.Hour)
+	cache := NewCache(2)
+	cache.now = func() time.Time { return now }
+
+	cache.Add("token-a", cachedClaims("alice", &inHour), "current")
+	cache.Add("token-b", cachedClaims("bob", nil), "")
+
+	claims, label, ok := cache.Get("token-a")
+	if !ok || claims.UserID != "alice" || label != "current" {
+		t.Fatalf("Get(token-a) = %+v, %q, %t, want alice, current, true", claims, label, ok)
+	}
+	// Callers get a copy they may change freely
+	claims.UserID = "mallory"
+	if claims, _, _ := cache.Get("token-a"); claims.UserID != "alice" {
+		t.Errorf("cached UserID = %q after changing a returned copy, want alice", claims.UserID)
+	}
+
+	// token-b is now the least recently used and makes room for token-c
+	cache.Add("token-c", cachedClaims("carol", nil), "")
+	if _, _, ok := cache.Get("token-b"); ok {
+		t.Error("Get(token-b) hit, want the least recently used token evicted")
+	}
+	if _, _, ok := cache.Get("token-c"); !ok {
+		t.Error("Get(token-c) missed, want hit")
+	}
+	if got := cache.Len(); got != 2 {
+		t.Errorf("Len() = %d, want 2", got)
+	}
+
+	// Expired tokens are misses and leave the cache
+	cache.now = func() time.Time { return inHour }
+	if _, _, ok := cache.Get("token-a"); ok {
+		t.Error("Get(token-a) hit at its exp, want miss")
+	}
+	if got := cache.Len(); got != 1 {
+		t.Errorf("Len() = %d after expiry, want 1", got)
+	}
+
+	if got := cache.Flush(); got != 1 {
+		t.Errorf("Flush() = %d, want 1", got)
+	}
+	if _, _, ok := cache.Get("token-c"); ok {
+		t.Error("Get(token-c) hit after Flush, want miss")
+	}
+}
+
+func TestCacheConcurrentUse(t *testing.T) {
+	cache := NewCache(16)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 200 {
+				token := fmt.Sprintf("token-%d", (i+j)%32)
+				if _, _, ok := cache.Get(token); !ok {
+					cache.Add(token, cachedClaims(token, nil), "")
+				}
+				if j%50 == 0 {
+					cache.Flush()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := cache.Len(); got > 16 {
+		t.Errorf("Len() = %d, want at most 16", got)
+	}
+}
+
+// BenchmarkValidateNatsToken compares full validation with a token cache hit
+func BenchmarkValidateNatsToken(b *testing.B) {
+	const secret = "test-secret-1234567890"
+	b.Setenv("NATS_TOKEN_SECRET", secret)
+	exp := time.Now().Add(time.Hour)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, cachedClaims("alice", &exp)).SignedString([]byte(secret))
+	if err != nil {
+		b.Fatalf("Failed to sign token: %v", err)
+	}
+
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := ValidateNatsToken(token); err != nil {
+				b.Fatalf("ValidateNatsToken() error = %v", err)
+			}
+		}
+	})
+	b.Run("cache hit", func(b *testing.B) {
+		cache := NewCache(1024)
+		claims, err := ValidateNatsToken(token)
+		if err != nil {
+			b.Fatalf("ValidateNatsToken() error = %v", err)
+		}
+		cache.Add(token, claims, "")
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, _, ok := cache.Get(token); !ok {
+				b.Fatal("Get() missed, want hit")
+			}
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package tokenvalidation
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// Response permission granted by allow_responses: true, matching the NATS
+// server defaults for the same setting.
+const (
+	defaultAllowResponsesMax     = 1
+	defaultAllowResponsesExpires = 2 * time.Minute
+)
+
+// ToJWTPermissions converts the permissions claim of a nats_token into
+// jwt.Permissions with a JSON round-trip, so the whole jwt.Permissions shape
+// is supported. The NATS server config spelling allow_responses is accepted
+// when resp is absent: true grants the server default, an object sets max
+// messages and an expires duration such as "1m". The resp ttl is given in
+// seconds or as a duration string such as "30s"; without it reply
+// subscriptions do not expire.
+func ToJWTPermissions(claim map[string]any) (jwt.Permissions, error) {
+	var perms struct {
+		jwt.Permissions
+		Resp *struct {
+			Max int             `json:"max"`
+			TTL json.RawMessage `json:"ttl,omitempty"`
+		} `json:"resp,omitempty"`
+		AllowResponses json.RawMessage `json:"allow_responses,omitempty"`
+	}
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return jwt.Permissions{}, fmt.Errorf("encoding permissions: %w", err)
+	}
+	if err := json.Unmarshal(data, &perms); err != nil {
+		return jwt.Permissions{}, fmt.Errorf("invalid permissions: %w", err)
+	}
+	if perms.Resp != nil {
+		ttl, err := responseTTL(perms.Resp.TTL)
+		if err != nil {
+			return jwt.Permissions{}, fmt.Errorf("invalid resp ttl: %w", err)
+		}
+		perms.Permissions.Resp = &jwt.ResponsePermission{MaxMsgs: perms.Resp.Max, Expires: ttl}
+		return perms.Permissions, nil
+	}
+	if len(perms.AllowResponses) == 0 {
+		return perms.Permissions, nil
+	}
+
+	var enabled bool
+	if err := json.Unmarshal(perms.AllowResponses, &enabled); err == nil {
+		if enabled {
+			perms.Permissions.Resp = &jwt.ResponsePermission{MaxMsgs: defaultAllowResponsesMax, Expires: defaultAllowResponsesExpires}
+		}
+		return perms.Permissions, nil
+	}
+	var limits struct {
+		Max     int    `json:"max"`
+		Expires string `json:"expires"`
+	}
+	if err := json.Unmarshal(perms.AllowResponses, &limits); err != nil {
+		return jwt.Permissions{}, fmt.Errorf("invalid allow_responses: %w", err)
+	}
+	resp := &jwt.ResponsePermission{MaxMsgs: limits.Max, Expires: defaultAllowResponsesExpires}
+	if resp.MaxMsgs == 0 {
+		resp.MaxMsgs = defaultAllowResponsesMax
+	}
+	if limits.Expires != "" {
+		if resp.Expires, err = time.ParseDuration(limits.Expires); err != nil {
+			return jwt.Permissions{}, fmt.Errorf("invalid allow_responses expires: %w", err)
+		}
+	}
+	perms.Permissions.Resp = resp
+	return perms.Permissions, nil
+}
+
+// responseTTL parses a resp ttl given as a number of seconds or as a duration
+// string, which may also be a plain number of seconds. An absent ttl is zero.
+func responseTTL(raw json.RawMessage) (time.Duration, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
+	}
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err != nil {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return 0, fmt.Errorf("%s is neither seconds nor a duration", raw)
+		}
+		if d, err := time.ParseDuration(text); err == nil {
+			seconds = d.Seconds()
+		} else if seconds, err = strconv.ParseFloat(text, 64); err != nil {
+			return 0, fmt.Errorf("%q is neither seconds nor a duration", text)
+		}
+	}
+	if seconds < 0 {
+		return 0, fmt.Errorf("%s must not be negative", raw)
+	}
+	if seconds > math.MaxInt64/float64(time.Second) {
+		return 0, fmt.Errorf("%s is too long", raw)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,121 @@
+package tokenvalidation
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+func TestToJWTPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		claim   map[string]any
+		want    jwt.Permissions
+		wantErr string
+	}{
+		{
+			name:  "allow only",
+			claim: map[string]any{"pub": map[string]any{"allow": []any{"orders.>"}}, "sub": map[string]any{"allow": []any{"_INBOX.>"}}},
+			want: jwt.Permissions{
+				Pub: jwt.Permission{Allow: jwt.StringList{"orders.>"}},
+				Sub: jwt.Permission{Allow: jwt.StringList{"_INBOX.>"}},
+			},
+		},
+		{
+			name:  "deny only",
+			claim: map[string]any{"pub": map[string]any{"deny": []any{"admin.>"}}, "sub": map[string]any{"deny": []any{"secret.>"}}},
+			want: jwt.Permissions{
+				Pub: jwt.Permission{Deny: jwt.StringList{"admin.>"}},
+				Sub: jwt.Permission{Deny: jwt.StringList{"secret.>"}},
+			},
+		},
+		{
+			name:  "allow and deny",
+			claim: map[string]any{"pub": map[string]any{"allow": []any{"orders.>"}, "deny": []any{"orders.secret"}}},
+			want: jwt.Permissions{
+				Pub: jwt.Permission{Allow: jwt.StringList{"orders.>"}, Deny: jwt.StringList{"orders.secret"}},
+			},
+		},
+		{
+			name:  "missing sections",
+			claim: map[string]any{"sub": map[string]any{"allow": []any{"_INBOX.>"}}},
+			want:  jwt.Permissions{Sub: jwt.Permission{Allow: jwt.StringList{"_INBOX.>"}}},
+		},
+		{
+			name:  "no permissions",
+			claim: nil,
+			want:  jwt.Permissions{},
+		},
+		{
+			name:  "resp max",
+			claim: map[string]any{"resp": map[string]any{"max": 5}},
+			want:  jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 5}},
+		},
+		{
+			name:  "resp ttl in seconds",
+			claim: map[string]any{"resp": map[string]any{"max": 1, "ttl": 30}},
+			want:  jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 1, Expires: 30 * time.Second}},
+		},
+		{
+			name:  "resp ttl fractional seconds",
+			claim: map[string]any{"resp": map[string]any{"ttl": 0.5}},
+			want:  jwt.Permissions{Resp: &jwt.ResponsePermission{Expires: 500 * time.Millisecond}},
+		},
+		{
+			name:  "resp ttl duration string",
+			claim: map[string]any{"resp": map[string]any{"max": 1, "ttl": "2m"}},
+			want:  jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 1, Expires: 2 * time.Minute}},
+		},
+		{
+			name:  "resp ttl seconds string",
+			claim: map[string]any{"resp": map[string]any{"ttl": "45"}},
+			want:  jwt.Permissions{Resp: &jwt.ResponsePermission{Expires: 45 * time.Second}},
+		},
+		{
+			name:    "invalid resp ttl",
+			claim:   map[string]any{"resp": map[string]any{"ttl": "soon"}},
+			wantErr: `invalid resp ttl: "soon" is neither seconds nor a duration`,
+		},
+		{
+			name:    "negative resp ttl",
+			claim:   map[string]any{"resp": map[string]any{"ttl": -1}},
+			wantErr: "invalid resp ttl: -1 must not be negative",
+		},
+		{
+			name:  "allow_responses true",
+			claim: map[string]any{"allow_responses": true},
+			want:  jwt.Permissions{Resp: &jwt.ResponsePermission{MaxMsgs: 1, Expires: 2 * time.Minute}},
+		},
+		{
+			name:    "non-string subject",
+			claim:   map[string]any{"pub": map[string]any{"allow": []any{42}}},
+			wantErr: "invalid permissions",
+		},
+		{
+			name:    "section is not an object",
+			claim:   map[string]any{"sub": "orders.>"},
+			wantErr: "invalid permissions",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToJWTPermissions(tt.claim)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ToJWTPermissions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ToJWTPermissions() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ToJWTPermissions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,12 +6,30 @@
 //
 // The main function, ValidateNatsToken, takes a JWT token string, validates its
 // format, signature, and claims, and returns the user ID and permissions if valid.
-// It relies on the NATS_TOKEN_SECRET environment variable for the signing key.
+// Tokens are accepted until their exp time and, when they carry an nbf claim,
+// from that time on, allowing DefaultLeeway of clock skew unless WithLeeway
+// sets another. WithMaxIssuedAtSkew additionally rejects tokens whose iat lies
+// too far in the future, which signals a clock problem or a forgery.
+// It relies on the NATS_TOKEN_SECRET environment variable for the signing key and,
+// when NATS_TOKEN_AUDIENCE or NATS_TOKEN_ISSUER are set, only accepts tokens
+// minted for that audience or by that issuer.
+//
+// ValidateWithSecrets validates tokens against an ordered list of labeled HMAC
+// secrets so key rotation is observable: the label of the matching secret is
+// reported alongside the claims.
+//
+// ValidateWithPublicKey validates asymmetrically signed tokens offline using only
+// a PEM public key, without touching the environment or configuration.
 package tokenvalidation
 
 import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"os"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
 	"strings"
 	"time"
 
@@ -19,13 +37,144 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Validation errors reported by the validators, classified by FailureReason.
+var (
+	ErrMalformed          = errors.New("invalid token format")
+	ErrInvalidSignature   = errors.New("invalid token signature")
+	ErrExpired            = errors.New("token expired")
+	ErrMissingUserID      = errors.New("missing user_id in token")
+	ErrAudienceMismatch   = errors.New("token audience does not include")
+	ErrIssuerMismatch     = errors.New("token issuer is not")
+	ErrSecretUnconfigured = errors.New("NATS_TOKEN_SECRET environment variable is not set")
+)
+
+// Failure reasons returned by FailureReason.
+const (
+	FailureMalformed    = "malformed"     // Not a well-formed JWT
+	FailureSignature    = "signature"     // Signature or signing method does not match
+	FailureExpired      = "expired"       // Past its exp time
+	FailureNotYetValid  = "not_yet_valid" // Before its nbf or iat time
+	FailureAudience     = "audience"      // Minted for another service
+	FailureIssuer       = "issuer"        // Minted by an untrusted issuer
+	FailureClaims       = "claims"        // Required claims missing or invalid
+	FailureUnconfigured = "unconfigured"  // No secret to validate with
+	FailurePermissions  = "permissions"   // Permissions claim cannot be used
+)
+
+// FailureReasons lists every reason FailureReason may return.
+var FailureReasons = []string{
+	FailureMalformed,
+	FailureSignature,
+	FailureExpired,
+	FailureNotYetValid,
+	FailureAudience,
+	FailureIssuer,
+	FailureClaims,
+	FailureUnconfigured,
+	FailurePermissions,
+}
+
+// Fingerprint returns a short SHA-256 hash of a token, logged in place of the
+// token so log lines can be correlated without exposing a usable credential.
+func Fingerprint(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))[:8]
+}
+
+// FailureReason classifies a validation error into a short, stable reason
+// suitable as a metric label. Unknown errors are reported as FailureClaims.
+func FailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrMalformed), errors.Is(err, jwt.ErrTokenMalformed):
+		return FailureMalformed
+	case errors.Is(err, ErrInvalidSignature), errors.Is(err, jwt.ErrSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return FailureSignature
+	case errors.Is(err, ErrExpired), errors.Is(err, jwt.ErrTokenExpired):
+		return FailureExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return FailureNotYetValid
+	case errors.Is(err, ErrAudienceMismatch):
+		return FailureAudience
+	case errors.Is(err, ErrIssuerMismatch):
+		return FailureIssuer
+	case errors.Is(err, ErrSecretUnconfigured):
+		return FailureUnconfigured
+	}
+	return FailureClaims
+}
+
 // NatsTokenClaims represents the custom claims structure for NATS JWT tokens.
 // It includes user ID, permissions, account details, and standard JWT registered claims.
 type NatsTokenClaims struct {
-	UserID               string         `json:"user_id"`     // Unique identifier for the user
-	Permissions          map[string]any `json:"permissions"` // User permissions for NATS subjects
-	Account              string         `json:"account"`     // Associated NATS account
+	UserID               string         `json:"user_id"`          // Unique identifier for the user
+	Permissions          map[string]any `json:"permissions"`      // User permissions for NATS subjects
+	Account              string         `json:"account"`          // Associated NATS account
+	Limits               *auth.Limits   `json:"limits,omitempty"` // Optional connection limits
+	Src                  []string       `json:"src,omitempty"`    // Optional source networks as CIDRs
 	jwt.RegisteredClaims                // Standard JWT claims (e.g., exp, iat)
+
+	leeway     time.Duration // Clock skew tolerated by Valid, set by the validators
+	maxIatSkew time.Duration // How far in the future iat may lie, 0 for any
+}
+
+// DefaultLeeway tolerates clock skew between the token issuer and this
+// service: a token is accepted up to this long after its exp time and before
+// its nbf time.
+const DefaultLeeway = 30 * time.Second
+
+// Option configures a validation.
+type Option func(*options)
+
+type options struct {
+	leeway     time.Duration
+	maxIatSkew time.Duration
+}
+
+// WithLeeway sets the clock skew tolerated when checking exp and nbf,
+// DefaultLeeway by default. Zero checks the times exactly.
+func WithLeeway(leeway time.Duration) Option {
+	return func(o *options) {
+		o.leeway = leeway
+	}
+}
+
+// WithMaxIssuedAtSkew rejects tokens whose iat lies more than skew in the
+// future. Zero, the default, does not check iat.
+func WithMaxIssuedAtSkew(skew time.Duration) Option {
+	return func(o *options) {
+		o.maxIatSkew = skew
+	}
+}
+
+// newClaims returns the claims a token is parsed into, applying opts.
+func newClaims(opts []Option) *NatsTokenClaims {
+	o := options{leeway: DefaultLeeway}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &NatsTokenClaims{leeway: o.leeway, maxIatSkew: o.maxIatSkew}
+}
+
+// Valid implements jwt.Claims. Like jwt.RegisteredClaims it rejects tokens
+// past their exp time or used before their nbf time, but tolerates the leeway
+// the claims were parsed with. A future iat is only rejected beyond the
+// maximum skew the claims were parsed with, if any.
+func (c NatsTokenClaims) Valid() error {
+	now := jwt.TimeFunc()
+	if !c.VerifyExpiresAt(now.Add(-c.leeway), false) {
+		return &jwt.ValidationError{
+			Inner:  fmt.Errorf("%s by %s", jwt.ErrTokenExpired, now.Sub(c.ExpiresAt.Time)),
+			Errors: jwt.ValidationErrorExpired,
+		}
+	}
+	if c.maxIatSkew > 0 && !c.VerifyIssuedAt(now.Add(c.maxIatSkew), false) {
+		logrus.WithField("iat", c.IssuedAt).Debug("Token issued in the future")
+		return &jwt.ValidationError{Inner: jwt.ErrTokenUsedBeforeIssued, Errors: jwt.ValidationErrorIssuedAt}
+	}
+	if !c.VerifyNotBefore(now.Add(c.leeway), false) {
+		logrus.WithField("nbf", c.NotBefore).Debug("Token not valid yet")
+		return &jwt.ValidationError{Inner: jwt.ErrTokenNotValidYet, Errors: jwt.ValidationErrorNotValidYet}
+	}
+	return nil
 }
 
 // ValidateNatsToken validates a NATS JWT token and extracts its user ID and permissions.
@@ -33,35 +182,39 @@ type NatsTokenClaims struct {
 // It performs the following checks:
 // 1. Ensures the NATS_TOKEN_SECRET environment variable is set.
 // 2. Verifies the token format (three parts: header, payload, signature).
-// 3. Parses and validates the JWT claims, including signature and expiration.
+// 3. Parses and validates the JWT claims, including signature, expiration and
+// not-before (with DefaultLeeway, or the leeway set by WithLeeway).
 // 4. Ensures the user ID is present in the claims.
-// 5. Returns the user ID and permissions if all checks pass.
+// 5. Ensures the token audience matches NATS_TOKEN_AUDIENCE, if set.
+// 6. Ensures the token issuer is NATS_TOKEN_ISSUER, if set.
+// 7. Returns the user ID and permissions if all checks pass.
 //
 // Args:
 //
 //	tokenString (string): The JWT token to validate.
+//	opts (...Option): Validation options, e.g. WithLeeway.
 //
 // Returns:
 //
 //	string: The user ID extracted from the token claims.
 //	map[string]any: The permissions extracted from the token claims.
 //	error: An error if validation fails (e.g., invalid format, signature, or expired token).
-func ValidateNatsToken(tokenString string) (*NatsTokenClaims, error) {
+func ValidateNatsToken(tokenString string, opts ...Option) (*NatsTokenClaims, error) {
 	// Retrieve the secret key from environment variable
 	secret := os.Getenv("NATS_TOKEN_SECRET")
 	if secret == "" {
 		logrus.Error("NATS_TOKEN_SECRET environment variable is not set")
-		return nil, errors.New("NATS_TOKEN_SECRET environment variable is not set")
+		return nil, ErrSecretUnconfigured
 	}
 
 	// Check basic token format
 	if len(strings.Split(tokenString, ".")) != 3 {
-		logrus.WithField("token", tokenString[:10]+"...").Debug("Invalid token format")
-		return nil, errors.New("invalid token format")
+		logrus.WithField("token_hash", Fingerprint(tokenString)).Debug("Invalid token format")
+		return nil, ErrMalformed
 	}
 
 	// Parse JWT with custom claims
-	claims := &NatsTokenClaims{}
+	claims := newClaims(opts)
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			logrus.WithField("method", token.Header["alg"]).Debug("Unexpected signing method")
@@ -72,12 +225,11 @@ func ValidateNatsToken(tokenString string) (*NatsTokenClaims, error) {
 
 	// Log token validation details
 	logrus.WithFields(logrus.Fields{
-		"token":   tokenString[:10] + "...",
-		"error":   err,
-		"valid":   token != nil && token.Valid,
-		"user_id": claims.UserID,
-		"raw":     token.Raw,
-		"exp":     claims.ExpiresAt,
+		"token_hash": Fingerprint(tokenString),
+		"error":      err,
+		"valid":      token != nil && token.Valid,
+		"user_id":    claims.UserID,
+		"exp":        claims.ExpiresAt,
 	}).Debug("Token validation result")
 
 	if err != nil {
@@ -86,20 +238,173 @@ func ValidateNatsToken(tokenString string) (*NatsTokenClaims, error) {
 	}
 	if !token.Valid {
 		logrus.Debug("Token is not valid")
-		return nil, errors.New("invalid token signature")
+		return nil, ErrInvalidSignature
 	}
 
+	if err := checkClaims(claims); err != nil {
+		return nil, err
+	}
+	if audience := os.Getenv("NATS_TOKEN_AUDIENCE"); audience != "" {
+		if err := CheckAudience(claims, audience); err != nil {
+			return nil, err
+		}
+	}
+	if issuer := os.Getenv("NATS_TOKEN_ISSUER"); issuer != "" {
+		if err := CheckIssuer(claims, issuer); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// CheckAudience ensures the token was minted for the given audience, so a
+// token issued for one service sharing the secret is not accepted by another.
+// Tokens without an audience are rejected.
+func CheckAudience(claims *NatsTokenClaims, audience string) error {
+	if !claims.VerifyAudience(audience, true) {
+		logrus.WithFields(logrus.Fields{
+			"aud":      claims.Audience,
+			"expected": audience,
+		}).Debug("Token audience mismatch")
+		return fmt.Errorf("%w %q", ErrAudienceMismatch, audience)
+	}
+	return nil
+}
+
+// CheckIssuer ensures the token was minted by the trusted issuer, so tokens
+// of another identity provider sharing the secret are not accepted. Tokens
+// without an issuer are rejected.
+func CheckIssuer(claims *NatsTokenClaims, issuer string) error {
+	if !claims.VerifyIssuer(issuer, true) {
+		logrus.WithFields(logrus.Fields{
+			"iss":      claims.Issuer,
+			"expected": issuer,
+		}).Debug("Token issuer mismatch")
+		return fmt.Errorf("%w %q", ErrIssuerMismatch, issuer)
+	}
+	return nil
+}
+
+// Secret is a labeled HMAC signing secret, e.g. {Label: "2025-key"}.
+type Secret struct {
+	Label string
+	Value string
+}
+
+// ValidateWithSecrets validates a NATS JWT token against the secrets in order
+// and returns the claims with the label of the first secret whose signature
+// matches. Claim checks are the same as for ValidateNatsToken; a token with a
+// matching signature but invalid claims is rejected without trying further
+// secrets.
+//
+// Args:
+//
+//	tokenString (string): The JWT token to validate.
+//	secrets ([]Secret): Candidate secrets, typically newest first.
+//	opts (...Option): Validation options, e.g. WithLeeway.
+//
+// Returns:
+//
+//	*NatsTokenClaims: The parsed claims if the token is valid.
+//	string: The label of the secret that validated the token.
+//	error: An error if no secret matches or validation fails.
+func ValidateWithSecrets(tokenString string, secrets []Secret, opts ...Option) (*NatsTokenClaims, string, error) {
+	if len(secrets) == 0 {
+		return nil, "", errors.New("no token secrets configured")
+	}
+	if len(strings.Split(tokenString, ".")) != 3 {
+		return nil, "", ErrMalformed
+	}
+
+	for _, secret := range secrets {
+		claims := newClaims(opts)
+		_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, errors.New("unexpected signing method")
+			}
+			return []byte(secret.Value), nil
+		})
+		if errors.Is(err, jwt.ErrSignatureInvalid) {
+			continue
+		}
+		if err != nil {
+			return nil, secret.Label, err
+		}
+		if err := checkClaims(claims); err != nil {
+			return nil, secret.Label, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"user_id": claims.UserID,
+			"key":     secret.Label,
+		}).Debug("Token validated")
+		return claims, secret.Label, nil
+	}
+	return nil, "", ErrInvalidSignature
+}
+
+// ValidateWithPublicKey validates a NATS JWT token signed with an asymmetric
+// algorithm (RS*, PS* or ES*) using only the PEM-encoded public key.
+//
+// It is meant for offline tooling and tests: unlike ValidateNatsToken it never
+// reads the environment or configuration. The signing method must match the key
+// type, so an HMAC token or an RSA token checked against an ECDSA key is rejected.
+// The same claim checks as ValidateNatsToken apply (expiration and user_id).
+//
+// Args:
+//
+//	tokenString (string): The JWT token to validate.
+//	publicKeyPEM ([]byte): PEM-encoded RSA or ECDSA public key.
+//	opts (...Option): Validation options, e.g. WithLeeway.
+//
+// Returns:
+//
+//	*NatsTokenClaims: The parsed claims if the token is valid.
+//	error: An error if the key cannot be parsed or validation fails.
+func ValidateWithPublicKey(tokenString string, publicKeyPEM []byte, opts ...Option) (*NatsTokenClaims, error) {
+	var key any
+	var err error
+	if key, err = jwt.ParseRSAPublicKeyFromPEM(publicKeyPEM); err != nil {
+		if key, err = jwt.ParseECPublicKeyFromPEM(publicKeyPEM); err != nil {
+			return nil, errors.New("public key must be a PEM-encoded RSA or ECDSA key")
+		}
+	}
+
+	claims := newClaims(opts)
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			if _, ok := key.(*rsa.PublicKey); ok {
+				return key, nil
+			}
+		case *jwt.SigningMethodECDSA:
+			if _, ok := key.(*ecdsa.PublicKey); ok {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("unexpected signing method %v for public key", token.Header["alg"])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims applies the claim checks shared by all validation modes.
+func checkClaims(claims *NatsTokenClaims) error {
 	// Check token expiration
-	if claims.ExpiresAt != nil && claims.ExpiresAt.Before(time.Now()) {
+	if claims.ExpiresAt != nil && claims.ExpiresAt.Before(time.Now().Add(-claims.leeway)) {
 		logrus.WithField("exp", claims.ExpiresAt).Debug("Token expired")
-		return nil, errors.New("token expired")
+		return ErrExpired
 	}
 
 	// Ensure user ID is present
 	if claims.UserID == "" {
 		logrus.Debug("Missing user_id in token")
-		return nil, errors.New("missing user_id in token")
+		return ErrMissingUserID
 	}
-
-	return claims, nil
+	return nil
 }
@@ -1,11 +1,22 @@
 package tokenvalidation
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
 )
 
 func TestMinimalJwtValidation(t *testing.T) {
@@ -49,3 +60,496 @@ func TestMinimalJwtValidation(t *testing.T) {
 		t.Errorf("Expected signature is invalid, got %v", err)
 	}
 }
+
+// publicKeyPEM encodes a public key as a PKIX PEM block.
+func publicKeyPEM(t *testing.T, pub crypto.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestValidateWithPublicKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ECDSA key: %v", err)
+	}
+
+	sign := func(t *testing.T, method jwt.SigningMethod, key any, claims *NatsTokenClaims) string {
+		t.Helper()
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return token
+	}
+	valid := func() *NatsTokenClaims {
+		return &NatsTokenClaims{
+			UserID:  "alice",
+			Account: "DEVELOPMENT",
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		}
+	}
+	expired := valid()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name      string
+		token     string
+		publicKey []byte
+		expectErr string
+	}{
+		{
+			name:      "RSA",
+			token:     sign(t, jwt.SigningMethodRS256, rsaKey, valid()),
+			publicKey: publicKeyPEM(t, &rsaKey.PublicKey),
+		},
+		{
+			name:      "ECDSA",
+			token:     sign(t, jwt.SigningMethodES256, ecKey, valid()),
+			publicKey: publicKeyPEM(t, &ecKey.PublicKey),
+		},
+		{
+			name:      "key type mismatch",
+			token:     sign(t, jwt.SigningMethodRS256, rsaKey, valid()),
+			publicKey: publicKeyPEM(t, &ecKey.PublicKey),
+			expectErr: "unexpected signing method",
+		},
+		{
+			name:      "HMAC token rejected",
+			token:     sign(t, jwt.SigningMethodHS256, []byte("secret"), valid()),
+			publicKey: publicKeyPEM(t, &rsaKey.PublicKey),
+			expectErr: "unexpected signing method",
+		},
+		{
+			name:      "expired token",
+			token:     sign(t, jwt.SigningMethodES256, ecKey, expired),
+			publicKey: publicKeyPEM(t, &ecKey.PublicKey),
+			expectErr: "expired",
+		},
+		{
+			name:      "missing user_id",
+			token:     sign(t, jwt.SigningMethodES256, ecKey, &NatsTokenClaims{Account: "DEVELOPMENT"}),
+			publicKey: publicKeyPEM(t, &ecKey.PublicKey),
+			expectErr: "missing user_id in token",
+		},
+		{
+			name:      "invalid PEM",
+			token:     sign(t, jwt.SigningMethodES256, ecKey, valid()),
+			publicKey: []byte("not a key"),
+			expectErr: "PEM-encoded RSA or ECDSA key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ValidateWithPublicKey(tt.token, tt.publicKey)
+			if tt.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Fatalf("Expected error containing %q, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if claims.UserID != "alice" || claims.Account != "DEVELOPMENT" {
+				t.Errorf("Unexpected claims: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestValidateWithSecrets(t *testing.T) {
+	secrets := []Secret{
+		{Label: "2025-key", Value: "secret-2025"},
+		{Label: "2024-key", Value: "secret-2024"},
+	}
+	sign := func(t *testing.T, secret string, exp time.Time) string {
+		t.Helper()
+		claims := &NatsTokenClaims{
+			UserID:           "alice",
+			Account:          "DEVELOPMENT",
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(exp)},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return token
+	}
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		token     string
+		wantLabel string
+		wantErr   string
+	}{
+		{name: "current secret", token: sign(t, "secret-2025", later), wantLabel: "2025-key"},
+		{name: "previous secret", token: sign(t, "secret-2024", later), wantLabel: "2024-key"},
+		{name: "unknown secret", token: sign(t, "secret-2023", later), wantErr: "invalid token signature"},
+		{name: "expired with matching secret", token: sign(t, "secret-2024", time.Now().Add(-time.Hour)), wantLabel: "2024-key", wantErr: "expired"},
+		{name: "malformed token", token: "not-a-token", wantErr: "invalid token format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, label, err := ValidateWithSecrets(tt.token, secrets)
+			if label != tt.wantLabel {
+				t.Errorf("Expected label %q, got %q", tt.wantLabel, label)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if claims.UserID != "alice" {
+				t.Errorf("Expected userID alice, got %v", claims.UserID)
+			}
+		})
+	}
+}
+
+func TestValidateNatsTokenAudience(t *testing.T) {
+	secret := "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	sign := func(audience ...string) string {
+		t.Helper()
+		claims := &NatsTokenClaims{
+			UserID:  "alice",
+			Account: "DEVELOPMENT",
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+				Audience:  audience,
+			},
+		}
+		tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return tokenString
+	}
+
+	tests := []struct {
+		name     string
+		required string
+		token    string
+		wantErr  string
+	}{
+		{name: "matching audience", required: "orders", token: sign("orders")},
+		{name: "one of several audiences", required: "orders", token: sign("billing", "orders")},
+		{name: "wrong audience", required: "orders", token: sign("billing"), wantErr: `token audience does not include "orders"`},
+		{name: "missing audience", required: "orders", token: sign(), wantErr: `token audience does not include "orders"`},
+		{name: "audience not required", token: sign("billing")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NATS_TOKEN_AUDIENCE", tt.required)
+			claims, err := ValidateNatsToken(tt.token)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected valid token, got error: %v", err)
+			}
+			if claims.UserID != "alice" {
+				t.Errorf("Expected userID alice, got %v", claims.UserID)
+			}
+		})
+	}
+}
+
+func TestValidateNatsTokenIssuer(t *testing.T) {
+	secret := "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	sign := func(issuer string) string {
+		t.Helper()
+		claims := &NatsTokenClaims{
+			UserID:  "alice",
+			Account: "DEVELOPMENT",
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+				Issuer:    issuer,
+			},
+		}
+		tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return tokenString
+	}
+
+	tests := []struct {
+		name     string
+		required string
+		token    string
+		wantErr  string
+	}{
+		{name: "trusted issuer", required: "https://idp.example.com", token: sign("https://idp.example.com")},
+		{name: "other issuer", required: "https://idp.example.com", token: sign("https://evil.example.com"), wantErr: `token issuer is not "https://idp.example.com"`},
+		{name: "missing issuer", required: "https://idp.example.com", token: sign(""), wantErr: `token issuer is not "https://idp.example.com"`},
+		{name: "issuer not required", token: sign("https://evil.example.com")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NATS_TOKEN_ISSUER", tt.required)
+			claims, err := ValidateNatsToken(tt.token)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Expected error %q, got %v", tt.wantErr, err)
+				}
+				if got := FailureReason(err); got != FailureIssuer {
+					t.Errorf("FailureReason(%v) = %q, want %q", err, got, FailureIssuer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected valid token, got error: %v", err)
+			}
+			if claims.UserID != "alice" {
+				t.Errorf("Expected userID alice, got %v", claims.UserID)
+			}
+		})
+	}
+}
+
+func TestValidateNatsTokenNotBefore(t *testing.T) {
+	secret := "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		opts      []Option
+		wantErr   bool
+	}{
+		{name: "used before nbf", notBefore: time.Now().Add(time.Hour), wantErr: true},
+		{name: "used within leeway of nbf", notBefore: time.Now().Add(DefaultLeeway / 2)},
+		{name: "used before configured leeway of nbf", notBefore: time.Now().Add(10 * time.Second), opts: []Option{WithLeeway(5 * time.Second)}, wantErr: true},
+		{name: "used after nbf", notBefore: time.Now().Add(-time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &NatsTokenClaims{
+				UserID:  "alice",
+				Account: "DEVELOPMENT",
+				RegisteredClaims: jwt.RegisteredClaims{
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(2 * time.Hour)),
+					NotBefore: jwt.NewNumericDate(tt.notBefore),
+				},
+			}
+			tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+			if err != nil {
+				t.Fatalf("Failed to sign token: %v", err)
+			}
+
+			_, err = ValidateNatsToken(tokenString, tt.opts...)
+			if tt.wantErr {
+				if !errors.Is(err, jwt.ErrTokenNotValidYet) {
+					t.Errorf("Expected token not valid yet, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Expected valid token, got error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateNatsTokenIssuedAt(t *testing.T) {
+	secret := "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		opts     []Option
+		wantErr  bool
+	}{
+		{name: "issued in the future without a maximum skew", issuedAt: time.Now().Add(time.Hour)},
+		{name: "issued in the past", issuedAt: time.Now().Add(-time.Minute), opts: []Option{WithMaxIssuedAtSkew(time.Minute)}},
+		{name: "issued within the maximum skew", issuedAt: time.Now().Add(30 * time.Second), opts: []Option{WithMaxIssuedAtSkew(time.Minute)}},
+		{name: "issued beyond the maximum skew", issuedAt: time.Now().Add(time.Hour), opts: []Option{WithMaxIssuedAtSkew(time.Minute)}, wantErr: true},
+		{name: "skew independent of leeway", issuedAt: time.Now().Add(10 * time.Second), opts: []Option{WithLeeway(time.Hour), WithMaxIssuedAtSkew(5 * time.Second)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &NatsTokenClaims{
+				UserID:  "alice",
+				Account: "DEVELOPMENT",
+				RegisteredClaims: jwt.RegisteredClaims{
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(2 * time.Hour)),
+					IssuedAt:  jwt.NewNumericDate(tt.issuedAt),
+				},
+			}
+			tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+			if err != nil {
+				t.Fatalf("Failed to sign token: %v", err)
+			}
+
+			_, err = ValidateNatsToken(tokenString, tt.opts...)
+			if tt.wantErr {
+				if !errors.Is(err, jwt.ErrTokenUsedBeforeIssued) {
+					t.Errorf("Expected token used before issued, got %v", err)
+				}
+				if got := FailureReason(err); got != FailureNotYetValid {
+					t.Errorf("FailureReason(%v) = %q, want %q", err, got, FailureNotYetValid)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Expected valid token, got error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateNatsTokenLeeway(t *testing.T) {
+	secret := "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+
+	tests := []struct {
+		name      string
+		expiredAt time.Time
+		opts      []Option
+		wantErr   bool
+	}{
+		{name: "expired within default leeway", expiredAt: time.Now().Add(-10 * time.Second)},
+		{name: "expired within leeway", expiredAt: time.Now().Add(-10 * time.Second), opts: []Option{WithLeeway(30 * time.Second)}},
+		{name: "expired past leeway", expiredAt: time.Now().Add(-60 * time.Second), opts: []Option{WithLeeway(30 * time.Second)}, wantErr: true},
+		{name: "expired without leeway", expiredAt: time.Now().Add(-10 * time.Second), opts: []Option{WithLeeway(0)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &NatsTokenClaims{
+				UserID:           "alice",
+				Account:          "DEVELOPMENT",
+				RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(tt.expiredAt)},
+			}
+			tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+			if err != nil {
+				t.Fatalf("Failed to sign token: %v", err)
+			}
+
+			_, err = ValidateNatsToken(tokenString, tt.opts...)
+			if tt.wantErr {
+				if FailureReason(err) != FailureExpired {
+					t.Errorf("Expected expired token, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Expected valid token, got error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	secrets := []Secret{{Label: "current", Value: "test-secret-1234567890"}}
+	sign := func(secret string, claims *NatsTokenClaims) string {
+		t.Helper()
+		tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return tokenString
+	}
+	valid := jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{name: "malformed", token: "not-a-jwt", want: FailureMalformed},
+		{name: "wrong secret", token: sign("another-secret", &NatsTokenClaims{UserID: "alice", RegisteredClaims: valid}), want: FailureSignature},
+		{name: "expired", token: sign(secrets[0].Value, &NatsTokenClaims{UserID: "alice", RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		}}), want: FailureExpired},
+		{name: "not yet valid", token: sign(secrets[0].Value, &NatsTokenClaims{UserID: "alice", RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(2 * time.Hour)),
+			NotBefore: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}}), want: FailureNotYetValid},
+		{name: "missing user_id", token: sign(secrets[0].Value, &NatsTokenClaims{RegisteredClaims: valid}), want: FailureClaims},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ValidateWithSecrets(tt.token, secrets)
+			if err == nil {
+				t.Fatal("Expected validation error, got nil")
+			}
+			if got := FailureReason(err); got != tt.want {
+				t.Errorf("FailureReason(%v) = %q, want %q", err, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("audience", func(t *testing.T) {
+		err := CheckAudience(&NatsTokenClaims{RegisteredClaims: jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"billing"}}}, "nats")
+		if got := FailureReason(err); got != FailureAudience {
+			t.Errorf("FailureReason(%v) = %q, want %q", err, got, FailureAudience)
+		}
+	})
+}
+
+// TestValidateNatsTokenLogsFingerprint tests that tokens are logged by their
+// fingerprint, never verbatim.
+func TestValidateNatsTokenLogsFingerprint(t *testing.T) {
+	secret := "test-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+	claims := &NatsTokenClaims{
+		UserID:           "alice",
+		Account:          "DEVELOPMENT",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetLevel(level)
+	}()
+
+	for _, token := range []string{tokenString, "a.b.c"} {
+		out.Reset()
+		_, _ = ValidateNatsToken(token)
+		if !strings.Contains(out.String(), "token_hash="+Fingerprint(token)) {
+			t.Errorf("Expected the token fingerprint in the log, got %q", out.String())
+		}
+		if strings.Contains(out.String(), token) {
+			t.Errorf("Token %q was logged verbatim: %q", token, out.String())
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package usersdebug
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// profilesKey is the top-level users file key holding the permission profiles
+// users reference with Profile. It cannot be used as a username.
+const profilesKey = "profiles"
+
+// profileVars are the values substituted into profile subjects, e.g.
+// "user.{{.Username}}.>".
+type profileVars struct {
+	Username string
+	Account  string
+}
+
+// expandProfile returns the permissions of profile with the user's username and
+// account substituted into every subject.
+func expandProfile(profile jwt.Permissions, vars profileVars) (jwt.Permissions, error) {
+	perms := jwt.Permissions{}
+	var err error
+	if perms.Pub, err = expandPermission(profile.Pub, vars); err != nil {
+		return perms, err
+	}
+	if perms.Sub, err = expandPermission(profile.Sub, vars); err != nil {
+		return perms, err
+	}
+	if profile.Resp != nil {
+		resp := *profile.Resp
+		perms.Resp = &resp
+	}
+	return perms, nil
+}
+
+// expandPermission substitutes vars into the allowed and denied subjects.
+func expandPermission(p jwt.Permission, vars profileVars) (jwt.Permission, error) {
+	var err error
+	var out jwt.Permission
+	if out.Allow, err = expandSubjects(p.Allow, vars); err != nil {
+		return out, err
+	}
+	if out.Deny, err = expandSubjects(p.Deny, vars); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// expandSubjects substitutes vars into each subject. Subjects without template
+// actions are copied as they are.
+func expandSubjects(subjects jwt.StringList, vars profileVars) (jwt.StringList, error) {
+	if subjects == nil {
+		return nil, nil
+	}
+	out := make(jwt.StringList, 0, len(subjects))
+	for _, subject := range subjects {
+		if !strings.Contains(subject, "{{") {
+			out = append(out, subject)
+			continue
+		}
+		tmpl, err := template.New("subject").Option("missingkey=error").Parse(subject)
+		if err != nil {
+			return nil, fmt.Errorf("subject %q: %w", subject, err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, vars); err != nil {
+			return nil, fmt.Errorf("subject %q: %w", subject, err)
+		}
+		out = append(out, b.String())
+	}
+	return out, nil
+}
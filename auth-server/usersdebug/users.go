@@ -2,59 +2,438 @@
 package usersdebug
 
 import (
+	"bytes"
+	_ "embed"
+	"fmt"
 	"os"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nats-io/jwt/v2"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 )
 
+// DuplicatePolicy controls how NewFromFiles resolves a username defined in
+// more than one file.
+type DuplicatePolicy string
+
+// Supported duplicate username policies.
+const (
+	FirstWins        DuplicatePolicy = "first-wins" // Keep the user from the earliest file
+	LastWins         DuplicatePolicy = "last-wins"  // Keep the user from the latest file
+	ErrorOnDuplicate DuplicatePolicy = "error"      // Fail loading on any duplicate
+)
+
+// defaultUsers is the insecure bootstrap user set used when no users file is configured.
+//
+//go:embed default_users.yaml
+var defaultUsers []byte
+
 // Repository allows calling test users
 type Repository struct {
-	users map[string]*auth.User
+	mu       sync.RWMutex // Guards users and aliases, swapped on reload
+	users    map[string]*auth.User
+	aliases  map[string]string // Alternate key to canonical username
+	insecure bool              // Holds the embedded bootstrap users
+	paths    []string          // Users files reloaded by Watch
+	policy   DuplicatePolicy   // Duplicate username policy for reloads
+	checks   *reloadChecks     // Checks reloaded users must pass, nil for none
+}
+
+// reloadChecks are the startup checks reapplied to reloaded users.
+type reloadChecks struct {
+	maxAccounts int
+	templates   []string
+}
+
+// newRepository builds a Repository and its alternate key index. An alternate
+// key may not repeat a username or another user's alternate key.
+func newRepository(users map[string]*auth.User) (*Repository, error) {
+	aliases := make(map[string]string)
+	for username, user := range users {
+		for _, key := range user.AlternateKeys {
+			if _, exists := users[key]; exists && key != username {
+				return nil, fmt.Errorf("alternate key %q of user %q is another user's username", key, username)
+			}
+			if other, exists := aliases[key]; exists && other != username {
+				return nil, fmt.Errorf("alternate key %q is used by users %q and %q", key, other, username)
+			}
+			aliases[key] = username
+		}
+	}
+	return &Repository{users: users, aliases: aliases}, nil
+}
+
+// DefaultUsersFile is the users file New loads when no path is given.
+const DefaultUsersFile = "users.yaml"
+
+// New returns a Repository struct with users loaded from the YAML file at path,
+// or from DefaultUsersFile in the working directory when path is empty.
+func New(path string) (*Repository, error) {
+	if path == "" {
+		path = DefaultUsersFile
+	}
+	return NewFromFile(path)
 }
 
-// New returns a Repository struct with users loaded from users.yaml
-func New() (*Repository, error) {
+// NewFromFile returns a Repository struct with users loaded from the given YAML file
+func NewFromFile(path string) (*Repository, error) {
 	// Read the YAML file
-	data, err := os.ReadFile("users.yaml")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := newRepository(users)
 	if err != nil {
 		return nil, err
 	}
+	repo.paths = []string{path}
+	repo.policy = ErrorOnDuplicate
+	return repo, nil
+}
 
+// NewFromFiles returns a Repository struct with users merged from the given YAML
+// files in order. Usernames defined in more than one file are resolved with policy.
+func NewFromFiles(paths []string, policy DuplicatePolicy) (*Repository, error) {
+	switch policy {
+	case FirstWins, LastWins, ErrorOnDuplicate:
+	default:
+		return nil, fmt.Errorf("unknown duplicate users policy %q", policy)
+	}
+	users, err := loadFiles(paths, policy)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := newRepository(users)
+	if err != nil {
+		return nil, err
+	}
+	repo.paths = paths
+	repo.policy = policy
+	return repo, nil
+}
+
+// loadFiles merges the users of the given YAML files in order, resolving
+// duplicate usernames with policy.
+func loadFiles(paths []string, policy DuplicatePolicy) (map[string]*auth.User, error) {
+	merged := make(map[string]*auth.User)
+	source := make(map[string]string)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		users, err := parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		for username, user := range users {
+			if first, exists := source[username]; exists {
+				if policy == ErrorOnDuplicate {
+					return nil, fmt.Errorf("duplicate user %q in %s and %s", username, first, path)
+				}
+				logrus.WithFields(logrus.Fields{
+					"username": username,
+					"first":    first,
+					"file":     path,
+					"policy":   policy,
+				}).Warn("Resolved duplicate username")
+				if policy == FirstWins {
+					continue
+				}
+			}
+			merged[username] = user
+			source[username] = path
+		}
+	}
+	return merged, nil
+}
+
+// NewDefault returns a Repository struct with the embedded bootstrap users.
+// These users have well-known passwords and are insecure by design.
+func NewDefault() (*Repository, error) {
+	users, err := parse(defaultUsers)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := newRepository(users)
+	if err != nil {
+		return nil, err
+	}
+	repo.insecure = true
+	return repo, nil
+}
+
+// parse builds users from YAML user definitions. Permissions are compiled into
+// jwt.Permissions once here and shared by pointer on every Get. Users with a
+// Profile get the permissions of the matching entry of the top-level profiles
+// section, with their username and account substituted.
+func parse(data []byte) (map[string]*auth.User, error) {
 	// Define a struct to match the YAML structure
 	type yamlUser struct {
 		Pass        string           `yaml:"Pass"`
+		PassHash    string           `yaml:"PassHash,omitempty"`
 		Account     string           `yaml:"Account"`
 		Permissions *jwt.Permissions `yaml:"Permissions,omitempty"`
+		ExpiresAt   time.Time        `yaml:"ExpiresAt,omitempty"`
+		// AlternateKeys lists extra identifiers (e.g. email) resolving to this user
+		AlternateKeys []string `yaml:"AlternateKeys,omitempty"`
+		// Template names a permission template from auth.permission_templates
+		Template string `yaml:"Template,omitempty"`
+		// Limits caps subscriptions, data and payload; unset limits are unlimited
+		Limits auth.Limits `yaml:"Limits,omitempty"`
+		// Profile names an entry of the profiles section providing the permissions
+		Profile string `yaml:"Profile,omitempty"`
+		// ConnectionTypes restricts how the user may connect, e.g. WEBSOCKET
+		ConnectionTypes []string `yaml:"ConnectionTypes,omitempty"`
+		// BearerToken issues a bearer user JWT, e.g. for embedded service clients
+		BearerToken bool `yaml:"BearerToken,omitempty"`
+		// Src restricts the networks the user may connect from, as CIDRs
+		Src []string `yaml:"Src,omitempty"`
+		// Times restricts the daily windows the user may connect in
+		Times []auth.TimeWindow `yaml:"Times,omitempty"`
+		// Locale is the time zone of Times, e.g. Europe/Berlin
+		Locale string `yaml:"Locale,omitempty"`
 	}
 
-	// Unmarshal YAML into a map
-	var yamlUsers map[string]yamlUser
-	if err := yaml.Unmarshal(data, &yamlUsers); err != nil {
+	// Unmarshal YAML into a map, setting the profiles aside
+	var nodes map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &nodes); err != nil {
 		return nil, err
 	}
+	var profiles map[string]jwt.Permissions
+	if node, ok := nodes[profilesKey]; ok {
+		if err := node.Decode(&profiles); err != nil {
+			return nil, fmt.Errorf("%s: %w", profilesKey, err)
+		}
+		delete(nodes, profilesKey)
+	}
+	yamlUsers := make(map[string]yamlUser, len(nodes))
+	for username, node := range nodes {
+		var yu yamlUser
+		if err := node.Decode(&yu); err != nil {
+			return nil, err
+		}
+		yamlUsers[username] = yu
+	}
 
 	// Convert yamlUser to auth.User
 	users := make(map[string]*auth.User)
 	for username, yu := range yamlUsers {
+		if yu.PassHash != "" {
+			if yu.Pass != "" {
+				return nil, fmt.Errorf("user %q sets both Pass and PassHash", username)
+			}
+			if _, err := bcrypt.Cost([]byte(yu.PassHash)); err != nil {
+				return nil, fmt.Errorf("user %q: PassHash is not a bcrypt hash: %w", username, err)
+			}
+			yu.Pass = yu.PassHash
+		}
+		if err := yu.Limits.Validate(); err != nil {
+			return nil, fmt.Errorf("user %q: %w", username, err)
+		}
+		connTypes, err := auth.NormalizeConnectionTypes(yu.ConnectionTypes)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", username, err)
+		}
+		if err := auth.ValidateCIDRs(yu.Src); err != nil {
+			return nil, fmt.Errorf("user %q: %w", username, err)
+		}
+		if err := auth.ValidateTimes(yu.Times, yu.Locale); err != nil {
+			return nil, fmt.Errorf("user %q: %w", username, err)
+		}
 		user := &auth.User{
-			Pass:    yu.Pass,
-			Account: yu.Account,
+			Pass:            yu.Pass,
+			Account:         yu.Account,
+			ExpiresAt:       yu.ExpiresAt,
+			AlternateKeys:   yu.AlternateKeys,
+			Template:        yu.Template,
+			Limits:          yu.Limits,
+			ConnectionTypes: connTypes,
+			BearerToken:     yu.BearerToken,
+			Src:             yu.Src,
+			Times:           yu.Times,
+			Locale:          yu.Locale,
 		}
 		if yu.Permissions != nil {
 			user.Permissions = *yu.Permissions
 		}
+		if yu.Profile != "" {
+			if yu.Permissions != nil {
+				return nil, fmt.Errorf("user %q sets both Profile and Permissions", username)
+			}
+			profile, ok := profiles[yu.Profile]
+			if !ok {
+				return nil, fmt.Errorf("user %q references unknown profile %q", username, yu.Profile)
+			}
+			perms, err := expandProfile(profile, profileVars{Username: username, Account: yu.Account})
+			if err != nil {
+				return nil, fmt.Errorf("user %q: profile %q: %w", username, yu.Profile, err)
+			}
+			user.Permissions = perms
+		}
 		users[username] = user
 	}
 
-	return &Repository{
-		users: users,
-	}, nil
+	return users, nil
+}
+
+// Insecure reports whether the repository holds the embedded bootstrap users
+// from NewDefault rather than users loaded from a real backend.
+func (r *Repository) Insecure() bool {
+	return r.insecure
+}
+
+// Count returns the number of users and of distinct accounts they reference.
+func (r *Repository) Count() (users, accounts int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := make(map[string]struct{})
+	for _, user := range r.users {
+		seen[user.Account] = struct{}{}
+	}
+	return len(r.users), len(seen)
+}
+
+// ValidateReloads makes Watch apply CheckMaxAccounts and CheckTemplates with
+// the given settings to reloaded users, keeping the previous users when they
+// fail, so a reload cannot bring in what would have failed at startup.
+func (r *Repository) ValidateReloads(maxAccounts int, templates []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = &reloadChecks{maxAccounts: maxAccounts, templates: templates}
+}
+
+// CheckMaxAccounts fails when the users reference more than max distinct
+// accounts, guarding against a corrupt backend dumping anomalous data. A max
+// of zero or less disables the check.
+func (r *Repository) CheckMaxAccounts(max int) error {
+	if max <= 0 {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	accounts := make(map[string]struct{})
+	for _, user := range r.users {
+		accounts[user.Account] = struct{}{}
+	}
+	if len(accounts) > max {
+		return fmt.Errorf("users reference %d distinct accounts, more than the maximum of %d", len(accounts), max)
+	}
+	return nil
+}
+
+// CheckTemplates fails when a user references a permission template that is
+// not in templates. Template names are matched case-insensitively.
+func (r *Repository) CheckTemplates(templates []string) error {
+	known := make(map[string]struct{}, len(templates))
+	for _, name := range templates {
+		known[strings.ToLower(name)] = struct{}{}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	usernames := make([]string, 0, len(r.users))
+	for username := range r.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		template := r.users[username].Template
+		if template == "" {
+			continue
+		}
+		if _, ok := known[strings.ToLower(template)]; !ok {
+			return fmt.Errorf("user %q references unknown permission template %q", username, template)
+		}
+	}
+	return nil
+}
+
+// MigratePasswords rewrites a users YAML document so every plaintext Pass is
+// replaced by a PassHash bcrypt hash of the given cost. Passwords already stored
+// as bcrypt hashes are moved to PassHash unchanged. Everything else, including
+// accounts, permissions, ordering and comments, is preserved.
+func MigratePasswords(data []byte, cost int) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return data, nil
+	}
+	users := doc.Content[0]
+	if users.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("users document must be a mapping of usernames")
+	}
+
+	for i := 0; i+1 < len(users.Content); i += 2 {
+		username, fields := users.Content[i].Value, users.Content[i+1]
+		if fields.Kind != yaml.MappingNode || username == profilesKey {
+			continue
+		}
+		for j := 0; j+1 < len(fields.Content); j += 2 {
+			key, value := fields.Content[j], fields.Content[j+1]
+			if key.Value != "Pass" {
+				continue
+			}
+			hash := value.Value
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				hashed, err := bcrypt.GenerateFromPassword([]byte(value.Value), cost)
+				if err != nil {
+					return nil, fmt.Errorf("hashing password of %q: %w", username, err)
+				}
+				hash = string(hashed)
+			}
+			key.Value = "PassHash"
+			value.Value = hash
+			value.Tag = "!!str"
+			value.Style = yaml.DoubleQuotedStyle
+		}
+	}
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
 }
 
-// Get returns a User from the repository
+// Canonical returns the username the alternate key belongs to, or key itself
+// when it is a username or unknown.
+func (r *Repository) Canonical(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, exists := r.users[key]; exists {
+		return key
+	}
+	if canonical, ok := r.aliases[key]; ok {
+		return canonical
+	}
+	return key
+}
+
+// Get returns a User from the repository by username or alternate key
 func (r *Repository) Get(username string) (*auth.User, bool) {
-	user, exists := r.users[username]
-	return user, exists
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if user, exists := r.users[username]; exists {
+		return user, true
+	}
+	if canonical, ok := r.aliases[username]; ok {
+		return r.users[canonical], true
+	}
+	return nil, false
 }
@@ -2,11 +2,15 @@ package usersdebug
 
 import (
 	"os"
+	"path/filepath"
 	"reflect"
 	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nats-io/jwt/v2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // TestNew tests the New function for creating a Repository from users.yaml
@@ -71,6 +75,22 @@ alice:
 				}
 			},
 		},
+		{
+			name: "User with expiry",
+			yamlContent: `
+contractor:
+  Pass: contractor
+  Account: DEVELOPMENT
+  ExpiresAt: 2030-01-31T00:00:00Z
+`,
+			wantErr: false,
+			validate: func(t *testing.T, repo *Repository) {
+				want := time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC)
+				if user, exists := repo.users["contractor"]; !exists || !user.ExpiresAt.Equal(want) {
+					t.Errorf("Expected contractor to expire at %v, got %+v, exists=%v", want, user, exists)
+				}
+			},
+		},
 		{
 			name:        "Non-existent YAML file",
 			yamlContent: "", // No file created
@@ -102,8 +122,8 @@ alice:
 				defer cleanup()
 			}
 
-			// Run the New function
-			repo, err := New()
+			// Run the New function with the default path
+			repo, err := New("")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -113,6 +133,20 @@ alice:
 			}
 		})
 	}
+
+	t.Run("Configured path", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.yaml")
+		if err := os.WriteFile(path, []byte("bob:\n  Pass: bob\n  Account: TEST\n"), 0644); err != nil {
+			t.Fatalf("Failed to write users file: %v", err)
+		}
+		repo, err := New(path)
+		if err != nil {
+			t.Fatalf("New(%q) error = %v", path, err)
+		}
+		if user, ok := repo.Get("bob"); !ok || user.Account != "TEST" {
+			t.Errorf("Get(bob) = %v, %v; want the user from %s", user, ok, path)
+		}
+	})
 }
 
 // TestGet tests the Get function for retrieving users from the Repository
@@ -183,3 +217,491 @@ func TestGet(t *testing.T) {
 		})
 	}
 }
+
+// TestNewDefault tests that the embedded bootstrap users load
+func TestNewDefault(t *testing.T) {
+	repo, err := NewDefault()
+	if err != nil {
+		t.Fatalf("NewDefault() error = %v", err)
+	}
+	if len(repo.users) == 0 {
+		t.Fatal("Expected embedded users, got none")
+	}
+	if !repo.Insecure() {
+		t.Error("Expected embedded users to be reported as insecure")
+	}
+	user, exists := repo.Get("demo")
+	if !exists {
+		t.Fatal("Expected embedded user 'demo' to exist")
+	}
+	if user.Pass != "demo" || user.Account != "DEVELOPMENT" {
+		t.Errorf("Expected demo user with Pass=demo, Account=DEVELOPMENT, got %+v", user)
+	}
+	if len(user.Permissions.Sub.Allow) == 0 {
+		t.Errorf("Expected demo user to have Sub permissions, got %+v", user.Permissions)
+	}
+}
+
+// TestNewFromFiles tests merging users files with each duplicate policy
+func TestNewFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(t *testing.T, name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	first := writeFile(t, "first.yaml", `
+alice:
+  Pass: first
+  Account: DEVELOPMENT
+sys:
+  Pass: sys
+  Account: SYS
+`)
+	second := writeFile(t, "second.yaml", `
+alice:
+  Pass: second
+  Account: TEST
+`)
+
+	tests := []struct {
+		name     string
+		policy   DuplicatePolicy
+		wantErr  bool
+		wantPass string
+	}{
+		{name: "first wins", policy: FirstWins, wantPass: "first"},
+		{name: "last wins", policy: LastWins, wantPass: "second"},
+		{name: "error on duplicate", policy: ErrorOnDuplicate, wantErr: true},
+		{name: "unknown policy", policy: "random", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := NewFromFiles([]string{first, second}, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewFromFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(repo.users) != 2 {
+				t.Errorf("Expected 2 users, got %d", len(repo.users))
+			}
+			if user, exists := repo.Get("alice"); !exists || user.Pass != tt.wantPass {
+				t.Errorf("Expected alice with Pass=%s, got %+v, exists=%v", tt.wantPass, user, exists)
+			}
+		})
+	}
+}
+
+// TestCheckMaxAccounts tests capping the number of distinct accounts
+func TestCheckMaxAccounts(t *testing.T) {
+	users, err := parse([]byte(`
+alice:
+  Pass: alice
+  Account: DEVELOPMENT
+bob:
+  Pass: bob
+  Account: DEVELOPMENT
+carol:
+  Pass: carol
+  Account: TEST
+sys:
+  Pass: sys
+  Account: SYS
+`))
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	repo, err := newRepository(users)
+	if err != nil {
+		t.Fatalf("newRepository() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		max     int
+		wantErr string
+	}{
+		{name: "disabled", max: 0},
+		{name: "at the cap", max: 3},
+		{name: "above the cap", max: 2, wantErr: "users reference 3 distinct accounts, more than the maximum of 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := repo.CheckMaxAccounts(tt.max)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckMaxAccounts(%d) error = %v", tt.max, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("CheckMaxAccounts(%d) error = %v, want %q", tt.max, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestAlternateKeys tests resolving users by username and alternate key
+func TestAlternateKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, "users.yaml")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write users.yaml: %v", err)
+		}
+		return path
+	}
+
+	t.Run("resolves username and email", func(t *testing.T) {
+		repo, err := NewFromFile(writeFile(t, `
+alice:
+  Pass: alice
+  Account: DEVELOPMENT
+  AlternateKeys:
+    - alice@example.com
+bob:
+  Pass: bob
+  Account: DEVELOPMENT
+`))
+		if err != nil {
+			t.Fatalf("NewFromFile() error = %v", err)
+		}
+		byName, exists := repo.Get("alice")
+		if !exists {
+			t.Fatal("Expected alice to resolve by username")
+		}
+		byEmail, exists := repo.Get("alice@example.com")
+		if !exists {
+			t.Fatal("Expected alice to resolve by email")
+		}
+		if byName != byEmail {
+			t.Errorf("Expected username and email to resolve to the same user, got %+v and %+v", byName, byEmail)
+		}
+		if _, exists := repo.Get("bob@example.com"); exists {
+			t.Error("Expected unknown alternate key not to resolve")
+		}
+		for key, want := range map[string]string{"alice@example.com": "alice", "alice": "alice", "bob@example.com": "bob@example.com"} {
+			if got := repo.Canonical(key); got != want {
+				t.Errorf("Canonical(%q) = %q, want %q", key, got, want)
+			}
+		}
+	})
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name: "alternate key shared by two users",
+			content: `
+alice:
+  AlternateKeys: [team@example.com]
+bob:
+  AlternateKeys: [team@example.com]
+`,
+		},
+		{
+			name: "alternate key is another username",
+			content: `
+alice:
+  AlternateKeys: [bob]
+bob:
+  Pass: bob
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewFromFile(writeFile(t, tt.content)); err == nil {
+				t.Error("NewFromFile() expected error, got nil")
+			}
+		})
+	}
+}
+
+// TestMigratePasswords tests round-tripping a users file through the password migration
+func TestMigratePasswords(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("bob"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	plain := []byte(`
+alice:
+  Pass: alice
+  Account: DEVELOPMENT
+  Permissions:
+    pub:
+      allow:
+        - $JS.API.STREAM.LIST
+    sub:
+      allow:
+        - _INBOX.>
+bob:
+  Pass: "` + string(hashed) + `"
+  Account: TEST
+`)
+
+	migrated, err := MigratePasswords(plain, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("MigratePasswords() error = %v", err)
+	}
+	if strings.Contains(string(migrated), "Pass:") {
+		t.Errorf("Expected no plaintext Pass fields, got:\n%s", migrated)
+	}
+
+	before, err := parse(plain)
+	if err != nil {
+		t.Fatalf("parse(plain) error = %v", err)
+	}
+	after, err := parse(migrated)
+	if err != nil {
+		t.Fatalf("parse(migrated) error = %v", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("Expected %d users after migration, got %d", len(before), len(after))
+	}
+	for username, want := range before {
+		got := after[username]
+		if got.Account != want.Account || !reflect.DeepEqual(got.Permissions, want.Permissions) {
+			t.Errorf("User %q changed: got %+v, want %+v", username, got, want)
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(got.Pass), []byte(username)); err != nil {
+			t.Errorf("User %q hash does not match the original password: %v", username, err)
+		}
+	}
+	if after["bob"].Pass != string(hashed) {
+		t.Error("Expected an existing bcrypt hash to be kept unchanged")
+	}
+}
+
+// TestParsePassHash tests validation of PassHash fields
+func TestParsePassHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "not a bcrypt hash", content: "alice:\n  PassHash: alice\n"},
+		{name: "both Pass and PassHash", content: "alice:\n  Pass: alice\n  PassHash: \"$2a$04$pQ3BnU.6NGfMICa02asbWeLemZXMqIfUiKGzBxUMdgZZaM3zvfS3G\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parse([]byte(tt.content)); err == nil {
+				t.Error("parse() expected error, got nil")
+			}
+		})
+	}
+}
+
+// BenchmarkGet measures per-request lookups of precompiled user permissions
+func BenchmarkGet(b *testing.B) {
+	repo, err := NewDefault()
+	if err != nil {
+		b.Fatalf("NewDefault() error = %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, exists := repo.Get("demo"); !exists {
+			b.Fatal("Expected user 'demo' to exist")
+		}
+	}
+}
+
+// TestCheckTemplates tests rejecting references to unknown permission templates
+func TestCheckTemplates(t *testing.T) {
+	users, err := parse([]byte(`
+alice:
+  Pass: alice
+  Account: DEVELOPMENT
+  Template: Reader
+bob:
+  Pass: bob
+  Account: DEVELOPMENT
+`))
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	if got := users["alice"].Template; got != "Reader" {
+		t.Errorf("alice Template = %q, want %q", got, "Reader")
+	}
+	repo, err := newRepository(users)
+	if err != nil {
+		t.Fatalf("newRepository() error = %v", err)
+	}
+
+	if err := repo.CheckTemplates([]string{"reader", "writer"}); err != nil {
+		t.Errorf("CheckTemplates() error = %v", err)
+	}
+	want := `user "alice" references unknown permission template "Reader"`
+	if err := repo.CheckTemplates([]string{"writer"}); err == nil || err.Error() != want {
+		t.Errorf("CheckTemplates() error = %v, want %q", err, want)
+	}
+}
+
+// TestParseLimits tests loading connection limits, keeping unset ones unlimited
+func TestParseLimits(t *testing.T) {
+	users, err := parse([]byte(`
+alice:
+  Pass: alice
+  Account: DEVELOPMENT
+  Limits:
+    subs: 100
+    payload: 0
+bob:
+  Pass: bob
+  Account: DEVELOPMENT
+`))
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	limits := users["alice"].Limits
+	if limits.Subs == nil || *limits.Subs != 100 {
+		t.Errorf("alice Limits.Subs = %v, want 100", limits.Subs)
+	}
+	if limits.Payload == nil || *limits.Payload != 0 {
+		t.Errorf("alice Limits.Payload = %v, want an explicit 0", limits.Payload)
+	}
+	if limits.Data != nil {
+		t.Errorf("alice Limits.Data = %v, want unset", *limits.Data)
+	}
+	if users["bob"].Limits != (auth.Limits{}) {
+		t.Errorf("bob Limits = %+v, want none", users["bob"].Limits)
+	}
+
+	if _, err := parse([]byte("alice:\n  Pass: alice\n  Limits:\n    data: -2\n")); err == nil {
+		t.Error("parse() expected error for a limit below -1, got nil")
+	}
+}
+
+func TestParseProfiles(t *testing.T) {
+	users, err := parse([]byte(`
+profiles:
+  readonly:
+    pub:
+      deny: [">"]
+    sub:
+      allow: ["user.{{.Username}}.>", "{{.Account}}.public.>", "_INBOX.>"]
+alice:
+  Pass: alice
+  Account: DEVELOPMENT
+  Profile: readonly
+bob:
+  Pass: bob
+  Account: TEST
+  Profile: readonly
+`))
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	if _, ok := users[profilesKey]; ok {
+		t.Errorf("parse() loaded the profiles section as a user")
+	}
+
+	want := map[string]jwt.Permissions{
+		"alice": {
+			Pub: jwt.Permission{Deny: jwt.StringList{">"}},
+			Sub: jwt.Permission{Allow: jwt.StringList{"user.alice.>", "DEVELOPMENT.public.>", "_INBOX.>"}},
+		},
+		"bob": {
+			Pub: jwt.Permission{Deny: jwt.StringList{">"}},
+			Sub: jwt.Permission{Allow: jwt.StringList{"user.bob.>", "TEST.public.>", "_INBOX.>"}},
+		},
+	}
+	for username, perms := range want {
+		if !reflect.DeepEqual(users[username].Permissions, perms) {
+			t.Errorf("%s Permissions = %+v, want %+v", username, users[username].Permissions, perms)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name:    "unknown profile",
+			data:    "alice:\n  Pass: alice\n  Profile: admin\n",
+			wantErr: `user "alice" references unknown profile "admin"`,
+		},
+		{
+			name:    "profile and permissions",
+			data:    "profiles:\n  readonly: {}\nalice:\n  Pass: alice\n  Profile: readonly\n  Permissions:\n    pub:\n      allow: [a]\n",
+			wantErr: `user "alice" sets both Profile and Permissions`,
+		},
+		{
+			name:    "unknown variable",
+			data:    "profiles:\n  readonly:\n    sub:\n      allow: [\"{{.Email}}.>\"]\nalice:\n  Pass: alice\n  Profile: readonly\n",
+			wantErr: `user "alice": profile "readonly": subject "{{.Email}}.>"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parse() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseConnectionSettings(t *testing.T) {
+	users, err := parse([]byte(`
+alice:
+  Pass: alice
+  Account: DEVELOPMENT
+  ConnectionTypes: [websocket, MQTT]
+  BearerToken: true
+  Src: [10.0.0.0/8]
+  Times:
+    - Start: "08:00"
+      End: "17:30"
+      Weekdays: [Mon, tuesday]
+  Locale: Europe/Berlin
+bob:
+  Pass: bob
+  Account: DEVELOPMENT
+`))
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	if want := []string{"WEBSOCKET", "MQTT"}; !reflect.DeepEqual(users["alice"].ConnectionTypes, want) {
+		t.Errorf("alice ConnectionTypes = %v, want %v", users["alice"].ConnectionTypes, want)
+	}
+	if users["bob"].ConnectionTypes != nil {
+		t.Errorf("bob ConnectionTypes = %v, want none", users["bob"].ConnectionTypes)
+	}
+	if !users["alice"].BearerToken || users["bob"].BearerToken {
+		t.Errorf("BearerToken = %t for alice and %t for bob, want true and false", users["alice"].BearerToken, users["bob"].BearerToken)
+	}
+
+	if want := []string{"10.0.0.0/8"}; !reflect.DeepEqual(users["alice"].Src, want) {
+		t.Errorf("alice Src = %v, want %v", users["alice"].Src, want)
+	}
+
+	wantTimes := []auth.TimeWindow{{Start: "08:00", End: "17:30", Weekdays: []string{"Mon", "tuesday"}}}
+	if !reflect.DeepEqual(users["alice"].Times, wantTimes) || users["alice"].Locale != "Europe/Berlin" {
+		t.Errorf("alice Times = %v in %q, want %v in Europe/Berlin", users["alice"].Times, users["alice"].Locale, wantTimes)
+	}
+
+	invalid := map[string]string{
+		"alice:\n  Pass: alice\n  ConnectionTypes: [CARRIER_PIGEON]\n":                           `user "alice": unknown connection type "CARRIER_PIGEON"`,
+		"alice:\n  Pass: alice\n  Src: [10.0.0.300/8]\n":                                         `user "alice": invalid source CIDR "10.0.0.300/8"`,
+		"alice:\n  Pass: alice\n  Times: [{Start: '8am', End: '17:00'}]\n":                       `user "alice": invalid time of day "8am", expected HH:MM`,
+		"alice:\n  Pass: alice\n  Times: [{Start: '08:00', End: '17:00', Weekdays: [Funday]}]\n": `user "alice": unknown weekday "Funday"`,
+		"alice:\n  Pass: alice\n  Locale: Mars/Olympus\n":                                        `user "alice": unknown locale "Mars/Olympus"`,
+	}
+	for data, want := range invalid {
+		if _, err := parse([]byte(data)); err == nil || err.Error() != want {
+			t.Errorf("parse() error = %v, want %q", err, want)
+		}
+	}
+}
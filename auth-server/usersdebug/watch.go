@@ -0,0 +1,145 @@
+package usersdebug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// reloadDelay coalesces the burst of events an editor or deployment tool
+// produces while rewriting a file into a single reload trigger.
+const reloadDelay = 100 * time.Millisecond
+
+// Watch calls trigger whenever one of the users files is written, created,
+// renamed or removed, until ctx is done. trigger is expected to call Reload
+// through the reload.Reloader shared with other reload sources such as SIGHUP,
+// so reloads of the repository never overlap. The parent directories are watched so
+// files replaced by a rename, as editors do, are picked up too. Kubernetes
+// ConfigMaps never touch the mounted file itself but swap the ..data symlink
+// it resolves through, so any other event in a watched directory reloads when
+// the resolved target of a users file changed.
+func (r *Repository) Watch(ctx context.Context, trigger func()) error {
+	if len(r.paths) == 0 {
+		return errors.New("repository has no users files to watch")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating users file watcher: %w", err)
+	}
+	defer func() {
+		if err := watcher.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close users file watcher")
+		}
+	}()
+
+	// files maps every users file to its resolved symlink target
+	files := make(map[string]string, len(r.paths))
+	dirs := make(map[string]struct{})
+	for _, path := range r.paths {
+		files[filepath.Clean(path)] = resolve(path)
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("watching %s: %w", dir, err)
+		}
+	}
+	logrus.WithField("files", r.paths).Info("Watching users files for changes")
+
+	reload := time.NewTimer(reloadDelay)
+	reload.Stop()
+	defer reload.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			_, watched := files[filepath.Clean(event.Name)]
+			if retargeted(files) || watched {
+				reload.Reset(reloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logrus.WithError(err).Error("Users file watcher failed")
+		case <-reload.C:
+			trigger()
+		}
+	}
+}
+
+// resolve returns the file path finally points to through any symlinks, or
+// an empty string while it cannot be resolved.
+func resolve(path string) string {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
+// retargeted updates the resolved targets of files and reports whether any
+// of them changed.
+func retargeted(files map[string]string) bool {
+	changed := false
+	for path, target := range files {
+		if current := resolve(path); current != target {
+			files[path] = current
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Reload reads the users files again and atomically swaps in the new users
+// once they pass the checks set by ValidateReloads. On error the previous
+// users are kept. The embedded users have no files and are not reloaded.
+func (r *Repository) Reload() error {
+	if len(r.paths) == 0 {
+		return nil
+	}
+	if err := r.reload(); err != nil {
+		return fmt.Errorf("reloading users files %v: %w", r.paths, err)
+	}
+	logrus.WithField("files", r.paths).Info("Reloaded users")
+	return nil
+}
+
+// reload swaps in the users read from the users files, see Reload.
+func (r *Repository) reload() error {
+	users, err := loadFiles(r.paths, r.policy)
+	if err != nil {
+		return err
+	}
+	fresh, err := newRepository(users)
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	checks := r.checks
+	r.mu.RUnlock()
+	if checks != nil {
+		if err := fresh.CheckMaxAccounts(checks.maxAccounts); err != nil {
+			return err
+		}
+		if err := fresh.CheckTemplates(checks.templates); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.users, r.aliases = fresh.users, fresh.aliases
+	r.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,228 @@
+package usersdebug
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/reload"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cond()
+}
+
+// TestWatch tests reloading the users file on change without a restart
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write users file: %v", err)
+		}
+	}
+	write("alice:\n  Pass: alice\n  Account: DEVELOPMENT\n")
+
+	repo, err := NewFromFile(path)
+	if err != nil {
+		t.Fatalf("NewFromFile() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- repo.Watch(ctx, reload.New(repo.Reload).Trigger) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Watch() error = %v", err)
+		}
+	}()
+
+	// Concurrent lookups stay safe while the users are swapped
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				repo.Get("alice")
+				repo.Get("bob")
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	// Give the watcher time to register before rewriting the file
+	time.Sleep(100 * time.Millisecond)
+
+	t.Run("adds and removes users", func(t *testing.T) {
+		write("bob:\n  Pass: bob\n  Account: TEST\n")
+		if !waitFor(t, func() bool { _, ok := repo.Get("bob"); return ok }) {
+			t.Fatal("bob was not loaded after the users file changed")
+		}
+		if _, ok := repo.Get("alice"); ok {
+			t.Error("alice is still present after being removed from the users file")
+		}
+	})
+
+	t.Run("keeps the previous users on parse errors", func(t *testing.T) {
+		write("bob: [\n")
+		time.Sleep(5 * reloadDelay)
+		user, ok := repo.Get("bob")
+		if !ok || user.Account != "TEST" {
+			t.Errorf("Get(bob) = %v, %v; want the previously loaded user", user, ok)
+		}
+	})
+
+	t.Run("picks up a file replaced by rename", func(t *testing.T) {
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte("carol:\n  Pass: carol\n  Account: TEST\n"), 0644); err != nil {
+			t.Fatalf("Failed to write users file: %v", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatalf("Failed to replace users file: %v", err)
+		}
+		if !waitFor(t, func() bool { _, ok := repo.Get("carol"); return ok }) {
+			t.Fatal("carol was not loaded after the users file was replaced")
+		}
+	})
+}
+
+// TestWatchConfigMap tests reloading a users file mounted from a Kubernetes
+// ConfigMap, updated by swapping the ..data symlink it resolves through
+func TestWatchConfigMap(t *testing.T) {
+	dir := t.TempDir()
+	// publish writes a ConfigMap version and points ..data at it
+	publish := func(version, content string) {
+		t.Helper()
+		if err := os.Mkdir(filepath.Join(dir, version), 0755); err != nil {
+			t.Fatalf("Failed to create version directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "users.yaml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write users file: %v", err)
+		}
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(version, tmp); err != nil {
+			t.Fatalf("Failed to link version: %v", err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+			t.Fatalf("Failed to swap ..data: %v", err)
+		}
+	}
+	publish("..2025_06_01_v1", "alice:\n  Pass: alice\n  Account: DEVELOPMENT\n")
+	path := filepath.Join(dir, "users.yaml")
+	if err := os.Symlink(filepath.Join("..data", "users.yaml"), path); err != nil {
+		t.Fatalf("Failed to link users file: %v", err)
+	}
+
+	repo, err := NewFromFile(path)
+	if err != nil {
+		t.Fatalf("NewFromFile() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- repo.Watch(ctx, reload.New(repo.Reload).Trigger) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Watch() error = %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	publish("..2025_06_02_v2", "bob:\n  Pass: bob\n  Account: TEST\n")
+	if !waitFor(t, func() bool { _, ok := repo.Get("bob"); return ok }) {
+		t.Fatal("bob was not loaded after the ConfigMap was updated")
+	}
+	if _, ok := repo.Get("alice"); ok {
+		t.Error("alice is still present after the ConfigMap update removed her")
+	}
+}
+
+// TestWatchWithoutFiles tests that the embedded users cannot be watched
+func TestWatchWithoutFiles(t *testing.T) {
+	repo, err := NewDefault()
+	if err != nil {
+		t.Fatalf("NewDefault() error = %v", err)
+	}
+	if err := repo.Watch(context.Background(), func() {}); err == nil {
+		t.Error("Watch() error = nil, want an error for a repository without users files")
+	}
+}
+
+// TestReloadValidation tests that reloads are checked like the startup load
+func TestReloadValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write users file: %v", err)
+		}
+	}
+	write("alice:\n  Pass: alice\n  Account: DEVELOPMENT\n")
+
+	repo, err := NewFromFile(path)
+	if err != nil {
+		t.Fatalf("NewFromFile() error = %v", err)
+	}
+	repo.ValidateReloads(1, []string{"readonly"})
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "too many accounts",
+			content: "alice:\n  Pass: alice\n  Account: DEVELOPMENT\nbob:\n  Pass: bob\n  Account: TEST\n",
+			wantErr: "users reference 2 distinct accounts, more than the maximum of 1",
+		},
+		{
+			name:    "unknown template",
+			content: "bob:\n  Pass: bob\n  Account: DEVELOPMENT\n  Template: admin\n",
+			wantErr: `user "bob" references unknown permission template "admin"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write(tt.content)
+			if err := repo.reload(); err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("reload() error = %v, want %q", err, tt.wantErr)
+			}
+			if _, ok := repo.Get("alice"); !ok {
+				t.Error("alice was dropped by a reload that failed validation")
+			}
+			if _, ok := repo.Get("bob"); ok {
+				t.Error("bob was loaded by a reload that failed validation")
+			}
+		})
+	}
+
+	t.Run("valid users", func(t *testing.T) {
+		write("bob:\n  Pass: bob\n  Account: DEVELOPMENT\n  Template: ReadOnly\n")
+		if err := repo.reload(); err != nil {
+			t.Fatalf("reload() error = %v", err)
+		}
+		if _, ok := repo.Get("bob"); !ok {
+			t.Error("bob was not loaded")
+		}
+	})
+}
@@ -0,0 +1,146 @@
+// Package usershttp provides a user repository backed by an external HTTP
+// service. Every lookup POSTs {"username": "..."} to the configured endpoint,
+// which answers 200 with the user as JSON or 404 for unknown users:
+//
+//	{"pass_hash": "$2a$10$...", "account": "DEVELOPMENT", "permissions": {"pub": {"allow": ["orders.>"]}}}
+//
+// The password may be plaintext or a bcrypt hash, and the permissions use the
+// jwt.Permissions shape and may be omitted. Server errors are retried with
+// exponential backoff; requests carry an optional bearer token.
+package usershttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// errNotFound reports a user the service does not know.
+var errNotFound = errors.New("user not found")
+
+// Config configures the users service client.
+type Config struct {
+	URL     string        // Endpoint receiving the lookups
+	Token   string        // Bearer token sent with every lookup, none when empty
+	Timeout time.Duration // Timeout of a single attempt
+	Retries int           // Retries after a 5xx response or transport error
+	Backoff time.Duration // Wait before the first retry, doubled after each
+}
+
+// Repository looks users up in an HTTP users service.
+type Repository struct {
+	cfg   Config
+	http  *http.Client
+	sleep func(time.Duration)
+}
+
+// New creates a Repository for the users service described by cfg.
+func New(cfg Config) *Repository {
+	return &Repository{
+		cfg:   cfg,
+		http:  &http.Client{Timeout: cfg.Timeout},
+		sleep: time.Sleep,
+	}
+}
+
+// lookupRequest is the body of a user lookup.
+type lookupRequest struct {
+	Username string `json:"username"`
+}
+
+// lookupResponse is the user returned by the service.
+type lookupResponse struct {
+	PassHash    string           `json:"pass_hash"`
+	Account     string           `json:"account"`
+	Permissions *jwt.Permissions `json:"permissions"`
+}
+
+// Get looks up a user by username. Unknown users and failed lookups both report
+// the user as missing; failures are logged.
+func (r *Repository) Get(username string) (*auth.User, bool) {
+	resp, err := r.lookup(username)
+	if errors.Is(err, errNotFound) {
+		return nil, false
+	}
+	if err != nil {
+		logrus.WithField("username", username).WithError(err).Error("Failed to look up user in the users service")
+		return nil, false
+	}
+	user := &auth.User{Pass: resp.PassHash, Account: resp.Account}
+	if resp.Permissions != nil {
+		user.Permissions = *resp.Permissions
+	}
+	return user, true
+}
+
+// Insecure reports false: service users are never the embedded demo users.
+func (r *Repository) Insecure() bool {
+	return false
+}
+
+// lookup asks the service for the user, retrying transport errors and 5xx
+// responses up to the configured retries.
+func (r *Repository) lookup(username string) (*lookupResponse, error) {
+	body, err := json.Marshal(lookupRequest{Username: username})
+	if err != nil {
+		return nil, err
+	}
+	backoff := r.cfg.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, retry, err := r.post(body)
+		if !retry || attempt >= r.cfg.Retries {
+			return resp, err
+		}
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"attempt": attempt + 1,
+			"retries": r.cfg.Retries,
+			"backoff": backoff.String(),
+		}).Warn("Users service lookup failed, retrying")
+		r.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends one lookup and reports whether a failure is worth retrying.
+func (r *Repository) post(body []byte) (*lookupResponse, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, r.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.cfg.Token)
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("users service request: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close users service response body")
+		}
+	}()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, errNotFound
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, true, fmt.Errorf("users service responded %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("users service responded %s", resp.Status)
+	}
+
+	var user lookupResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&user); err != nil {
+		return nil, false, fmt.Errorf("decoding users service response: %w", err)
+	}
+	return &user, false, nil
+}
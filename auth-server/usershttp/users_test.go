@@ -0,0 +1,144 @@
+package usershttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUsersService serves alice and bob, answers 404 for other users and fails
+// with 503 for the first failures requests of "flaky".
+func newUsersService(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer service-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req lookupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.Username {
+		case "alice":
+			_, _ = w.Write([]byte(`{"pass_hash": "$2a$10$hash", "account": "DEVELOPMENT", "permissions": {"pub": {"allow": ["orders.>"]}, "sub": {"allow": ["_INBOX.>"]}}}`))
+		case "bob":
+			_, _ = w.Write([]byte(`{"pass_hash": "bob", "account": "TEST"}`))
+		case "garbled":
+			_, _ = w.Write([]byte(`{"pass_hash": `))
+		case "flaky":
+			if calls.Load() <= failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte(`{"pass_hash": "flaky", "account": "TEST"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+// newTestRepository creates a Repository for url recording its backoff waits.
+func newTestRepository(url, token string, retries int) (*Repository, *[]time.Duration) {
+	repo := New(Config{URL: url, Token: token, Timeout: time.Second, Retries: retries, Backoff: 100 * time.Millisecond})
+	var sleeps []time.Duration
+	repo.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return repo, &sleeps
+}
+
+func TestRepository_Get(t *testing.T) {
+	srv, _ := newUsersService(t, 0)
+	repo, _ := newTestRepository(srv.URL, "service-token", 0)
+
+	t.Run("user with permissions", func(t *testing.T) {
+		user, ok := repo.Get("alice")
+		require.True(t, ok)
+		assert.Equal(t, "$2a$10$hash", user.Pass)
+		assert.Equal(t, "DEVELOPMENT", user.Account)
+		assert.Equal(t, jwt.Permissions{
+			Pub: jwt.Permission{Allow: jwt.StringList{"orders.>"}},
+			Sub: jwt.Permission{Allow: jwt.StringList{"_INBOX.>"}},
+		}, user.Permissions)
+	})
+
+	t.Run("user without permissions", func(t *testing.T) {
+		user, ok := repo.Get("bob")
+		require.True(t, ok)
+		assert.Equal(t, "TEST", user.Account)
+		assert.Equal(t, jwt.Permissions{}, user.Permissions)
+	})
+
+	tests := []struct {
+		name     string
+		token    string
+		username string
+	}{
+		{"unknown user", "service-token", "mallory"},
+		{"invalid response", "service-token", "garbled"},
+		{"rejected bearer token", "wrong-token", "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, sleeps := newTestRepository(srv.URL, tt.token, 2)
+			user, ok := repo.Get(tt.username)
+			assert.False(t, ok)
+			assert.Nil(t, user)
+			assert.Empty(t, *sleeps, "client errors must not be retried")
+		})
+	}
+}
+
+func TestRepository_Retries(t *testing.T) {
+	t.Run("server errors are retried with backoff", func(t *testing.T) {
+		srv, calls := newUsersService(t, 2)
+		repo, sleeps := newTestRepository(srv.URL, "service-token", 3)
+
+		user, ok := repo.Get("flaky")
+		require.True(t, ok)
+		assert.Equal(t, "TEST", user.Account)
+		assert.Equal(t, int32(3), calls.Load())
+		assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, *sleeps)
+	})
+
+	t.Run("retries are bounded", func(t *testing.T) {
+		srv, calls := newUsersService(t, 10)
+		repo, sleeps := newTestRepository(srv.URL, "service-token", 2)
+
+		_, ok := repo.Get("flaky")
+		assert.False(t, ok)
+		assert.Equal(t, int32(3), calls.Load())
+		assert.Len(t, *sleeps, 2)
+	})
+
+	t.Run("unknown users are not retried", func(t *testing.T) {
+		srv, calls := newUsersService(t, 0)
+		repo, sleeps := newTestRepository(srv.URL, "service-token", 3)
+
+		_, ok := repo.Get("mallory")
+		assert.False(t, ok)
+		assert.Equal(t, int32(1), calls.Load())
+		assert.Empty(t, *sleeps)
+	})
+
+	t.Run("unreachable service", func(t *testing.T) {
+		srv, _ := newUsersService(t, 0)
+		srv.Close()
+		repo, sleeps := newTestRepository(srv.URL, "service-token", 1)
+
+		_, ok := repo.Get("alice")
+		assert.False(t, ok)
+		assert.Len(t, *sleeps, 1)
+	})
+}
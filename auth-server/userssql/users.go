@@ -0,0 +1,59 @@
+// Package userssql provides a user repository backed by a SQL database. Users
+// are looked up with a configurable query taking the username as its only
+// argument and returning the password (plaintext or bcrypt hash), the account
+// and the permissions as JSON, in that order. The permissions use the
+// jwt.Permissions shape, e.g. {"pub": {"allow": ["orders.>"]}}, and may be NULL.
+package userssql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultQuery looks users up in a nats_users table using PostgreSQL placeholders.
+const DefaultQuery = "SELECT pass_hash, account, permissions FROM nats_users WHERE username = $1"
+
+// Repository looks users up in a SQL database.
+type Repository struct {
+	db    *sql.DB
+	query string
+}
+
+// New creates a Repository running query against db. The caller owns db and
+// closes it after the repository is no longer used.
+func New(db *sql.DB, query string) *Repository {
+	return &Repository{db: db, query: query}
+}
+
+// Get looks up a user by username. Unknown users and failed lookups both report
+// the user as missing; failures are logged.
+func (r *Repository) Get(username string) (*auth.User, bool) {
+	var pass, account string
+	var perms []byte
+	err := r.db.QueryRow(r.query, username).Scan(&pass, &account, &perms)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false
+	}
+	if err != nil {
+		logrus.WithField("username", username).WithError(err).Error("Failed to look up user in the database")
+		return nil, false
+	}
+
+	user := &auth.User{Pass: pass, Account: account}
+	if len(perms) > 0 {
+		if err := json.Unmarshal(perms, &user.Permissions); err != nil {
+			logrus.WithField("username", username).WithError(err).Error("Invalid permissions JSON in the database")
+			return nil, false
+		}
+	}
+	return user, true
+}
+
+// Insecure reports false: database users are never the embedded demo users.
+func (r *Repository) Insecure() bool {
+	return false
+}
@@ -0,0 +1,116 @@
+package userssql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDriver serves the rows of a users table keyed by username, ignoring the
+// query text. A missing username yields no rows; "broken" fails the query.
+type fakeDriver struct {
+	users map[string][]driver.Value
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{users: d.users}, nil }
+
+type fakeConn struct {
+	users map[string][]driver.Value
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return &fakeStmt{users: c.users}, nil }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+type fakeStmt struct {
+	users map[string][]driver.Value
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return 1 }
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	username, _ := args[0].(string)
+	if username == "broken" {
+		return nil, errors.New("connection reset")
+	}
+	rows := &fakeRows{}
+	if row, ok := s.users[username]; ok {
+		rows.rows = [][]driver.Value{row}
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return []string{"pass_hash", "account", "permissions"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("userssql-fake", &fakeDriver{users: map[string][]driver.Value{
+		"alice":   {"$2a$10$hash", "DEVELOPMENT", []byte(`{"pub": {"allow": ["orders.>"]}, "sub": {"allow": ["_INBOX.>"], "deny": ["_INBOX.admin"]}, "resp": {"max": 1, "ttl": 0}}`)},
+		"nobody":  {"nobody", "TEST", nil},
+		"garbled": {"garbled", "TEST", []byte(`{"pub": `)},
+	}})
+}
+
+func TestRepository_Get(t *testing.T) {
+	db, err := sql.Open("userssql-fake", "")
+	require.NoError(t, err)
+	defer db.Close()
+	repo := New(db, DefaultQuery)
+
+	t.Run("user with permissions", func(t *testing.T) {
+		user, ok := repo.Get("alice")
+		require.True(t, ok)
+		assert.Equal(t, "$2a$10$hash", user.Pass)
+		assert.Equal(t, "DEVELOPMENT", user.Account)
+		assert.Equal(t, jwt.Permissions{
+			Pub:  jwt.Permission{Allow: jwt.StringList{"orders.>"}},
+			Sub:  jwt.Permission{Allow: jwt.StringList{"_INBOX.>"}, Deny: jwt.StringList{"_INBOX.admin"}},
+			Resp: &jwt.ResponsePermission{MaxMsgs: 1},
+		}, user.Permissions)
+	})
+
+	t.Run("NULL permissions", func(t *testing.T) {
+		user, ok := repo.Get("nobody")
+		require.True(t, ok)
+		assert.Equal(t, "TEST", user.Account)
+		assert.Equal(t, jwt.Permissions{}, user.Permissions)
+	})
+
+	tests := []struct {
+		name     string
+		username string
+	}{
+		{"unknown user", "mallory"},
+		{"invalid permissions JSON", "garbled"},
+		{"query failure", "broken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, ok := repo.Get(tt.username)
+			assert.False(t, ok)
+			assert.Nil(t, user)
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/authkeys"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/config"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/usersdebug"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/usershttp"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/vault"
+
+	"github.com/sirupsen/logrus"
+)
+
+// User backends reported in validationReport.Backend.
+const (
+	backendDatabase = "database" // auth.users_dsn
+	backendService  = "service"  // auth.users_http
+	backendFiles    = "files"    // auth.users_file and environment users files
+	backendEmbedded = "embedded" // Insecure embedded demo users
+)
+
+// validationReport is the result of -validate. Its JSON form is a stable schema
+// for CI: fields are only ever added, and warnings and errors are always arrays.
+type validationReport struct {
+	Valid       bool     `json:"valid"`
+	Environment string   `json:"environment"` // Configured environment, empty when the config could not be loaded
+	Backend     string   `json:"backend"`     // User backend, empty when it could not be loaded
+	Users       int      `json:"users"`       // Loaded users; 0 for the database backend
+	Accounts    int      `json:"accounts"`    // Distinct accounts of the loaded users
+	XKey        bool     `json:"xkey"`        // Whether authorization responses can be encrypted
+	Warnings    []string `json:"warnings"`
+	Errors      []string `json:"errors"`
+}
+
+// validate loads the configuration, keys and users the server would start
+// with and reports every problem found, without connecting to NATS.
+func validate(configPaths []string) validationReport {
+	report := validationReport{Warnings: []string{}, Errors: []string{}}
+	fail := func(format string, args ...any) validationReport {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+		return report
+	}
+
+	cfg, err := config.Load(configPaths...)
+	if err != nil {
+		return fail("load config: %v", err)
+	}
+	report.Environment = cfg.Environment
+	if cfg.Vault.Enabled {
+		if err := applyVaultSecrets(cfg, vault.NewClient(cfg.Vault.Address, cfg.Vault.Token)); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+	if cfg.Nats.URL == "" || cfg.Auth.IssuerSeed == "" {
+		report.Errors = append(report.Errors, "missing required configuration")
+	}
+
+	keyPairs, err := authkeys.Parse(cfg.Auth.IssuerSeed, cfg.Auth.XKeySeed, cfg.Auth.IssuerAccount, cfg.Auth.AccountIssuers)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("parse auth keys: %v", err))
+	} else {
+		report.XKey = keyPairs.HasXKey
+	}
+	if !cfg.Auth.DisableTokenAuth && len(tokenSecretsOf(cfg)) == 0 && os.Getenv("NATS_TOKEN_SECRET") == "" {
+		report.Warnings = append(report.Warnings, "no nats_token secret configured: token logins will fail")
+	}
+
+	var db *sql.DB
+	if cfg.Auth.Backend == config.BackendSQL {
+		if db, err = openUsersDB(cfg); err != nil {
+			return fail("%v", err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				logrus.WithError(err).Debug("Failed to close users database")
+			}
+		}()
+	}
+	userRepo, err := newUserRepository(cfg, db)
+	if err != nil {
+		return fail("%v", err)
+	}
+	switch repo := userRepo.(type) {
+	case *usersdebug.Repository:
+		report.Backend = backendFiles
+		if repo.Insecure() {
+			report.Backend = backendEmbedded
+			report.Warnings = append(report.Warnings, "auth.users_file is not configured: using the insecure embedded users")
+		}
+		report.Users, report.Accounts = repo.Count()
+	case *usershttp.Repository:
+		report.Backend = backendService
+	default:
+		report.Backend = backendDatabase
+	}
+
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// writeReport prints report as indented JSON, or as text for humans.
+func writeReport(w io.Writer, report validationReport, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	status := "valid"
+	if !report.Valid {
+		status = "INVALID"
+	}
+	if _, err := fmt.Fprintf(w, "Configuration is %s\n", status); err != nil {
+		return err
+	}
+	if report.Environment != "" {
+		if _, err := fmt.Fprintf(w, "Environment: %s\n", report.Environment); err != nil {
+			return err
+		}
+	}
+	if report.Backend != "" {
+		if _, err := fmt.Fprintf(w, "Users: %d in %d accounts (%s backend)\nXKey encryption: %t\n", report.Users, report.Accounts, report.Backend, report.XKey); err != nil {
+			return err
+		}
+	}
+	for _, warning := range report.Warnings {
+		if _, err := fmt.Fprintf(w, "WARNING: %s\n", warning); err != nil {
+			return err
+		}
+	}
+	for _, e := range report.Errors {
+		if _, err := fmt.Fprintf(w, "ERROR: %s\n", e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
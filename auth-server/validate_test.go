@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	t.Setenv("NATS_TOKEN_SECRET", "")
+	dir := t.TempDir()
+	issuer, err := nkeys.CreateAccount()
+	require.NoError(t, err)
+	issuerSeed, err := issuer.Seed()
+	require.NoError(t, err)
+	curve, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+	xkeySeed, err := curve.Seed()
+	require.NoError(t, err)
+	usersFile := filepath.Join(dir, "users.yaml")
+	require.NoError(t, os.WriteFile(usersFile, []byte("alice:\n  Pass: alice\n  Account: DEVELOPMENT\nbob:\n  Pass: bob\n  Account: DEVELOPMENT\nsys:\n  Pass: sys\n  Account: SYS\n"), 0o600))
+
+	writeConfig := func(t *testing.T, name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+	valid := writeConfig(t, "valid.yml", `
+environment: development
+nats:
+  url: nats://localhost:4222
+auth:
+  issuer_seed: "`+string(issuerSeed)+`"
+  xkey_seed: "`+string(xkeySeed)+`"
+  users_file: "`+usersFile+`"
+`)
+	invalid := writeConfig(t, "invalid.yml", `
+environment: development
+nats:
+  url: nats://localhost:4222
+auth:
+  issuer_seed: "SAAGNOTASEED"
+  xkey_seed: "`+string(xkeySeed)+`"
+  users_file: "`+usersFile+`"
+`)
+
+	tests := []struct {
+		name string
+		path string
+		want map[string]any
+	}{
+		{
+			name: "valid config",
+			path: valid,
+			want: map[string]any{
+				"valid":       true,
+				"environment": "development",
+				"backend":     "files",
+				"users":       float64(3),
+				"accounts":    float64(2),
+				"xkey":        true,
+				"warnings":    []any{"no nats_token secret configured: token logins will fail"},
+				"errors":      []any{},
+			},
+		},
+		{
+			name: "invalid config",
+			path: invalid,
+			want: map[string]any{
+				"valid":       false,
+				"environment": "development",
+				"backend":     "files",
+				"users":       float64(3),
+				"accounts":    float64(2),
+				"xkey":        false,
+				"warnings":    []any{"no nats_token secret configured: token logins will fail"},
+				"errors":      []any{`parse auth keys: parsing issuer seed "SAA...": nkeys: invalid checksum`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			require.NoError(t, writeReport(&out, validate([]string{tt.path}), true))
+
+			var got map[string]any
+			require.NoError(t, json.Unmarshal(out.Bytes(), &got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("text report", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, writeReport(&out, validate([]string{invalid}), false))
+		assert.Contains(t, out.String(), "Configuration is INVALID\nEnvironment: development\n")
+		assert.Contains(t, out.String(), "ERROR: parse auth keys:")
+	})
+}
@@ -0,0 +1,132 @@
+// Package vault reads the auth server's secrets from HashiCorp Vault over its
+// HTTP API. Secrets are referenced as "path#key", e.g.
+// "secret/data/nats#issuer_seed"; both KV version 1 and version 2 mounts are
+// supported.
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reader reads the key/value data stored at a Vault path.
+type Reader interface {
+	Read(path string) (map[string]any, error)
+}
+
+// Client is a minimal Vault HTTP client authenticating with a token.
+type Client struct {
+	address string
+	token   string
+	http    *http.Client
+}
+
+// NewClient creates a Client for the Vault server at address.
+func NewClient(address, token string) *Client {
+	return &Client{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Read returns the data stored at path. For KV version 2 mounts the secret's
+// data is unwrapped from the versioned response.
+func (c *Client) Read(path string) (map[string]any, error) {
+	req, err := http.NewRequest(http.MethodGet, c.address+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close Vault response body")
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading %s: vault responded %s", path, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	// KV version 2 nests the secret under data.data next to its metadata
+	if nested, ok := body.Data["data"].(map[string]any); ok {
+		if _, versioned := body.Data["metadata"]; versioned {
+			return nested, nil
+		}
+	}
+	return body.Data, nil
+}
+
+// Refs references the secrets to fetch as "path#key". Empty references are skipped.
+type Refs struct {
+	IssuerSeed  string
+	XKeySeed    string
+	TokenSecret string
+	NatsPass    string
+}
+
+// Secrets holds the fetched secret values. Values whose reference was empty stay empty.
+type Secrets struct {
+	IssuerSeed  string
+	XKeySeed    string
+	TokenSecret string
+	NatsPass    string
+}
+
+// Fetch reads every referenced secret, reading each Vault path only once.
+func Fetch(r Reader, refs Refs) (Secrets, error) {
+	cache := make(map[string]map[string]any)
+	get := func(ref string) (string, error) {
+		if ref == "" {
+			return "", nil
+		}
+		path, key, ok := strings.Cut(ref, "#")
+		if !ok || path == "" || key == "" {
+			return "", fmt.Errorf("secret reference %q must be path#key", ref)
+		}
+		data, cached := cache[path]
+		if !cached {
+			var err error
+			if data, err = r.Read(path); err != nil {
+				return "", err
+			}
+			cache[path] = data
+		}
+		value, ok := data[key].(string)
+		if !ok || value == "" {
+			return "", fmt.Errorf("secret %q not found", ref)
+		}
+		return value, nil
+	}
+
+	var s Secrets
+	var err error
+	if s.IssuerSeed, err = get(refs.IssuerSeed); err != nil {
+		return Secrets{}, err
+	}
+	if s.XKeySeed, err = get(refs.XKeySeed); err != nil {
+		return Secrets{}, err
+	}
+	if s.TokenSecret, err = get(refs.TokenSecret); err != nil {
+		return Secrets{}, err
+	}
+	if s.NatsPass, err = get(refs.NatsPass); err != nil {
+		return Secrets{}, err
+	}
+	return s, nil
+}
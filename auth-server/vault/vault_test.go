@@ -0,0 +1,119 @@
+package vault
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeReader serves secrets from memory and counts reads per path.
+type fakeReader struct {
+	data  map[string]map[string]any
+	reads map[string]int
+}
+
+func (f *fakeReader) Read(path string) (map[string]any, error) {
+	if f.reads == nil {
+		f.reads = make(map[string]int)
+	}
+	f.reads[path]++
+	data, ok := f.data[path]
+	if !ok {
+		return nil, errors.New("vault responded 404 Not Found")
+	}
+	return data, nil
+}
+
+func TestFetch(t *testing.T) {
+	reader := &fakeReader{data: map[string]map[string]any{
+		"secret/data/nats": {"issuer_seed": "SAISSUER", "xkey_seed": "SXKEY", "token_secret": "token-secret"},
+		"secret/data/svc":  {"pass": "service-pass"},
+	}}
+
+	t.Run("fetches every reference", func(t *testing.T) {
+		got, err := Fetch(reader, Refs{
+			IssuerSeed:  "secret/data/nats#issuer_seed",
+			XKeySeed:    "secret/data/nats#xkey_seed",
+			TokenSecret: "secret/data/nats#token_secret",
+			NatsPass:    "secret/data/svc#pass",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, Secrets{
+			IssuerSeed:  "SAISSUER",
+			XKeySeed:    "SXKEY",
+			TokenSecret: "token-secret",
+			NatsPass:    "service-pass",
+		}, got)
+		assert.Equal(t, 1, reader.reads["secret/data/nats"])
+	})
+
+	t.Run("skips empty references", func(t *testing.T) {
+		got, err := Fetch(reader, Refs{NatsPass: "secret/data/svc#pass"})
+		require.NoError(t, err)
+		assert.Equal(t, Secrets{NatsPass: "service-pass"}, got)
+	})
+
+	tests := []struct {
+		name    string
+		refs    Refs
+		wantErr string
+	}{
+		{name: "malformed reference", refs: Refs{IssuerSeed: "secret/data/nats"}, wantErr: "must be path#key"},
+		{name: "missing key", refs: Refs{XKeySeed: "secret/data/nats#missing"}, wantErr: "not found"},
+		{name: "missing path", refs: Refs{TokenSecret: "secret/data/other#key"}, wantErr: "404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Fetch(reader, tt.refs)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestClientRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/nats":
+			_, _ = w.Write([]byte(`{"data":{"data":{"issuer_seed":"SAV2"},"metadata":{"version":3}}}`))
+		case "/v1/kv/nats":
+			_, _ = w.Write([]byte(`{"data":{"issuer_seed":"SAV1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		token   string
+		path    string
+		want    map[string]any
+		wantErr string
+	}{
+		{name: "kv version 2", token: "vault-token", path: "secret/data/nats", want: map[string]any{"issuer_seed": "SAV2"}},
+		{name: "kv version 1", token: "vault-token", path: "kv/nats", want: map[string]any{"issuer_seed": "SAV1"}},
+		{name: "missing path", token: "vault-token", path: "kv/missing", wantErr: "404"},
+		{name: "bad token", token: "guess", path: "kv/nats", wantErr: "403"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewClient(server.URL+"/", tt.token).Read(tt.path)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
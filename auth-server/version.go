@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Build information injected at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%FT%TZ)" ./auth-server
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// devBuild stands in for build information that was not injected.
+const devBuild = "dev"
+
+// defaultServiceVersion is the micro service version of development builds, as
+// micro requires a SemVer version.
+const defaultServiceVersion = "0.0.1"
+
+// buildInfo describes the running binary.
+type buildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+}
+
+// currentBuild returns the injected build information, with devBuild for
+// every value that was not set.
+func currentBuild() buildInfo {
+	orDev := func(s string) string {
+		if s == "" {
+			return devBuild
+		}
+		return s
+	}
+	return buildInfo{Version: orDev(version), Commit: orDev(commit), BuildDate: orDev(buildDate)}
+}
+
+// String formats the build information for the -version flag.
+func (b buildInfo) String() string {
+	return fmt.Sprintf("auth-server %s (commit %s, built %s)", b.Version, b.Commit, b.BuildDate)
+}
+
+// serviceVersion returns the version registered with the micro service. A
+// leading "v" is dropped, as micro only accepts plain SemVer versions.
+func (b buildInfo) serviceVersion() string {
+	if b.Version == devBuild {
+		return defaultServiceVersion
+	}
+	return strings.TrimPrefix(b.Version, "v")
+}
+
+// metadata returns the build information as micro service metadata.
+func (b buildInfo) metadata() map[string]string {
+	return map[string]string{
+		"version":    b.Version,
+		"commit":     b.Commit,
+		"build_date": b.BuildDate,
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrentBuild(t *testing.T) {
+	t.Run("development build", func(t *testing.T) {
+		build := currentBuild()
+		assert.Equal(t, buildInfo{Version: "dev", Commit: "dev", BuildDate: "dev"}, build)
+		assert.Equal(t, "0.0.1", build.serviceVersion())
+		assert.Equal(t, "auth-server dev (commit dev, built dev)", build.String())
+	})
+
+	t.Run("injected build", func(t *testing.T) {
+		version, commit, buildDate = "v1.4.0", "abc1234", "2025-06-01T12:00:00Z"
+		defer func() { version, commit, buildDate = "", "", "" }()
+
+		build := currentBuild()
+		assert.Equal(t, "1.4.0", build.serviceVersion())
+		assert.Equal(t, map[string]string{
+			"version":    "v1.4.0",
+			"commit":     "abc1234",
+			"build_date": "2025-06-01T12:00:00Z",
+		}, build.metadata())
+	})
+}
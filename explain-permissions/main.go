@@ -0,0 +1,73 @@
+// Command explain-permissions prints the permissions a user from a users file
+// is granted, or with -diff compares the grants of two users as a structured
+// diff of added and removed allow/deny subjects and response limits. With
+// -against the second user is looked up in another users file, so the same
+// user can be compared before and after a change to the file.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/permissions"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/usersdebug"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	usersFile := flag.String("users", "users.yaml", "Users file to look users up in")
+	against := flag.String("against", "", "With -diff, users file to look up the second user in (default: -users)")
+	diff := flag.Bool("diff", false, "Compare the permissions of two users: -diff userA userB")
+	flag.Parse()
+
+	repo, err := usersdebug.NewFromFile(*usersFile)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", *usersFile, err)
+	}
+
+	if !*diff {
+		if flag.NArg() != 1 {
+			return fmt.Errorf("usage: explain-permissions [-users file] user")
+		}
+		user, exists := repo.Get(flag.Arg(0))
+		if !exists {
+			return fmt.Errorf("user %q not found in %s", flag.Arg(0), *usersFile)
+		}
+		return printJSON(user.Permissions)
+	}
+
+	if flag.NArg() != 2 {
+		return fmt.Errorf("usage: explain-permissions [-users file] [-against file] -diff userA userB")
+	}
+	otherFile, other := *usersFile, repo
+	if *against != "" {
+		otherFile = *against
+		if other, err = usersdebug.NewFromFile(otherFile); err != nil {
+			return fmt.Errorf("load %s: %w", otherFile, err)
+		}
+	}
+	from, exists := repo.Get(flag.Arg(0))
+	if !exists {
+		return fmt.Errorf("user %q not found in %s", flag.Arg(0), *usersFile)
+	}
+	to, exists := other.Get(flag.Arg(1))
+	if !exists {
+		return fmt.Errorf("user %q not found in %s", flag.Arg(1), otherFile)
+	}
+	return printJSON(permissions.Compare(from.Permissions, to.Permissions))
+}
+
+// printJSON writes v as indented JSON, leaving subject wildcards unescaped.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
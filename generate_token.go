@@ -3,11 +3,18 @@
 // the NATS server URL via the -server flag, and a -test flag to control whether to test
 // the connection. It validates the input, generates a signed JWT token using HMAC-SHA256,
 // and, if -test is true, uses the token to connect to the NATS server and list all streams.
+// The -consumers, -kv and -objects flags extend the test to consumers per stream and
+// key-value/object store buckets. With -resign the program instead re-signs a batch of
+// tokens from OLD_NATS_TOKEN_SECRET to NATS_TOKEN_SECRET for secret rotation.
+// The token is written to stdout or the -output file in the -format raw (the token
+// alone, for piping), json ({"token": ..., "expires_at": ...}) or creds (a NATS
+// credentials file).
 // The program is designed for NATS-based applications requiring secure authentication
 // and authorization.
 //
-// The JSON input must include a non-empty user_id. Permissions, account, and TTL are
-// optional. If permissions are absent or incomplete, publish and subscribe permissions
+// The JSON input must include a non-empty user_id. Permissions, account, TTL,
+// audience, and not_before are optional. The audience restricts the token to the
+// named service; not_before schedules the token to become valid at a later time. If permissions are absent or incomplete, publish and subscribe permissions
 // default to denying all (empty allow and deny lists). If TTL is not specified, the token
 // expires after 2 minutes. The token is signed using the NATS_TOKEN_SECRET environment
 // variable. For NATS request-reply patterns, the permissions.sub.allow field must include
@@ -15,32 +22,46 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/auth"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
 )
 
 // TestNatsTokenClaims represents the custom claims structure for NATS JWT tokens.
 // It includes user ID, permissions, account details, TTL, and standard JWT
 // registered claims.
 type TestNatsTokenClaims struct {
-	UserID               string         `json:"user_id"`     // Unique identifier for the user (required)
-	Permissions          map[string]any `json:"permissions"` // User permissions for NATS subjects (optional)
-	Account              string         `json:"account"`     // Associated NATS account (optional)
-	TTL                  int            `json:"ttl"`         // Token time-to-live in seconds (optional)
+	UserID               string         `json:"user_id"`              // Unique identifier for the user (required)
+	Permissions          map[string]any `json:"permissions"`          // User permissions for NATS subjects (optional)
+	Account              string         `json:"account"`              // Associated NATS account (optional)
+	TTL                  int            `json:"ttl"`                  // Token time-to-live in seconds (optional)
+	TargetAudience       string         `json:"audience"`             // Service the token is minted for (optional)
+	ValidFrom            *time.Time     `json:"not_before,omitempty"` // Time the token becomes valid, RFC 3339 (optional)
+	Src                  []string       `json:"src,omitempty"`        // Networks the client may connect from, as CIDRs (optional)
+	Limits               *auth.Limits   `json:"limits,omitempty"`     // Connection limits (optional)
 	jwt.RegisteredClaims                // Standard JWT claims (e.g., exp, iat)
 }
 
 // GenerateNatsToken generates a NATS JWT token from a JSON input string.
 //
-// The input JSON must include a non-empty user_id. Permissions, account, and TTL
-// are optional. If permissions are absent or incomplete, pub and sub permissions
+// The input JSON must include a non-empty user_id. Permissions, account, TTL,
+// audience, and not_before are optional. A non-empty audience is set as the
+// token's "aud" claim so only the service with that identifier accepts it. A
+// not_before time (RFC 3339) is set as the "nbf" claim, and the TTL then counts
+// from that time rather than from now. If permissions are absent or incomplete, pub and sub permissions
 // default to denying all (empty allow and deny lists). If TTL is not provided,
 // the token expires after 2 minutes. The token is signed using the
 // NATS_TOKEN_SECRET environment variable with HMAC-SHA256.
@@ -51,7 +72,7 @@ type TestNatsTokenClaims struct {
 //
 // Args:
 //
-//	inputJSON (string): JSON string containing user_id, permissions, account, and ttl.
+//	inputJSON (string): JSON string containing user_id, permissions, account, ttl, audience, and not_before.
 //
 // Returns:
 //
@@ -96,13 +117,9 @@ func GenerateNatsToken(inputJSON string) (string, error) {
 				"deny":  []string{},
 			}
 		}
-		// Handle resp permissions, renaming max to maxMsgs
-		if resp, ok := claims.Permissions["resp"].(map[string]any); ok {
-			if maxMsgs, ok := resp["max"].(float64); ok {
-				resp["maxMsgs"] = maxMsgs
-				delete(resp, "max")
-				claims.Permissions["resp"] = resp
-			}
+		// Reject permissions the server would refuse, such as an invalid resp ttl
+		if _, err := tokenvalidation.ToJWTPermissions(claims.Permissions); err != nil {
+			return "", err
 		}
 	}
 
@@ -111,13 +128,112 @@ func GenerateNatsToken(inputJSON string) (string, error) {
 		claims.TTL = 120 // 2 minutes in seconds
 	}
 
-	// Set registered claims
+	// Set registered claims; a scheduled token's TTL starts at its not_before time
 	now := time.Now()
+	validFrom := now
+	if claims.ValidFrom != nil && claims.ValidFrom.After(now) {
+		validFrom = *claims.ValidFrom
+	}
 	claims.RegisteredClaims = jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(claims.TTL) * time.Second)),
+		ExpiresAt: jwt.NewNumericDate(validFrom.Add(time.Duration(claims.TTL) * time.Second)),
 		IssuedAt:  jwt.NewNumericDate(now),
 	}
+	if claims.ValidFrom != nil {
+		claims.NotBefore = jwt.NewNumericDate(*claims.ValidFrom)
+	}
+	if claims.TargetAudience != "" {
+		claims.Audience = jwt.ClaimStrings{claims.TargetAudience}
+	}
+
+	return signNatsToken(claims)
+}
+
+// ResignNatsToken re-issues a token signed with oldSecret under the current
+// NATS_TOKEN_SECRET, e.g. when rotating the secret.
+//
+// The token is validated against oldSecret first, so expired or tampered tokens
+// are not re-issued. All claims, including the src networks and limits that
+// restrict the token, are preserved except iat and exp: iat is set to
+// now and exp keeps the token's original lifetime (exp - iat) from now. A token
+// without iat gets the default 2 minute TTL.
+//
+// Args:
+//
+//	tokenString (string): The token signed with the old secret.
+//	oldSecret (string): The secret the token is currently signed with.
+//
+// Returns:
+//
+//	string: The re-signed JWT token string.
+//	error: An error if the token is invalid for oldSecret or signing fails.
+func ResignNatsToken(tokenString, oldSecret string) (string, error) {
+	old, _, err := tokenvalidation.ValidateWithSecrets(tokenString, []tokenvalidation.Secret{{Label: "old", Value: oldSecret}})
+	if err != nil {
+		return "", fmt.Errorf("failed to validate token: %w", err)
+	}
 
+	lifetime := 120 * time.Second
+	if old.IssuedAt != nil && old.ExpiresAt != nil {
+		lifetime = old.ExpiresAt.Sub(old.IssuedAt.Time)
+	}
+	now := time.Now()
+	claims := TestNatsTokenClaims{
+		UserID:           old.UserID,
+		Permissions:      old.Permissions,
+		Account:          old.Account,
+		TTL:              int(lifetime / time.Second),
+		Src:              old.Src,
+		Limits:           old.Limits,
+		RegisteredClaims: old.RegisteredClaims,
+	}
+	if len(old.Audience) > 0 {
+		claims.TargetAudience = old.Audience[0]
+	}
+	if old.NotBefore != nil {
+		claims.ValidFrom = &old.NotBefore.Time
+	}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(lifetime))
+
+	return signNatsToken(claims)
+}
+
+// ResignNatsTokens re-signs the tokens read from in, one per line, with
+// ResignNatsToken and writes the results to out in the same order. Blank lines
+// are skipped. A token that fails is reported to errOut with its line number and
+// written as an empty line, so the output stays aligned with the input.
+//
+// Returns:
+//
+//	int: The number of tokens that could not be re-signed.
+//	error: An error if reading the input or writing the output fails.
+func ResignNatsTokens(in io.Reader, out, errOut io.Writer, oldSecret string) (int, error) {
+	failed := 0
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		tokenString := strings.TrimSpace(scanner.Text())
+		if tokenString == "" {
+			continue
+		}
+		resigned, err := ResignNatsToken(tokenString, oldSecret)
+		if err != nil {
+			failed++
+			fmt.Fprintf(errOut, "line %d: %v\n", line, err)
+		}
+		if _, err := fmt.Fprintln(out, resigned); err != nil {
+			return failed, fmt.Errorf("failed to write token: %w", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return failed, fmt.Errorf("failed to read tokens: %w", err)
+	}
+	return failed, nil
+}
+
+// signNatsToken signs claims using the NATS_TOKEN_SECRET environment variable
+// with HMAC-SHA256.
+func signNatsToken(claims TestNatsTokenClaims) (string, error) {
 	// Retrieve secret from environment variable
 	secret := os.Getenv("NATS_TOKEN_SECRET")
 	if secret == "" {
@@ -134,22 +250,119 @@ func GenerateNatsToken(inputJSON string) (string, error) {
 	return tokenString, nil
 }
 
+// Output formats of the generated token, selected with -format.
+const (
+	FormatRaw   = "raw"   // The token alone on a line
+	FormatJSON  = "json"  // {"token": ..., "expires_at": ...}
+	FormatCreds = "creds" // NATS credentials file holding the token and a user nkey seed
+)
+
+// credsTemplate is the standard NATS credentials file layout, as written by
+// nsc and jwt.FormatUserConfig.
+const credsTemplate = `-----BEGIN NATS USER JWT-----
+%s
+------END NATS USER JWT------
+
+************************* IMPORTANT *************************
+NKEY Seed printed below can be used to sign and prove identity.
+NKEYs are sensitive and should be treated as secrets.
+
+-----BEGIN USER NKEY SEED-----
+%s
+------END USER NKEY SEED------
+
+*************************************************************
+`
+
+// tokenOutput is the json output format.
+type tokenOutput struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// FormatToken renders a generated token in the given output format, ending
+// with a newline. The creds format stores the token in the JWT section of a
+// NATS credentials file next to a freshly generated user nkey seed, as
+// jwt.FormatUserConfig only accepts nkey-signed user JWTs.
+func FormatToken(tokenString, format string) (string, error) {
+	switch format {
+	case FormatRaw:
+		return tokenString + "\n", nil
+	case FormatJSON:
+		claims := &tokenvalidation.NatsTokenClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+			return "", fmt.Errorf("failed to decode token: %w", err)
+		}
+		out := tokenOutput{Token: tokenString}
+		if claims.ExpiresAt != nil {
+			out.ExpiresAt = claims.ExpiresAt.UTC()
+		}
+		data, err := json.Marshal(out)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode token: %w", err)
+		}
+		return string(data) + "\n", nil
+	case FormatCreds:
+		user, err := nkeys.CreateUser()
+		if err != nil {
+			return "", fmt.Errorf("failed to create user nkey: %w", err)
+		}
+		seed, err := user.Seed()
+		if err != nil {
+			return "", fmt.Errorf("failed to read user nkey seed: %w", err)
+		}
+		return fmt.Sprintf(credsTemplate, tokenString, seed), nil
+	}
+	return "", fmt.Errorf("unknown format %q, expected raw, json or creds", format)
+}
+
+// writeOutput writes data to the file at path, readable by its owner only as it
+// holds a credential, or to stdout when path is empty.
+func writeOutput(path, data string) error {
+	if path == "" {
+		_, err := fmt.Print(data)
+		return err
+	}
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		return fmt.Errorf("failed to write token: %w", err)
+	}
+	return nil
+}
+
+// DiagnosticOptions selects the optional JetStream checks run by TestNatsConnection
+// in addition to listing streams.
+type DiagnosticOptions struct {
+	Consumers    bool // List consumers of every stream
+	KeyValue     bool // List key-value buckets
+	ObjectStores bool // List object store buckets
+}
+
+// Diagnostics holds the JetStream resources visible with a token.
+type Diagnostics struct {
+	Streams            []string            // Stream names
+	Consumers          map[string][]string // Consumer names keyed by stream name
+	KeyValueBuckets    []string            // Key-value bucket names
+	ObjectStoreBuckets []string            // Object store bucket names
+}
+
 // TestNatsConnection tests connectivity to a NATS server using the provided JWT token.
 //
 // It connects to the specified NATS server using the JWT token for authentication
-// and attempts to list all streams (equivalent to `nats stream ls -a`). The function
-// returns the list of stream names or an error if the connection or stream listing fails.
+// and attempts to list all streams (equivalent to `nats stream ls -a`). Depending on
+// opts it also lists consumers per stream and key-value/object store buckets, which
+// exercises the token's JetStream permissions more thoroughly.
 //
 // Args:
 //
 //	serverURL (string): The NATS server URL (e.g., "nats://localhost:4222").
 //	jwtToken (string): The JWT token for authentication.
+//	opts (DiagnosticOptions): Optional checks to run.
 //
 // Returns:
 //
-//	[]string: List of stream names if successful.
+//	*Diagnostics: The JetStream resources found if successful.
 //	error: An error if the connection or stream listing fails.
-func TestNatsConnection(serverURL, jwtToken string) ([]string, error) {
+func TestNatsConnection(serverURL, jwtToken string, opts DiagnosticOptions) (*Diagnostics, error) {
 	// Connect to NATS server with JWT token
 	nc, err := nats.Connect(serverURL, nats.Token(jwtToken))
 	if err != nil {
@@ -163,25 +376,83 @@ func TestNatsConnection(serverURL, jwtToken string) ([]string, error) {
 		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
 	}
 
+	return RunDiagnostics(js, opts), nil
+}
+
+// RunDiagnostics lists the JetStream resources selected by opts using an existing
+// JetStream context. Streams are always listed.
+func RunDiagnostics(js nats.JetStreamContext, opts DiagnosticOptions) *Diagnostics {
+	diag := &Diagnostics{}
+
 	// List all streams
-	var streams []string
 	for stream := range js.Streams() {
 		if stream == nil {
 			continue
 		}
-		streams = append(streams, stream.Config.Name)
+		diag.Streams = append(diag.Streams, stream.Config.Name)
+	}
+
+	// List consumers per stream
+	if opts.Consumers {
+		diag.Consumers = make(map[string][]string, len(diag.Streams))
+		for _, stream := range diag.Streams {
+			consumers := []string{}
+			for consumer := range js.Consumers(stream) {
+				if consumer == nil {
+					continue
+				}
+				consumers = append(consumers, consumer.Name)
+			}
+			diag.Consumers[stream] = consumers
+		}
+	}
+
+	// List key-value buckets
+	if opts.KeyValue {
+		for bucket := range js.KeyValueStoreNames() {
+			diag.KeyValueBuckets = append(diag.KeyValueBuckets, bucket)
+		}
+	}
+
+	// List object store buckets
+	if opts.ObjectStores {
+		for bucket := range js.ObjectStoreNames() {
+			diag.ObjectStoreBuckets = append(diag.ObjectStoreBuckets, bucket)
+		}
 	}
 
-	return streams, nil
+	return diag
+}
+
+// printNames prints a titled list of names, or the empty message if there are none.
+func printNames(title, empty string, names []string) {
+	if len(names) == 0 {
+		fmt.Println(empty)
+		return
+	}
+	fmt.Println(title)
+	for _, name := range names {
+		fmt.Printf("- %s\n", name)
+	}
 }
 
 func main() {
 	// Define command-line flags
-	inputJSON := flag.String("input", "", "JSON string containing user_id, permissions, account, and ttl")
+	inputJSON := flag.String("input", "", "JSON string containing user_id, permissions, account, ttl, audience, and not_before")
 	serverURL := flag.String("server", "nats://localhost:4222", "NATS server URL")
 	testConn := flag.Bool("test", false, "Test NATS connection with the generated token (true/false)")
+	listConsumers := flag.Bool("consumers", false, "With -test, also list consumers of every stream")
+	listKV := flag.Bool("kv", false, "With -test, also list key-value buckets")
+	listObjects := flag.Bool("objects", false, "With -test, also list object store buckets")
+	resign := flag.String("resign", "", "Re-sign the tokens in this file (one per line, - for stdin) signed with OLD_NATS_TOKEN_SECRET")
+	output := flag.String("output", "", "Write the token to this file instead of stdout")
+	format := flag.String("format", FormatRaw, "Output format of the token: raw, json or creds")
 	flag.Parse()
 
+	if *resign != "" {
+		os.Exit(runResign(*resign))
+	}
+
 	// Default JSON input, including "_INBOX.>" in sub permissions to support NATS request-reply
 	defaultJSON := `{
 		"user_id": "bob",
@@ -206,7 +477,7 @@ func main() {
 	jsonInput := *inputJSON
 	if jsonInput == "" {
 		jsonInput = defaultJSON
-		fmt.Println("No input provided; using default JSON with _INBOX.> permission for NATS request-reply")
+		fmt.Fprintln(os.Stderr, "No input provided; using default JSON with _INBOX.> permission for NATS request-reply")
 	}
 
 	// Generate token
@@ -215,23 +486,71 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error generating token: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("Generated token: %s\n", tokenString)
+	formatted, err := FormatToken(tokenString, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error formatting token: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeOutput(*output, formatted); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing token: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Test NATS connection if -test is true
 	if *testConn {
-		streams, err := TestNatsConnection(*serverURL, tokenString)
+		diag, err := TestNatsConnection(*serverURL, tokenString, DiagnosticOptions{
+			Consumers:    *listConsumers,
+			KeyValue:     *listKV,
+			ObjectStores: *listObjects,
+		})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error testing NATS connection: %v\n", err)
 			os.Exit(1)
 		}
 
-		if len(streams) == 0 {
-			fmt.Println("No Streams defined")
-		} else {
-			fmt.Println("Streams found:")
-			for _, stream := range streams {
-				fmt.Printf("- %s\n", stream)
+		printNames("Streams found:", "No Streams defined", diag.Streams)
+		if *listConsumers {
+			for _, stream := range diag.Streams {
+				printNames(fmt.Sprintf("Consumers of %s:", stream), fmt.Sprintf("No Consumers defined for %s", stream), diag.Consumers[stream])
 			}
 		}
+		if *listKV {
+			printNames("Key-Value buckets found:", "No Key-Value buckets defined", diag.KeyValueBuckets)
+		}
+		if *listObjects {
+			printNames("Object Store buckets found:", "No Object Store buckets defined", diag.ObjectStoreBuckets)
+		}
+	}
+}
+
+// runResign re-signs the tokens in path (stdin for "-") from OLD_NATS_TOKEN_SECRET
+// to NATS_TOKEN_SECRET, printing them to stdout, and returns the exit code.
+func runResign(path string) int {
+	oldSecret := os.Getenv("OLD_NATS_TOKEN_SECRET")
+	if oldSecret == "" {
+		fmt.Fprintln(os.Stderr, "OLD_NATS_TOKEN_SECRET environment variable is not set")
+		return 1
+	}
+
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening tokens: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	failed, err := ResignNatsTokens(in, os.Stdout, os.Stderr, oldSecret)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error re-signing tokens: %v\n", err)
+		return 1
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d token(s) could not be re-signed\n", failed)
+		return 1
 	}
+	return 0
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	natsjwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeJetStream implements the listing calls of nats.JetStreamContext used by
+// RunDiagnostics; any other call panics through the nil embedded interface.
+type fakeJetStream struct {
+	nats.JetStreamContext
+	streams   []string
+	consumers map[string][]string
+	kv        []string
+	objects   []string
+}
+
+func (f *fakeJetStream) Streams(_ ...nats.JSOpt) <-chan *nats.StreamInfo {
+	ch := make(chan *nats.StreamInfo, len(f.streams))
+	for _, name := range f.streams {
+		ch <- &nats.StreamInfo{Config: nats.StreamConfig{Name: name}}
+	}
+	close(ch)
+	return ch
+}
+
+func (f *fakeJetStream) Consumers(stream string, _ ...nats.JSOpt) <-chan *nats.ConsumerInfo {
+	ch := make(chan *nats.ConsumerInfo, len(f.consumers[stream]))
+	for _, name := range f.consumers[stream] {
+		ch <- &nats.ConsumerInfo{Stream: stream, Name: name}
+	}
+	close(ch)
+	return ch
+}
+
+func (f *fakeJetStream) KeyValueStoreNames() <-chan string {
+	return namesChan(f.kv)
+}
+
+func (f *fakeJetStream) ObjectStoreNames(_ ...nats.ObjectOpt) <-chan string {
+	return namesChan(f.objects)
+}
+
+func namesChan(names []string) <-chan string {
+	ch := make(chan string, len(names))
+	for _, name := range names {
+		ch <- name
+	}
+	close(ch)
+	return ch
+}
+
+func TestRunDiagnostics(t *testing.T) {
+	js := &fakeJetStream{
+		streams:   []string{"ORDERS", "EVENTS"},
+		consumers: map[string][]string{"ORDERS": {"billing", "shipping"}},
+		kv:        []string{"config"},
+		objects:   []string{"assets"},
+	}
+
+	t.Run("streams only", func(t *testing.T) {
+		diag := RunDiagnostics(js, DiagnosticOptions{})
+		assert.Equal(t, []string{"ORDERS", "EVENTS"}, diag.Streams)
+		assert.Nil(t, diag.Consumers)
+		assert.Nil(t, diag.KeyValueBuckets)
+		assert.Nil(t, diag.ObjectStoreBuckets)
+	})
+
+	t.Run("all checks", func(t *testing.T) {
+		diag := RunDiagnostics(js, DiagnosticOptions{Consumers: true, KeyValue: true, ObjectStores: true})
+		assert.Equal(t, []string{"ORDERS", "EVENTS"}, diag.Streams)
+		assert.Equal(t, map[string][]string{
+			"ORDERS": {"billing", "shipping"},
+			"EVENTS": {},
+		}, diag.Consumers)
+		assert.Equal(t, []string{"config"}, diag.KeyValueBuckets)
+		assert.Equal(t, []string{"assets"}, diag.ObjectStoreBuckets)
+	})
+}
+
+func TestGenerateNatsTokenAudience(t *testing.T) {
+	t.Setenv("NATS_TOKEN_SECRET", "test-secret-1234567890")
+
+	token, err := GenerateNatsToken(`{"user_id": "alice", "account": "DEVELOPMENT", "audience": "orders"}`)
+	require.NoError(t, err)
+
+	t.Setenv("NATS_TOKEN_AUDIENCE", "orders")
+	claims, err := tokenvalidation.ValidateNatsToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.UserID)
+
+	t.Setenv("NATS_TOKEN_AUDIENCE", "billing")
+	_, err = tokenvalidation.ValidateNatsToken(token)
+	assert.EqualError(t, err, `token audience does not include "billing"`)
+}
+
+func TestGenerateNatsTokenResponseTTL(t *testing.T) {
+	t.Setenv("NATS_TOKEN_SECRET", "test-secret-1234567890")
+
+	for input, want := range map[string]time.Duration{
+		`{"max": 1, "ttl": 30}`:    30 * time.Second,
+		`{"max": 1, "ttl": "45s"}`: 45 * time.Second,
+		`{"max": 1}`:               0,
+	} {
+		token, err := GenerateNatsToken(`{"user_id": "svc", "permissions": {"resp": ` + input + `}}`)
+		require.NoError(t, err, input)
+		claims, err := tokenvalidation.ValidateNatsToken(token)
+		require.NoError(t, err, input)
+		perms, err := tokenvalidation.ToJWTPermissions(claims.Permissions)
+		require.NoError(t, err, input)
+		require.NotNil(t, perms.Resp, input)
+		assert.Equal(t, 1, perms.Resp.MaxMsgs, input)
+		assert.Equal(t, want, perms.Resp.Expires, input)
+	}
+
+	_, err := GenerateNatsToken(`{"user_id": "svc", "permissions": {"resp": {"ttl": "soon"}}}`)
+	assert.ErrorContains(t, err, "invalid resp ttl")
+}
+
+func TestGenerateNatsTokenNotBefore(t *testing.T) {
+	t.Setenv("NATS_TOKEN_SECRET", "test-secret-1234567890")
+
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	token, err := GenerateNatsToken(`{"user_id": "alice", "ttl": 600, "not_before": "` + start.Format(time.RFC3339) + `"}`)
+	require.NoError(t, err)
+
+	_, err = tokenvalidation.ValidateNatsToken(token)
+	assert.ErrorIs(t, err, jwt.ErrTokenNotValidYet, "a token used before its not_before time is rejected")
+
+	// Once the scheduled time has come, the token is valid for its TTL from then on
+	jwt.TimeFunc = func() time.Time { return start.Add(time.Minute) }
+	defer func() { jwt.TimeFunc = time.Now }()
+	claims, err := tokenvalidation.ValidateNatsToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, start.Unix(), claims.NotBefore.Unix())
+	assert.Equal(t, start.Add(600*time.Second).Unix(), claims.ExpiresAt.Unix())
+}
+
+func TestResignNatsToken(t *testing.T) {
+	t.Setenv("NATS_TOKEN_SECRET", "old-secret-1234567890")
+	token, err := GenerateNatsToken(`{"user_id": "svc", "permissions": {"pub": {"allow": ["orders.>"]}, "sub": {"allow": ["_INBOX.>"]}}, "account": "PROD", "ttl": 86400, "audience": "orders"}`)
+	require.NoError(t, err)
+	old, err := tokenvalidation.ValidateNatsToken(token)
+	require.NoError(t, err)
+
+	t.Setenv("NATS_TOKEN_SECRET", "new-secret-0987654321")
+	_, err = tokenvalidation.ValidateNatsToken(token)
+	require.Error(t, err, "the old token is not valid for the new secret")
+
+	resigned, err := ResignNatsToken(token, "old-secret-1234567890")
+	require.NoError(t, err)
+	claims, err := tokenvalidation.ValidateNatsToken(resigned)
+	require.NoError(t, err)
+	assert.Equal(t, old.UserID, claims.UserID)
+	assert.Equal(t, old.Permissions, claims.Permissions)
+	assert.Equal(t, old.Account, claims.Account)
+	assert.Equal(t, old.Audience, claims.Audience)
+	assert.Equal(t, 86400*time.Second, claims.ExpiresAt.Sub(claims.IssuedAt.Time), "the lifetime is kept")
+	assert.WithinDuration(t, time.Now(), claims.IssuedAt.Time, 5*time.Second)
+
+	_, err = ResignNatsToken(token, "wrong-secret")
+	assert.ErrorContains(t, err, "invalid token signature")
+}
+
+func TestResignNatsTokenKeepsRestrictions(t *testing.T) {
+	t.Setenv("NATS_TOKEN_SECRET", "old-secret-1234567890")
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	token, err := GenerateNatsToken(`{"user_id": "svc", "account": "PROD", "ttl": 3600, "audience": "orders",
+		"not_before": "` + start.Format(time.RFC3339) + `", "src": ["10.0.0.0/8"],
+		"limits": {"subs": 10, "data": 1024, "payload": 512},
+		"permissions": {"pub": {"allow": ["orders.>"]}, "sub": {"allow": ["_INBOX.>"]}}}`)
+	require.NoError(t, err)
+	old, err := tokenvalidation.ValidateNatsToken(token)
+	require.NoError(t, err)
+	require.NotNil(t, old.Limits)
+
+	t.Setenv("NATS_TOKEN_SECRET", "new-secret-0987654321")
+	resigned, err := ResignNatsToken(token, "old-secret-1234567890")
+	require.NoError(t, err)
+	claims, err := tokenvalidation.ValidateNatsToken(resigned)
+	require.NoError(t, err)
+
+	assert.Equal(t, old.UserID, claims.UserID)
+	assert.Equal(t, old.Account, claims.Account)
+	assert.Equal(t, old.Permissions, claims.Permissions)
+	assert.Equal(t, old.Audience, claims.Audience)
+	assert.Equal(t, old.NotBefore, claims.NotBefore)
+	assert.Equal(t, []string{"10.0.0.0/8"}, claims.Src)
+	assert.Equal(t, old.Limits, claims.Limits)
+}
+
+func TestResignNatsTokens(t *testing.T) {
+	t.Setenv("NATS_TOKEN_SECRET", "old-secret-1234567890")
+	alice, err := GenerateNatsToken(`{"user_id": "alice"}`)
+	require.NoError(t, err)
+	bob, err := GenerateNatsToken(`{"user_id": "bob"}`)
+	require.NoError(t, err)
+
+	t.Setenv("NATS_TOKEN_SECRET", "new-secret-0987654321")
+	var out, errOut strings.Builder
+	failed, err := ResignNatsTokens(strings.NewReader(alice+"\n\nnot-a-token\n"+bob+"\n"), &out, &errOut, "old-secret-1234567890")
+	require.NoError(t, err)
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, "line 3: failed to validate token: invalid token format\n", errOut.String())
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	assert.Empty(t, lines[1], "a failed token keeps its place in the output")
+	for i, userID := range map[int]string{0: "alice", 2: "bob"} {
+		claims, err := tokenvalidation.ValidateNatsToken(lines[i])
+		require.NoError(t, err)
+		assert.Equal(t, userID, claims.UserID)
+	}
+}
+
+func TestFormatToken(t *testing.T) {
+	t.Setenv("NATS_TOKEN_SECRET", "test-secret-1234567890")
+	token, err := GenerateNatsToken(`{"user_id": "alice", "ttl": 600}`)
+	require.NoError(t, err)
+	claims, err := tokenvalidation.ValidateNatsToken(token)
+	require.NoError(t, err)
+
+	raw, err := FormatToken(token, FormatRaw)
+	require.NoError(t, err)
+	assert.Equal(t, token+"\n", raw, "raw output can be piped as is")
+
+	out, err := FormatToken(token, FormatJSON)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"token": "`+token+`", "expires_at": "`+claims.ExpiresAt.UTC().Format(time.RFC3339)+`"}`, out)
+
+	creds, err := FormatToken(token, FormatCreds)
+	require.NoError(t, err)
+	credsJWT, err := natsjwt.ParseDecoratedJWT([]byte(creds))
+	require.NoError(t, err)
+	assert.Equal(t, token, credsJWT, "the token is stored in the JWT section")
+	user, err := natsjwt.ParseDecoratedNKey([]byte(creds))
+	require.NoError(t, err)
+	pub, err := user.PublicKey()
+	require.NoError(t, err)
+	assert.True(t, nkeys.IsValidPublicUserKey(pub))
+
+	_, err = FormatToken(token, "yaml")
+	assert.EqualError(t, err, `unknown format "yaml", expected raw, json or creds`)
+}
+
+func TestWriteOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(t, writeOutput(path, `{"token": "abc"}`+"\n"))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"token": "abc"}`+"\n", string(data))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	assert.ErrorContains(t, writeOutput(filepath.Join(t.TempDir(), "missing", "token"), "abc\n"), "failed to write token")
+}
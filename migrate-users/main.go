@@ -0,0 +1,44 @@
+// Command migrate-users rewrites a plaintext users.yaml so every password is
+// stored as a bcrypt PassHash. Accounts and permissions are kept unchanged.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/usersdebug"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	in := flag.String("in", "users.yaml", "Plaintext users file to migrate")
+	out := flag.String("out", "users.hashed.yaml", "Path to write the migrated users file")
+	cost := flag.Int("cost", bcrypt.DefaultCost, "bcrypt cost used to hash passwords")
+	flag.Parse()
+
+	if *cost < bcrypt.MinCost || *cost > bcrypt.MaxCost {
+		return fmt.Errorf("cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		return fmt.Errorf("read users file: %w", err)
+	}
+	migrated, err := usersdebug.MigratePasswords(data, *cost)
+	if err != nil {
+		return fmt.Errorf("migrate %s: %w", *in, err)
+	}
+	if err := os.WriteFile(*out, migrated, 0o600); err != nil {
+		return fmt.Errorf("write migrated users file: %w", err)
+	}
+	fmt.Printf("Wrote hashed users to %s\n", *out)
+	return nil
+}
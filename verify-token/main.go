@@ -0,0 +1,186 @@
+// Command verify-token inspects a nats_token offline, without involving the
+// server. The token is read from -input or stdin and validated like the server
+// does: with -config, against the auth.token_secrets, leeway, audience and
+// issuer of the server's config file; otherwise against NATS_TOKEN_SECRET,
+// honouring NATS_TOKEN_AUDIENCE and NATS_TOKEN_ISSUER. Its user_id, account,
+// permissions and times are printed whether or not it is valid, and the exit
+// status is non-zero when it is not.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/config"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	input := flag.String("input", "", "Token to verify (default: read from stdin)")
+	configPath := flag.String("config", "", "Server config file whose token settings to validate with (default: the NATS_TOKEN_* environment)")
+	flag.Parse()
+
+	v := &validator{}
+	if *configPath != "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return fmt.Errorf("load config: %w", err)
+		}
+		v = validatorFor(cfg)
+	}
+
+	tokenString := *input
+	if tokenString == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("read token: %w", err)
+		}
+		tokenString = string(data)
+	}
+	tokenString = strings.TrimSpace(tokenString)
+	if tokenString == "" {
+		return errors.New("usage: verify-token [-config config.yml] [-input token] (or pipe the token to stdin)")
+	}
+
+	// Decode without verifying first, so rejected tokens can still be inspected
+	claims := &tokenvalidation.NatsTokenClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		return fmt.Errorf("decode token: %w", err)
+	}
+	if err := printClaims(claims); err != nil {
+		return err
+	}
+
+	keyLabel, err := v.validate(tokenString)
+	if keyLabel != "" {
+		fmt.Printf("key:         %s\n", keyLabel)
+	}
+	if err != nil {
+		fmt.Printf("valid:       no (%s: %v)\n", tokenvalidation.FailureReason(err), err)
+		return errors.New("token is not valid")
+	}
+	fmt.Println("valid:       yes")
+	return nil
+}
+
+// validator validates nats_tokens with the token settings of a server. The
+// zero value validates like a server without token settings in its config.
+type validator struct {
+	secrets  []tokenvalidation.Secret
+	opts     []tokenvalidation.Option
+	audience string
+	issuer   string
+}
+
+// validatorFor returns a validator using the token settings of cfg. Secrets
+// the server reads from Vault are not fetched; without auth.token_secrets,
+// NATS_TOKEN_SECRET is used as by the server.
+func validatorFor(cfg *config.Config) *validator {
+	v := &validator{
+		opts: []tokenvalidation.Option{
+			tokenvalidation.WithLeeway(cfg.Auth.TokenLeeway),
+			tokenvalidation.WithMaxIssuedAtSkew(cfg.Auth.TokenMaxIatSkew),
+		},
+		audience: cfg.Auth.TokenAudience,
+		issuer:   cfg.Auth.TokenIssuer,
+	}
+	for _, secret := range cfg.Auth.TokenSecrets {
+		v.secrets = append(v.secrets, tokenvalidation.Secret{Label: secret.Label, Value: secret.Value})
+	}
+	return v
+}
+
+// validate validates token, returning the label of the secret whose signature
+// matched, if it is labeled.
+func (v *validator) validate(token string) (string, error) {
+	var claims *tokenvalidation.NatsTokenClaims
+	var keyLabel string
+	var err error
+	if len(v.secrets) > 0 {
+		claims, keyLabel, err = tokenvalidation.ValidateWithSecrets(token, v.secrets, v.opts...)
+	} else {
+		claims, err = tokenvalidation.ValidateNatsToken(token, v.opts...)
+	}
+	if err != nil {
+		return keyLabel, err
+	}
+	if v.audience != "" {
+		if err := tokenvalidation.CheckAudience(claims, v.audience); err != nil {
+			return keyLabel, err
+		}
+	}
+	if v.issuer != "" {
+		if err := tokenvalidation.CheckIssuer(claims, v.issuer); err != nil {
+			return keyLabel, err
+		}
+	}
+	return keyLabel, nil
+}
+
+// printClaims writes the claims an operator needs to debug a login.
+func printClaims(claims *tokenvalidation.NatsTokenClaims) error {
+	fmt.Printf("user_id:     %s\n", claims.UserID)
+	fmt.Printf("account:     %s\n", claims.Account)
+	if claims.Issuer != "" {
+		fmt.Printf("issuer:      %s\n", claims.Issuer)
+	}
+	if len(claims.Audience) > 0 {
+		fmt.Printf("audience:    %s\n", strings.Join(claims.Audience, ", "))
+	}
+	fmt.Printf("issued at:   %s\n", formatTime(claims.IssuedAt, "-"))
+	if claims.NotBefore != nil {
+		fmt.Printf("not before:  %s\n", formatTime(claims.NotBefore, "-"))
+	}
+	fmt.Printf("expires:     %s\n", formatTime(claims.ExpiresAt, "never"))
+
+	fmt.Println("permissions:")
+	if claims.Permissions == nil {
+		fmt.Println("  none")
+		return nil
+	}
+	data, err := marshalIndent(claims.Permissions)
+	if err != nil {
+		return fmt.Errorf("encode permissions: %w", err)
+	}
+	fmt.Printf("  %s\n", strings.ReplaceAll(strings.TrimSpace(data), "\n", "\n  "))
+	return nil
+}
+
+// formatTime prints t in RFC 3339 with how far it is from now, or missing when
+// the claim is absent.
+func formatTime(t *jwt.NumericDate, missing string) string {
+	if t == nil {
+		return missing
+	}
+	d := time.Until(t.Time).Round(time.Second)
+	if d < 0 {
+		return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.RFC3339), -d)
+	}
+	return fmt.Sprintf("%s (in %s)", t.Local().Format(time.RFC3339), d)
+}
+
+// marshalIndent encodes v as indented JSON, leaving subject wildcards unescaped.
+func marshalIndent(v any) (string, error) {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/config"
+	"sergey-arkhipov/nats-auth-callout-server/auth-server/tokenvalidation"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signToken signs a nats_token for alice expiring at exp with secret.
+func signToken(t *testing.T, secret string, exp time.Time, audience ...string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &tokenvalidation.NatsTokenClaims{
+		UserID:  "alice",
+		Account: "DEVELOPMENT",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(exp),
+			Audience:  audience,
+		},
+	}).SignedString([]byte(secret))
+	require.NoError(t, err)
+	return token
+}
+
+// loadConfig loads a server config file with the given auth settings.
+func loadConfig(t *testing.T, auth string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`auth:
+  issuer_seed: SAAGTESTSEED
+  xkey_seed: SXAKTESTSEED
+`+auth), 0600))
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	return cfg
+}
+
+func TestValidatorFor(t *testing.T) {
+	t.Setenv("NATS_TOKEN_SECRET", "env-secret-1234567890")
+	cfg := loadConfig(t, `  token_secrets:
+    - label: current
+      value: current-secret-1234567890
+    - label: previous
+      value: previous-secret-1234567890
+  token_leeway: 2m
+  token_audience: nats-auth
+`)
+	v := validatorFor(cfg)
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		token     string
+		wantLabel string
+		wantErr   string
+	}{
+		{
+			name:      "valid token",
+			token:     signToken(t, "current-secret-1234567890", now.Add(time.Hour), "nats-auth"),
+			wantLabel: "current",
+		},
+		{
+			name:      "token of a rotated secret",
+			token:     signToken(t, "previous-secret-1234567890", now.Add(time.Hour), "nats-auth"),
+			wantLabel: "previous",
+		},
+		{
+			name:      "expired within the configured leeway",
+			token:     signToken(t, "current-secret-1234567890", now.Add(-time.Minute), "nats-auth"),
+			wantLabel: "current",
+		},
+		{
+			name:      "expired token",
+			token:     signToken(t, "current-secret-1234567890", now.Add(-time.Hour), "nats-auth"),
+			wantLabel: "current",
+			wantErr:   tokenvalidation.FailureExpired,
+		},
+		{
+			name:    "wrong secret",
+			token:   signToken(t, "env-secret-1234567890", now.Add(time.Hour), "nats-auth"),
+			wantErr: tokenvalidation.FailureSignature,
+		},
+		{
+			name:      "other audience",
+			token:     signToken(t, "current-secret-1234567890", now.Add(time.Hour), "billing"),
+			wantLabel: "current",
+			wantErr:   tokenvalidation.FailureAudience,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			label, err := v.validate(tt.token)
+			assert.Equal(t, tt.wantLabel, label)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tt.wantErr, tokenvalidation.FailureReason(err))
+		})
+	}
+}
+
+func TestValidatorEnvironment(t *testing.T) {
+	const secret = "env-secret-1234567890"
+	t.Setenv("NATS_TOKEN_SECRET", secret)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		v       *validator
+		token   string
+		wantErr string
+	}{
+		{
+			name:  "valid token",
+			v:     &validator{},
+			token: signToken(t, secret, now.Add(time.Hour)),
+		},
+		{
+			name:    "expired token",
+			v:       &validator{},
+			token:   signToken(t, secret, now.Add(-time.Hour)),
+			wantErr: tokenvalidation.FailureExpired,
+		},
+		{
+			name:    "wrong secret",
+			v:       &validator{},
+			token:   signToken(t, "other-secret-1234567890", now.Add(time.Hour)),
+			wantErr: tokenvalidation.FailureSignature,
+		},
+		{
+			name:  "config without token secrets falls back to the environment",
+			v:     validatorFor(loadConfig(t, "")),
+			token: signToken(t, secret, now.Add(time.Hour)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			label, err := tt.v.validate(tt.token)
+			assert.Empty(t, label)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tt.wantErr, tokenvalidation.FailureReason(err))
+		})
+	}
+}